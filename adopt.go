@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// subvolumeInfo is a sub-volume listed by "btrfs subvolume list -u -R".
+type subvolumeInfo struct {
+	path         string
+	uuid         string
+	receivedUUID string // "-" if the sub-volume was not received
+	generation   int
+}
+
+// adoptCommand reconstructs the replication state of existing snapshots, eg. after migrating from another tool.
+func adoptCommand(args []string) {
+	fs := flag.NewFlagSet("adopt", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	rename := fs.Bool("rename", false, "rename adopted destination snapshots to the name of their source snapshot")
+	fs.Parse(args)
+	jf.setup()
+
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	st := jf.loadState()
+	if st == nil {
+		log.Printf("No -state given, only reporting corresponding snapshots")
+	}
+
+	failed := 0
+	for i := range jobs {
+		j := &jobs[i]
+		if len(jobs) > 1 {
+			log.Printf("Adopting job %s", j.name)
+		}
+		if err := j.adopt(st, *rename, *dryRun); err != nil {
+			log.Printf("Job %s failed: %v", j.name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(jobs))
+	}
+}
+
+// adopt finds the destination snapshots which were received from source snapshots by comparing their received UUID
+// with the UUIDs of the source snapshots. Destination snapshots named differently than their source snapshot are
+// renamed if rename is set and ignored otherwise. The corresponding snapshots are recorded in st as the result of a
+// completed run so that the next run continues incrementally.
+func (j *job) adopt(st *state, rename, dryRun bool) error {
+	sourceInfos, err := j.source.listSubvolumeInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get local snapshots: %v", err)
+	}
+	destinationInfos, err := j.destination.listSubvolumeInfo()
+	if err != nil {
+		return fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+
+	byUUID := make(map[string]string)
+	for _, info := range sourceInfos {
+		dir, name := path.Split(info.path)
+		if path.Clean(dir) == path.Clean(j.source.snapshotPath) && j.source.snapshotRegex.MatchString(name) {
+			byUUID[info.uuid] = name
+		}
+	}
+
+	var adopted []string
+	dir := path.Join(j.destination.mountPoint, j.destination.snapshotPath)
+	for _, info := range destinationInfos {
+		d, name := path.Split(info.path)
+		if path.Clean(d) != path.Clean(j.destination.snapshotPath) {
+			continue
+		}
+		sourceName, ok := byUUID[info.receivedUUID]
+		if !ok {
+			continue
+		}
+		if name != sourceName {
+			if !rename {
+				log.Printf("%s was received from %s, use -rename to adopt it", name, sourceName)
+				continue
+			}
+			log.Printf("Renaming %s to %s", name, sourceName)
+			if !dryRun {
+				if _, err := j.destination.run("mv", "-T", path.Join(dir, name), path.Join(dir, sourceName)); err != nil {
+					return fmt.Errorf("adopt: %v", err)
+				}
+			}
+		}
+		log.Printf("Adopting %s", sourceName)
+		adopted = append(adopted, sourceName)
+	}
+	log.Printf("Adopted %d snapshots", len(adopted))
+
+	if st == nil || dryRun || len(adopted) == 0 {
+		return nil
+	}
+	destinationSnapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+	st.updateListing(&j.destination, destinationSnapshots)
+	now := time.Now()
+	st.Runs[j.key()] = &runRecord{Started: now, Finished: now, Planned: adopted, Completed: adopted}
+	st.touch(sectionRuns, j.key())
+	if err := st.save(); err != nil {
+		return fmt.Errorf("adopt: %v", err)
+	}
+	return nil
+}
+
+// listSubvolumeInfo returns all sub-volumes of n including their UUIDs.
+func (n *node) listSubvolumeInfo() ([]subvolumeInfo, error) {
+	out, err := n.run("btrfs", "subvolume", "list", "-u", "-R", n.mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	return parseSubvolumeInfo(out)
+}
+
+// parseSubvolumeInfo parses the output of "btrfs subvolume list -u -R", eg:
+//
+//	ID 257 gen 12 top level 5 received_uuid - uuid 0f1c... path snapshot/1
+func parseSubvolumeInfo(out string) ([]subvolumeInfo, error) {
+	var res []subvolumeInfo
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		var info subvolumeInfo
+		tokens := strings.Split(line, " ")
+		for i := 0; i+1 < len(tokens); i++ {
+			switch tokens[i] {
+			case "gen":
+				info.generation, _ = strconv.Atoi(tokens[i+1])
+			case "uuid":
+				info.uuid = tokens[i+1]
+			case "received_uuid":
+				info.receivedUUID = tokens[i+1]
+			case "path":
+				info.path = strings.Join(tokens[i+1:], " ")
+				i = len(tokens)
+			}
+		}
+		if info.path == "" || info.uuid == "" || info.receivedUUID == "" {
+			return nil, fmt.Errorf("parseSubvolumeInfo: unexpected btrfs output: %s", line)
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParseSubvolumeInfo(t *testing.T) {
+	res, err := parseSubvolumeInfo("ID 257 gen 12 top level 5 received_uuid - uuid aaaa path snapshot/1\nID 258 gen 13 top level 5 received_uuid aaaa uuid bbbb path backup/my snap\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []subvolumeInfo{{"snapshot/1", "aaaa", "-", 12}, {"backup/my snap", "bbbb", "aaaa", 13}}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected result: %#v", res)
+	}
+
+	if _, err := parseSubvolumeInfo("ID 257 gen 12 top level 5 path snapshot/1\n"); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list -u -R /mnt": "ID 1 gen 1 top level 5 received_uuid - uuid u1 path snapshot/1\n" +
+			"ID 2 gen 2 top level 5 received_uuid - uuid u2 path snapshot/2\n" +
+			"ID 3 gen 3 top level 5 received_uuid - uuid u3 path snapshot/3\n",
+		"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup": "ID 1 gen 1 top level 5 received_uuid u1 uuid r1 path laptop/1\n" +
+			"ID 2 gen 2 top level 5 received_uuid u2 uuid r2 path laptop/home.20190102\n" +
+			"ID 3 gen 3 top level 5 received_uuid ux uuid r3 path laptop/other\n",
+		"ssh -C -p22 nas -- mv -T /backup/laptop/home.20190102 /backup/laptop/2": "",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":                        "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+	s, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without rename only snapshots with matching names are adopted
+	if err := j.adopt(s, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if rec := s.Runs[j.key()]; !reflect.DeepEqual(rec.Completed, []string{"1"}) {
+		t.Errorf("unexpected record: %#v", rec)
+	}
+
+	if err := j.adopt(s, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if rec := s.Runs[j.key()]; rec.Finished.IsZero() || !reflect.DeepEqual(rec.Completed, []string{"1", "2"}) {
+		t.Errorf("unexpected record: %#v", rec)
+	}
+	if got := s.Listings[j.destination.key()].Snapshots; !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Errorf("unexpected listing: %#v", got)
+	}
+}
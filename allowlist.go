@@ -0,0 +1,34 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// allowlistExecutor refuses to run commands referring to paths outside of the allowlist, eg. because of a typo in the
+// configuration targeting "/". Remote commands are checked as well.
+type allowlistExecutor struct {
+	executor  executor
+	allowlist []string
+}
+
+func (e allowlistExecutor) exec(cmds [][]string) (string, int, error) {
+	if err := e.check(cmds); err != nil {
+		return "", 0, err
+	}
+	return e.executor.exec(cmds)
+}
+
+// check returns an error if a command of cmds refers to a path outside of the allowlist.
+func (e allowlistExecutor) check(cmds [][]string) error {
+	for _, cmd := range cmds {
+		remote := unwrapCommand(cmd)
+		if remote == nil {
+			return fmt.Errorf("allowlist: cannot determine remote command: %s", strings.Join(cmd, " "))
+		}
+		if err := checkAllowedPaths(remote, e.allowlist); err != nil {
+			return fmt.Errorf("allowlist: refusing to run %s: %v", strings.Join(remote, " "), err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestAllowlistExecutor(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs send --quiet /mnt/snapshot/1 | ssh -C -p22 nas -- btrfs receive /backup": "",
+		"ssh -C -p22 nas -- btrfs subvolume delete /":                                    "",
+		"ssh -C -p22 nas -- df --output=avail -B1 /":                                     "",
+	}}
+	a := allowlistExecutor{e, []string{"/mnt", "/backup"}}
+	data := []struct {
+		cmds [][]string
+		err  bool
+	}{
+		{[][]string{{"btrfs", "send", "--quiet", "/mnt/snapshot/1"}, {"ssh", "-C", "-p22", "nas", "--", "btrfs", "receive", "/backup"}}, false},
+		{[][]string{{"ssh", "-C", "-p22", "nas", "--", "btrfs", "subvolume", "delete", "/"}}, true},
+		{[][]string{{"ssh", "-C", "-p22", "nas", "--", "df", "--output=avail", "-B1", "/"}}, false},
+		{[][]string{sshWrapperCmd(&node{address: "nas", sshPort: 22, wrapper: "w"}, []string{"btrfs", "receive", "/etc"}, true).args()}, true},
+	}
+	for di, d := range data {
+		_, _, err := a.exec(d.cmds)
+		if d.err && err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+		if !d.err && err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+	}
+	if e.calls["ssh -C -p22 nas -- btrfs subvolume delete /"] != 0 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
+
+func TestLoadJobsAllowlist(t *testing.T) {
+	data := []struct {
+		args []string
+		err  bool
+	}{
+		{[]string{"-dst", "nas:22/backup"}, false},
+		{[]string{"-dst", "nas:22/backup", "-allow", "/mnt,/backup"}, false},
+		{[]string{"-dst", "nas:22/backup", "-allow", "/mnt"}, true},
+		{[]string{"-dst", "nas:22/srv", "-allow", "/mnt,/backup"}, true},
+	}
+	for di, d := range data {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		jf := addJobFlags(fs)
+		if err := fs.Parse(d.args); err != nil {
+			t.Fatal(err)
+		}
+		_, err := jf.loadJobs()
+		if d.err && err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+		if !d.err && err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// browseAPI is an HTTP API for browsing the snapshots at the destination of each job:
+//
+//	GET /api/snapshots?job=NAME                         list snapshots
+//	GET /api/ls?job=NAME&snapshot=SNAP&path=DIR         list directory inside a snapshot
+//	GET /api/stat?job=NAME&snapshot=SNAP&path=FILE      describe a file inside a snapshot
+//	GET /api/download?job=NAME&snapshot=SNAP&path=FILE  download a regular file
+//
+// Paths are relative to the root of the snapshot. The job parameter may be omitted if only one job is defined.
+// With a pauser, the transfers of the daemon are controlled by:
+//
+//	GET  /api/pause               report whether transfers are paused
+//	POST /api/pause?for=DURATION  pause after the current snapshot, until resumed if for is omitted
+//	POST /api/resume              resume transfers
+//
+// With a transfer registry, in-flight transfers are listed and cancelled by:
+//
+//	GET  /api/transfers           list the jobs transferring snapshots
+//	GET  /api/queue               list the pending, running and recently finished jobs with sizes and ETAs
+//	POST /api/cancel?job=NAME     cancel the transfer of a job, cleaning up the partially received snapshot
+//
+// With metrics, they are served on /metrics in the Prometheus text format.
+//
+// With a token every request has to authenticate with the header "Authorization: Bearer TOKEN", otherwise anyone who
+// can connect may download files and control the daemon.
+type browseAPI struct {
+	jobs      func() []job
+	token     string            // required by every request if not empty
+	pause     *pauser           // nil disables the pause endpoints
+	transfers *transferRegistry // nil disables the transfer endpoints
+	metrics   *metrics          // nil disables /metrics
+}
+
+// fileInfo describes a file inside a snapshot.
+type fileInfo struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"` // file, dir, link or other
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// browsePathRegex restricts paths to characters which are passed safely through ssh.
+var browsePathRegex = regexp.MustCompile(`^[a-zA-Z0-9\-_\.\/+@,=]*$`)
+
+func (a *browseAPI) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/snapshots", a.snapshots)
+	mux.HandleFunc("/api/ls", a.ls)
+	mux.HandleFunc("/api/stat", a.stat)
+	mux.HandleFunc("/api/download", a.download)
+	if a.pause != nil {
+		mux.HandleFunc("/api/pause", a.pause.handlePause)
+		mux.HandleFunc("/api/resume", a.pause.handleResume)
+	}
+	if a.transfers != nil {
+		mux.HandleFunc("/api/transfers", a.transfers.handleTransfers)
+		mux.HandleFunc("/api/cancel", a.transfers.handleCancel)
+		mux.HandleFunc("/api/queue", a.transfers.handleQueue)
+	}
+	if a.metrics != nil {
+		mux.HandleFunc("/metrics", a.metrics.handler)
+	}
+	if a.token == "" {
+		return mux
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+a.token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// serve runs the API on addr until it fails.
+func (a *browseAPI) serve(addr string) {
+	log.Printf("Serving browse API on %s", addr)
+	log.Printf("Browse API failed: %v", http.ListenAndServe(addr, a.handler()))
+}
+
+// checkListenAddress returns an error if the API would be served without a token on an address reachable from other
+// hosts. Binding to all interfaces, eg. ":8080", counts as reachable.
+func checkListenAddress(addr, token string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("checkListenAddress: %v", err)
+	}
+	if token != "" || host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("checkListenAddress: %s is not a loopback address, use -api-token-file to serve the API on it", addr)
+}
+
+// readAPIToken returns the token contained in file, "" if file is empty.
+func readAPIToken(file string) (string, error) {
+	if file == "" {
+		return "", nil
+	}
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return "", fmt.Errorf("readAPIToken: %v", err)
+	}
+	token := strings.TrimSpace(string(buf))
+	if token == "" {
+		return "", fmt.Errorf("readAPIToken: %s is empty", file)
+	}
+	return token, nil
+}
+
+// doAPIRequest sends req to the daemon API, authenticated by token unless it is empty.
+func doAPIRequest(req *http.Request, token string) (*http.Response, error) {
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// addAPIFlags adds the flags addressing the API of a daemon to fs. The returned function returns the address and the
+// token once fs is parsed.
+func addAPIFlags(fs *flag.FlagSet) func() (string, string) {
+	addr := fs.String("api", "localhost:8080", "address of the daemon API")
+	tokenFile := fs.String("api-token-file", "", "file containing the token of the daemon API")
+	return func() (string, string) {
+		token, err := readAPIToken(*tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return *addr, token
+	}
+}
+
+func (a *browseAPI) snapshots(w http.ResponseWriter, r *http.Request) {
+	j, err := a.job(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	snapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, snapshots)
+}
+
+func (a *browseAPI) ls(w http.ResponseWriter, r *http.Request) {
+	j, p, status, err := a.file(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	entries, err := j.destination.findFiles(p, "-mindepth", "1", "-maxdepth", "1")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+func (a *browseAPI) stat(w http.ResponseWriter, r *http.Request) {
+	j, p, status, err := a.file(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	entries, err := j.destination.findFiles(p, "-maxdepth", "0")
+	if err != nil || len(entries) != 1 {
+		http.Error(w, fmt.Sprintf("not found: %s", r.FormValue("path")), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, entries[0])
+}
+
+func (a *browseAPI) download(w http.ResponseWriter, r *http.Request) {
+	j, p, status, err := a.file(r)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	entries, err := j.destination.findFiles(p, "-maxdepth", "0")
+	if err != nil || len(entries) != 1 || entries[0].Type != "file" {
+		http.Error(w, fmt.Sprintf("not a regular file: %s", r.FormValue("path")), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(p)))
+	w.Header().Set("Content-Length", strconv.FormatInt(entries[0].Size, 10))
+	// the file is streamed, once it started a failure can only be reported by closing the connection early
+	if err := j.destination.runOutput(w, "cat", p); err != nil {
+		log.Printf("Downloading %s failed: %v", p, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// job returns the job selected by the request.
+func (a *browseAPI) job(r *http.Request) (*job, error) {
+	jobs := a.jobs()
+	return selectJob(jobs, r.FormValue("job"))
+}
+
+// file returns the job selected by the request and the absolute path at the destination of the requested file with
+// symbolic links resolved. Links leading outside of the snapshot are refused. On error the HTTP status to respond with
+// is returned as well.
+func (a *browseAPI) file(r *http.Request) (*job, string, int, error) {
+	j, err := a.job(r)
+	if err != nil {
+		return nil, "", http.StatusNotFound, err
+	}
+	snapshot, p := r.FormValue("snapshot"), r.FormValue("path")
+	if !j.destination.snapshotRegex.MatchString(snapshot) {
+		return nil, "", http.StatusBadRequest, fmt.Errorf("invalid snapshot: %q", snapshot)
+	}
+	if !browsePathRegex.MatchString(p) {
+		return nil, "", http.StatusBadRequest, fmt.Errorf("invalid path: %q", p)
+	}
+	// cleaning an absolute path removes all ".." elements leaving the snapshot
+	rel := path.Clean("/" + p)
+	root := path.Join(j.destination.mountPoint, j.destination.snapshotPath, snapshot)
+	resolved, err := j.destination.resolveInside(path.Join(root, rel), root)
+	if err != nil {
+		return nil, "", http.StatusNotFound, fmt.Errorf("not found: %s", p)
+	}
+	return j, resolved, 0, nil
+}
+
+// resolveInside resolves the symbolic links of the existing path p at n using realpath. The result has to be located
+// inside root, whose links are resolved as well, and must be passed safely through ssh.
+func (n *node) resolveInside(p, root string) (string, error) {
+	out, err := n.run("realpath", "-e", root, p)
+	if err != nil {
+		return "", fmt.Errorf("resolveInside: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	if len(lines) != 2 {
+		return "", fmt.Errorf("resolveInside: unexpected output: %q", out)
+	}
+	resolvedRoot, resolved := lines[0], lines[1]
+	if resolved != resolvedRoot && !strings.HasPrefix(resolved, resolvedRoot+"/") {
+		return "", fmt.Errorf("resolveInside: %s leads outside of %s", p, root)
+	}
+	if !browsePathRegex.MatchString(resolved) {
+		return "", fmt.Errorf("resolveInside: invalid path: %q", resolved)
+	}
+	return resolved, nil
+}
+
+// findFormat is the output format of find parsed by parseFindOutput.
+const findFormat = `%y %s %T@ %f\0`
+
+// findFiles describes the files found by find at p using the additional arguments.
+func (n *node) findFiles(p string, args ...string) ([]fileInfo, error) {
+	format := findFormat
+	if n.sshPort != 0 && n.wrapper == "" {
+		format = "'" + format + "'" // the remote shell would split the format at spaces
+	}
+	cmd := append([]string{"find", p}, args...)
+	cmd = append(cmd, "-printf", format)
+	out, err := n.run(cmd...)
+	if err != nil {
+		return nil, fmt.Errorf("findFiles: %v", err)
+	}
+	return parseFindOutput(out)
+}
+
+// parseFindOutput parses the output of find -printf '%y %s %T@ %f\0'.
+func parseFindOutput(out string) ([]fileInfo, error) {
+	res := []fileInfo{}
+	for _, entry := range strings.Split(out, "\x00") {
+		if entry == "" {
+			continue
+		}
+		fields := strings.SplitN(entry, " ", 4)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("parseFindOutput: invalid entry: %q", entry)
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parseFindOutput: invalid size: %q", entry)
+		}
+		mtime, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parseFindOutput: invalid mtime: %q", entry)
+		}
+		info := fileInfo{Name: fields[3], Size: size, ModTime: time.Unix(int64(mtime), 0).UTC()}
+		switch fields[0] {
+		case "f":
+			info.Type = "file"
+		case "d":
+			info.Type = "dir"
+		case "l":
+			info.Type = "link"
+		default:
+			info.Type = "other"
+		}
+		res = append(res, info)
+	}
+	return res, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Writing response failed: %v", err)
+	}
+}
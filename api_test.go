@@ -0,0 +1,134 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseFindOutput(t *testing.T) {
+	res, err := parseFindOutput("d 4096 1546300800.5 user\x00f 12 1546300860.0000000000 doc with space.txt\x00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []fileInfo{
+		{Name: "user", Type: "dir", Size: 4096, ModTime: time.Unix(1546300800, 0).UTC()},
+		{Name: "doc with space.txt", Type: "file", Size: 12, ModTime: time.Unix(1546300860, 0).UTC()},
+	}
+	if !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected result: %#v", res)
+	}
+
+	if _, err := parseFindOutput("f x 1 foo\x00"); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+}
+
+func TestBrowseAPI(t *testing.T) {
+	find := "ssh -C -p22 nas -- find /backup/laptop/2/user/doc.txt -maxdepth 0 -printf '%y %s %T@ %f\\0'"
+	e := &mapExecutor{out: map[string]string{
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":                                                 "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+		"ssh -C -p22 nas -- find /backup/laptop/2/user -mindepth 1 -maxdepth 1 -printf '%y %s %T@ %f\\0'": "f 5 1546300800.0 doc.txt\x00",
+		find: "f 5 1546300800.0 doc.txt\x00",
+		"ssh -C -p22 nas -- find /backup/laptop/2/user -maxdepth 0 -printf '%y %s %T@ %f\\0'": "d 4096 1546300800.0 user\x00",
+		"ssh -C -p22 nas -- cat /backup/laptop/2/user/doc.txt":                                "hello",
+		"ssh -C -p22 nas -- realpath -e /backup/laptop/2 /backup/laptop/2/user":               "/backup/laptop/2\n/backup/laptop/2/user\n",
+		"ssh -C -p22 nas -- realpath -e /backup/laptop/2 /backup/laptop/2/user/doc.txt":       "/backup/laptop/2\n/backup/laptop/2/user/doc.txt\n",
+		"ssh -C -p22 nas -- realpath -e /backup/laptop/2 /backup/laptop/2/user/link":          "/backup/laptop/2\n/backup/laptop/2/user/doc.txt\n",
+		"ssh -C -p22 nas -- realpath -e /backup/laptop/2 /backup/laptop/2/user/root":          "/backup/laptop/2\n/\n",
+		"ssh -C -p22 nas -- realpath -e /backup/laptop/2 /backup/laptop/2/user/shadow":        "/backup/laptop/2\n/etc/shadow\n",
+		"ssh -C -p22 nas -- realpath -e /backup/laptop/2 /backup/laptop/2/user/other":         "/backup/laptop/2\n/backup/laptop/20/doc.txt\n",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	jobs := []job{{
+		name:        "laptop",
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}}
+	h := (&browseAPI{jobs: func() []job { return jobs }}).handler()
+
+	data := []struct {
+		url    string
+		status int
+		body   string
+	}{
+		{"/api/snapshots", 200, "[\"1\",\"2\"]\n"},
+		{"/api/snapshots?job=other", 404, ""},
+		{"/api/ls?snapshot=2&path=user", 200, "[{\"name\":\"doc.txt\",\"type\":\"file\",\"size\":5,\"mtime\":\"2019-01-01T00:00:00Z\"}]\n"},
+		{"/api/ls?snapshot=2&path=../../user", 200, "[{\"name\":\"doc.txt\",\"type\":\"file\",\"size\":5,\"mtime\":\"2019-01-01T00:00:00Z\"}]\n"},
+		{"/api/ls?snapshot=..&path=user", 400, ""},
+		{"/api/ls?snapshot=2&path=user%3Breboot", 400, ""},
+		{"/api/stat?snapshot=2&path=/user/doc.txt", 200, "{\"name\":\"doc.txt\",\"type\":\"file\",\"size\":5,\"mtime\":\"2019-01-01T00:00:00Z\"}\n"},
+		{"/api/download?snapshot=2&path=user/doc.txt", 200, "hello"},
+		{"/api/download?snapshot=2&path=user", 404, ""},
+		{"/api/download?snapshot=2&path=user/link", 200, "hello"},
+		{"/api/download?snapshot=2&path=user/shadow", 404, ""},
+		{"/api/download?snapshot=2&path=user/other", 404, ""},
+		{"/api/ls?snapshot=2&path=user/root", 404, ""},
+		{"/api/stat?snapshot=2&path=user/missing", 404, ""},
+	}
+	for di, d := range data {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, d.url, nil))
+		if rec.Code != d.status {
+			t.Errorf("%d: unexpected status %d: %s", di, rec.Code, rec.Body.String())
+			continue
+		}
+		if d.status == 200 && rec.Body.String() != d.body {
+			t.Errorf("%d: unexpected body: %q", di, rec.Body.String())
+		}
+	}
+}
+
+func TestBrowseAPIToken(t *testing.T) {
+	h := (&browseAPI{jobs: func() []job { return nil }, pause: newPauser(), token: "secret"}).handler()
+	data := []struct {
+		auth   string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer other", http.StatusUnauthorized},
+		{"secret", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+	for di, d := range data {
+		req := httptest.NewRequest(http.MethodPost, "/api/pause", nil)
+		if d.auth != "" {
+			req.Header.Set("Authorization", d.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != d.status {
+			t.Errorf("%d: unexpected status %d", di, rec.Code)
+		}
+	}
+}
+
+func TestCheckListenAddress(t *testing.T) {
+	data := []struct {
+		addr  string
+		token string
+		err   bool
+	}{
+		{"localhost:8080", "", false},
+		{"127.0.0.1:8080", "", false},
+		{"[::1]:8080", "", false},
+		{":8080", "", true},
+		{"0.0.0.0:8080", "", true},
+		{"192.168.1.2:8080", "", true},
+		{"nas:8080", "", true},
+		{":8080", "secret", false},
+		{"localhost", "", true},
+	}
+	for _, d := range data {
+		err := checkListenAddress(d.addr, d.token)
+		if d.err && err == nil {
+			t.Errorf("%s: expected error but succeeded", d.addr)
+		}
+		if !d.err && err != nil {
+			t.Errorf("%s: unexpected error: %v", d.addr, err)
+		}
+	}
+}
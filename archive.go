@@ -0,0 +1,456 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// An archive destination stores the streams of btrfs send as files instead of receiving them, eg. on a storage box
+// which doesn't run btrfs or isn't trusted with the data. The file of a full send is named <snapshot>.btrfs, the file
+// of an incremental send <snapshot>~<parent>.btrfs. Encrypted files carry an additional .age or .gpg suffix. Files are
+// written to a hidden .<snapshot>.partial file first and renamed once complete. A manifest next to the files records the
+// parent of every stream for restoring them without this tool.
+const (
+	archiveSuffix    = ".btrfs"
+	archiveSeparator = "~"
+	archiveManifest  = "manifest.json"
+)
+
+// encryption are the recipients the streams stored in an archive are encrypted for, either with age or with GPG.
+type encryption struct {
+	age []string // age recipients, eg. age1...
+	gpg []string // GPG key IDs or user IDs
+}
+
+func (e encryption) enabled() bool {
+	return len(e.age) > 0 || len(e.gpg) > 0
+}
+
+// suffix returns the suffix of encrypted files.
+func (e encryption) suffix() string {
+	switch {
+	case len(e.age) > 0:
+		return ".age"
+	case len(e.gpg) > 0:
+		return ".gpg"
+	}
+	return ""
+}
+
+// filter returns the filter encrypting the stream with the local age or gpg binary.
+func (e encryption) filter() filter {
+	var args []string
+	if len(e.age) > 0 {
+		args = []string{"age"}
+		for _, r := range e.age {
+			args = append(args, "-r", r)
+		}
+	} else {
+		args = []string{"gpg", "--batch", "--yes", "--encrypt"}
+		for _, r := range e.gpg {
+			args = append(args, "--recipient", r)
+		}
+	}
+	return execFilter{args}
+}
+
+func (e encryption) validate() error {
+	if len(e.age) > 0 && len(e.gpg) > 0 {
+		return fmt.Errorf("age and gpg recipients cannot be combined")
+	}
+	for _, r := range append(append([]string(nil), e.age...), e.gpg...) {
+		if r == "" || strings.HasPrefix(r, "-") || strings.ContainsAny(r, " \t") {
+			return fmt.Errorf("invalid recipient: %q", r)
+		}
+	}
+	return nil
+}
+
+// decryptionFilter returns the filter decrypting a file of the archive named name. age needs an identity file, gpg
+// finds the secret key in its keyring or agent. It returns nil if the file is not encrypted.
+func decryptionFilter(name, identity string) (filter, error) {
+	switch {
+	case strings.HasSuffix(name, ".age"):
+		if identity == "" {
+			return nil, fmt.Errorf("decryptionFilter: %s is encrypted with age, an identity file is required", name)
+		}
+		return execFilter{[]string{"age", "-d", "-i", identity}}, nil
+	case strings.HasSuffix(name, ".gpg"):
+		return execFilter{[]string{"gpg", "--batch", "--decrypt"}}, nil
+	}
+	return nil, nil
+}
+
+// archiveFile is a stream stored in an archive.
+type archiveFile struct {
+	name     string // file name
+	snapshot string
+	parent   string // empty for a full send
+}
+
+// archiveName returns the file name of the stream of snapshot sent relative to parent to n.
+func (n *node) archiveName(snapshot, parent string) string {
+	name := snapshot
+	if parent != "" {
+		name += archiveSeparator + parent
+	}
+	return name + archiveSuffix + n.encryption.suffix()
+}
+
+// parseArchiveName parses a file name created by archiveName. It returns false for other files.
+func parseArchiveName(name string) (archiveFile, bool) {
+	base := strings.TrimSuffix(strings.TrimSuffix(name, ".age"), ".gpg")
+	if !strings.HasSuffix(base, archiveSuffix) || strings.HasPrefix(base, ".") {
+		return archiveFile{}, false
+	}
+	snapshot, parent, _ := strings.Cut(strings.TrimSuffix(base, archiveSuffix), archiveSeparator)
+	if snapshot == "" {
+		return archiveFile{}, false
+	}
+	return archiveFile{name: name, snapshot: snapshot, parent: parent}, true
+}
+
+// archiveDir returns the directory of n containing the archive.
+func (n *node) archiveDir() string {
+	return path.Join(n.mountPoint, n.snapshotPath)
+}
+
+// partialArchive returns the path of the file snapshot is written to before it is complete.
+func (n *node) partialArchive(snapshot string) string {
+	return path.Join(n.archiveDir(), "."+snapshot+".partial")
+}
+
+// listArchive returns the streams stored in the archive n sorted by their snapshots. An archive whose directory
+// doesn't exist yet is empty.
+func (n *node) listArchive() ([]archiveFile, error) {
+	if n.s3 != nil {
+		out, err := n.run(n.s3.list(n.archiveDir())...)
+		if err != nil {
+			return nil, fmt.Errorf("listArchive: %v", err)
+		}
+		return n.parseArchive(parseS3List(out, n.archiveDir())), nil
+	}
+	out, err := n.run("ls", "-1", n.archiveDir())
+	if err != nil {
+		// the directory is created by the first stream
+		if _, testErr := n.run("test", "-e", n.archiveDir()); testErr != nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("listArchive: %v", err)
+	}
+	return n.parseArchive(out), nil
+}
+
+// parseArchive returns the streams of the archive n among the file names in out, one per line.
+func (n *node) parseArchive(out string) []archiveFile {
+	bySnapshot := make(map[string]archiveFile)
+	var snapshots []string
+	for _, name := range strings.Split(out, "\n") {
+		f, ok := parseArchiveName(name)
+		if !ok || !n.snapshotRegex.MatchString(f.snapshot) {
+			continue
+		}
+		if _, ok := bySnapshot[f.snapshot]; !ok {
+			snapshots = append(snapshots, f.snapshot)
+		}
+		bySnapshot[f.snapshot] = f
+	}
+	n.sortSnapshots(snapshots)
+	var res []archiveFile
+	for _, s := range snapshots {
+		res = append(res, bySnapshot[s])
+	}
+	return res
+}
+
+// archiveSnapshot writes the output of sendCmd to the archive at destination and returns the number of bytes
+// transmitted. The stream is encrypted by the filters of the executor of source.
+func archiveSnapshot(source, destination *node, sendCmd []string, snapshot, parent string) (int, error) {
+	if strings.Contains(snapshot, archiveSeparator) || strings.Contains(parent, archiveSeparator) {
+		return 0, fmt.Errorf("archiveSnapshot: snapshot names must not contain %q", archiveSeparator)
+	}
+	if destination.s3 != nil {
+		// the object is created once the upload is complete
+		name := path.Join(destination.archiveDir(), destination.archiveName(snapshot, parent))
+		// the stream is not much larger than the data of the source, reflinked data aside
+		used, err := source.usedSpace()
+		if err != nil {
+			log.Printf("Cannot estimate the size of %s, its upload fails if it exceeds 10,000 chunks: %v", snapshot, err)
+		}
+		_, transmitted, err := source.executor.exec([][]string{sendCmd, destination.s3.upload(name, used+used/8)})
+		if err != nil {
+			return transmitted, fmt.Errorf("archiveSnapshot: %w", err)
+		}
+		destination.updateManifest()
+		return transmitted, nil
+	}
+	if _, err := destination.run("mkdir", "-p", destination.archiveDir()); err != nil {
+		return 0, fmt.Errorf("archiveSnapshot: %v", err)
+	}
+	part := destination.partialArchive(snapshot)
+	_, transmitted, err := source.executor.exec([][]string{sendCmd, destination.command("dd", "of="+part, "bs=1M", "status=none")})
+	if err != nil {
+		return transmitted, fmt.Errorf("archiveSnapshot: %w", err)
+	}
+	if _, err := destination.run("mv", "-T", part, path.Join(destination.archiveDir(), destination.archiveName(snapshot, parent))); err != nil {
+		return transmitted, fmt.Errorf("archiveSnapshot: %v", err)
+	}
+	destination.updateManifest()
+	return transmitted, nil
+}
+
+// manifest lists the streams of an archive and their parents. It is derived from the file names, which remain
+// authoritative, and rewritten whenever the archive changes.
+type manifest struct {
+	Streams []manifestStream `json:"streams"`
+}
+
+type manifestStream struct {
+	File       string `json:"file"`
+	Snapshot   string `json:"snapshot"`
+	Parent     string `json:"parent,omitempty"`     // empty for a full send
+	Encryption string `json:"encryption,omitempty"` // age or gpg
+}
+
+func newManifest(archive []archiveFile) manifest {
+	m := manifest{Streams: []manifestStream{}}
+	for _, f := range archive {
+		s := manifestStream{File: f.name, Snapshot: f.snapshot, Parent: f.parent}
+		switch {
+		case strings.HasSuffix(f.name, ".age"):
+			s.Encryption = "age"
+		case strings.HasSuffix(f.name, ".gpg"):
+			s.Encryption = "gpg"
+		}
+		m.Streams = append(m.Streams, s)
+	}
+	return m
+}
+
+// updateManifest rewrites the manifest of the archive n. Errors are logged since the streams are complete without it.
+func (n *node) updateManifest() {
+	if err := n.writeManifest(); err != nil {
+		log.Printf("Warning: cannot update the manifest of %s: %v", n.archiveDir(), err)
+	}
+}
+
+func (n *node) writeManifest() error {
+	archive, err := n.listArchive()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(newManifest(archive), "", "  ")
+	if err != nil {
+		return err
+	}
+	return n.writeFile(path.Join(n.archiveDir(), archiveManifest), append(data, '\n'))
+}
+
+// writeFile replaces the file p at n with data. The data is written to a hidden partial file next to p first, which
+// is renamed to p once complete. Objects in object storage are replaced atomically by the upload.
+func (n *node) writeFile(p string, data []byte) error {
+	// the manifest of a large archive exceeds the maximum length of an argument
+	e := withExecutorImpl(n.executor, func(e *executorImpl) { e.filters = nil })
+	if n.s3 != nil {
+		_, _, err := execInput(e, data, [][]string{n.s3.upload(p, 0)})
+		return err
+	}
+	part := path.Join(path.Dir(p), "."+path.Base(p)+".partial")
+	if _, _, err := execInput(e, data, [][]string{n.command("dd", "of="+part, "status=none")}); err != nil {
+		return err
+	}
+	_, err := n.run("mv", "-T", part, p)
+	return err
+}
+
+// restoreChain returns the streams which have to be received in order to restore snapshot from the archive: the
+// stream of snapshot preceded by its parents back to a full send or to a parent present in local.
+func restoreChain(archive []archiveFile, snapshot string, local map[string]bool) ([]archiveFile, error) {
+	bySnapshot := make(map[string]archiveFile)
+	for _, f := range archive {
+		bySnapshot[f.snapshot] = f
+	}
+	var chain []archiveFile
+	for s := snapshot; ; {
+		f, ok := bySnapshot[s]
+		if !ok {
+			if s == snapshot {
+				return nil, fmt.Errorf("restoreChain: unknown snapshot: %s", snapshot)
+			}
+			return nil, fmt.Errorf("restoreChain: parent %s of %s missing in the archive", s, chain[0].snapshot)
+		}
+		chain = append([]archiveFile{f}, chain...)
+		if f.parent == "" || local[f.parent] {
+			return chain, nil
+		}
+		if len(chain) > len(archive) {
+			return nil, fmt.Errorf("restoreChain: cyclic chain of %s", snapshot)
+		}
+		s = f.parent
+	}
+}
+
+// restoreArchive receives snapshot from the archive at the destination of j into receiver, decrypting the streams
+// with identity if they are encrypted with age. Parents missing at the source are received as well.
+func (j *job) restoreArchive(snapshot string, receiver *node, local map[string]bool, identity string, dryRun bool) error {
+	archive, err := j.destination.listArchive()
+	if err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
+	chain, err := restoreChain(archive, snapshot, local)
+	if err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
+	return receiveStreams(&j.destination, chain, receiver, identity, dryRun)
+}
+
+// receiveStreams receives the streams of chain stored in archive into receiver in order, decrypting them with identity
+// if they are encrypted with age.
+func receiveStreams(archive *node, chain []archiveFile, receiver *node, identity string, dryRun bool) error {
+	for _, f := range chain {
+		log.Printf("Receiving %s from %s", f.snapshot, f.name)
+		decrypt, err := decryptionFilter(f.name, identity)
+		if err != nil {
+			return fmt.Errorf("restore: %v", err)
+		}
+		if dryRun {
+			continue
+		}
+		if receiver.subvolume != "" {
+			if _, err := receiver.run("mkdir", "-p", receiver.receiveDir(f.snapshot)); err != nil {
+				return fmt.Errorf("restore: %v", err)
+			}
+		}
+		e := withExecutorImpl(archive.executor, func(e *executorImpl) {
+			e.filters = nil
+			if decrypt != nil {
+				e.filters = []filter{decrypt}
+			}
+		})
+		read := archive.command("cat", path.Join(archive.archiveDir(), f.name))
+		if archive.s3 != nil {
+			read = archive.s3.download(path.Join(archive.archiveDir(), f.name))
+		}
+		cmds := [][]string{
+			read,
+			receiver.stdinCommand(receiver.btrfsReceive(receiver.receiveDir(f.snapshot))...),
+		}
+		if _, _, err := e.exec(cmds); err != nil {
+			return fmt.Errorf("restore: %s: %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+// forcesFullSends reports whether transfers to n may be turned into full sends, see fullSends.
+func (n *node) forcesFullSends() bool {
+	return n.archive && (n.fullEvery > 0 || n.fullTag != "" || n.maxChain > 0)
+}
+
+// fullSends turns the transfers to the archive n into full sends if the snapshot carries the full tag of n, if the
+// full send starting the chain of its parent is older than the full interval of n or if the chain would exceed the
+// maximum number of incremental streams of n. This bounds the chains which have to be received to restore a snapshot.
+func (n *node) fullSends(transfers []transfer, archive []archiveFile) []transfer {
+	roots := make(map[string]string) // the full send starting the chain of a snapshot
+	lengths := make(map[string]int)  // the number of incremental streams in the chain of a snapshot
+	add := func(snapshot, parent string) {
+		if parent == "" {
+			roots[snapshot], lengths[snapshot] = snapshot, 0
+		} else {
+			roots[snapshot], lengths[snapshot] = roots[parent], lengths[parent]+1
+		}
+	}
+	// the archive is sorted, parents are older than their children
+	for _, f := range archive {
+		add(f.snapshot, f.parent)
+	}
+	res := append([]transfer(nil), transfers...)
+	for i, t := range res {
+		switch {
+		case t.parent == "":
+		case n.fullTag != "" && strings.HasSuffix(t.snapshot, "_"+n.fullTag):
+			log.Printf("Sending %s in full, it is tagged %s", t.snapshot, n.fullTag)
+			res[i].parent = ""
+		case n.maxChain > 0 && lengths[t.parent] >= n.maxChain:
+			log.Printf("Sending %s in full, the chain of %s already has %d incremental streams", t.snapshot, t.parent, lengths[t.parent])
+			res[i].parent = ""
+		case n.fullEvery > 0 && n.fullDue(t.snapshot, roots[t.parent]):
+			log.Printf("Sending %s in full, the last full send %s is older than %v", t.snapshot, roots[t.parent], n.fullEvery)
+			res[i].parent = ""
+		}
+		add(t.snapshot, res[i].parent)
+	}
+	return res
+}
+
+// fullDue reports whether snapshot is at least the full interval of n newer than the full send root. Snapshots without
+// a time or an unknown root are never due.
+func (n *node) fullDue(snapshot, root string) bool {
+	t, ok := n.snapshotTime(snapshot)
+	if !ok || root == "" {
+		return false
+	}
+	last, ok := n.snapshotTime(root)
+	return ok && t.Sub(last) >= n.fullEvery
+}
+
+// pruneArchive deletes the streams of snapshots from the archive n. Streams which are needed to restore a remaining
+// snapshot, its parents back to the full send, are kept, so only whole chains or their superseded ends are deleted.
+func (n *node) pruneArchive(snapshots []string, dryRun bool) (int, error) {
+	archive, err := n.listArchive()
+	if err != nil {
+		return 0, fmt.Errorf("prune: %v", err)
+	}
+	deleted := make(map[string]bool)
+	for _, s := range snapshots {
+		deleted[s] = true
+	}
+	parents := make(map[string]string)
+	for _, f := range archive {
+		parents[f.snapshot] = f.parent
+	}
+	needed := make(map[string]string) // snapshots needed by a remaining snapshot mapped to it
+	for _, f := range archive {
+		if deleted[f.snapshot] {
+			continue
+		}
+		for p := f.parent; p != "" && needed[p] == "" && p != f.snapshot; p = parents[p] {
+			needed[p] = f.snapshot
+		}
+	}
+	var files []string
+	for _, f := range archive {
+		if !deleted[f.snapshot] {
+			continue
+		}
+		if dependent := needed[f.snapshot]; dependent != "" {
+			log.Printf("Keeping %s because %s depends on it", f.snapshot, dependent)
+			continue
+		}
+		log.Printf("Deleting %s", f.name)
+		files = append(files, path.Join(n.archiveDir(), f.name))
+	}
+	if len(files) == 0 {
+		log.Printf("Nothing to prune")
+		return 0, nil
+	}
+	if dryRun {
+		return 0, nil
+	}
+	if n.s3 != nil {
+		for i, f := range files {
+			if _, err := n.run(n.s3.remove(f)...); err != nil {
+				n.updateManifest()
+				return i, fmt.Errorf("prune: %v", err)
+			}
+		}
+	} else if _, err := n.run(append([]string{"rm", "-f", "--"}, files...)...); err != nil {
+		return 0, fmt.Errorf("prune: %v", err)
+	}
+	n.updateManifest()
+	log.Printf("Deleted %d archived streams", len(files))
+	return len(files), nil
+}
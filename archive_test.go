@@ -0,0 +1,253 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestArchiveName(t *testing.T) {
+	data := []struct {
+		name     string
+		expected archiveFile
+		ok       bool
+	}{
+		{"1.btrfs", archiveFile{name: "1.btrfs", snapshot: "1"}, true},
+		{"2~1.btrfs", archiveFile{name: "2~1.btrfs", snapshot: "2", parent: "1"}, true},
+		{"2~1.btrfs.age", archiveFile{name: "2~1.btrfs.age", snapshot: "2", parent: "1"}, true},
+		{"root.2019-01-02.btrfs.gpg", archiveFile{name: "root.2019-01-02.btrfs.gpg", snapshot: "root.2019-01-02"}, true},
+		{".2.partial", archiveFile{}, false},
+		{"notes.txt", archiveFile{}, false},
+		{"~1.btrfs", archiveFile{}, false},
+	}
+	for di, d := range data {
+		f, ok := parseArchiveName(d.name)
+		if ok != d.ok || f != d.expected {
+			t.Errorf("%d: unexpected result: %+v, %v", di, f, ok)
+		}
+	}
+
+	n := node{encryption: encryption{age: []string{"age1abc"}}}
+	if name := n.archiveName("2", "1"); name != "2~1.btrfs.age" {
+		t.Errorf("unexpected name: %s", name)
+	}
+}
+
+func TestArchiveSend(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"ssh -C -p22 box -- ls -1 /backup/laptop":    "1.btrfs.age\n.2.partial\n",
+		"ssh -C -p22 box -- mkdir -p /backup/laptop": "",
+		"btrfs send --quiet -p /mnt/snapshot/1 /mnt/snapshot/2 | ssh -C -p22 box -- dd of=/backup/laptop/.2.partial bs=1M status=none": "",
+		"ssh -C -p22 box -- mv -T /backup/laptop/.2.partial /backup/laptop/2~1.btrfs.age":                                              "",
+	}}
+	manifest := `printf %s {
+  "streams": [
+    {
+      "file": "1.btrfs.age",
+      "snapshot": "1",
+      "encryption": "age"
+    }
+  ]
+}
+ | ssh -C -p22 box -- dd of=/backup/laptop/.manifest.json.partial status=none`
+	e.out[manifest] = ""
+	e.out["ssh -C -p22 box -- mv -T /backup/laptop/.manifest.json.partial /backup/laptop/manifest.json"] = ""
+	r := regexp.MustCompile(`^\d$`)
+	destination := node{address: "box", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e,
+		archive: true, encryption: encryption{age: []string{"age1abc", "age1def"}}}
+	source := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e}
+
+	snapshots, err := destination.getSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snapshots, []string{"1"}) {
+		t.Errorf("unexpected snapshots: %v", snapshots)
+	}
+	if _, err := sendTransfers(&source, &destination, []transfer{{snapshot: "2", parent: "1"}}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+	if e.calls[manifest] != 1 {
+		t.Errorf("manifest not written: %v", e.calls)
+	}
+	// a new archive
+	local := node{address: "localhost", mountPoint: "/media/usb", snapshotPath: "laptop", snapshotRegex: r, executor: e, archive: true}
+	if snapshots, err := local.getSnapshots(); err != nil || len(snapshots) != 0 {
+		t.Errorf("unexpected snapshots: %v, %v", snapshots, err)
+	}
+	e.out["test -e /media/usb/laptop"] = ""
+	if _, err := local.getSnapshots(); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+	if filters := destination.streamFilters(); !reflect.DeepEqual(filters, []filter{execFilter{[]string{"age", "-r", "age1abc", "-r", "age1def"}}}) {
+		t.Errorf("unexpected filters: %v", filters)
+	}
+
+	// a failed transfer leaves no partial file behind
+	e.out["ssh -C -p22 box -- rm -f /backup/laptop/.3.partial"] = ""
+	if _, err := sendTransfers(&source, &destination, []transfer{{snapshot: "3", parent: "2"}}, false, nil); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+	if e.calls["ssh -C -p22 box -- rm -f /backup/laptop/.3.partial"] != 1 {
+		t.Errorf("partial file not removed")
+	}
+}
+
+func TestRestoreChain(t *testing.T) {
+	archive := []archiveFile{
+		{name: "1.btrfs", snapshot: "1"},
+		{name: "2~1.btrfs", snapshot: "2", parent: "1"},
+		{name: "3~2.btrfs", snapshot: "3", parent: "2"},
+		{name: "4.btrfs", snapshot: "4"},
+		{name: "6~5.btrfs", snapshot: "6", parent: "5"},
+	}
+	data := []struct {
+		snapshot string
+		local    map[string]bool
+		expected []string
+		err      bool
+	}{
+		{"3", nil, []string{"1", "2", "3"}, false},
+		{"3", map[string]bool{"2": true}, []string{"3"}, false},
+		{"4", map[string]bool{"3": true}, []string{"4"}, false},
+		{"6", nil, nil, true}, // parent missing
+		{"7", nil, nil, true},
+	}
+	for di, d := range data {
+		chain, err := restoreChain(archive, d.snapshot, d.local)
+		if d.err {
+			if err == nil {
+				t.Errorf("%d: expected error but succeeded", di)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+			continue
+		}
+		var snapshots []string
+		for _, f := range chain {
+			snapshots = append(snapshots, f.snapshot)
+		}
+		if !reflect.DeepEqual(snapshots, d.expected) {
+			t.Errorf("%d: unexpected chain: %v", di, snapshots)
+		}
+	}
+}
+
+func TestRestoreArchive(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":               "ID 1 gen 1 top level 5 path snapshot/1\n",
+		"ssh -C -p22 box -- ls -1 /backup/laptop": "1.btrfs.gpg\n2~1.btrfs.gpg\n3~2.btrfs.gpg\n",
+		"ssh -C -p22 box -- cat /backup/laptop/2~1.btrfs.gpg | btrfs receive /mnt/restore": "",
+		"ssh -C -p22 box -- cat /backup/laptop/3~2.btrfs.gpg | btrfs receive /mnt/restore": "",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "box", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e, archive: true},
+	}
+	if err := j.restore("3", "/mnt/restore", "", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if e.calls["ssh -C -p22 box -- cat /backup/laptop/3~2.btrfs.gpg | btrfs receive /mnt/restore"] != 1 {
+		t.Errorf("snapshot not restored: %v", e.calls)
+	}
+
+	// age needs an identity
+	e.out["ssh -C -p22 box -- ls -1 /backup/laptop"] = "1.btrfs.age\n2~1.btrfs.age\n"
+	if err := j.restore("2", "/mnt/restore", "", "", false); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+	if _, err := decryptionFilter("2~1.btrfs.age", "/root/key.txt"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFullSends(t *testing.T) {
+	transfers := []transfer{
+		{snapshot: "2019-01-10_00-00", parent: "2019-01-01_00-00"},
+		{snapshot: "2019-01-20_00-00_monthly", parent: "2019-01-10_00-00"},
+		{snapshot: "2019-02-15_00-00", parent: "2019-01-20_00-00_monthly"},
+		{snapshot: "2019-02-16_00-00", parent: "2019-02-15_00-00"},
+	}
+	full := []archiveFile{{name: "2019-01-01_00-00.btrfs", snapshot: "2019-01-01_00-00"}}
+	chain := []archiveFile{
+		{name: "2018-12-01_00-00.btrfs", snapshot: "2018-12-01_00-00"},
+		{name: "2019-01-01_00-00~2018-12-01_00-00.btrfs", snapshot: "2019-01-01_00-00", parent: "2018-12-01_00-00"},
+	}
+	data := []struct {
+		fullEvery time.Duration
+		fullTag   string
+		maxChain  int
+		archive   []archiveFile
+		expected  []string // snapshots sent in full
+	}{
+		{0, "", 0, full, nil},
+		{0, "monthly", 0, full, []string{"2019-01-20_00-00_monthly"}},
+		{7 * 24 * time.Hour, "", 0, full, []string{"2019-01-10_00-00", "2019-01-20_00-00_monthly", "2019-02-15_00-00"}},
+		{30 * 24 * time.Hour, "", 0, full, []string{"2019-02-15_00-00"}},
+		{30 * 24 * time.Hour, "monthly", 0, full, []string{"2019-01-20_00-00_monthly"}},
+		{30 * 24 * time.Hour, "", 0, nil, nil}, // the chain of the parent is unknown
+		{0, "", 1, full, []string{"2019-01-20_00-00_monthly", "2019-02-16_00-00"}},
+		{0, "", 2, chain, []string{"2019-01-20_00-00_monthly"}},
+		{0, "", 2, nil, []string{"2019-02-15_00-00"}},
+	}
+	for di, d := range data {
+		n := node{archive: true, fullEvery: d.fullEvery, fullTag: d.fullTag, maxChain: d.maxChain}
+		var full []string
+		for i, tr := range n.fullSends(transfers, d.archive) {
+			if tr.snapshot != transfers[i].snapshot {
+				t.Fatalf("%d: unexpected transfer: %v", di, tr)
+			}
+			if tr.parent == "" {
+				full = append(full, tr.snapshot)
+			} else if tr.parent != transfers[i].parent {
+				t.Errorf("%d: unexpected parent: %v", di, tr)
+			}
+		}
+		if !reflect.DeepEqual(full, d.expected) {
+			t.Errorf("%d: unexpected full sends: %v", di, full)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-dst", "box:22/backup", "-full-every", "30d"},
+		{"-dst", "box:22/backup", "-archive", "-full-tag", "no spaces"},
+		{"-dst", "box:22/backup", "-archive", "-full-every", "monthly"},
+		{"-dst", "box:22/backup", "-archive", "-max-chain", "-1"},
+		{"-dst", "box:22/backup", "-max-chain", "10"},
+	} {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		jf := addJobFlags(fs)
+		if err := fs.Parse(args); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := jf.loadJobs(); err == nil {
+			t.Errorf("%v: expected error but succeeded", args)
+		}
+	}
+}
+
+func TestPruneArchive(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":               "ID 5 gen 5 top level 5 path snapshot/5\n",
+		"ssh -C -p22 box -- ls -1 /backup/laptop": "1.btrfs\n2~1.btrfs\n3~2.btrfs\n4.btrfs\n5~4.btrfs\n",
+		"ssh -C -p22 box -- rm -f -- /backup/laptop/1.btrfs /backup/laptop/2~1.btrfs /backup/laptop/3~2.btrfs": "",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "box", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e, archive: true},
+	}
+	// 4 is kept as 5 depends on it
+	n, err := j.pruneNode(&j.destination, retention{keep: 1}, deleteBatches{}, references{}, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("unexpected number of deleted streams: %d", n)
+	}
+}
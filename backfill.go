@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// timeWindow is a daily time window like 01:00-06:00. Windows may span midnight, eg. 22:00-04:00.
+type timeWindow struct {
+	start, end int // minutes since midnight
+}
+
+func parseTimeWindow(s string) (timeWindow, error) {
+	var h1, m1, h2, m2 int
+	if _, err := fmt.Sscanf(s, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); err != nil {
+		return timeWindow{}, fmt.Errorf("invalid time window: %s", s)
+	}
+	for _, v := range []struct{ v, max int }{{h1, 23}, {m1, 59}, {h2, 23}, {m2, 59}} {
+		if v.v < 0 || v.v > v.max {
+			return timeWindow{}, fmt.Errorf("invalid time window: %s", s)
+		}
+	}
+	return timeWindow{start: h1*60 + m1, end: h2*60 + m2}, nil
+}
+
+// contains returns true if t is inside the window. A window with equal start and end covers the whole day.
+func (w timeWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.start == w.end {
+		return true
+	}
+	if w.start < w.end {
+		return m >= w.start && m < w.end
+	}
+	return m >= w.start || m < w.end
+}
+
+// planBackfill returns transfers for all local snapshots older than the most recent remote snapshot which are missing
+// remotely, newest first. Every snapshot is sent relative to the nearest older snapshot present remotely or, if there
+// is none, the nearest newer one.
+func planBackfill(localSnapshots, remoteSnapshots []string) []transfer {
+	present := make(map[string]bool)
+	for _, s := range remoteSnapshots {
+		present[s] = true
+	}
+	newest := -1
+	for i, s := range localSnapshots {
+		if present[s] {
+			newest = i
+		}
+	}
+
+	var res []transfer
+	for i := newest - 1; i >= 0; i-- {
+		snapshot := localSnapshots[i]
+		if present[snapshot] {
+			continue
+		}
+		parent := ""
+		for k := i - 1; k >= 0 && parent == ""; k-- {
+			if present[localSnapshots[k]] {
+				parent = localSnapshots[k]
+			}
+		}
+		for k := i + 1; k < len(localSnapshots) && parent == ""; k++ {
+			if present[localSnapshots[k]] {
+				parent = localSnapshots[k]
+			}
+		}
+		res = append(res, transfer{snapshot: snapshot, parent: parent})
+		present[snapshot] = true
+	}
+	return res
+}
+
+// backfill sends historical snapshots missing at the destination until the byte budget is exhausted or the time window
+// closes. A budget of 0 means unlimited. done is called after every successful transfer.
+func (j *job) backfill(localSnapshots, remoteSnapshots []string, budget int, window *timeWindow, dryRun bool, done func(t transfer, transmitted int)) error {
+	transfers := planBackfill(localSnapshots, remoteSnapshots)
+	if len(transfers) == 0 {
+		return nil
+	}
+	log.Printf("Backfilling up to %d historical snapshots", len(transfers))
+
+	transmitted := 0
+	for _, t := range transfers {
+		if window != nil && !window.contains(time.Now()) {
+			log.Printf("Backfill window closed, %s and older snapshots remain", t.snapshot)
+			return nil
+		}
+		if budget > 0 && transmitted >= budget {
+			log.Printf("Backfill budget of %s exhausted, %s and older snapshots remain", formatBytes(budget), t.snapshot)
+			return nil
+		}
+		_, err := sendTransfers(&j.source, &j.destination, []transfer{t}, dryRun, func(t transfer, n int) {
+			transmitted += n
+			if done != nil {
+				done(t, n)
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("backfill: %v", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTimeWindow(t *testing.T) {
+	data := []struct {
+		window string
+		hour   int
+		minute int
+		in     bool
+	}{
+		{"01:00-06:00", 0, 59, false},
+		{"01:00-06:00", 1, 0, true},
+		{"01:00-06:00", 5, 59, true},
+		{"01:00-06:00", 6, 0, false},
+		{"22:00-04:00", 23, 0, true},
+		{"22:00-04:00", 3, 30, true},
+		{"22:00-04:00", 12, 0, false},
+		{"00:00-00:00", 12, 0, true},
+	}
+
+	for _, d := range data {
+		w, err := parseTimeWindow(d.window)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tm := time.Date(2024, 1, 1, d.hour, d.minute, 0, 0, time.Local)
+		if w.contains(tm) != d.in {
+			t.Errorf("%s contains %02d:%02d != %v", d.window, d.hour, d.minute, d.in)
+		}
+	}
+
+	for _, s := range []string{"", "1-6", "25:00-06:00", "01:00-06:60"} {
+		if _, err := parseTimeWindow(s); err == nil {
+			t.Errorf("%q: expected error but succeeded", s)
+		}
+	}
+}
+
+func TestPlanBackfill(t *testing.T) {
+	local := []string{"1", "2", "3", "4", "5", "6"}
+	data := []struct {
+		remote    []string
+		transfers []transfer
+	}{
+		{[]string{"1", "5"}, []transfer{{"4", "1"}, {"3", "1"}, {"2", "1"}}},
+		{[]string{"5"}, []transfer{{"4", "5"}, {"3", "4"}, {"2", "3"}, {"1", "2"}}},
+		{[]string{"1", "2", "3"}, nil},
+		{[]string{}, nil},
+	}
+
+	for di, d := range data {
+		if res := planBackfill(local, d.remote); !reflect.DeepEqual(res, d.transfers) {
+			t.Errorf("%d: unexpected transfers: %#v", di, res)
+		}
+	}
+}
+
+// meteringExecutor reports n transmitted bytes for every invocation.
+type meteringExecutor struct {
+	n int
+}
+
+func (e meteringExecutor) exec(cmds [][]string) (string, int, error) {
+	return "", e.n, nil
+}
+
+func TestBackfillBudget(t *testing.T) {
+	data := []struct {
+		budget int
+		window *timeWindow
+		sent   []string
+	}{
+		{0, nil, []string{"3", "2", "1"}},
+		{250, nil, []string{"3", "2", "1"}},
+		{200, nil, []string{"3", "2"}},
+		{1, nil, []string{"3"}},
+		{0, &timeWindow{start: time.Now().Hour()*60 + time.Now().Minute() + 1, end: 0}, nil},
+	}
+
+	for di, d := range data {
+		j := job{
+			source:      node{mountPoint: "/foo", snapshotPath: "bar", executor: meteringExecutor{100}},
+			destination: node{mountPoint: "/foo"},
+		}
+		var sent []string
+		err := j.backfill([]string{"1", "2", "3", "4"}, []string{"4"}, d.budget, d.window, false, func(t transfer, n int) {
+			sent = append(sent, t.snapshot)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(sent, d.sent) {
+			t.Errorf("%d: unexpected snapshots sent: %#v", di, sent)
+		}
+	}
+}
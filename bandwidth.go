@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+)
+
+// bandwidthShare divides a total rate among the transfers running at the same time in proportion to the weights of
+// their destinations, so that a fast transfer to a local NAS doesn't starve a concurrent transfer over a slow offsite
+// link. The share of a transfer grows as others finish, but never exceeds the limit of its own destination.
+type bandwidthShare struct {
+	total int // bytes per second
+
+	mu      sync.Mutex
+	weights map[*rateLimiter]int // weights of the running transfers
+}
+
+func newBandwidthShare(total int) *bandwidthShare {
+	return &bandwidthShare{total: total, weights: make(map[*rateLimiter]int)}
+}
+
+// join returns the limiter of a transfer with weight, which is additionally limited to limit bytes per second unless
+// it is 0. The transfer has to leave once it finished.
+func (s *bandwidthShare) join(weight, limit int) *rateLimiter {
+	if weight <= 0 {
+		weight = 1
+	}
+	l := newRateLimiter(s.total)
+	l.rateOf = func() float64 {
+		r := s.rate(l)
+		if limit > 0 && float64(limit) < r {
+			r = float64(limit)
+		}
+		return r
+	}
+	s.mu.Lock()
+	s.weights[l] = weight
+	s.mu.Unlock()
+	return l
+}
+
+func (s *bandwidthShare) leave(l *rateLimiter) {
+	s.mu.Lock()
+	delete(s.weights, l)
+	s.mu.Unlock()
+}
+
+// rate returns the share of the total rate of the transfer limited by l.
+func (s *bandwidthShare) rate(l *rateLimiter) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sum := 0
+	for _, w := range s.weights {
+		sum += w
+	}
+	if sum == 0 {
+		return float64(s.total)
+	}
+	return float64(s.total) * float64(s.weights[l]) / float64(sum)
+}
+
+// destinationGroups returns the indexes of jobs grouped by destination in the order of their first job. Jobs sending
+// to the same destination run one after another, different destinations may run concurrently.
+func destinationGroups(jobs []job) [][]int {
+	index := make(map[string]int)
+	var groups [][]int
+	for i := range jobs {
+		key := jobs[i].destination.key()
+		g, ok := index[key]
+		if !ok {
+			g = len(groups)
+			index[key] = g
+			groups = append(groups, nil)
+		}
+		groups[g] = append(groups[g], i)
+	}
+	return groups
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBandwidthShare(t *testing.T) {
+	s := newBandwidthShare(1000)
+	nas := s.join(3, 0)
+	offsite := s.join(1, 0)
+	if r := nas.rateOf(); r != 750 {
+		t.Errorf("unexpected rate: %v", r)
+	}
+	if r := offsite.rateOf(); r != 250 {
+		t.Errorf("unexpected rate: %v", r)
+	}
+
+	// the limit of the destination caps its share
+	capped := s.join(4, 100)
+	if r := capped.rateOf(); r != 100 {
+		t.Errorf("unexpected rate: %v", r)
+	}
+	s.leave(capped)
+
+	// the remaining transfer gets the whole rate
+	s.leave(nas)
+	if r := offsite.rateOf(); r != 1000 {
+		t.Errorf("unexpected rate: %v", r)
+	}
+}
+
+func TestDestinationGroups(t *testing.T) {
+	jobs := []job{
+		{destination: node{address: "nas", sshPort: 22, mountPoint: "/backup"}},
+		{destination: node{address: "offsite", sshPort: 22, mountPoint: "/backup"}},
+		{destination: node{address: "nas", sshPort: 22, mountPoint: "/backup"}},
+	}
+	if groups := destinationGroups(jobs); !reflect.DeepEqual(groups, [][]int{{0, 2}, {1}}) {
+		t.Errorf("unexpected groups: %v", groups)
+	}
+}
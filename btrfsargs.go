@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// btrfsFlag is an optional argument of btrfs send or receive which may be passed on with -send-args and -receive-args.
+type btrfsFlag struct {
+	value bool   // the flag is followed by a value, eg. --max-errors 10
+	since [2]int // first btrfs-progs version supporting the flag, zero for all versions
+}
+
+// sendFlags are the supported additional arguments of btrfs send. Arguments naming subvolumes, eg. -c, would
+// interfere with the choice of parents.
+var sendFlags = map[string]btrfsFlag{
+	"-e":                {},
+	"-v":                {},
+	"--verbose":         {},
+	"--no-data":         {},
+	"--proto":           {value: true, since: [2]int{6, 0}},
+	"--compressed-data": {since: [2]int{6, 0}},
+}
+
+// receiveFlags are the supported additional arguments of btrfs receive. Arguments changing what is received, eg.
+// --dump, are missing on purpose.
+var receiveFlags = map[string]btrfsFlag{
+	"-e":                 {},
+	"-v":                 {},
+	"-E":                 {value: true},
+	"--max-errors":       {value: true},
+	"-m":                 {value: true},
+	"-C":                 {},
+	"--chroot":           {},
+	"--force-decompress": {since: [2]int{6, 0}},
+}
+
+// checkBtrfsArgs returns an error if args contains an argument missing in flags or a flag without its value.
+func checkBtrfsArgs(args []string, flags map[string]btrfsFlag) error {
+	for i := 0; i < len(args); i++ {
+		f, ok := flags[args[i]]
+		if !ok {
+			return fmt.Errorf("unsupported argument: %s", args[i])
+		}
+		if f.value {
+			if i+1 == len(args) || strings.HasPrefix(args[i+1], "-") {
+				return fmt.Errorf("missing value of %s", args[i])
+			}
+			i++
+		}
+	}
+	return nil
+}
+
+// requiredVersion returns the first btrfs-progs version supporting all flags in args.
+func requiredVersion(args []string, flags map[string]btrfsFlag) [2]int {
+	var v [2]int
+	for _, a := range args {
+		if f, ok := flags[a]; ok && versionLess(v, f.since) {
+			v = f.since
+		}
+	}
+	return v
+}
+
+// parseBtrfsVersion extracts the version from the output of "btrfs --version", eg. "btrfs-progs v6.2".
+func parseBtrfsVersion(str string) ([2]int, error) {
+	matches := regexp.MustCompile(`v(\d+)\.(\d+)`).FindStringSubmatch(str)
+	if len(matches) != 3 {
+		return [2]int{}, fmt.Errorf("unexpected btrfs version: %s", str)
+	}
+	major, _ := strconv.Atoi(matches[1])
+	minor, _ := strconv.Atoi(matches[2])
+	return [2]int{major, minor}, nil
+}
+
+func versionLess(a, b [2]int) bool {
+	return a[0] < b[0] || (a[0] == b[0] && a[1] < b[1])
+}
+
+// checkBtrfsVersions verifies that the btrfs-progs of the source and the destination of j support the additional
+// arguments of btrfs send and receive. btrfs is only asked for its version if an argument requires one.
+func (j *job) checkBtrfsVersions() error {
+	for _, c := range []struct {
+		n     *node
+		args  []string
+		flags map[string]btrfsFlag
+	}{
+		{&j.source, j.destination.sendArgs, sendFlags},
+		{&j.destination, j.destination.receiveArgs, receiveFlags},
+	} {
+		required := requiredVersion(c.args, c.flags)
+		if required == [2]int{} || c.n.archive {
+			continue
+		}
+		version, err := c.n.btrfsVersion()
+		if err != nil {
+			return fmt.Errorf("checkBtrfsVersions: %v", err)
+		}
+		v, err := parseBtrfsVersion(version)
+		if err != nil {
+			return fmt.Errorf("checkBtrfsVersions: %v", err)
+		}
+		if versionLess(v, required) {
+			return fmt.Errorf("checkBtrfsVersions: %s: %s is older than v%d.%d required by %s", c.n.key(), version, required[0], required[1], strings.Join(c.args, " "))
+		}
+	}
+	return nil
+}
+
+// sendCommand returns the btrfs send invocation of a stream sent to n with the additional arguments of n.
+func (n *node) sendCommand(args ...string) []string {
+	cmd := append([]string{"btrfs", "send", "--quiet"}, n.sendArgs...)
+	return append(cmd, args...)
+}
+
+// btrfsReceive returns the btrfs receive invocation at n with the additional arguments of n.
+func (n *node) btrfsReceive(args ...string) []string {
+	cmd := append([]string{"btrfs", "receive"}, n.receiveArgs...)
+	return append(cmd, args...)
+}
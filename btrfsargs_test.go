@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckBtrfsArgs(t *testing.T) {
+	data := []struct {
+		args  []string
+		flags map[string]btrfsFlag
+		err   bool
+	}{
+		{nil, sendFlags, false},
+		{[]string{"--proto", "2", "--compressed-data"}, sendFlags, false},
+		{[]string{"--proto"}, sendFlags, true},
+		{[]string{"--proto", "--compressed-data"}, sendFlags, true},
+		{[]string{"-c", "/mnt/snapshot/1"}, sendFlags, true},
+		{[]string{"-E", "10", "-v"}, receiveFlags, false},
+		{[]string{"--dump"}, receiveFlags, true},
+	}
+	for di, d := range data {
+		if err := checkBtrfsArgs(d.args, d.flags); d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+	}
+}
+
+func TestParseBtrfsVersion(t *testing.T) {
+	data := []struct {
+		str  string
+		want [2]int
+		err  bool
+	}{
+		{"btrfs-progs v6.2", [2]int{6, 2}, false},
+		{"btrfs-progs v5.16.2 \n", [2]int{5, 16}, false},
+		{"btrfs-progs", [2]int{}, true},
+	}
+	for di, d := range data {
+		res, err := parseBtrfsVersion(d.str)
+		if d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+		if res != d.want {
+			t.Errorf("%d: unexpected version: %v", di, res)
+		}
+	}
+}
+
+func TestCheckBtrfsVersions(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs --version":                    "btrfs-progs v6.2\n",
+		"ssh -C -p22 nas -- btrfs --version": "btrfs-progs v5.16.2\n",
+	}}
+	j := job{
+		source:      node{address: "localhost", executor: e},
+		destination: node{address: "nas", sshPort: 22, executor: e},
+	}
+	// nothing to check without arguments requiring a version
+	j.destination.receiveArgs = []string{"--max-errors", "10"}
+	if err := j.checkBtrfsVersions(); err != nil || len(e.calls) != 0 {
+		t.Errorf("unexpected error: %v, calls: %v", err, e.calls)
+	}
+	j.destination.sendArgs = []string{"--proto", "2"}
+	if err := j.checkBtrfsVersions(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	j.destination.receiveArgs = []string{"--force-decompress"}
+	if err := j.checkBtrfsVersions(); err == nil {
+		t.Error("expected error but succeeded")
+	}
+}
+
+func TestReceiveArgs(t *testing.T) {
+	n := &node{address: "nas", sshPort: 22, receiveArgs: []string{"--max-errors", "10"}, compress: compressZstd}
+	want := []string{"ssh", "-p22", "nas", "--", "zstd", "-d", "-c", "-q", "|", "btrfs", "receive", "--max-errors", "10", "/backup"}
+	if res := n.receiveCommand("/backup"); !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected command: %v", res)
+	}
+	n.sendArgs = []string{"--compressed-data"}
+	if res := n.sendCommand("/mnt/1"); !reflect.DeepEqual(res, []string{"btrfs", "send", "--quiet", "--compressed-data", "/mnt/1"}) {
+		t.Errorf("unexpected command: %v", res)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errCancelled is returned by commands killed because their transfer was cancelled.
+var errCancelled = errors.New("cancelled")
+
+// cancelled reports whether the commands of e were cancelled.
+func (e executorImpl) cancelled() bool {
+	select {
+	case <-e.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// withExecutorImpl returns e with f applied to the executorImpl running its commands. Executors not running commands
+// themselves, eg. when replaying a recording, are returned unchanged.
+func withExecutorImpl(e executor, f func(e *executorImpl)) executor {
+	switch e := e.(type) {
+	case executorImpl:
+		f(&e)
+		return e
+	case allowlistExecutor:
+		e.executor = withExecutorImpl(e.executor, f)
+		return e
+	case recordExecutor:
+		e.executor = withExecutorImpl(e.executor, f)
+		return e
+	}
+	return e
+}
+
+// transferRegistry tracks the jobs of a daemon which are transferring snapshots so that a single one can be cancelled
+// without stopping the daemon. It also keeps the queue of the current run, see queue.go.
+type transferRegistry struct {
+	mu        sync.Mutex
+	transfers map[string]*inflightTransfer // by job name
+	pending   []string                     // jobs of the current run which haven't started yet, in order
+	finished  []queueEntry                 // most recently finished jobs, oldest first
+	sizes     map[string]sizeHistory       // sizes of the snapshots sent by job name
+}
+
+type inflightTransfer struct {
+	started     time.Time
+	cancel      chan struct{}
+	cancelled   bool
+	snapshots   []queuedSnapshot // planned and sent snapshots
+	transmitted int
+}
+
+// transferInfo describes an in-flight transfer in the API.
+type transferInfo struct {
+	Job       string    `json:"job"`
+	Started   time.Time `json:"started"`
+	Cancelled bool      `json:"cancelled"`
+}
+
+func newTransferRegistry() *transferRegistry {
+	return &transferRegistry{transfers: make(map[string]*inflightTransfer), sizes: make(map[string]sizeHistory)}
+}
+
+// start registers the transfers of j and makes the source executor of j cancellable. It does nothing on a nil
+// registry.
+func (r *transferRegistry) start(j *job) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t := &inflightTransfer{started: time.Now(), cancel: make(chan struct{})}
+	r.transfers[j.name] = t
+	r.dequeue(j.name)
+	j.source.executor = withExecutorImpl(j.source.executor, func(e *executorImpl) { e.cancel = t.cancel })
+}
+
+// finish unregisters the transfers of j and records the result of its run in the queue. A job which failed before
+// starting is recorded as well.
+func (r *transferRegistry) finish(j *job, err error) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dequeue(j.name)
+	r.recordFinished(j.name, r.transfers[j.name], err)
+	delete(r.transfers, j.name)
+}
+
+// cancel kills the command transferring a snapshot of the job with the given name. The failed receive is cleaned up
+// like any other and the job stops. It returns false if the job isn't transferring snapshots.
+func (r *transferRegistry) cancel(name string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.transfers[name]
+	if !ok {
+		return false
+	}
+	if !t.cancelled {
+		t.cancelled = true
+		close(t.cancel)
+	}
+	return true
+}
+
+func (r *transferRegistry) list() []transferInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := []transferInfo{}
+	for name, t := range r.transfers {
+		res = append(res, transferInfo{Job: name, Started: t.started, Cancelled: t.cancelled})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Job < res[j].Job })
+	return res
+}
+
+// handleTransfers serves GET /api/transfers.
+func (r *transferRegistry) handleTransfers(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, r.list())
+}
+
+// handleCancel serves POST /api/cancel?job=NAME.
+func (r *transferRegistry) handleCancel(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := req.URL.Query().Get("job")
+	if !r.cancel(name) {
+		http.Error(w, "no transfer of job "+name+" in flight", http.StatusNotFound)
+		return
+	}
+	log.Printf("Cancelling the transfer of job %s", name)
+	writeJSON(w, r.list())
+}
+
+// cancelCommand cancels the in-flight transfer of a job of a daemon serving its API with -listen.
+func cancelCommand(args []string) {
+	fs := flag.NewFlagSet("cancel", flag.ExitOnError)
+	api := addAPIFlags(fs)
+	jobName := fs.String("job", "", "job whose transfer is cancelled")
+	fs.Parse(args)
+
+	if *jobName == "" {
+		log.Fatal("-job is required")
+	}
+	addr, token := api()
+	if err := postControl(os.Stdout, addr, token, "/api/cancel", url.Values{"job": {*jobName}}); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestExecutorCancel(t *testing.T) {
+	cancel := make(chan struct{})
+	e := executorImpl{cancel: cancel}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(cancel)
+	}()
+	start := time.Now()
+	if _, _, err := e.exec([][]string{{"sleep", "10"}, {"cat"}}); err != errCancelled {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("commands not killed, took %v", d)
+	}
+	if _, _, err := e.exec([][]string{{"true"}}); err != errCancelled {
+		t.Errorf("unexpected error after cancelling: %v", err)
+	}
+}
+
+func TestTransferRegistry(t *testing.T) {
+	r := newTransferRegistry()
+	a := &job{name: "a", source: node{executor: allowlistExecutor{executor: executorImpl{}}}}
+	b := &job{name: "b", source: node{executor: executorImpl{}}}
+	r.start(a)
+	r.start(b)
+	h := (&browseAPI{jobs: func() []job { return nil }, transfers: r}).handler()
+
+	data := []struct {
+		method string
+		url    string
+		status int
+	}{
+		{http.MethodGet, "/api/transfers", http.StatusOK},
+		{http.MethodPost, "/api/cancel?job=a", http.StatusOK},
+		{http.MethodPost, "/api/cancel?job=c", http.StatusNotFound},
+		{http.MethodGet, "/api/cancel?job=b", http.StatusMethodNotAllowed},
+	}
+	for di, d := range data {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(d.method, d.url, nil))
+		if rec.Code != d.status {
+			t.Errorf("%d: unexpected status %d: %s", di, rec.Code, rec.Body.String())
+		}
+	}
+
+	// only the transfer of a is cancelled
+	if !a.source.executor.(allowlistExecutor).executor.(executorImpl).cancelled() {
+		t.Errorf("a not cancelled")
+	}
+	if b.source.executor.(executorImpl).cancelled() {
+		t.Errorf("b cancelled")
+	}
+	if !r.cancel("a") {
+		t.Errorf("cancelling twice failed")
+	}
+	r.finish(a, nil)
+	if list := r.list(); len(list) != 1 || list[0].Job != "b" {
+		t.Errorf("unexpected transfers: %+v", list)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression algorithms of the stream sent to a destination.
+const (
+	compressZstd = "zstd"
+	compressGzip = "gzip"
+)
+
+// validCompression reports whether c is a compression algorithm, empty disables compression.
+func validCompression(c string) bool {
+	return c == "" || c == compressZstd || c == compressGzip
+}
+
+// compression returns the algorithm compressing the stream sent to n. Streams to local nodes are not compressed as
+// they don't cross a network.
+func (n *node) compression() string {
+	if n.sshPort == 0 {
+		return ""
+	}
+	return n.compress
+}
+
+// streamFilters returns the filters applied to the stream sent to n: the configured ones followed by compression and
+// the encryption of an archive.
+func (n *node) streamFilters() []filter {
+	filters := append([]filter(nil), n.filters...)
+	if c := n.compression(); c != "" {
+		filters = append(filters, compressFilter{c})
+	}
+	if n.archive && n.encryption.enabled() {
+		filters = append(filters, n.encryption.filter())
+	}
+	return filters
+}
+
+// receiveCommand returns the command receiving a stream into dir at n, decompressing it first if it is compressed.
+// The remote shell runs the pipeline.
+func (n *node) receiveCommand(dir string) []string {
+	switch n.compression() {
+	case compressZstd:
+		return n.command(append([]string{"zstd", "-d", "-c", "-q", "|"}, n.btrfsReceive(dir)...)...)
+	case compressGzip:
+		return n.command(append([]string{"gzip", "-d", "-c", "|"}, n.btrfsReceive(dir)...)...)
+	}
+	return n.stdinCommand(n.btrfsReceive(dir)...)
+}
+
+// resolveCompression falls back to gzip if zstd is missing at the destination of j, which decompresses the stream with
+// the zstd binary.
+func (j *job) resolveCompression() {
+	if j.destination.compression() != compressZstd {
+		return
+	}
+	if _, err := j.destination.run("zstd", "--version"); err == nil {
+		return
+	}
+	log.Printf("zstd not available at %s, compressing with gzip", j.destination.key())
+	j.destination.compress = compressGzip
+	filters := j.destination.streamFilters()
+	j.source.executor = withExecutorImpl(j.source.executor, func(e *executorImpl) { e.filters = filters })
+}
+
+// compressFilter compresses the stream in-process with gzip or zstd. It logs the size of the stream before and after
+// compression.
+type compressFilter struct {
+	algorithm string
+}
+
+func (f compressFilter) String() string { return "compress:" + f.algorithm }
+
+func (f compressFilter) wrap(r io.Reader) (io.ReadCloser, error) {
+	raw := &meterReader{r: r}
+	var compressed io.ReadCloser
+	var err error
+	switch f.algorithm {
+	case compressZstd:
+		compressed, err = encodeStream(raw, "zstdFilter", func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w)
+		})
+	case compressGzip:
+		compressed, err = gzipFilter{}.wrap(raw)
+	default:
+		err = fmt.Errorf("compressFilter: unknown algorithm: %s", f.algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &compressReader{ReadCloser: compressed, raw: raw, algorithm: f.algorithm}, nil
+}
+
+type compressReader struct {
+	io.ReadCloser
+	raw        *meterReader
+	compressed int
+	algorithm  string
+}
+
+func (c *compressReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.compressed += n
+	return n, err
+}
+
+func (c *compressReader) Close() error {
+	log.Printf("Compressed %s to %s with %s", formatBytes(c.raw.meter), formatBytes(c.compressed), c.algorithm)
+	return c.ReadCloser.Close()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompressFilter(t *testing.T) {
+	stream := strings.Repeat("btrfs send stream ", 1000)
+	decompress := map[string][]string{compressGzip: {"gzip", "-d", "-c"}, compressZstd: {"zstd", "-d", "-c", "-q"}}
+	for _, algorithm := range []string{compressGzip, compressZstd} {
+		// the receive command decompresses the stream with the binary
+		if _, err := exec.LookPath(algorithm); err != nil {
+			t.Logf("skipping %s: %v", algorithm, err)
+			continue
+		}
+		var compressed bytes.Buffer
+		if err := copyFiltered(&compressed, strings.NewReader(stream), []filter{compressFilter{algorithm}}); err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if compressed.Len() >= len(stream) {
+			t.Errorf("%s: not compressed: %d bytes", algorithm, compressed.Len())
+		}
+		c := exec.Command(decompress[algorithm][0], decompress[algorithm][1:]...)
+		c.Stdin = &compressed
+		out, err := c.Output()
+		if err != nil {
+			t.Fatalf("%s: %v", algorithm, err)
+		}
+		if string(out) != stream {
+			t.Errorf("%s: unexpected stream after decompression", algorithm)
+		}
+	}
+}
+
+func TestCompressionCommands(t *testing.T) {
+	data := []struct {
+		n       node
+		receive string
+		ssh     string
+	}{
+		{node{address: "nas", sshPort: 22}, "ssh -C -p22 nas -- btrfs receive /backup", "ssh -C -p22 nas --"},
+		{node{address: "nas", sshPort: 22, compress: compressZstd}, "ssh -p22 nas -- zstd -d -c -q | btrfs receive /backup", "ssh -p22 nas --"},
+		{node{address: "nas", sshPort: 22, compress: compressGzip}, "ssh -p22 nas -- gzip -d -c | btrfs receive /backup", "ssh -p22 nas --"},
+		{node{address: "localhost", compress: compressZstd}, "btrfs receive /backup", ""},
+	}
+	for di, d := range data {
+		if cmd := strings.Join(d.n.receiveCommand("/backup"), " "); cmd != d.receive {
+			t.Errorf("%d: unexpected receive command: %s", di, cmd)
+		}
+		if d.ssh != "" && strings.Join(sshArgs(&d.n), " ") != d.ssh {
+			t.Errorf("%d: unexpected ssh command: %v", di, sshArgs(&d.n))
+		}
+		if filters := d.n.streamFilters(); (d.n.compression() != "") != (len(filters) == 1) {
+			t.Errorf("%d: unexpected filters: %v", di, filters)
+		}
+	}
+}
+
+func TestResolveCompression(t *testing.T) {
+	data := []struct {
+		remote   bool
+		expected string
+	}{
+		{true, compressZstd},
+		{false, compressGzip},
+	}
+	for di, d := range data {
+		e := &mapExecutor{out: map[string]string{}}
+		if d.remote {
+			e.out["ssh -p22 nas -- zstd --version"] = "*** Zstandard CLI v1.5.5"
+		}
+		j := job{
+			source:      node{executor: executorImpl{filters: []filter{compressFilter{compressZstd}}}},
+			destination: node{address: "nas", sshPort: 22, compress: compressZstd, executor: e},
+		}
+		j.resolveCompression()
+		if j.destination.compress != d.expected {
+			t.Errorf("%d: unexpected compression: %s", di, j.destination.compress)
+		}
+		if filters := j.source.executor.(executorImpl).filters; !reflect.DeepEqual(filters, []filter{compressFilter{d.expected}}) {
+			t.Errorf("%d: unexpected filters: %v", di, filters)
+		}
+	}
+}
+
+func TestCompressionFlags(t *testing.T) {
+	data := []struct {
+		args []string
+		err  bool
+	}{
+		{[]string{"-dst", "nas:22/backup", "-compress", "zstd"}, false},
+		{[]string{"-dst", "nas:22/backup", "-compress", "gzip", "-filter", "meter"}, false},
+		{[]string{"-dst", "nas:22/backup", "-compress", "lz4"}, true},
+		{[]string{"-dst", "nas:22/backup", "-compress", "zstd", "-dst-wrapper", "btrfs-backup receive-server"}, true},
+		{[]string{"-dst", "nas:22/backup", "-compress", "zstd", "-staging-dir", "/var/tmp"}, true},
+		{[]string{"-dst", "nas:22/backup", "-compress", "zstd", "-ssh-compression", "yes"}, true},
+		{[]string{"-dst", "nas:22/backup", "-compress", "zstd", "-ssh-compression", "no"}, false},
+	}
+	for di, d := range data {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		jf := addJobFlags(fs)
+		if err := fs.Parse(d.args); err != nil {
+			t.Fatal(err)
+		}
+		jobs, err := jf.loadJobs()
+		if d.err {
+			if err == nil {
+				t.Errorf("%d: expected error but succeeded", di)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", di, err)
+		}
+		// compression is the last filter so that the receive command only has to decompress
+		filters := jobs[0].source.executor.(executorImpl).filters
+		if len(filters) == 0 || filters[len(filters)-1] != (compressFilter{jobs[0].destination.compress}) {
+			t.Errorf("%d: unexpected filters: %v", di, filters)
+		}
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// config is the content of a configuration file, eg:
+//
+//	include:
+//	  - conf.d/*.yaml
+//	allow:
+//	  - /mnt
+//	  - /backup
+//	defaults:
+//	  snapshot_path: snapshot
+//	destinations:
+//	  nas:
+//	    address: nas:22/backup
+//	    dst_snapshot_path: laptop
+//	    bwlimit: 8MB/s
+//	    crypt_device: /dev/mapper/backup
+//	    filters: [meter]
+//	  offsite:
+//	    address: "@offsite/backup"
+//	connections:
+//	  offsite:
+//	    addresses: [offsite.lan:22, offsite.example.com:2222]
+//	    user: backup
+//	jobs:
+//	  root:
+//	    source: localhost:0/mnt
+//	    destination: nas
+//	    snapshot_path: snapshot/root
+//	    snapshot_regex: ^\d{4}-\d\d-\d\d_\d\d-\d\d$
+//	profiles:
+//	  laptop-to-nas:
+//	    source: localhost:0/home
+//	    destinations: [nas]
+//	    jobs: [root]
+//	    keep: 30
+//	    interval: 6h
+//
+// Every job replicates the snapshots of one subvolume. Its settings are resolved from the defaults, overridden by the
+// settings of the destination and finally by the settings of the job itself.
+type config struct {
+	Include      []string                      `yaml:"include,omitempty"`
+	Allow        []string                      `yaml:"allow,omitempty"` // directories the tool may read, receive into or delete under
+	Defaults     settings                      `yaml:"defaults,omitempty"`
+	Destinations map[string]*destinationConfig `yaml:"destinations,omitempty"`
+	Jobs         map[string]*jobConfig         `yaml:"jobs,omitempty"`
+	Profiles     map[string]*profileConfig     `yaml:"profiles,omitempty"`
+	Connections  map[string]*connectionConfig  `yaml:"connections,omitempty"`
+
+	conns map[string]*connection // resolved connections, shared by all nodes referencing them
+}
+
+// connectionConfig describes how to reach a host. Sources and destinations reference it by an address like @nas/backup.
+type connectionConfig struct {
+	Addresses []string `yaml:"addresses,omitempty"` // host:port in order of preference, eg. [nas.lan:22, nas.example.com:2222]
+	BWLimit   string   `yaml:"bwlimit,omitempty"`   // default maximum transfer rate to the host, eg. 8MB/s
+	sshConfig `yaml:",inline"`
+}
+
+// s3Config are the options of an archive in object storage.
+type s3Config struct {
+	Endpoint     string `yaml:"endpoint,omitempty"`      // endpoint URL of S3-compatible storage
+	Profile      string `yaml:"profile,omitempty"`       // aws CLI profile holding the credentials
+	StorageClass string `yaml:"storage_class,omitempty"` // storage class of uploaded streams, eg. STANDARD_IA
+}
+
+// sshConfig are the ssh options of a connection, a destination or the source of a job.
+type sshConfig struct {
+	User                  string   `yaml:"user,omitempty"`                     // ssh login name
+	Key                   string   `yaml:"key,omitempty"`                      // ssh identity file
+	Jump                  string   `yaml:"jump,omitempty"`                     // ssh jump host, eg. user@bastion:22
+	KnownHosts            string   `yaml:"known_hosts,omitempty"`              // known_hosts file
+	StrictHostKeyChecking string   `yaml:"strict_host_key_checking,omitempty"` // yes, no or accept-new
+	Compression           string   `yaml:"compression,omitempty"`              // ssh compression: yes or no
+	ConnectTimeout        string   `yaml:"connect_timeout,omitempty"`          // eg. 10s
+	SSHArgs               []string `yaml:"ssh_args,omitempty"`                 // additional ssh arguments, eg. [-o, ServerAliveInterval=30]
+}
+
+// options returns the ssh options described by sc.
+func (sc sshConfig) options() (sshOptions, error) {
+	o := sshOptions{
+		user:                  sc.User,
+		key:                   sc.Key,
+		jump:                  sc.Jump,
+		knownHosts:            sc.KnownHosts,
+		strictHostKeyChecking: sc.StrictHostKeyChecking,
+		compression:           sc.Compression,
+		extraArgs:             sc.SSHArgs,
+	}
+	if sc.ConnectTimeout != "" {
+		var err error
+		if o.connectTimeout, err = time.ParseDuration(sc.ConnectTimeout); err != nil {
+			return o, fmt.Errorf("invalid connect_timeout: %v", err)
+		}
+	}
+	return o, o.validate()
+}
+
+// sshConfig returns the configuration describing o or nil if all options are unset.
+func (o sshOptions) sshConfig() *sshConfig {
+	sc := &sshConfig{
+		User:                  o.user,
+		Key:                   o.key,
+		Jump:                  o.jump,
+		KnownHosts:            o.knownHosts,
+		StrictHostKeyChecking: o.strictHostKeyChecking,
+		Compression:           o.compression,
+		SSHArgs:               o.extraArgs,
+	}
+	if o.connectTimeout > 0 {
+		sc.ConnectTimeout = o.connectTimeout.String()
+	}
+	if reflect.DeepEqual(*sc, sshConfig{}) {
+		return nil
+	}
+	return sc
+}
+
+type destinationConfig struct {
+	Address       string     `yaml:"address,omitempty"`        // host:port/path or s3://bucket/prefix
+	BWLimit       string     `yaml:"bwlimit,omitempty"`        // maximum transfer rate, eg. 8MB/s
+	CryptDevice   string     `yaml:"crypt_device,omitempty"`   // unlocked encrypted device which must be mounted at the destination
+	Cleanup       string     `yaml:"cleanup,omitempty"`        // handling of snapshots whose receive failed: delete, keep, rename or quarantine
+	QuarantineDir string     `yaml:"quarantine_dir,omitempty"` // directory relative to the mount point receiving quarantined snapshots
+	IncomingDir   string     `yaml:"incoming_dir,omitempty"`   // directory relative to the mount point receiving snapshots before they are moved into place
+	Wrapper       string     `yaml:"wrapper,omitempty"`        // command forced by authorized_keys, eg. btrfs-backup receive-server
+	Filters       []string   `yaml:"filters,omitempty"`        // chain of filters applied to the stream, eg. "exec:zstd -c"
+	Compress      string     `yaml:"compress,omitempty"`       // compression of the stream over ssh: zstd or gzip
+	Archive       bool       `yaml:"archive,omitempty"`        // store streams as files instead of receiving them
+	AgeRecipients []string   `yaml:"age_recipients,omitempty"` // age recipients the streams of an archive are encrypted for
+	GPGRecipients []string   `yaml:"gpg_recipients,omitempty"` // GPG keys the streams of an archive are encrypted for
+	FullEvery     string     `yaml:"full_every,omitempty"`     // interval of full sends to an archive, eg. 30d
+	FullTag       string     `yaml:"full_tag,omitempty"`       // tag of snapshots sent to an archive in full
+	MaxChain      int        `yaml:"max_chain,omitempty"`      // maximum number of incremental streams after a full send
+	Weight        int        `yaml:"weight,omitempty"`         // share of -total-bwlimit relative to other destinations
+	StagingDir    string     `yaml:"staging_dir,omitempty"`    // local directory staging streams before uploading them
+	StagingMax    string     `yaml:"staging_max,omitempty"`    // maximum size of the staging directory, eg. 100GiB
+	UploadRetries int        `yaml:"upload_retries,omitempty"` // number of times an interrupted upload is resumed within a run
+	SendRetries   int        `yaml:"send_retries,omitempty"`   // number of times a transiently failing transfer is retried
+	SendArgs      []string   `yaml:"send_args,omitempty"`      // additional arguments of btrfs send, eg. [--proto, "2"]
+	ReceiveArgs   []string   `yaml:"receive_args,omitempty"`   // additional arguments of btrfs receive, eg. [--max-errors, "10"]
+	SSH           *sshConfig `yaml:"ssh,omitempty"`            // ssh options, overriding the ones of a connection
+	S3            *s3Config  `yaml:"s3,omitempty"`             // object storage options of an s3:// destination
+	OnBattery     string     `yaml:"on_battery,omitempty"`     // how jobs run while on battery: run, skip or a rate, eg. 1MB/s
+	OnMetered     string     `yaml:"on_metered,omitempty"`     // how jobs run while on a metered connection: run, skip or a rate
+	settings      `yaml:",inline"`
+}
+
+type jobConfig struct {
+	Source       string     `yaml:"source,omitempty"`       // host:port/path, defaults to localhost:0/mnt
+	Destination  string     `yaml:"destination,omitempty"`  // name of the destination
+	Destinations []string   `yaml:"destinations,omitempty"` // names of several destinations, resulting in jobs <job>-<destination>
+	Layout       string     `yaml:"layout,omitempty"`       // subvolume layout of the source, eg. ubuntu
+	Subvolumes   []string   `yaml:"subvolumes,omitempty"`   // subvolumes of the layout, defaults to all subvolumes of the layout
+	SourceSSH    *sshConfig `yaml:"source_ssh,omitempty"`   // ssh options of a remote source, overriding the ones of a connection
+	BWLimit      string     `yaml:"bwlimit,omitempty"`      // maximum transfer rate, overriding the one of the destination
+	settings     `yaml:",inline"`
+}
+
+// profileConfig bundles jobs with their retention and schedule. A profile replicates its source to each of its
+// destinations, the resulting jobs are named <profile>-<destination>. Additionally it can select jobs by name.
+type profileConfig struct {
+	Source       string   `yaml:"source,omitempty"`       // host:port/path, defaults to localhost:0/mnt
+	Destinations []string `yaml:"destinations,omitempty"` // names of the destinations receiving the source
+	Jobs         []string `yaml:"jobs,omitempty"`         // names of additional jobs
+	Keep         int      `yaml:"keep,omitempty"`         // number of most recent snapshots kept by prune
+	Retention    string   `yaml:"retention,omitempty"`    // windows of snapshots kept by prune, eg. 7d,daily:90d
+	Interval     string   `yaml:"interval,omitempty"`     // time between runs in daemon mode, eg. 6h
+	Layout       string   `yaml:"layout,omitempty"`       // subvolume layout of the source, eg. ubuntu
+	Subvolumes   []string `yaml:"subvolumes,omitempty"`   // subvolumes of the layout
+	settings     `yaml:",inline"`
+}
+
+// settings can be specified as defaults, per destination and per job. Unset fields are nil.
+type settings struct {
+	SnapshotPath    *string `yaml:"snapshot_path,omitempty"`        // directory containing snapshots relative to the source mount point
+	DstSnapshotPath *string `yaml:"dst_snapshot_path,omitempty"`    // directory containing snapshots relative to the destination mount point
+	SnapshotRegex   *string `yaml:"snapshot_regex,omitempty"`       // regular expression matching the names of snapshots
+	TimeLayout      *string `yaml:"snapshot_time_layout,omitempty"` // Go time layout of the time captured by snapshot_regex
+	NameLayout      *string `yaml:"snapshot_name_layout,omitempty"` // Go time layout of the names of created snapshots
+	Origin          *string `yaml:"origin,omitempty"`               // subvolume snapshotted by create, eg. /home
+}
+
+// merge overrides all fields of s which are set in o.
+func (s *settings) merge(o settings) {
+	sv := reflect.ValueOf(s).Elem()
+	ov := reflect.ValueOf(o)
+	for i := 0; i < ov.NumField(); i++ {
+		if !ov.Field(i).IsNil() {
+			sv.Field(i).Set(ov.Field(i))
+		}
+	}
+}
+
+func stringOr(s *string, def string) string {
+	if s == nil {
+		return def
+	}
+	return *s
+}
+
+// loadConfig reads the configuration file at path including all files referenced by it.
+func loadConfig(path string) (*config, error) {
+	return loadConfigFile(path, make(map[string]bool))
+}
+
+// loadConfigFile loads path and its includes. Included files are merged first so that the settings of the including
+// file take precedence. active contains the files currently being loaded to detect include cycles.
+func loadConfigFile(path string, active map[string]bool) (*config, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadConfig: %v", err)
+	}
+	if active[abs] {
+		return nil, fmt.Errorf("loadConfig: include cycle: %s", path)
+	}
+	active[abs] = true
+	defer delete(active, abs)
+
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadConfig: %v", err)
+	}
+	var c config
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil {
+		return nil, fmt.Errorf("loadConfig: %s: %v", path, err)
+	}
+
+	res := &config{
+		Destinations: make(map[string]*destinationConfig),
+		Jobs:         make(map[string]*jobConfig),
+		Profiles:     make(map[string]*profileConfig),
+		Connections:  make(map[string]*connectionConfig),
+	}
+	for _, pattern := range c.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("loadConfig: %s: %v", path, err)
+		}
+		if len(matches) == 0 && !hasGlobMeta(pattern) {
+			return nil, fmt.Errorf("loadConfig: %s: include not found: %s", path, pattern)
+		}
+		for _, m := range matches {
+			inc, err := loadConfigFile(m, active)
+			if err != nil {
+				return nil, err
+			}
+			if err := res.add(inc); err != nil {
+				return nil, fmt.Errorf("loadConfig: %s: %v", m, err)
+			}
+		}
+	}
+	if err := res.add(&c); err != nil {
+		return nil, fmt.Errorf("loadConfig: %s: %v", path, err)
+	}
+	return res, nil
+}
+
+func hasGlobMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// add merges o into c. Destinations and jobs must not be defined twice.
+func (c *config) add(o *config) error {
+	c.Defaults.merge(o.Defaults)
+	c.Allow = append(c.Allow, o.Allow...)
+	for name, d := range o.Destinations {
+		if _, ok := c.Destinations[name]; ok {
+			return fmt.Errorf("destination %s defined twice", name)
+		}
+		c.Destinations[name] = d
+	}
+	for name, j := range o.Jobs {
+		if _, ok := c.Jobs[name]; ok {
+			return fmt.Errorf("job %s defined twice", name)
+		}
+		c.Jobs[name] = j
+	}
+	for name, p := range o.Profiles {
+		if _, ok := c.Profiles[name]; ok {
+			return fmt.Errorf("profile %s defined twice", name)
+		}
+		c.Profiles[name] = p
+	}
+	for name, cc := range o.Connections {
+		if _, ok := c.Connections[name]; ok {
+			return fmt.Errorf("connection %s defined twice", name)
+		}
+		c.Connections[name] = cc
+	}
+	return nil
+}
+
+// connection returns the connection with the given name. Every connection is resolved once so that its endpoint is
+// only probed once.
+func (c *config) connection(name string) (*connection, error) {
+	if conn, ok := c.conns[name]; ok {
+		return conn, nil
+	}
+	cc, ok := c.Connections[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown connection: %s", name)
+	}
+	if len(cc.Addresses) == 0 {
+		return nil, fmt.Errorf("connection %s: no addresses", name)
+	}
+	conn := &connection{name: name}
+	var err error
+	if conn.ssh, err = cc.sshConfig.options(); err != nil {
+		return nil, fmt.Errorf("connection %s: %v", name, err)
+	}
+	for _, a := range cc.Addresses {
+		e, err := parseEndpoint(a)
+		if err != nil {
+			return nil, fmt.Errorf("connection %s: %v", name, err)
+		}
+		conn.endpoints = append(conn.endpoints, e)
+	}
+	if cc.BWLimit != "" {
+		if conn.bwLimit, err = parseRate(cc.BWLimit); err != nil {
+			return nil, fmt.Errorf("connection %s: bwlimit: %v", name, err)
+		}
+	}
+	if c.conns == nil {
+		c.conns = make(map[string]*connection)
+	}
+	c.conns[name] = conn
+	return conn, nil
+}
+
+// parseNode is like the package level parseNode but additionally accepts addresses like @nas/backup referencing a
+// connection.
+func (c *config) parseNode(str string) (node, error) {
+	if !strings.HasPrefix(str, "@") {
+		return parseNode(str)
+	}
+	matches := regexp.MustCompile(`^@([a-zA-Z0-9\-_\.]+)(\/[a-zA-Z0-9\-_\.\/]+)$`).FindStringSubmatch(str)
+	if len(matches) != 3 {
+		return node{}, fmt.Errorf("invalid node: %s", str)
+	}
+	conn, err := c.connection(matches[1])
+	if err != nil {
+		return node{}, err
+	}
+	return node{
+		address:    conn.endpoints[0].address,
+		sshPort:    conn.endpoints[0].sshPort,
+		mountPoint: matches[2],
+		conn:       conn,
+		bwLimit:    conn.bwLimit,
+	}, nil
+}
+
+// jobs returns the jobs of the configuration sorted by name.
+func (c *config) jobs() ([]job, error) {
+	return c.buildJobs(c.Jobs)
+}
+
+// profile returns the profile with the given name.
+func (c *config) profile(name string) (*profileConfig, error) {
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile: %s", name)
+	}
+	if _, err := parseRetention(p.Keep, p.Retention); err != nil {
+		return nil, fmt.Errorf("profile %s: %v", name, err)
+	}
+	if p.Interval != "" {
+		if _, err := time.ParseDuration(p.Interval); err != nil {
+			return nil, fmt.Errorf("profile %s: invalid interval: %v", name, err)
+		}
+	}
+	return p, nil
+}
+
+// profileJobs returns the jobs of the named profile sorted by name.
+func (c *config) profileJobs(name string) ([]job, error) {
+	p, err := c.profile(name)
+	if err != nil {
+		return nil, err
+	}
+	jcs := make(map[string]*jobConfig)
+	for _, d := range p.Destinations {
+		jcs[name+"-"+d] = &jobConfig{Source: p.Source, Destination: d, Layout: p.Layout, Subvolumes: p.Subvolumes, settings: p.settings}
+	}
+	for _, j := range p.Jobs {
+		jc, ok := c.Jobs[j]
+		if !ok {
+			return nil, fmt.Errorf("profile %s: unknown job: %s", name, j)
+		}
+		jcs[j] = jc
+	}
+	if len(jcs) == 0 {
+		return nil, fmt.Errorf("profile %s: no destinations or jobs", name)
+	}
+	return c.buildJobs(jcs)
+}
+
+// expandDestinations replaces jobs listing several destinations with one job <job>-<destination> per destination.
+func expandDestinations(jcs map[string]*jobConfig) (map[string]*jobConfig, error) {
+	res := make(map[string]*jobConfig)
+	add := func(name string, jc *jobConfig) error {
+		if _, ok := res[name]; ok {
+			return fmt.Errorf("job %s defined twice", name)
+		}
+		res[name] = jc
+		return nil
+	}
+	for name, jc := range jcs {
+		if len(jc.Destinations) == 0 {
+			if err := add(name, jc); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if jc.Destination != "" {
+			return nil, fmt.Errorf("job %s: destination and destinations are mutually exclusive", name)
+		}
+		for _, d := range jc.Destinations {
+			djc := *jc
+			djc.Destination, djc.Destinations = d, nil
+			if err := add(name+"-"+d, &djc); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return res, nil
+}
+
+// buildJobs resolves the settings of the given job configurations and returns the jobs sorted by name.
+func (c *config) buildJobs(jcs map[string]*jobConfig) ([]job, error) {
+	jcs, err := expandDestinations(jcs)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for name := range jcs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var jobs []job
+	for _, name := range names {
+		jc := jcs[name]
+		dc, ok := c.Destinations[jc.Destination]
+		if !ok {
+			return nil, fmt.Errorf("job %s: unknown destination: %q", name, jc.Destination)
+		}
+
+		var s settings
+		s.merge(c.Defaults)
+		s.merge(dc.settings)
+		s.merge(jc.settings)
+
+		src := jc.Source
+		if src == "" {
+			src = "localhost:0/mnt"
+		}
+		source, err := c.parseNode(src)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %v", name, err)
+		}
+		source.snapshotPath = stringOr(s.SnapshotPath, "snapshot")
+
+		destination, err := c.parseNode(dc.Address)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: destination %s: %v", name, jc.Destination, err)
+		}
+		destination.snapshotPath = stringOr(s.DstSnapshotPath, "")
+		if s.SnapshotRegex != nil {
+			r, err := regexp.Compile(*s.SnapshotRegex)
+			if err != nil {
+				return nil, fmt.Errorf("job %s: snapshot_regex: %v", name, err)
+			}
+			source.snapshotRegex, destination.snapshotRegex = r, r
+		}
+		if s.TimeLayout != nil && s.SnapshotRegex == nil {
+			return nil, fmt.Errorf("job %s: snapshot_time_layout requires snapshot_regex", name)
+		}
+		source.timeLayout = stringOr(s.TimeLayout, "")
+		source.nameLayout = stringOr(s.NameLayout, "")
+		source.origin = stringOr(s.Origin, "")
+		destination.timeLayout = source.timeLayout
+		destination.cryptDevice = dc.CryptDevice
+		destination.cleanup = dc.Cleanup
+		destination.quarantineDir = dc.QuarantineDir
+		destination.incomingDir = dc.IncomingDir
+		destination.wrapper = dc.Wrapper
+		destination.compress = dc.Compress
+		destination.archive = destination.archive || dc.Archive
+		if dc.S3 != nil {
+			if destination.s3 == nil {
+				return nil, fmt.Errorf("job %s: destination %s: s3 requires an s3:// address", name, jc.Destination)
+			}
+			destination.s3.endpoint, destination.s3.profile, destination.s3.storageClass = dc.S3.Endpoint, dc.S3.Profile, dc.S3.StorageClass
+		}
+		destination.encryption = encryption{age: dc.AgeRecipients, gpg: dc.GPGRecipients}
+		if dc.FullEvery != "" {
+			if destination.fullEvery, err = parseAge(dc.FullEvery); err != nil {
+				return nil, fmt.Errorf("job %s: destination %s: full_every: %v", name, jc.Destination, err)
+			}
+		}
+		destination.fullTag = dc.FullTag
+		destination.maxChain = dc.MaxChain
+		if dc.Weight < 0 {
+			return nil, fmt.Errorf("job %s: destination %s: invalid weight: %d", name, jc.Destination, dc.Weight)
+		}
+		destination.weight = dc.Weight
+		destination.filters, err = parseFilters(dc.Filters)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: destination %s: %v", name, jc.Destination, err)
+		}
+		destination.stagingDir = dc.StagingDir
+		destination.uploadRetries = dc.UploadRetries
+		destination.sendRetries = dc.SendRetries
+		destination.sendArgs = dc.SendArgs
+		destination.receiveArgs = dc.ReceiveArgs
+		if dc.SSH != nil {
+			if destination.ssh, err = dc.SSH.options(); err != nil {
+				return nil, fmt.Errorf("job %s: destination %s: ssh: %v", name, jc.Destination, err)
+			}
+		}
+		if jc.SourceSSH != nil {
+			if source.ssh, err = jc.SourceSSH.options(); err != nil {
+				return nil, fmt.Errorf("job %s: source_ssh: %v", name, err)
+			}
+		}
+		if destination.onBattery, err = parseUsagePolicy(dc.OnBattery); err != nil {
+			return nil, fmt.Errorf("job %s: destination %s: on_battery: %v", name, jc.Destination, err)
+		}
+		if destination.onMetered, err = parseUsagePolicy(dc.OnMetered); err != nil {
+			return nil, fmt.Errorf("job %s: destination %s: on_metered: %v", name, jc.Destination, err)
+		}
+		if dc.StagingMax != "" {
+			destination.stagingMax, err = parseBytes(dc.StagingMax)
+			if err != nil {
+				return nil, fmt.Errorf("job %s: destination %s: staging_max: %v", name, jc.Destination, err)
+			}
+		}
+		if dc.BWLimit != "" {
+			destination.bwLimit, err = parseRate(dc.BWLimit)
+			if err != nil {
+				return nil, fmt.Errorf("job %s: destination %s: bwlimit: %v", name, jc.Destination, err)
+			}
+		}
+		if jc.BWLimit != "" {
+			destination.bwLimit, err = parseRate(jc.BWLimit)
+			if err != nil {
+				return nil, fmt.Errorf("job %s: bwlimit: %v", name, err)
+			}
+		}
+
+		j := job{name: name, source: source, destination: destination}
+		if jc.Layout == "" {
+			jobs = append(jobs, j)
+			continue
+		}
+		expanded, err := expandLayout(j, jc.Layout, jc.Subvolumes)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %v", name, err)
+		}
+		jobs = append(jobs, expanded...)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestConfigJobs(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": `
+include:
+  - conf.d/*.yaml
+defaults:
+  snapshot_path: snapshots
+  dst_snapshot_path: default
+destinations:
+  nas:
+    address: nas:22/backup
+    dst_snapshot_path: laptop
+jobs:
+  root:
+    destination: nas
+`,
+		"conf.d/home.yaml": `
+defaults:
+  snapshot_path: ignored
+jobs:
+  home:
+    source: localhost:0/home
+    destination: nas
+    snapshot_path: .snapshots
+    dst_snapshot_path: laptop/home
+  data:
+    source: server:2222/data
+    destination: usb
+destinations:
+  usb:
+    address: localhost:0/media/usb
+    bwlimit: 8MB/s
+`,
+	})
+
+	c, err := loadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := c.jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []job{
+		{
+			name:        "data",
+			source:      node{address: "server", sshPort: 2222, mountPoint: "/data", snapshotPath: "snapshots"},
+			destination: node{address: "localhost", sshPort: 0, mountPoint: "/media/usb", snapshotPath: "default", bwLimit: 8000000},
+		},
+		{
+			name:        "home",
+			source:      node{address: "localhost", sshPort: 0, mountPoint: "/home", snapshotPath: ".snapshots"},
+			destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop/home"},
+		},
+		{
+			name:        "root",
+			source:      node{address: "localhost", sshPort: 0, mountPoint: "/mnt", snapshotPath: "snapshots"},
+			destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop"},
+		},
+	}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Errorf("unexpected jobs:\n%#v", jobs)
+	}
+}
+
+func TestConfigSnapshotRegex(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"config.yaml": `
+defaults:
+  snapshot_regex: ^\d+$
+destinations:
+  nas:
+    address: nas:22/backup
+jobs:
+  root:
+    destination: nas
+  home:
+    destination: nas
+    snapshot_regex: ^home-\d+$
+`})
+	c, err := loadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := c.jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, j := range jobs {
+		want := map[string]string{"home": `^home-\d+$`, "root": `^\d+$`}[j.name]
+		if j.source.snapshotRegex.String() != want || j.destination.snapshotRegex.String() != want {
+			t.Errorf("%s: unexpected regex: %v, %v", j.name, j.source.snapshotRegex, j.destination.snapshotRegex)
+		}
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	data := []map[string]string{
+		{"config.yaml": "foo: bar"},
+		{"config.yaml": "include: [missing.yaml]"},
+		{"config.yaml": "include: [config.yaml]"},
+		{"config.yaml": "include: [a.yaml]\njobs: {a: {destination: x}}", "a.yaml": "jobs: {a: {destination: x}}"},
+		{"config.yaml": "jobs: {a: {destination: x}}"},
+		{"config.yaml": "destinations: {x: {address: foo}}\njobs: {a: {destination: x}}"},
+		{"config.yaml": "destinations: {x: {address: foo:22/mnt, bwlimit: fast}}\njobs: {a: {destination: x}}"},
+		{"config.yaml": "destinations: {x: {address: foo:22/mnt}}\njobs: {a: {destination: x, bwlimit: fast}}"},
+		{"config.yaml": "destinations: {x: {address: foo:22/mnt}}\njobs: {a: {destination: x, snapshot_regex: '('}}"},
+		{"config.yaml": "destinations: {x: {address: foo:22/mnt}}\njobs: {a: {destination: x, snapshot_time_layout: '20060102'}}"},
+		{"config.yaml": "destinations: {x: {address: foo:22/mnt}}\njobs: {a: {destination: x, destinations: [x]}}"},
+		{"config.yaml": "destinations: {x: {address: foo:22/mnt}}\njobs: {a: {destinations: [x]}, a-x: {destination: x}}"},
+	}
+
+	for di, d := range data {
+		dir := writeFiles(t, d)
+		c, err := loadConfig(filepath.Join(dir, "config.yaml"))
+		if err == nil {
+			_, err = c.jobs()
+		}
+		if err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+	}
+}
+
+func TestConfigDestinations(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"config.yaml": `
+destinations:
+  nas:
+    address: nas:22/backup
+  offsite:
+    address: offsite.example.com:22/backup
+jobs:
+  home:
+    destinations: [nas, offsite]
+    snapshot_path: home
+`})
+	c, err := loadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := c.jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 {
+		t.Fatalf("unexpected jobs: %+v", jobs)
+	}
+	for i, want := range []string{"nas", "offsite.example.com"} {
+		if jobs[i].destination.address != want || jobs[i].source.snapshotPath != "home" {
+			t.Errorf("%d: unexpected job: %+v", i, jobs[i])
+		}
+	}
+	if jobs[0].name != "home-nas" || jobs[1].name != "home-offsite" {
+		t.Errorf("unexpected names: %s, %s", jobs[0].name, jobs[1].name)
+	}
+
+	// the same on the command line
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	jf := addJobFlags(fs)
+	if err := fs.Parse([]string{"-dst", "nas:22/backup,localhost:0/media/usb"}); err != nil {
+		t.Fatal(err)
+	}
+	if jobs, err = jf.loadJobs(); err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].name != "nas" || jobs[1].name != "usb" || jobs[1].destination.mountPoint != "/media/usb" {
+		t.Errorf("unexpected jobs: %+v", jobs)
+	}
+}
+
+func TestConfigBWLimit(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": `
+destinations:
+  nas:
+    address: nas:22/backup
+    bwlimit: 8MB/s
+jobs:
+  home:
+    destination: nas
+  root:
+    destination: nas
+    bwlimit: 1MB/s
+`,
+	})
+	data := []struct {
+		args     []string
+		expected map[string]int
+		err      bool
+	}{
+		{nil, map[string]int{"home": 8000000, "root": 1000000}, false},
+		{[]string{"-bwlimit", "20MiB/s"}, map[string]int{"home": 20 << 20, "root": 20 << 20}, false},
+		{[]string{"-bwlimit", "fast"}, nil, true},
+	}
+	for di, d := range data {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		jf := addJobFlags(fs)
+		if err := fs.Parse(append([]string{"-config", filepath.Join(dir, "config.yaml")}, d.args...)); err != nil {
+			t.Fatal(err)
+		}
+		jobs, err := jf.loadJobs()
+		if d.err {
+			if err == nil {
+				t.Errorf("%d: expected error but succeeded", di)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%d: unexpected error: %v", di, err)
+		}
+		for _, j := range jobs {
+			if j.destination.bwLimit != d.expected[j.name] || j.source.executor.(executorImpl).bwLimit != d.expected[j.name] {
+				t.Errorf("%d: %s: unexpected limit %d", di, j.name, j.destination.bwLimit)
+			}
+		}
+	}
+}
+
+func TestConfigProfiles(t *testing.T) {
+	dir := writeFiles(t, map[string]string{
+		"config.yaml": `
+destinations:
+  nas:
+    address: nas:22/backup
+  offsite:
+    address: vps:22/backup
+jobs:
+  root:
+    destination: nas
+  other:
+    destination: nas
+profiles:
+  laptop:
+    source: localhost:0/home
+    destinations: [nas, offsite]
+    jobs: [root]
+    snapshot_path: .snapshots
+    keep: 30
+    interval: 6h
+  broken:
+    jobs: [missing]
+  empty: {}
+  invalid:
+    jobs: [root]
+    interval: often
+`,
+	})
+
+	c, err := loadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := c.profileJobs("laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, j := range jobs {
+		names = append(names, j.name)
+	}
+	if !reflect.DeepEqual(names, []string{"laptop-nas", "laptop-offsite", "root"}) {
+		t.Errorf("unexpected jobs: %v", names)
+	}
+	if jobs[0].source.mountPoint != "/home" || jobs[0].source.snapshotPath != ".snapshots" || jobs[1].destination.address != "vps" {
+		t.Errorf("unexpected jobs:\n%#v", jobs)
+	}
+	if p, _ := c.profile("laptop"); p.Keep != 30 || p.Interval != "6h" {
+		t.Errorf("unexpected profile: %#v", p)
+	}
+
+	for _, name := range []string{"broken", "empty", "invalid", "unknown"} {
+		if _, err := c.profileJobs(name); err == nil {
+			t.Errorf("%s: expected error but succeeded", name)
+		}
+	}
+
+	// the retention of the profile applies unless given by the flags, eg. to send, prune and plan
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	jf := addJobFlags(fs)
+	if err := fs.Parse([]string{"-config", filepath.Join(dir, "config.yaml"), "-profile", "laptop"}); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := jf.retention(0, ""); err != nil || r.keep != 30 {
+		t.Errorf("unexpected retention: %+v, %v", r, err)
+	}
+	if r, err := jf.retention(5, ""); err != nil || r.keep != 5 {
+		t.Errorf("unexpected retention: %+v, %v", r, err)
+	}
+}
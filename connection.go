@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// connection is a named way to reach a host, eg. a NAS reachable by its LAN address at home and by its WAN address
+// otherwise. Nodes referencing the connection are reached via the reachable endpoint with the lowest latency.
+type connection struct {
+	name      string
+	endpoints []endpoint // in order of preference
+	ssh       sshOptions
+	bwLimit   int // default maximum bytes per second sent to the host, 0 means unlimited
+
+	mu       sync.Mutex
+	selected *endpoint // nil until probed
+}
+
+// sshOptions control how ssh connects to a host. Empty fields use the defaults of the ssh client configuration.
+type sshOptions struct {
+	user                  string        // login name
+	key                   string        // identity file
+	jump                  string        // jump host, empty for a direct connection
+	knownHosts            string        // known_hosts file
+	strictHostKeyChecking string        // yes, no or accept-new
+	compression           string        // yes or no, empty compresses unless the stream is compressed already
+	connectTimeout        time.Duration // 0 uses the TCP timeout of the system
+	extraArgs             []string      // additional arguments, eg. -o ServerAliveInterval=30
+}
+
+// validate checks the options which are passed on verbatim.
+func (o sshOptions) validate() error {
+	switch o.strictHostKeyChecking {
+	case "", "yes", "no", "accept-new":
+	default:
+		return fmt.Errorf("invalid strict host key checking: %s", o.strictHostKeyChecking)
+	}
+	switch o.compression {
+	case "", "yes", "no":
+	default:
+		return fmt.Errorf("invalid compression: %s, must be yes or no", o.compression)
+	}
+	if o.connectTimeout < 0 || o.connectTimeout%time.Second != 0 {
+		return fmt.Errorf("invalid connect timeout: %v, must be whole seconds", o.connectTimeout)
+	}
+	for _, arg := range o.extraArgs {
+		// the remote command follows --, see unwrapCommand
+		if arg == "--" {
+			return fmt.Errorf("invalid ssh argument: %s", arg)
+		}
+	}
+	return nil
+}
+
+// merge overrides all fields of o which are set in p.
+func (o sshOptions) merge(p sshOptions) sshOptions {
+	for _, f := range []struct{ dst, src *string }{
+		{&o.user, &p.user}, {&o.key, &p.key}, {&o.jump, &p.jump}, {&o.knownHosts, &p.knownHosts},
+		{&o.strictHostKeyChecking, &p.strictHostKeyChecking}, {&o.compression, &p.compression},
+	} {
+		if *f.src != "" {
+			*f.dst = *f.src
+		}
+	}
+	if p.connectTimeout != 0 {
+		o.connectTimeout = p.connectTimeout
+	}
+	o.extraArgs = append(append([]string(nil), o.extraArgs...), p.extraArgs...)
+	return o
+}
+
+// args returns the ssh arguments for o.
+func (o sshOptions) args() []string {
+	var args []string
+	if o.user != "" {
+		args = append(args, "-l", o.user)
+	}
+	if o.key != "" {
+		args = append(args, "-i", o.key)
+	}
+	if o.jump != "" {
+		args = append(args, "-J", o.jump)
+	}
+	if o.knownHosts != "" {
+		args = append(args, "-o", "UserKnownHostsFile="+o.knownHosts)
+	}
+	if o.strictHostKeyChecking != "" {
+		args = append(args, "-o", "StrictHostKeyChecking="+o.strictHostKeyChecking)
+	}
+	if o.connectTimeout > 0 {
+		args = append(args, "-o", fmt.Sprintf("ConnectTimeout=%d", int(o.connectTimeout/time.Second)))
+	}
+	return append(args, o.extraArgs...)
+}
+
+// endpoint is an address of a host.
+type endpoint struct {
+	address string
+	sshPort int // 0 for localhost
+}
+
+// probeTimeout limits how long an endpoint is probed before the next one is tried.
+const probeTimeout = 3 * time.Second
+
+// dialTimeout connects to a TCP address. It is replaced by tests.
+var dialTimeout = net.DialTimeout
+
+func parseEndpoint(str string) (endpoint, error) {
+	matches := regexp.MustCompile(`^([a-z0-9\-\.]+):([0-9]+)$`).FindStringSubmatch(str)
+	if len(matches) != 3 {
+		return endpoint{}, fmt.Errorf("invalid endpoint: %s", str)
+	}
+	port, err := strconv.Atoi(matches[2])
+	if err != nil {
+		return endpoint{}, fmt.Errorf("invalid endpoint: %s", str)
+	}
+	return endpoint{address: matches[1], sshPort: port}, nil
+}
+
+// endpoint returns the endpoint used to reach the host, probing the endpoints if that didn't happen yet.
+func (c *connection) endpoint() endpoint {
+	c.mu.Lock()
+	selected := c.selected
+	c.mu.Unlock()
+	if selected != nil {
+		return *selected
+	}
+	return c.probe()
+}
+
+// probe connects to all endpoints concurrently and selects the reachable one with the lowest connect latency.
+// Endpoints which are equally fast are chosen in order of preference. If none is reachable, the most preferred
+// endpoint is used so that commands fail with a meaningful error.
+func (c *connection) probe() endpoint {
+	best := c.endpoints[0]
+	// endpoints behind a jump host can't be probed from here
+	if len(c.endpoints) > 1 && c.ssh.jump == "" {
+		latencies := make([]time.Duration, len(c.endpoints))
+		var wg sync.WaitGroup
+		for i, e := range c.endpoints {
+			wg.Add(1)
+			go func(i int, e endpoint) {
+				defer wg.Done()
+				latencies[i] = probeEndpoint(e)
+			}(i, e)
+		}
+		wg.Wait()
+
+		bestLatency := time.Duration(-1)
+		for i, e := range c.endpoints {
+			if latencies[i] < 0 {
+				log.Printf("Connection %s: %s:%d is unreachable", c.name, e.address, e.sshPort)
+				continue
+			}
+			if bestLatency < 0 || latencies[i] < bestLatency {
+				best, bestLatency = e, latencies[i]
+			}
+		}
+		if bestLatency >= 0 {
+			log.Printf("Connection %s: using %s:%d (%v)", c.name, best.address, best.sshPort, bestLatency.Round(time.Millisecond))
+		}
+	}
+	c.mu.Lock()
+	c.selected = &best
+	c.mu.Unlock()
+	return best
+}
+
+// probeEndpoint returns the time it takes to connect to e or -1 if e is unreachable. Local endpoints are always
+// reachable.
+func probeEndpoint(e endpoint) time.Duration {
+	if e.sshPort == 0 {
+		return 0
+	}
+	start := time.Now()
+	conn, err := dialTimeout("tcp", net.JoinHostPort(e.address, strconv.Itoa(e.sshPort)), probeTimeout)
+	if err != nil {
+		return -1
+	}
+	conn.Close()
+	return time.Since(start)
+}
+
+// reprobeConnections probes the connections of jobs again, eg. at the start of a daemon's run after the host moved to
+// another network, and updates the addresses of the nodes.
+func reprobeConnections(jobs []job) {
+	probed := make(map[*connection]bool)
+	for i := range jobs {
+		for _, n := range []*node{&jobs[i].source, &jobs[i].destination} {
+			if n.conn == nil {
+				continue
+			}
+			if !probed[n.conn] {
+				n.conn.probe()
+				probed[n.conn] = true
+			}
+			e := n.conn.endpoint()
+			n.address, n.sshPort = e.address, e.sshPort
+		}
+	}
+}
+
+// sshOptions returns the ssh options of n, the options of its connection overridden by its own.
+func (n *node) sshOptions() sshOptions {
+	if n.conn == nil {
+		return n.ssh
+	}
+	return n.conn.ssh.merge(n.ssh)
+}
+
+// sshArgs returns the ssh invocation reaching n without the remote command. ssh compresses unless disabled by the
+// options of n, which helps on slow links but costs throughput on fast ones.
+func sshArgs(n *node) []string {
+	o := n.sshOptions()
+	cmd := []string{"ssh", "-C", fmt.Sprintf("-p%d", n.sshPort)}
+	// compressing the compressed stream again only costs CPU
+	if o.compression == "no" || (o.compression == "" && n.compression() != "") {
+		cmd = []string{"ssh", fmt.Sprintf("-p%d", n.sshPort)}
+	}
+	cmd = append(cmd, o.args()...)
+	return append(cmd, n.address, "--")
+}
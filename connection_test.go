@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnectionEndpoint(t *testing.T) {
+	defer func(d func(string, string, time.Duration) (net.Conn, error)) { dialTimeout = d }(dialTimeout)
+	var mu sync.Mutex
+	delays := map[string]time.Duration{"nas.example.com:2222": 200 * time.Millisecond, "vpn:22": 0}
+	dials := 0
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		mu.Lock()
+		dials++
+		delay, ok := delays[address]
+		mu.Unlock()
+		if !ok {
+			return nil, errors.New("no route to host")
+		}
+		time.Sleep(delay)
+		c, _ := net.Pipe()
+		return c, nil
+	}
+
+	// the fastest reachable endpoint is used
+	c := &connection{name: "nas", endpoints: []endpoint{{"nas.lan", 22}, {"nas.example.com", 2222}, {"vpn", 22}}}
+	if e := c.endpoint(); e != (endpoint{"vpn", 22}) {
+		t.Errorf("unexpected endpoint: %v", e)
+	}
+	c.endpoint()
+	if dials != 3 {
+		t.Errorf("unexpected number of probes: %d", dials)
+	}
+
+	// probing again picks up changes of the network
+	mu.Lock()
+	delays["nas.lan:22"] = 0
+	delete(delays, "vpn:22")
+	mu.Unlock()
+	jobs := []job{{source: node{address: "localhost"}, destination: node{address: "vpn", sshPort: 22, conn: c}}}
+	reprobeConnections(jobs)
+	if n := jobs[0].destination; n.address != "nas.lan" || n.sshPort != 22 {
+		t.Errorf("unexpected node address: %s:%d", n.address, n.sshPort)
+	}
+
+	// nothing reachable, the preferred endpoint is used
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, errors.New("no route to host")
+	}
+	c = &connection{name: "nas", endpoints: []endpoint{{"nas.example.com", 2222}, {"nas.lan", 22}}}
+	if e := c.endpoint(); e != (endpoint{"nas.example.com", 2222}) {
+		t.Errorf("unexpected endpoint: %v", e)
+	}
+}
+
+func TestSSHArgs(t *testing.T) {
+	n := &node{address: "nas.lan", sshPort: 22}
+	if res := sshArgs(n); !reflect.DeepEqual(res, []string{"ssh", "-C", "-p22", "nas.lan", "--"}) {
+		t.Errorf("unexpected args: %v", res)
+	}
+	n.conn = &connection{ssh: sshOptions{user: "backup", key: "/etc/btrfs-backup/id_ed25519", jump: "bastion"}}
+	want := []string{"ssh", "-C", "-p22", "-l", "backup", "-i", "/etc/btrfs-backup/id_ed25519", "-J", "bastion", "nas.lan", "--"}
+	if res := sshArgs(n); !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected args: %v", res)
+	}
+	// options of the node override the ones of the connection
+	n.ssh = sshOptions{user: "root", knownHosts: "/etc/btrfs-backup/known_hosts", strictHostKeyChecking: "yes", connectTimeout: 10 * time.Second, extraArgs: []string{"-o", "ServerAliveInterval=30"}}
+	want = []string{"ssh", "-C", "-p22", "-l", "root", "-i", "/etc/btrfs-backup/id_ed25519", "-J", "bastion",
+		"-o", "UserKnownHostsFile=/etc/btrfs-backup/known_hosts", "-o", "StrictHostKeyChecking=yes", "-o", "ConnectTimeout=10",
+		"-o", "ServerAliveInterval=30", "nas.lan", "--"}
+	if res := sshArgs(n); !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected args: %v", res)
+	}
+	if res := unwrapCommand(sshCmd(n, []string{"ls"})); !reflect.DeepEqual(res, []string{"ls"}) {
+		t.Errorf("unexpected remote command: %v", res)
+	}
+
+	// ssh compression is disabled for compressed streams unless enabled explicitly
+	data := []struct {
+		compression string
+		compress    string
+		want        string
+	}{
+		{"", "", "-C"},
+		{"", "zstd", "-p22"},
+		{"no", "", "-p22"},
+		{"yes", "", "-C"},
+	}
+	for di, d := range data {
+		n := &node{address: "nas.lan", sshPort: 22, compress: d.compress, ssh: sshOptions{compression: d.compression}}
+		if res := sshArgs(n); res[1] != d.want {
+			t.Errorf("%d: unexpected args: %v", di, res)
+		}
+	}
+}
+
+func TestSSHOptionsValidate(t *testing.T) {
+	data := []struct {
+		o   sshOptions
+		err bool
+	}{
+		{sshOptions{}, false},
+		{sshOptions{strictHostKeyChecking: "accept-new", connectTimeout: 5 * time.Second}, false},
+		{sshOptions{strictHostKeyChecking: "maybe"}, true},
+		{sshOptions{compression: "no"}, false},
+		{sshOptions{compression: "off"}, true},
+		{sshOptions{connectTimeout: 1500 * time.Millisecond}, true},
+		{sshOptions{extraArgs: []string{"--", "reboot"}}, true},
+	}
+	for di, d := range data {
+		if err := d.o.validate(); d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+	}
+}
+
+func TestConfigConnections(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"config.yaml": `
+connections:
+  nas:
+    addresses: [nas.lan:22, nas.example.com:2222]
+    user: backup
+    bwlimit: 1MB/s
+destinations:
+  nas:
+    address: "@nas/backup"
+jobs:
+  root:
+    destination: nas
+  home:
+    source: "@nas/home"
+    destination: nas
+`})
+	c, err := loadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := c.jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	home, root := jobs[0], jobs[1]
+	if root.destination.conn == nil || root.destination.conn != home.source.conn {
+		t.Fatalf("connection not shared: %v, %v", root.destination.conn, home.source.conn)
+	}
+	if root.destination.key() != "@nas/backup" || root.destination.bwLimit != 1000000 || root.destination.conn.ssh.user != "backup" {
+		t.Errorf("unexpected destination: %s, %d", root.destination.key(), root.destination.bwLimit)
+	}
+
+	for _, conf := range []string{
+		"destinations: {x: {address: '@nas/backup'}}\njobs: {a: {destination: x}}",
+		"connections: {nas: {}}\ndestinations: {x: {address: '@nas/backup'}}\njobs: {a: {destination: x}}",
+		"connections: {nas: {addresses: [nas]}}\ndestinations: {x: {address: '@nas/backup'}}\njobs: {a: {destination: x}}",
+	} {
+		dir := writeFiles(t, map[string]string{"config.yaml": conf})
+		c, err := loadConfig(filepath.Join(dir, "config.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.jobs(); err == nil {
+			t.Errorf("%q: expected error but succeeded", conf)
+		}
+	}
+}
+
+func TestConfigSSHOptions(t *testing.T) {
+	dir := writeFiles(t, map[string]string{"config.yaml": `
+connections:
+  nas:
+    addresses: [nas.lan:22]
+    user: backup
+    strict_host_key_checking: accept-new
+destinations:
+  nas:
+    address: "@nas/backup"
+    ssh:
+      key: /etc/btrfs-backup/id_ed25519
+      known_hosts: /etc/btrfs-backup/known_hosts
+      connect_timeout: 10s
+      ssh_args: [-o, ServerAliveInterval=30]
+jobs:
+  root:
+    destination: nas
+`, "invalid.yaml": `
+destinations:
+  nas:
+    address: nas:22/backup
+    ssh:
+      strict_host_key_checking: sometimes
+jobs:
+  root:
+    destination: nas
+`})
+	c, err := loadConfig(filepath.Join(dir, "config.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := c.jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := sshOptions{user: "backup", key: "/etc/btrfs-backup/id_ed25519", knownHosts: "/etc/btrfs-backup/known_hosts",
+		strictHostKeyChecking: "accept-new", connectTimeout: 10 * time.Second, extraArgs: []string{"-o", "ServerAliveInterval=30"}}
+	if res := jobs[0].destination.sshOptions(); !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected options: %+v", res)
+	}
+
+	c, err = loadConfig(filepath.Join(dir, "invalid.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.jobs(); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+)
+
+// correlateSnapshots returns destinationSnapshots with each snapshot named like the source snapshot it was received
+// from, matched by the received UUID of the destination snapshot and the UUID of the source snapshot. This keeps
+// renamed destination snapshots usable as parents. Destination snapshots named like a source snapshot but received
+// from another sub-volume are dropped since they don't have the content of the source snapshot. Snapshots of which
+// the source has no snapshot of the same name, eg. because it was pruned, keep their name.
+func (j *job) correlateSnapshots(sourceSnapshots, destinationSnapshots []string) ([]string, error) {
+	if j.destination.archive {
+		log.Printf("Archives have no UUIDs, matching snapshots by name")
+		return destinationSnapshots, nil
+	}
+	sourceInfos, err := j.source.listSubvolumeInfo()
+	if err != nil {
+		return nil, fmt.Errorf("correlateSnapshots: %v", err)
+	}
+	destinationInfos, err := j.destination.listSubvolumeInfo()
+	if err != nil {
+		return nil, fmt.Errorf("correlateSnapshots: %v", err)
+	}
+
+	bySource := make(map[string]bool)
+	byUUID := make(map[string]string)
+	byReceivedUUID := make(map[string]string) // snapshots the source received back from the destination, see reverseSync
+	for _, s := range sourceSnapshots {
+		bySource[s] = true
+		if info, ok := findInfo(sourceInfos, path.Join(j.source.snapshotPath, s, j.source.subvolume)); ok {
+			byUUID[info.uuid] = s
+			if info.receivedUUID != "-" {
+				byReceivedUUID[info.receivedUUID] = s
+			}
+		}
+	}
+
+	var res []string
+	seen := make(map[string]bool)
+	for _, s := range destinationSnapshots {
+		source, matched := "", false
+		if info, ok := findInfo(destinationInfos, path.Join(j.destination.snapshotPath, s, j.destination.subvolume)); ok {
+			source, matched = byUUID[info.receivedUUID]
+			if info.receivedUUID == "-" {
+				source, matched = byReceivedUUID[info.uuid]
+			}
+		}
+		switch {
+		case matched && source != s:
+			log.Printf("%s at the destination was received from %s", s, source)
+		case matched:
+		case bySource[s]:
+			log.Printf("Warning: %s at the destination was not received from the source snapshot of the same name, ignoring it", s)
+			continue
+		default:
+			source = s
+		}
+		if !seen[source] {
+			seen[source] = true
+			res = append(res, source)
+		}
+	}
+	return orderLike(res, sourceSnapshots), nil
+}
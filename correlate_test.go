@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestCorrelateSnapshots(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list -u -R /mnt": "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\nID 2 gen 2 top level 5 received_uuid - uuid a2 path snapshot/2\nID 3 gen 3 top level 5 received_uuid - uuid a3 path snapshot/3\n",
+		// 0 was pruned at the source, 2 was renamed and 3 has the name of a source snapshot but another origin
+		"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup": "ID 1 gen 1 top level 5 received_uuid a0 uuid b0 path laptop/0\nID 2 gen 2 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 3 gen 3 top level 5 received_uuid a2 uuid b2 path laptop/old\nID 4 gen 4 top level 5 received_uuid x3 uuid b3 path laptop/3\n",
+	}}
+	r := regexp.MustCompile(`^.+$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+	res, err := j.correlateSnapshots([]string{"1", "2", "3"}, []string{"0", "1", "3", "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, []string{"0", "1", "2"}) {
+		t.Errorf("unexpected snapshots: %v", res)
+	}
+	// the missing snapshot is planned relative to the renamed one
+	if transfers := planTransfers([]string{"1", "2", "3"}, res); !reflect.DeepEqual(transfers, []transfer{{snapshot: "3", parent: "2"}}) {
+		t.Errorf("unexpected transfers: %v", transfers)
+	}
+
+	// archives have no UUIDs
+	j.destination.archive = true
+	if res, err := j.correlateSnapshots([]string{"1"}, []string{"1"}); err != nil || !reflect.DeepEqual(res, []string{"1"}) {
+		t.Errorf("unexpected result: %v, %v", res, err)
+	}
+}
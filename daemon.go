@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// daemon runs all jobs repeatedly. On SIGHUP the jobs are reloaded. A run which is in progress is not interrupted by a
+// reload, the new jobs are used starting with the next run. On SIGINT or SIGTERM, see handleSignals, the daemon exits
+// once the run in progress stopped.
+//
+// Like anacron, the end of the last run is recorded in the state so that a restarted daemon, eg. after the machine was
+// off, waits for the next scheduled run if none was missed and catches up after the settle delay otherwise.
+type daemon struct {
+	load     func() ([]job, error) // loads and validates the jobs
+	interval time.Duration         // time between the end of a run and the start of the next one
+	settle   time.Duration         // delay of the first run at startup unless it isn't due yet, eg. until the network is up
+	st       *state
+	opts     options
+
+	mu   sync.Mutex
+	jobs []job
+}
+
+func (d *daemon) run() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	done := make(chan *runReport)
+	timer := time.NewTimer(d.firstRun(time.Now()))
+	running, stop := false, interrupted
+	for {
+		select {
+		case <-stop:
+			if !running {
+				log.Printf("Exiting")
+				return
+			}
+			// wait for the run to stop
+			stop = nil
+		case <-hup:
+			if err := d.reload(); err != nil {
+				log.Printf("Reloading configuration failed, keeping previous configuration: %v", err)
+			} else {
+				log.Printf("Configuration reloaded")
+			}
+		case <-timer.C:
+			jobs := d.currentJobs()
+			running = true
+			go func() {
+				done <- runJobs(jobs, d.st, d.opts)
+			}()
+		case report := <-done:
+			running = false
+			if failed := report.failed(); failed > 0 {
+				log.Printf("%d jobs failed", failed)
+			}
+			// an interrupted run is caught up after a restart
+			if isInterrupted() {
+				log.Printf("Exiting")
+				return
+			}
+			d.recordRun(report)
+			log.Printf("Next run in %v", d.interval)
+			timer.Reset(d.interval)
+		}
+	}
+}
+
+// firstRun returns the delay of the first run at now. If the last recorded run is less than the interval ago, no run
+// was missed and the first one is scheduled an interval after it. Otherwise, including if no run was recorded, it is
+// a catch-up run after the settle delay.
+func (d *daemon) firstRun(now time.Time) time.Duration {
+	if d.st != nil && !d.st.LastDaemonRun.IsZero() {
+		due := d.st.LastDaemonRun.Add(d.interval)
+		if due.After(now) {
+			log.Printf("Last run finished %s, next run in %v", d.st.LastDaemonRun.Format(time.RFC3339), due.Sub(now).Round(time.Second))
+			return due.Sub(now)
+		}
+		log.Printf("Missed the run due %s, catching up", due.Format(time.RFC3339))
+	}
+	if d.settle > 0 {
+		log.Printf("First run in %v", d.settle)
+	}
+	return d.settle
+}
+
+// recordRun records the end of a run in the state. Deferred runs are not recorded so that they are caught up after a
+// restart.
+func (d *daemon) recordRun(report *runReport) {
+	if d.st == nil || d.opts.dryRun || report.Outcome == outcomeDeferred {
+		return
+	}
+	d.st.LastDaemonRun = report.Finished
+	d.st.touch(sectionLastDaemonRun, "")
+	if err := d.st.save(); err != nil {
+		log.Print(err)
+	}
+}
+
+// reload replaces the jobs if they can be loaded successfully.
+func (d *daemon) reload() error {
+	jobs, err := d.load()
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.jobs = jobs
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *daemon) currentJobs() []job {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.jobs
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDaemonReload(t *testing.T) {
+	var loadErr error
+	d := &daemon{
+		load: func() ([]job, error) {
+			if loadErr != nil {
+				return nil, loadErr
+			}
+			return []job{{name: "a"}, {name: "b"}}, nil
+		},
+		jobs: []job{{name: "a"}},
+	}
+
+	loadErr = fmt.Errorf("mock error")
+	if err := d.reload(); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+	if len(d.currentJobs()) != 1 {
+		t.Errorf("jobs replaced by invalid configuration")
+	}
+
+	loadErr = nil
+	if err := d.reload(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(d.currentJobs()) != 2 {
+		t.Errorf("jobs not replaced")
+	}
+}
+
+func TestDaemonFirstRun(t *testing.T) {
+	now := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	data := []struct {
+		st       *state
+		expected time.Duration
+	}{
+		{nil, 5 * time.Minute},
+		{&state{}, 5 * time.Minute},
+		{&state{LastDaemonRun: now.Add(-time.Hour)}, 5 * time.Hour},
+		{&state{LastDaemonRun: now.Add(-6 * time.Hour)}, 5 * time.Minute},
+		{&state{LastDaemonRun: now.Add(-3 * 24 * time.Hour)}, 5 * time.Minute},
+	}
+	for di, d := range data {
+		dm := &daemon{interval: 6 * time.Hour, settle: 5 * time.Minute, st: d.st}
+		if delay := dm.firstRun(now); delay != d.expected {
+			t.Errorf("%d: unexpected delay %v, expected %v", di, delay, d.expected)
+		}
+	}
+}
+
+func TestDaemonRecordRun(t *testing.T) {
+	st, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	d := &daemon{st: st}
+	d.recordRun(&runReport{Outcome: outcomeDeferred, Finished: finished})
+	if !st.LastDaemonRun.IsZero() {
+		t.Errorf("deferred run recorded")
+	}
+	d.recordRun(&runReport{Outcome: outcomeSuccess, Finished: finished})
+	loaded, err := loadState(st.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.LastDaemonRun.Equal(finished) {
+		t.Errorf("unexpected last run: %v", loaded.LastDaemonRun)
+	}
+}
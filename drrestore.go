@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// drRestoreCommand restores the source of a job onto a blank btrfs file system after it was lost.
+func drRestoreCommand(args []string) {
+	fs := flag.NewFlagSet("dr-restore", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run, only print the steps")
+	target := fs.String("target", "", "mount point of the top level sub-volume of the blank btrfs file system to restore onto")
+	snapshot := fs.String("snapshot", "", "snapshot to restore, defaults to the newest one")
+	name := fs.String("name", "", "name of the restored writable sub-volume, defaults to the name of the snapshotted sub-volume recorded in the metadata")
+	jobName := fs.String("job", "", "job to restore from, required if several jobs are defined")
+	identity := fs.String("identity", "", "age identity file decrypting the streams of an archive encrypted with age")
+	fs.Parse(args)
+	jf.setup()
+
+	if *target == "" {
+		log.Fatal("-target is required")
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	j, err := selectJob(jobs, *jobName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := j.drRestore(*target, *snapshot, *name, *identity, *dryRun, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// drRestore restores snapshot, by default the newest one at the destination of j, onto the blank btrfs file system
+// mounted at target and writes the steps to w. The snapshot is received in full, or from its chain of streams in an
+// archive, and kept read-only as the parent of the next backup. A writable snapshot of it named name, which has no
+// received UUID, becomes the new sub-volume and gets the properties recorded by saveMetadata. The fstab entries of
+// the source are printed for the new file system, the default sub-volume and quota limits are printed for reference
+// as their IDs differ on the new file system.
+func (j *job) drRestore(target, snapshot, name, identity string, dryRun bool, w io.Writer) error {
+	var m *metadata
+	if out, err := j.destination.readMetadata(); err != nil {
+		log.Printf("The layout of the source cannot be recreated: %v", err)
+	} else {
+		m = &metadata{}
+		if err := json.Unmarshal([]byte(out), m); err != nil {
+			return fmt.Errorf("drRestore: %v", err)
+		}
+	}
+	if snapshot == "" {
+		snapshots, err := j.destination.getSnapshots()
+		if err != nil {
+			return fmt.Errorf("drRestore: %v", err)
+		}
+		if len(snapshots) == 0 {
+			return fmt.Errorf("drRestore: no snapshots at %s", j.destination.key())
+		}
+		snapshot = snapshots[len(snapshots)-1]
+	}
+	if name == "" {
+		name = "restored"
+		if m != nil && m.Subvolume != "/" {
+			name = path.Base(m.Subvolume)
+		}
+	}
+
+	receiver := node{address: "localhost", mountPoint: target, subvolume: j.source.subvolume, executor: j.source.executor}
+	out, err := receiver.run("btrfs", "subvolume", "list", target)
+	if err != nil {
+		return fmt.Errorf("drRestore: %s: %v", target, err)
+	}
+	if existing, err := parseSubVolumes(out); err != nil || len(existing) > 0 {
+		return fmt.Errorf("drRestore: %s isn't a blank btrfs file system, it has sub-volumes %v", target, existing)
+	}
+
+	fmt.Fprintf(w, "1. Receiving %s from %s into %s\n", snapshot, j.destination.key(), target)
+	if j.destination.archive {
+		err = j.restoreArchive(snapshot, &receiver, nil, identity, dryRun)
+	} else {
+		_, err = sendSnapshot(&j.destination, &receiver, snapshot, "", dryRun)
+	}
+	if err != nil {
+		return fmt.Errorf("drRestore: %v", err)
+	}
+
+	received := path.Join(receiver.receiveDir(snapshot), receiver.receivedName(snapshot))
+	restored := path.Join(target, name)
+	fmt.Fprintf(w, "2. Creating the writable sub-volume %s from %s, which stays as the parent of the next backup\n", restored, received)
+	if !dryRun {
+		if _, err := receiver.run("btrfs", "subvolume", "snapshot", received, restored); err != nil {
+			return fmt.Errorf("drRestore: %v", err)
+		}
+	}
+	if m == nil {
+		return nil
+	}
+
+	var properties []string
+	for k := range m.Properties {
+		// the read-only property of the snapshot is set by btrfs receive, the new sub-volume must stay writable
+		if k != "ro" && m.Properties[k] != "" {
+			properties = append(properties, k)
+		}
+	}
+	sort.Strings(properties)
+	for _, k := range properties {
+		fmt.Fprintf(w, "3. Setting %s=%s on %s\n", k, m.Properties[k], restored)
+		if dryRun {
+			continue
+		}
+		if _, err := receiver.run("btrfs", "property", "set", restored, k, m.Properties[k]); err != nil {
+			return fmt.Errorf("drRestore: %v", err)
+		}
+	}
+
+	uuid, err := receiver.run("findmnt", "-n", "-o", "UUID", "-T", target)
+	if err != nil {
+		return fmt.Errorf("drRestore: %v", err)
+	}
+	fmt.Fprintf(w, "4. Entries of /etc/fstab for the new file system:\n")
+	for _, entry := range m.Fstab {
+		fmt.Fprintf(w, "   %s\n", restoreFstabEntry(entry, strings.TrimSpace(uuid), m.Subvolume, name))
+	}
+	fmt.Fprintf(w, "5. For reference, the source had the default sub-volume %q", m.Default)
+	if len(m.QGroups) > 0 {
+		fmt.Fprintf(w, " and the qgroups, to be recreated with btrfs qgroup limit:\n")
+		for _, q := range m.QGroups {
+			fmt.Fprintf(w, "   %s\n", q)
+		}
+	} else {
+		fmt.Fprintf(w, "\n")
+	}
+	return nil
+}
+
+// restoreFstabEntry returns the fstab entry of the source for the file system with uuid. The entry mounting the
+// snapshotted sub-volume at origin mounts the restored sub-volume name instead.
+func restoreFstabEntry(entry, uuid, origin, name string) string {
+	fields := strings.Fields(entry)
+	if len(fields) < 4 {
+		return entry
+	}
+	fields[0] = "UUID=" + uuid
+	if fields[1] == origin {
+		var options []string
+		for _, o := range strings.Split(fields[3], ",") {
+			if !strings.HasPrefix(o, "subvol=") && !strings.HasPrefix(o, "subvolid=") {
+				options = append(options, o)
+			}
+		}
+		fields[3] = strings.Join(append(options, "subvol=/"+name), ",")
+	}
+	return strings.Join(fields, " ")
+}
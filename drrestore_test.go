@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestDRRestore(t *testing.T) {
+	meta := `{"subvolume": "/home", "properties": {"ro": "false", "compression": "zstd:3"}, "default_subvolume": "ID 5 (FS_TREE)",
+		"qgroups": ["0/257 16384 16384 10737418240 none"], "fstab": ["UUID=abc /home btrfs rw,subvol=/@home,compress=zstd:3 0 0"]}`
+	e := &mapExecutor{out: map[string]string{
+		"ssh -C -p22 nas -- cat /backup/laptop/metadata.json":                         meta,
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":                             "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+		"btrfs subvolume list /new":                                                   "",
+		"ssh -C -p22 nas -- btrfs send --quiet /backup/laptop/2 | btrfs receive /new": "",
+		"btrfs subvolume snapshot /new/2 /new/home":                                   "",
+		"btrfs property set /new/home compression zstd:3":                             "",
+		"findmnt -n -o UUID -T /new":                                                  "f00d\n",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+
+	var buf bytes.Buffer
+	if err := j.drRestore("/new", "", "", "", false, &buf); err != nil {
+		t.Fatal(err)
+	}
+	for cmd := range e.out {
+		if e.calls[cmd] == 0 {
+			t.Errorf("%s not run", cmd)
+		}
+	}
+	for _, want := range []string{"UUID=f00d /home btrfs rw,compress=zstd:3,subvol=/home 0 0", "0/257 16384 16384 10737418240 none"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("%q missing in output:\n%s", want, buf.String())
+		}
+	}
+
+	// the target must be blank
+	e.out["btrfs subvolume list /new"] = "ID 256 gen 1 top level 5 path home\n"
+	if err := j.drRestore("/new", "", "", "", false, &buf); err == nil {
+		t.Error("expected error but succeeded")
+	}
+}
+
+func TestRestoreFstabEntry(t *testing.T) {
+	data := []struct {
+		entry, want string
+	}{
+		{"UUID=abc / btrfs defaults,subvol=@ 0 0", "UUID=f00d / btrfs defaults,subvol=/restored 0 0"},
+		{"UUID=abc /var btrfs subvolid=258,noatime 0 0", "UUID=f00d /var btrfs subvolid=258,noatime 0 0"},
+		{"/dev/sda2 /", "/dev/sda2 /"},
+	}
+	for _, d := range data {
+		if res := restoreFstabEntry(d.entry, "f00d", "/", "restored"); res != d.want {
+			t.Errorf("%s: unexpected entry: %s", d.entry, res)
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// filter transforms the byte stream sent from the source to the destination, eg. to compress or encrypt it. Filters
+// are chained in the order they are configured, the receiving command must accept the output of the last one.
+type filter interface {
+	// wrap returns a reader applying the filter to r. Closing it releases all resources of the filter.
+	wrap(r io.Reader) (io.ReadCloser, error)
+	// String returns the specification the filter was parsed from.
+	String() string
+}
+
+// parseFilters parses filter specifications: gzip, gunzip, meter or exec:<command> running an arbitrary command which
+// reads the stream from stdin and writes the filtered stream to stdout, eg. "exec:zstd -c".
+func parseFilters(specs []string) ([]filter, error) {
+	var res []filter
+	for _, spec := range specs {
+		switch {
+		case spec == "gzip":
+			res = append(res, gzipFilter{})
+		case spec == "gunzip":
+			res = append(res, gunzipFilter{})
+		case spec == "meter":
+			res = append(res, meterFilter{})
+		case strings.HasPrefix(spec, "exec:"):
+			args := strings.Fields(strings.TrimPrefix(spec, "exec:"))
+			if len(args) == 0 {
+				return nil, fmt.Errorf("parseFilters: missing command: %s", spec)
+			}
+			res = append(res, execFilter{args})
+		default:
+			return nil, fmt.Errorf("parseFilters: unknown filter: %s", spec)
+		}
+	}
+	return res, nil
+}
+
+// filterSpecs returns the specifications of filters.
+func filterSpecs(filters []filter) []string {
+	var res []string
+	for _, f := range filters {
+		res = append(res, f.String())
+	}
+	return res
+}
+
+// gzipFilter compresses the stream.
+type gzipFilter struct{}
+
+func (gzipFilter) String() string { return "gzip" }
+
+func (gzipFilter) wrap(r io.Reader) (io.ReadCloser, error) {
+	return encodeStream(r, "gzipFilter", func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	})
+}
+
+// encodeStream returns a reader of r encoded in-process by the writer newWriter returns. name prefixes the errors of
+// the encoder.
+func encodeStream(r io.Reader, name string, newWriter func(w io.Writer) (io.WriteCloser, error)) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	ew, err := newWriter(pw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(ew, r)
+		if closeErr := ew.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	return &encodeReader{pr, name, done}, nil
+}
+
+type encodeReader struct {
+	*io.PipeReader
+	name string
+	done <-chan error // receives the result of encoding once r is no longer read
+}
+
+// Close stops the encoding and waits for it to finish, returning its error.
+func (e *encodeReader) Close() error {
+	e.PipeReader.Close()
+	if err := <-e.done; err != nil && err != io.ErrClosedPipe {
+		return fmt.Errorf("%s: %v", e.name, err)
+	}
+	return nil
+}
+
+// gunzipFilter decompresses a stream compressed with gzip.
+type gunzipFilter struct{}
+
+func (gunzipFilter) String() string { return "gunzip" }
+
+func (gunzipFilter) wrap(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// meterFilter logs the number of bytes which passed its position in the chain, eg. to compare the size of the stream
+// before and after compression.
+type meterFilter struct{}
+
+func (meterFilter) String() string { return "meter" }
+
+func (meterFilter) wrap(r io.Reader) (io.ReadCloser, error) {
+	return &meterReader{r: r}, nil
+}
+
+type meterReader struct {
+	r     io.Reader
+	meter int
+}
+
+func (m *meterReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.meter += n
+	return n, err
+}
+
+func (m *meterReader) Close() error {
+	log.Printf("Filter meter: %s", formatBytes(m.meter))
+	return nil
+}
+
+// execFilter pipes the stream through an external command.
+type execFilter struct {
+	args []string
+}
+
+func (f execFilter) String() string { return "exec:" + strings.Join(f.args, " ") }
+
+func (f execFilter) wrap(r io.Reader) (io.ReadCloser, error) {
+	c := exec.Command(f.args[0], f.args[1:]...)
+	c.Stderr = os.Stderr
+	// copy stdin ourselves, otherwise Wait would block until r is exhausted even if the command was killed
+	stdin, err := c.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("execFilter: %v", err)
+	}
+	stdout, err := c.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("execFilter: %v", err)
+	}
+	if err := c.Start(); err != nil {
+		return nil, fmt.Errorf("execFilter: %v", err)
+	}
+	copied := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(stdin, r)
+		if closeErr := stdin.Close(); err == nil {
+			err = closeErr
+		}
+		copied <- err
+	}()
+	return &execReader{cmd: c, stdout: stdout, copied: copied}, nil
+}
+
+type execReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	waited bool
+	killed bool
+
+	copied  <-chan error // receives the result of copying the input to the command
+	joined  bool
+	copyErr error
+}
+
+// Read returns the error of the command or of copying its input once its output is exhausted. The command sees the
+// end of its input if reading the input failed, so its output may be incomplete despite it succeeding.
+func (e *execReader) Read(p []byte) (int, error) {
+	n, err := e.stdout.Read(p)
+	if err == io.EOF && !e.waited {
+		e.waited = true
+		if waitErr := e.cmd.Wait(); waitErr != nil {
+			e.join()
+			return n, fmt.Errorf("execFilter: %s: %v", strings.Join(e.cmd.Args, " "), waitErr)
+		}
+		if err := e.join(); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+// join waits for the input of the command to be copied and returns the error of copying it.
+func (e *execReader) join() error {
+	if !e.joined {
+		e.joined = true
+		if err := <-e.copied; err != nil {
+			e.copyErr = fmt.Errorf("execFilter: %s: %v", strings.Join(e.cmd.Args, " "), err)
+		}
+	}
+	return e.copyErr
+}
+
+// Close terminates the command if it is still running and waits for its input to be copied. It returns the error of
+// copying the input unless the command was terminated, which fails the copy.
+func (e *execReader) Close() error {
+	if !e.waited {
+		e.waited = true
+		e.killed = true
+		e.stdout.Close()
+		e.cmd.Process.Kill()
+		e.cmd.Wait()
+	}
+	err := e.join()
+	if e.killed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseFilters(t *testing.T) {
+	data := []struct {
+		specs []string
+		res   []filter
+		err   bool
+	}{
+		{specs: nil, res: nil},
+		{specs: []string{"gzip", "meter", "gunzip"}, res: []filter{gzipFilter{}, meterFilter{}, gunzipFilter{}}},
+		{specs: []string{"exec:zstd  -c"}, res: []filter{execFilter{[]string{"zstd", "-c"}}}},
+		{specs: []string{"exec:"}, err: true},
+		{specs: []string{"zstd"}, err: true},
+	}
+	for di, d := range data {
+		res, err := parseFilters(d.specs)
+		if d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, d.res) {
+			t.Errorf("%d: unexpected result: %v", di, res)
+		}
+	}
+}
+
+func TestCopyFiltered(t *testing.T) {
+	in := strings.Repeat("btrfs-backup ", 1000)
+	filters := []filter{gzipFilter{}, meterFilter{}, execFilter{[]string{"cat"}}, gunzipFilter{}}
+	var out bytes.Buffer
+	if err := copyFiltered(&out, strings.NewReader(in), filters); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != in {
+		t.Errorf("unexpected output: %q", out.String())
+	}
+
+	err := copyFiltered(io.Discard, strings.NewReader(in), []filter{execFilter{[]string{"false"}}})
+	if err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+}
+
+// failingReader returns its data followed by err.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		err = f.err
+	}
+	return n, err
+}
+
+func TestCopyFilteredInputError(t *testing.T) {
+	// the command sees the end of its input and succeeds, the truncated stream must fail nevertheless
+	for _, filters := range [][]filter{{execFilter{[]string{"cat"}}}, {gzipFilter{}}, {gzipFilter{}, execFilter{[]string{"cat"}}, gunzipFilter{}}} {
+		r := &failingReader{strings.NewReader(strings.Repeat("btrfs-backup ", 1000)), errors.New("connection reset")}
+		err := copyFiltered(io.Discard, r, filters)
+		if err == nil || !strings.Contains(err.Error(), "connection reset") {
+			t.Errorf("%v: unexpected error: %v", filters, err)
+		}
+	}
+}
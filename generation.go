@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	generationOrderWarn   = "warn"   // only log snapshots whose generation contradicts their name
+	generationOrderParent = "parent" // order snapshots by generation when picking parents
+)
+
+// parseGenerations extracts the generation of every sub-volume from the output of "btrfs subvolume list". Lines which
+// don't contain a generation are ignored.
+func parseGenerations(out string) map[string]int {
+	res := make(map[string]int)
+	for _, line := range strings.Split(out, "\n") {
+		tokens := strings.Split(line, " ")
+		gen, p := -1, ""
+		for i := 0; i+1 < len(tokens); i++ {
+			switch tokens[i] {
+			case "gen":
+				if g, err := strconv.Atoi(tokens[i+1]); err == nil && gen < 0 {
+					gen = g
+				}
+			case "path":
+				p = strings.Join(tokens[i+1:], " ")
+				i = len(tokens)
+			}
+		}
+		if gen >= 0 && p != "" {
+			res[p] = gen
+		}
+	}
+	return res
+}
+
+// misorderedSnapshots returns all snapshots which have a lower generation than a snapshot preceding them by name. This
+// happens eg. if the clock jumped when a snapshot was created or a snapshot was restored from a backup. Snapshots
+// without a known generation are ignored.
+func misorderedSnapshots(snapshots []string, generations map[string]int) []string {
+	var res []string
+	maxGen := -1
+	for _, s := range snapshots {
+		gen, ok := generations[s]
+		if !ok {
+			continue
+		}
+		if gen < maxGen {
+			res = append(res, s)
+		} else {
+			maxGen = gen
+		}
+	}
+	return res
+}
+
+// orderByGeneration returns the snapshots sorted by generation. Snapshots with an unknown generation come first.
+// Snapshots with equal generations keep their relative order.
+func orderByGeneration(snapshots []string, generations map[string]int) []string {
+	gen := func(s string) int {
+		if g, ok := generations[s]; ok {
+			return g
+		}
+		return -1
+	}
+	res := append([]string(nil), snapshots...)
+	sort.SliceStable(res, func(i, j int) bool {
+		return gen(res[i]) < gen(res[j])
+	})
+	return res
+}
+
+// orderLike returns snapshots in the order in which they appear in reference. Snapshots which are not contained in
+// reference come first in their original order.
+func orderLike(snapshots, reference []string) []string {
+	present := make(map[string]bool)
+	for _, s := range snapshots {
+		present[s] = true
+	}
+	inReference := make(map[string]bool)
+	for _, s := range reference {
+		inReference[s] = true
+	}
+
+	var res []string
+	for _, s := range snapshots {
+		if !inReference[s] {
+			res = append(res, s)
+		}
+	}
+	for _, s := range reference {
+		if present[s] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseGenerations(t *testing.T) {
+	out := "ID 6988 gen 23968 top level 5 path snapshot/2019-01-11_03-00\nfoo bar\nID 6989 gen 23981 cgen 23980 top level 5 path snapshot/with space\n"
+	want := map[string]int{"snapshot/2019-01-11_03-00": 23968, "snapshot/with space": 23981}
+	if res := parseGenerations(out); !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected result: %#v", res)
+	}
+}
+
+func TestMisorderedSnapshots(t *testing.T) {
+	data := []struct {
+		snapshots   []string
+		generations map[string]int
+		misordered  []string
+		ordered     []string
+	}{
+		{
+			[]string{"1", "2", "3"},
+			map[string]int{"1": 10, "2": 20, "3": 30},
+			nil,
+			[]string{"1", "2", "3"},
+		},
+		{
+			[]string{"1", "2", "3", "4"},
+			map[string]int{"1": 10, "2": 40, "3": 30, "4": 50},
+			[]string{"3"},
+			[]string{"1", "3", "2", "4"},
+		},
+		{
+			[]string{"1", "2", "3"},
+			map[string]int{"1": 10, "3": 5},
+			[]string{"3"},
+			[]string{"2", "3", "1"},
+		},
+	}
+
+	for di, d := range data {
+		if res := misorderedSnapshots(d.snapshots, d.generations); !reflect.DeepEqual(res, d.misordered) {
+			t.Errorf("%d: unexpected misordered snapshots: %#v", di, res)
+		}
+		if res := orderByGeneration(d.snapshots, d.generations); !reflect.DeepEqual(res, d.ordered) {
+			t.Errorf("%d: unexpected order: %#v", di, res)
+		}
+	}
+}
+
+func TestOrderLike(t *testing.T) {
+	res := orderLike([]string{"0", "2", "3"}, []string{"1", "3", "2", "4"})
+	if want := []string{"0", "3", "2"}; !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected result: %#v", res)
+	}
+}
@@ -1,3 +1,11 @@
 module github.com/mwuertinger/btrfs-backup
 
 go 1.20
+
+require gopkg.in/yaml.v3 v3.0.1
+
+require (
+	github.com/klauspost/compress v1.17.4
+	golang.org/x/crypto v0.17.0
+	golang.org/x/sys v0.15.0 // indirect
+)
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// holdCommand pins snapshots against pruning, eg. until an audit is done. Without snapshots it lists the held
+// snapshots of the job. Holds are recorded in the state file.
+func holdCommand(args []string) {
+	fs := flag.NewFlagSet("hold", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	jobName := fs.String("job", "", "job whose snapshots are held, required if several jobs are defined")
+	source := fs.Bool("source", false, "hold the snapshots at the source instead of the destination")
+	reason := fs.String("reason", "", "why the snapshots are held, eg. audit 2024-Q2")
+	fs.Parse(args)
+	jf.setup()
+
+	st, n := holdTarget(jf, *jobName, *source)
+	if fs.NArg() == 0 {
+		printHolds(st.holds(n))
+		return
+	}
+	if *reason == "" {
+		log.Fatal("-reason is required")
+	}
+	for _, s := range fs.Args() {
+		if err := st.hold(n, s, *reason); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Holding %s on %s", s, n.key())
+	}
+	if err := st.save(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// releaseCommand removes holds created by the hold command.
+func releaseCommand(args []string) {
+	fs := flag.NewFlagSet("release", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	jobName := fs.String("job", "", "job whose snapshots are released, required if several jobs are defined")
+	source := fs.Bool("source", false, "release the snapshots at the source instead of the destination")
+	fs.Parse(args)
+	jf.setup()
+
+	if fs.NArg() == 0 {
+		log.Fatal("no snapshots given")
+	}
+	st, n := holdTarget(jf, *jobName, *source)
+	for _, s := range fs.Args() {
+		if !st.release(n, s) {
+			log.Fatalf("%s is not held on %s", s, n.key())
+		}
+		log.Printf("Released %s on %s", s, n.key())
+	}
+	if err := st.save(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// holdTarget returns the state and the node of the selected job whose snapshots are held or released.
+func holdTarget(jf *jobFlags, jobName string, source bool) (*state, *node) {
+	st := jf.loadState()
+	if st == nil {
+		log.Fatal("-state is required")
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	j, err := selectJob(jobs, jobName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if source {
+		return st, &j.source
+	}
+	return st, &j.destination
+}
+
+func printHolds(holds map[string]string) {
+	var snapshots []string
+	for s := range holds {
+		snapshots = append(snapshots, s)
+	}
+	sort.Strings(snapshots)
+	for _, s := range snapshots {
+		fmt.Printf("%s\t%s\n", s, holds[s])
+	}
+}
+
+// withoutHeld returns snapshots except the ones in holds.
+func withoutHeld(snapshots []string, holds map[string]string) []string {
+	var res []string
+	for _, s := range snapshots {
+		if reason, ok := holds[s]; ok {
+			log.Printf("Keeping %s because it is held: %s", s, reason)
+			continue
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// hold records that snapshot of n must not be deleted. The snapshot must exist.
+func (s *state) hold(n *node, snapshot, reason string) error {
+	snapshots, err := n.getSnapshots()
+	if err != nil {
+		return fmt.Errorf("hold: %v", err)
+	}
+	found := false
+	for _, existing := range snapshots {
+		found = found || existing == snapshot
+	}
+	if !found {
+		return fmt.Errorf("hold: no snapshot %s on %s", snapshot, n.key())
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Holds == nil {
+		s.Holds = make(map[string]map[string]string)
+	}
+	if s.Holds[n.key()] == nil {
+		s.Holds[n.key()] = make(map[string]string)
+	}
+	s.Holds[n.key()][snapshot] = reason
+	s.touchSnapshot(sectionHolds, n, snapshot)
+	return nil
+}
+
+// release removes the hold of snapshot of n. It returns false if the snapshot is not held.
+func (s *state) release(n *node, snapshot string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	holds := s.Holds[n.key()]
+	if _, ok := holds[snapshot]; !ok {
+		return false
+	}
+	delete(holds, snapshot)
+	if len(holds) == 0 {
+		delete(s.Holds, n.key())
+	}
+	s.touchSnapshot(sectionHolds, n, snapshot)
+	return true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestHoldRelease(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"ssh -C -p22 nas -- btrfs subvolume list /backup": "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+	}}
+	n := &node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: regexp.MustCompile(`^\d$`), executor: e}
+	other := &node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "desktop"}
+
+	p := filepath.Join(t.TempDir(), "state.json")
+	st, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.hold(n, "2", "audit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.hold(n, "3", "audit"); err == nil {
+		t.Error("expected error holding a missing snapshot")
+	}
+	if err := st.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if holds := st.holds(n); !reflect.DeepEqual(holds, map[string]string{"2": "audit"}) {
+		t.Errorf("unexpected holds: %v", holds)
+	}
+	if holds := st.holds(other); holds != nil {
+		t.Errorf("unexpected holds of other node: %v", holds)
+	}
+	if res := withoutHeld([]string{"1", "2"}, st.holds(n)); !reflect.DeepEqual(res, []string{"1"}) {
+		t.Errorf("unexpected result: %v", res)
+	}
+
+	if st.release(other, "2") {
+		t.Error("released snapshot of other node")
+	}
+	if !st.release(n, "2") {
+		t.Error("failed to release snapshot")
+	}
+	if st.release(n, "2") || len(st.Holds) != 0 {
+		t.Errorf("unexpected holds after release: %v", st.Holds)
+	}
+}
+
+func TestHoldConcurrentSavers(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	newNode := func() *node {
+		e := &mapExecutor{out: map[string]string{
+			"ssh -C -p22 nas -- btrfs subvolume list /backup": "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\nID 3 gen 3 top level 5 path laptop/3\n",
+		}}
+		return &node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: regexp.MustCompile(`^\d$`), executor: e}
+	}
+	st, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.hold(newNode(), "3", "audit"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// both load the state before either saves it, one holds a snapshot, the other one holds another snapshot of the
+	// same node and releases the existing hold
+	a, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := a.hold(newNode(), "1", "legal"); err != nil {
+			t.Error(err)
+		}
+		if err := a.save(); err != nil {
+			t.Error(err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := b.hold(newNode(), "2", "audit"); err != nil {
+			t.Error(err)
+		}
+		if !b.release(newNode(), "3") {
+			t.Error("failed to release snapshot")
+		}
+		if err := b.save(); err != nil {
+			t.Error(err)
+		}
+	}()
+	wg.Wait()
+
+	if st, err = loadState(p); err != nil {
+		t.Fatal(err)
+	}
+	if holds := st.holds(newNode()); !reflect.DeepEqual(holds, map[string]string{"1": "legal", "2": "audit"}) {
+		t.Errorf("unexpected holds: %v", holds)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+)
+
+// incomingPath returns the directory inside the incoming directory of n which snapshot is received into before it is
+// moved into place. Every snapshot has a directory of its own so that nested snapshots, which are all received under
+// the name of their sub-volume, don't collide.
+func (n *node) incomingPath(snapshot string) string {
+	return path.Join(n.mountPoint, n.incomingDir, snapshot)
+}
+
+// receivedName returns the name btrfs receive gives to snapshot in the directory it is received into.
+func (n *node) receivedName(snapshot string) string {
+	if n.subvolume != "" {
+		return n.subvolume
+	}
+	return snapshot
+}
+
+// prepareIncoming creates the incoming directory of snapshot and disposes of the remains of an interrupted receive of
+// it according to the cleanup setting of n, which would make receiving it again fail.
+func (n *node) prepareIncoming(snapshot string) error {
+	dir := n.incomingPath(snapshot)
+	received := path.Join(dir, n.receivedName(snapshot))
+	if _, err := n.run("test", "-e", received); err == nil {
+		log.Printf("Found the remains of an interrupted receive of %s", snapshot)
+		if err := n.disposePartial(received); err != nil {
+			return fmt.Errorf("prepareIncoming: %v", err)
+		}
+	}
+	if _, err := n.run("mkdir", "-p", dir); err != nil {
+		return fmt.Errorf("prepareIncoming: %v", err)
+	}
+	return nil
+}
+
+// moveIncoming verifies that snapshot was received completely into its incoming directory, see verifyReceived, and
+// moves it into place, so that the snapshot directory of n never contains partially received snapshots.
+func (n *node) moveIncoming(snapshot string) error {
+	dir := n.incomingPath(snapshot)
+	received := path.Join(dir, n.receivedName(snapshot))
+	out, err := n.run("btrfs", "subvolume", "show", received)
+	if err != nil {
+		return fmt.Errorf("moveIncoming: %v", err)
+	}
+	if err := verifyReceived(out); err != nil {
+		return fmt.Errorf("moveIncoming: %s: %v", snapshot, err)
+	}
+	target := path.Join(n.receiveDir(snapshot), n.receivedName(snapshot))
+	if _, err := n.run("test", "-e", target); err == nil {
+		return fmt.Errorf("moveIncoming: %s already exists", target)
+	}
+	if n.subvolume != "" {
+		if _, err := n.run("mkdir", "-p", n.receiveDir(snapshot)); err != nil {
+			return fmt.Errorf("moveIncoming: %v", err)
+		}
+	}
+	if _, err := n.run("mv", "-T", received, target); err != nil {
+		return fmt.Errorf("moveIncoming: %v", err)
+	}
+	if _, err := n.run("rmdir", dir); err != nil {
+		return fmt.Errorf("moveIncoming: %v", err)
+	}
+	return nil
+}
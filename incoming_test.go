@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSendSnapshotIncoming(t *testing.T) {
+	const (
+		complete   = "snapshot\n\tName: \t\t\t2\n\tReceived UUID: \t\taaaa-bbbb\n\tFlags: \t\t\treadonly\n"
+		incomplete = "snapshot\n\tName: \t\t\t2\n\tReceived UUID: \t\t-\n\tFlags: \t\t\t-\n"
+	)
+	tests := []struct {
+		name      string
+		subvolume string
+		out       map[string]string
+		err       bool
+	}{
+		{
+			name: "complete",
+			out: map[string]string{
+				"ssh -C -p22 nas -- mkdir -p /backup/.incoming/2":                                                              "",
+				"btrfs send --quiet -p /mnt/snapshot/1 /mnt/snapshot/2 | ssh -C -p22 nas -- btrfs receive /backup/.incoming/2": "",
+				"ssh -C -p22 nas -- btrfs subvolume show /backup/.incoming/2/2":                                                complete,
+				"ssh -C -p22 nas -- mv -T /backup/.incoming/2/2 /backup/2":                                                     "",
+				"ssh -C -p22 nas -- rmdir /backup/.incoming/2":                                                                 "",
+			},
+		},
+		{
+			name:      "nested",
+			subvolume: "@",
+			out: map[string]string{
+				"ssh -C -p22 nas -- mkdir -p /backup/.incoming/2":                                                                  "",
+				"btrfs send --quiet -p /mnt/snapshot/1/@ /mnt/snapshot/2/@ | ssh -C -p22 nas -- btrfs receive /backup/.incoming/2": "",
+				"ssh -C -p22 nas -- btrfs subvolume show /backup/.incoming/2/@":                                                    complete,
+				"ssh -C -p22 nas -- mkdir -p /backup/laptop/2":                                                                     "",
+				"ssh -C -p22 nas -- mv -T /backup/.incoming/2/@ /backup/laptop/2/@":                                                "",
+				"ssh -C -p22 nas -- rmdir /backup/.incoming/2":                                                                     "",
+			},
+		},
+		{
+			name: "remains of an interrupted receive",
+			out: map[string]string{
+				"ssh -C -p22 nas -- test -e /backup/.incoming/2/2":                                                             "",
+				"ssh -C -p22 nas -- btrfs subvolume delete /backup/.incoming/2/2":                                              "",
+				"ssh -C -p22 nas -- mkdir -p /backup/.incoming/2":                                                              "",
+				"btrfs send --quiet -p /mnt/snapshot/1 /mnt/snapshot/2 | ssh -C -p22 nas -- btrfs receive /backup/.incoming/2": "",
+				"ssh -C -p22 nas -- btrfs subvolume show /backup/.incoming/2/2":                                                complete,
+				"ssh -C -p22 nas -- mv -T /backup/.incoming/2/2 /backup/2":                                                     "",
+				"ssh -C -p22 nas -- rmdir /backup/.incoming/2":                                                                 "",
+			},
+		},
+		{
+			name: "incomplete",
+			out: map[string]string{
+				"ssh -C -p22 nas -- mkdir -p /backup/.incoming/2":                                                              "",
+				"btrfs send --quiet -p /mnt/snapshot/1 /mnt/snapshot/2 | ssh -C -p22 nas -- btrfs receive /backup/.incoming/2": "",
+				"ssh -C -p22 nas -- btrfs subvolume show /backup/.incoming/2/2":                                                incomplete,
+			},
+			err: true,
+		},
+		{
+			name: "exists",
+			out: map[string]string{
+				"ssh -C -p22 nas -- mkdir -p /backup/.incoming/2":                                                              "",
+				"btrfs send --quiet -p /mnt/snapshot/1 /mnt/snapshot/2 | ssh -C -p22 nas -- btrfs receive /backup/.incoming/2": "",
+				"ssh -C -p22 nas -- btrfs subvolume show /backup/.incoming/2/2":                                                complete,
+				"ssh -C -p22 nas -- test -e /backup/2":                                                                         "",
+			},
+			err: true,
+		},
+	}
+
+	for _, test := range tests {
+		e := &mapExecutor{out: test.out}
+		source := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", subvolume: test.subvolume, executor: e}
+		destination := node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", subvolume: test.subvolume, incomingDir: ".incoming", executor: e}
+		_, err := sendSnapshot(&source, &destination, "2", "1", false)
+		if test.err != (err != nil) {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		for cmd := range test.out {
+			if e.calls[cmd] == 0 {
+				t.Errorf("%s: %s not run", test.name, cmd)
+			}
+		}
+	}
+
+	// a failed receive is cleaned up in the incoming directory
+	e := &mapExecutor{out: map[string]string{"ssh -C -p22 nas -- btrfs subvolume delete /backup/.incoming/2/2": ""}}
+	destination := node{address: "nas", sshPort: 22, mountPoint: "/backup", incomingDir: ".incoming", cleanup: cleanupDelete, executor: e}
+	if err := destination.cleanupReceive("2"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,141 @@
+//go:build integration
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The integration tests run against loopback btrfs file systems and require root as well as the btrfs tools:
+//
+//	sudo go test -tags integration -run Integration .
+
+// loopbackBtrfs creates and mounts a btrfs file system backed by a file and returns its mount point.
+func loopbackBtrfs(t *testing.T) string {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("integration tests require root")
+	}
+	if _, err := exec.LookPath("mkfs.btrfs"); err != nil {
+		t.Skip("integration tests require mkfs.btrfs")
+	}
+	dir := t.TempDir()
+	img := filepath.Join(dir, "btrfs.img")
+	mnt := filepath.Join(dir, "mnt")
+	f, err := os.Create(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mkfs.btrfs refuses file systems smaller than 114 MiB
+	if err := f.Truncate(128 << 20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.Mkdir(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, cmd := range [][]string{{"mkfs.btrfs", "-q", img}, {"mount", "-o", "loop", img, mnt}} {
+		if out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput(); err != nil {
+			t.Fatalf("%v: %v: %s", cmd, err, out)
+		}
+	}
+	t.Cleanup(func() {
+		if out, err := exec.Command("umount", mnt).CombinedOutput(); err != nil {
+			t.Errorf("umount: %v: %s", err, out)
+		}
+	})
+	return mnt
+}
+
+func TestIntegration(t *testing.T) {
+	src := loopbackBtrfs(t)
+	dst := loopbackBtrfs(t)
+
+	j := job{
+		name:        "integration",
+		source:      node{address: "localhost", mountPoint: src, snapshotPath: "snapshot", snapshotRegex: defaultSnapshotRegex, executor: defaultExecutor},
+		destination: node{address: "localhost", mountPoint: dst, snapshotRegex: defaultSnapshotRegex, executor: defaultExecutor, cleanup: cleanupDelete},
+	}
+	data := filepath.Join(src, "data")
+	if _, err := j.source.run("btrfs", "subvolume", "create", data); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(src, "snapshot"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// each snapshot contains a file named after it
+	start := time.Date(2019, 1, 1, 3, 0, 0, 0, time.Local)
+	var names []string
+	snapshot := func(i int) string {
+		name, err := snapshotName(start.Add(time.Duration(i)*time.Hour), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(data, name), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := j.source.createSnapshot(data, name, false); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+		return name
+	}
+
+	// initial full transfer
+	if _, err := sendSnapshot(&j.source, &j.destination, snapshot(0), "", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// incremental transfers
+	snapshot(1)
+	snapshot(2)
+	st, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.run(st, options{}); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snapshots, names) {
+		t.Fatalf("unexpected destination snapshots: %v", snapshots)
+	}
+
+	// verify the contents of the received snapshots
+	for i, s := range snapshots {
+		for _, name := range names[:i+1] {
+			buf, err := os.ReadFile(filepath.Join(dst, s, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != name {
+				t.Errorf("unexpected content of %s in %s: %q", name, s, buf)
+			}
+		}
+	}
+
+	// nothing left to send
+	if err := j.run(st, options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := j.prune(retention{keep: 1}, deleteBatches{}, references{}, true, false); err != nil {
+		t.Fatal(err)
+	}
+	snapshots, err = j.destination.getSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snapshots, names[2:]) {
+		t.Errorf("unexpected destination snapshots after pruning: %v", snapshots)
+	}
+}
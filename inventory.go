@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// inventory is an Ansible-style hosts file. Hosts are organized in groups, variables can be set for all hosts, per
+// group and per host. Every host results in one job, eg:
+//
+//	[clients]
+//	laptop ssh_port=22
+//	desktop address=10.0.0.2 ssh_port=2222
+//
+//	[clients:vars]
+//	dst=localhost:0/srv/backup
+//	dst_snapshot_path={{.host}}/snapshot
+//
+// Variable values are Go templates which are executed with the variables of the host as well as "host" (name of the
+// host in the inventory) and "group" (first group containing the host).
+type inventory struct {
+	groups    map[string]*inventoryGroup
+	groupList []string // group names in order of appearance
+	hostList  []string // host names in order of appearance
+	hostVars  map[string]map[string]string
+}
+
+type inventoryGroup struct {
+	hosts    []string
+	children []string
+	vars     map[string]string
+}
+
+// inventoryDefaults are applied before any variables from the inventory.
+var inventoryDefaults = map[string]string{
+	"address":       "{{.host}}",
+	"ssh_port":      "22",
+	"mount_point":   "/mnt",
+	"snapshot_path": "snapshot",
+}
+
+func loadInventory(path string) (*inventory, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadInventory: %v", err)
+	}
+	defer f.Close()
+	inv, err := parseInventory(f)
+	if err != nil {
+		return nil, fmt.Errorf("loadInventory: %s: %v", path, err)
+	}
+	return inv, nil
+}
+
+func parseInventory(r io.Reader) (*inventory, error) {
+	inv := &inventory{
+		groups:   make(map[string]*inventoryGroup),
+		hostVars: make(map[string]map[string]string),
+	}
+
+	section, kind := "all", ""
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: invalid section: %s", lineNo, line)
+			}
+			section, kind = line[1:len(line)-1], ""
+			if i := strings.Index(section, ":"); i >= 0 {
+				section, kind = section[:i], section[i+1:]
+			}
+			if kind != "" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("line %d: invalid section type: %s", lineNo, kind)
+			}
+			inv.group(section)
+			continue
+		}
+
+		g := inv.group(section)
+		switch kind {
+		case "vars":
+			k, v, err := parseInventoryVar(line)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			g.vars[k] = v
+		case "children":
+			inv.group(line)
+			g.children = append(g.children, line)
+		default:
+			fields := strings.Fields(line)
+			host := fields[0]
+			if _, ok := inv.hostVars[host]; !ok {
+				inv.hostVars[host] = make(map[string]string)
+				inv.hostList = append(inv.hostList, host)
+			}
+			for _, field := range fields[1:] {
+				k, v, err := parseInventoryVar(field)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNo, err)
+				}
+				inv.hostVars[host][k] = v
+			}
+			g.hosts = append(g.hosts, host)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func parseInventoryVar(s string) (string, string, error) {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return "", "", fmt.Errorf("invalid variable: %s", s)
+	}
+	return strings.TrimSpace(s[:i]), strings.TrimSpace(s[i+1:]), nil
+}
+
+func (inv *inventory) group(name string) *inventoryGroup {
+	g, ok := inv.groups[name]
+	if !ok {
+		g = &inventoryGroup{vars: make(map[string]string)}
+		inv.groups[name] = g
+		inv.groupList = append(inv.groupList, name)
+	}
+	return g
+}
+
+// hostGroups returns all groups except "all" containing host, directly or via children, in order of appearance.
+func (inv *inventory) hostGroups(host string) []string {
+	var res []string
+	for _, name := range inv.groupList {
+		if name != "all" && inv.groupContains(name, host, 0) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+func (inv *inventory) groupContains(group, host string, depth int) bool {
+	if depth > len(inv.groupList) {
+		return false // cycle
+	}
+	g := inv.groups[group]
+	for _, h := range g.hosts {
+		if h == host {
+			return true
+		}
+	}
+	for _, c := range g.children {
+		if inv.groupContains(c, host, depth+1) {
+			return true
+		}
+	}
+	return false
+}
+
+// vars returns the rendered variables of host. Host variables take precedence over group variables which take
+// precedence over variables of the "all" group.
+func (inv *inventory) vars(host string) (map[string]string, error) {
+	raw := make(map[string]string)
+	for k, v := range inventoryDefaults {
+		raw[k] = v
+	}
+	if g, ok := inv.groups["all"]; ok {
+		for k, v := range g.vars {
+			raw[k] = v
+		}
+	}
+	groups := inv.hostGroups(host)
+	for _, name := range groups {
+		for k, v := range inv.groups[name].vars {
+			raw[k] = v
+		}
+	}
+	for k, v := range inv.hostVars[host] {
+		raw[k] = v
+	}
+
+	group := "all"
+	if len(groups) > 0 {
+		group = groups[0]
+	}
+
+	// Variables may reference each other, so render them repeatedly until the result is stable.
+	data := map[string]string{"host": host, "group": group}
+	for k, v := range raw {
+		data[k] = v
+	}
+	for pass := 0; pass <= len(raw); pass++ {
+		res := map[string]string{"host": host, "group": group}
+		for k, v := range raw {
+			t, err := template.New(k).Option("missingkey=error").Parse(v)
+			if err != nil {
+				return nil, fmt.Errorf("host %s: variable %s: %v", host, k, err)
+			}
+			var buf bytes.Buffer
+			if err := t.Execute(&buf, data); err != nil {
+				return nil, fmt.Errorf("host %s: variable %s: %v", host, k, err)
+			}
+			res[k] = buf.String()
+		}
+		if reflect.DeepEqual(res, data) {
+			return res, nil
+		}
+		data = res
+	}
+	return nil, fmt.Errorf("host %s: variables reference each other cyclically", host)
+}
+
+// jobs returns one job per host of the inventory.
+func (inv *inventory) jobs() ([]job, error) {
+	var jobs []job
+	for _, host := range inv.hostList {
+		vars, err := inv.vars(host)
+		if err != nil {
+			return nil, err
+		}
+
+		port, err := strconv.Atoi(vars["ssh_port"])
+		if err != nil {
+			return nil, fmt.Errorf("host %s: invalid ssh_port: %s", host, vars["ssh_port"])
+		}
+		if vars["dst"] == "" {
+			return nil, fmt.Errorf("host %s: dst not set", host)
+		}
+		destination, err := parseNode(vars["dst"])
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %v", host, err)
+		}
+		destination.snapshotPath = vars["dst_snapshot_path"]
+		destination.cryptDevice = vars["dst_crypt_device"]
+		destination.cleanup = vars["cleanup"]
+		destination.quarantineDir = vars["quarantine_dir"]
+		destination.incomingDir = vars["incoming_dir"]
+		destination.wrapper = vars["dst_wrapper"]
+		destination.compress = vars["compress"]
+		destination.filters, err = parseFilters(splitList(vars["filters"]))
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %v", host, err)
+		}
+		destination.stagingDir = vars["staging_dir"]
+		if vars["staging_max"] != "" {
+			destination.stagingMax, err = parseBytes(vars["staging_max"])
+			if err != nil {
+				return nil, fmt.Errorf("host %s: staging_max: %v", host, err)
+			}
+		}
+		if vars["bwlimit"] != "" {
+			destination.bwLimit, err = parseRate(vars["bwlimit"])
+			if err != nil {
+				return nil, fmt.Errorf("host %s: bwlimit: %v", host, err)
+			}
+		}
+
+		jobs = append(jobs, job{
+			name: host,
+			source: node{
+				address:      vars["address"],
+				sshPort:      port,
+				mountPoint:   vars["mount_point"],
+				snapshotPath: vars["snapshot_path"],
+			},
+			destination: destination,
+		})
+	}
+	return jobs, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInventoryJobs(t *testing.T) {
+	in := `
+# backup clients
+[laptops]
+laptop1
+laptop2 address=10.0.0.2 ssh_port=2222
+
+[servers]
+web mount_point=/data
+
+[clients:children]
+laptops
+servers
+
+[all:vars]
+dst=localhost:0/srv/backup
+dst_snapshot_path={{.group}}/{{.host}}
+
+[laptops:vars]
+snapshot_path=snapshots/{{.address}}
+
+[servers:vars]
+dst=nas:22/backup
+`
+	inv, err := parseInventory(strings.NewReader(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := inv.jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []job{
+		{
+			name:        "laptop1",
+			source:      node{address: "laptop1", sshPort: 22, mountPoint: "/mnt", snapshotPath: "snapshots/laptop1"},
+			destination: node{address: "localhost", sshPort: 0, mountPoint: "/srv/backup", snapshotPath: "laptops/laptop1"},
+		},
+		{
+			name:        "laptop2",
+			source:      node{address: "10.0.0.2", sshPort: 2222, mountPoint: "/mnt", snapshotPath: "snapshots/10.0.0.2"},
+			destination: node{address: "localhost", sshPort: 0, mountPoint: "/srv/backup", snapshotPath: "laptops/laptop2"},
+		},
+		{
+			name:        "web",
+			source:      node{address: "web", sshPort: 22, mountPoint: "/data", snapshotPath: "snapshot"},
+			destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "servers/web"},
+		},
+	}
+	if !reflect.DeepEqual(jobs, want) {
+		t.Errorf("unexpected jobs:\n%#v", jobs)
+	}
+}
+
+func TestInventoryErrors(t *testing.T) {
+	data := []string{
+		"[foo",
+		"[foo:bar]",
+		"host foo",
+		"host",                  // dst missing
+		"host dst=foo",          // invalid dst
+		"host dst={{.missing}}", // unknown variable
+		"host a={{.b}} b={{.a}} dst=localhost:0/mnt", // cycle
+	}
+
+	for di, d := range data {
+		inv, err := parseInventory(strings.NewReader(d))
+		if err == nil {
+			_, err = inv.jobs()
+		}
+		if err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+	}
+}
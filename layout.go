@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// layoutUbuntu is the subvolume layout created by the Ubuntu installer: the top-level subvolumes "@" (root) and "@home"
+// whose snapshots share one directory and are named after the subvolume, eg. @-2024-05-01 or @home-2024-05-01_03-00.
+const layoutUbuntu = "ubuntu"
+
+var ubuntuSubvolumes = []string{"@", "@home"}
+
+// layoutTimeshift is the directory structure of Timeshift in btrfs mode. Every snapshot is a directory named after its
+// creation time containing one subvolume per backed up subvolume, eg. timeshift-btrfs/snapshots/2024-05-01_12-00-01/@.
+const layoutTimeshift = "timeshift"
+
+var timeshiftSubvolumes = []string{"@"}
+
+var timeshiftSnapshotRegex = regexp.MustCompile(`^\d\d\d\d-\d\d-\d\d_\d\d-\d\d-\d\d$`)
+
+// subvolumeSnapshotRegex matches snapshots of subvol named <subvol>-<date>[_<time>][_<tag>].
+func subvolumeSnapshotRegex(subvol string) *regexp.Regexp {
+	return regexp.MustCompile(`^` + regexp.QuoteMeta(subvol) + `-\d\d\d\d-\d\d-\d\d(_\d\d-\d\d)?(_[a-zA-Z0-9-]+)?$`)
+}
+
+// expandLayout returns one job per subvolume of the layout. Every job only considers the snapshots of its subvolume and
+// stores them in a directory named after the subvolume at the destination. An empty subvols selects the default
+// subvolumes of the layout.
+func expandLayout(j job, layout string, subvols []string) ([]job, error) {
+	var defaults []string
+	switch layout {
+	case layoutUbuntu:
+		defaults = ubuntuSubvolumes
+	case layoutTimeshift:
+		defaults = timeshiftSubvolumes
+	default:
+		return nil, fmt.Errorf("unknown layout: %s", layout)
+	}
+	if len(subvols) == 0 {
+		subvols = defaults
+	}
+	var jobs []job
+	for _, subvol := range subvols {
+		if subvol == "" || path.Base(subvol) != subvol {
+			return nil, fmt.Errorf("invalid subvolume: %q", subvol)
+		}
+		sj := j
+		sj.name = j.name + "-" + subvol
+		sj.source.snapshotRegex = subvolumeSnapshotRegex(subvol)
+		if layout == layoutTimeshift {
+			// the destination mirrors the nested structure because received subvolumes keep their name
+			sj.source.snapshotRegex = timeshiftSnapshotRegex
+			sj.source.subvolume = subvol
+			sj.destination.subvolume = subvol
+		}
+		sj.destination.snapshotRegex = sj.source.snapshotRegex
+		sj.destination.snapshotPath = path.Join(j.destination.snapshotPath, subvol)
+		jobs = append(jobs, sj)
+	}
+	return jobs, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExpandLayout(t *testing.T) {
+	j := job{
+		name:        "laptop",
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshots"},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop"},
+	}
+	jobs, err := expandLayout(j, layoutUbuntu, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[0].name != "laptop-@" || jobs[1].name != "laptop-@home" ||
+		jobs[0].destination.snapshotPath != "laptop/@" || jobs[1].destination.snapshotPath != "laptop/@home" {
+		t.Fatalf("unexpected jobs: %#v", jobs)
+	}
+
+	subVolumes := []string{"snapshots/@-2024-05-01", "snapshots/@home-2024-05-01", "snapshots/@-2024-05-02_03-00", "snapshots/@-foo", "@"}
+	if res := filterSnapshots(subVolumes, "snapshots", jobs[0].source.snapshotRegex); !reflect.DeepEqual(res, []string{"@-2024-05-01", "@-2024-05-02_03-00"}) {
+		t.Errorf("unexpected snapshots of @: %v", res)
+	}
+	if res := filterSnapshots(subVolumes, "snapshots", jobs[1].source.snapshotRegex); !reflect.DeepEqual(res, []string{"@home-2024-05-01"}) {
+		t.Errorf("unexpected snapshots of @home: %v", res)
+	}
+
+	if _, err := expandLayout(j, "fedora", nil); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+	if _, err := expandLayout(j, layoutUbuntu, []string{"@/x"}); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+}
+
+func TestTimeshiftLayout(t *testing.T) {
+	j := job{
+		name:        "laptop",
+		source:      node{address: "localhost", mountPoint: "/run/timeshift/backup", snapshotPath: "timeshift-btrfs/snapshots"},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop"},
+	}
+	jobs, err := expandLayout(j, layoutTimeshift, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("unexpected jobs: %#v", jobs)
+	}
+	j = jobs[0]
+
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /run/timeshift/backup": "ID 1 gen 1 top level 5 path timeshift-btrfs/snapshots/2024-05-01_12-00-01/@\n" +
+			"ID 2 gen 2 top level 5 path timeshift-btrfs/snapshots/2024-05-01_12-00-01/@home\n" +
+			"ID 3 gen 3 top level 5 path timeshift-btrfs/snapshots/2024-05-02_12-00-01/@\n" +
+			"ID 4 gen 4 top level 5 path @\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":                  "ID 1 gen 1 top level 5 path laptop/@/2024-05-01_12-00-01/@\n",
+		"btrfs subvolume list -u -R /run/timeshift/backup":                 "ID 1 gen 1 top level 5 received_uuid - uuid a1 path timeshift-btrfs/snapshots/2024-05-01_12-00-01/@\n",
+		"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup":            "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/@/2024-05-01_12-00-01/@\n",
+		"ssh -C -p22 nas -- mkdir -p /backup/laptop/@/2024-05-02_12-00-01": "",
+		"btrfs send --quiet -p /run/timeshift/backup/timeshift-btrfs/snapshots/2024-05-01_12-00-01/@ /run/timeshift/backup/timeshift-btrfs/snapshots/2024-05-02_12-00-01/@ | ssh -C -p22 nas -- btrfs receive /backup/laptop/@/2024-05-02_12-00-01": "",
+	}}
+	j.source.executor = e
+	j.destination.executor = e
+
+	snapshots, generations, err := j.source.listSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snapshots, []string{"2024-05-01_12-00-01", "2024-05-02_12-00-01"}) || generations["2024-05-02_12-00-01"] != 3 {
+		t.Errorf("unexpected snapshots: %v %v", snapshots, generations)
+	}
+	if err := j.run(nil, options{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// listCommand prints the snapshots of every job and where they are present.
+func listCommand(args []string) {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	fs.Parse(args)
+	jf.setup()
+
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	st := jf.loadState()
+	failed := 0
+	for i := range jobs {
+		j := &jobs[i]
+		if len(jobs) > 1 {
+			fmt.Printf("%s:\n", j.name)
+		}
+		if err := j.list(os.Stdout, st); err != nil {
+			log.Printf("Job %s failed: %v", j.name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(jobs))
+	}
+}
+
+// list writes one line per snapshot present on either node of j, marking on which nodes it is present and whether it
+// is held in st.
+func (j *job) list(w io.Writer, st *state) error {
+	sourceSnapshots, err := j.source.getSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to get local snapshots: %v", err)
+	}
+	destinationSnapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+
+	atSource := make(map[string]bool)
+	atDestination := make(map[string]bool)
+	var all []string
+	for _, s := range sourceSnapshots {
+		atSource[s] = true
+		all = append(all, s)
+	}
+	for _, s := range destinationSnapshots {
+		atDestination[s] = true
+		if !atSource[s] {
+			all = append(all, s)
+		}
+	}
+	j.source.sortSnapshots(all)
+
+	mark := func(present bool, name string) string {
+		if present {
+			return name
+		}
+		return "-"
+	}
+	sourceHolds, destinationHolds := st.holds(&j.source), st.holds(&j.destination)
+	for _, s := range all {
+		line := fmt.Sprintf("%s\t%s\t%s", s, mark(atSource[s], "source"), mark(atDestination[s], "destination"))
+		if reason, ok := sourceHolds[s]; ok {
+			line += fmt.Sprintf("\theld at source: %s", reason)
+		}
+		if reason, ok := destinationHolds[s]; ok {
+			line += fmt.Sprintf("\theld at destination: %s", reason)
+		}
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// verifyCommand checks that the snapshots at the destination were received from the source.
+func verifyCommand(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	parallel := fs.Int("parallel", 1, "verify up to this many destinations concurrently")
+	full := fs.Bool("full", false, "compare all snapshots with the source, including those unchanged since their last verification")
+	fs.Parse(args)
+	jf.setup()
+	if *parallel < 1 {
+		log.Fatalf("invalid -parallel: %d", *parallel)
+	}
+
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	st := jf.loadState()
+	for i := range jobs {
+		jobs[i].source.executor = observerExecutor{jobs[i].source.executor}
+		jobs[i].destination.executor = observerExecutor{jobs[i].destination.executor}
+	}
+	failed := verifyJobs(jobs, st, *parallel, *full)
+	if st != nil {
+		if err := st.save(); err != nil {
+			log.Print(err)
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(jobs))
+	}
+}
+
+// verifyJobs verifies the jobs of up to parallel destinations concurrently and returns the number of failed jobs. The
+// jobs of a destination are verified one after another as they share its recorded generations.
+func verifyJobs(jobs []job, st *state, parallel int, full bool) int {
+	var mu sync.Mutex
+	failed := 0
+	verifyJob := func(i int) {
+		j := &jobs[i]
+		if len(jobs) > 1 {
+			log.Printf("Verifying job %s", j.name)
+		}
+		if err := j.verify(st, full); err != nil {
+			log.Printf("Job %s failed: %v", j.name, err)
+			mu.Lock()
+			failed++
+			mu.Unlock()
+		}
+	}
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, parallel)
+	for _, group := range destinationGroups(jobs) {
+		wg.Add(1)
+		go func(group []int) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			for _, i := range group {
+				verifyJob(i)
+			}
+		}(group)
+	}
+	wg.Wait()
+	return failed
+}
+
+// verify checks that every snapshot at the destination was received and, if the source still has a snapshot of the
+// same name, that it was received from that snapshot. A mismatch means that incremental transfers based on the
+// snapshot would fail or corrupt the destination. Snapshots which were made writable are flagged as well as snapshots
+// whose generation advanced since it was recorded in st: someone changed them after they were received, which silently
+// breaks incremental transfers based on them. The generations of snapshots verified for the first time are recorded
+// as well as the time every snapshot passed verification. Unless full, snapshots which passed before and didn't change
+// since aren't compared with the source again.
+func (j *job) verify(st *state, full bool) error {
+	drifts, _, destinationSnapshots, err := j.checkSnapshots(st, full)
+	if err != nil {
+		return err
+	}
+	for _, d := range drifts {
+		log.Printf("%s: %s", d.snapshot, d.reason)
+	}
+	if len(drifts) > 0 {
+		return fmt.Errorf("verify: %d of %d snapshots failed verification", len(drifts), len(destinationSnapshots))
+	}
+	log.Printf("Verified %d snapshots", len(destinationSnapshots))
+	return nil
+}
+
+// drift is a destination snapshot failing verification.
+type drift struct {
+	snapshot string
+	reason   string
+	missing  bool // the sub-volume of the snapshot wasn't found
+	// the snapshot is writable, but still received from the source and unmodified since its generation was recorded
+	resealable bool
+}
+
+// checkSnapshots returns the destination snapshots of j failing verification, see verify, as well as the snapshots of
+// the source and of the destination. Unless full, snapshots which passed verification before according to st and whose
+// generation didn't change since aren't compared with the source again, which saves listing the UUIDs of the source if
+// there are no new snapshots.
+func (j *job) checkSnapshots(st *state, full bool) ([]drift, []string, []string, error) {
+	sourceSnapshots, err := j.source.getSnapshots()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get local snapshots: %v", err)
+	}
+	destinationSnapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+	destinationInfos, err := j.destination.listSubvolumeInfo()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+
+	writable, err := j.destination.writableSnapshots()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+	isWritable := make(map[string]bool)
+	for _, s := range writable {
+		isWritable[s] = true
+	}
+	generations := st.generations(&j.destination)
+	verified := st.verified(&j.destination)
+
+	unchanged := make(map[string]bool)
+	compare := false
+	for _, s := range destinationSnapshots {
+		info, ok := findInfo(destinationInfos, path.Join(j.destination.snapshotPath, s, j.destination.subvolume))
+		unchanged[s] = !full && ok && !verified[s].IsZero() && generations[s] == info.generation
+		compare = compare || !unchanged[s]
+	}
+	sourceUUIDs := make(map[string]string)
+	sourceReceived := make(map[string]string)
+	if compare {
+		sourceInfos, err := j.source.listSubvolumeInfo()
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to get local snapshots: %v", err)
+		}
+		for _, s := range sourceSnapshots {
+			if info, ok := findInfo(sourceInfos, path.Join(j.source.snapshotPath, s, j.source.subvolume)); ok {
+				sourceUUIDs[s], sourceReceived[s] = info.uuid, info.receivedUUID
+			}
+		}
+	}
+	var drifts []drift
+	now := time.Now()
+	for _, s := range destinationSnapshots {
+		info, ok := findInfo(destinationInfos, path.Join(j.destination.snapshotPath, s, j.destination.subvolume))
+		modified := ok && generations != nil && generations[s] != 0 && info.generation > generations[s]
+		// snapshots sent back to the source after a failover, see reverseSync, were created at the destination; an
+		// unchanged one was found to be sent back before
+		reversed := info.receivedUUID == "-" && !isWritable[s] && (unchanged[s] || sourceReceived[s] == info.uuid)
+		n := len(drifts)
+		switch {
+		case !ok:
+			drifts = append(drifts, drift{snapshot: s, reason: "sub-volume not found", missing: true})
+		case info.receivedUUID == "-" && isWritable[s]:
+			drifts = append(drifts, drift{snapshot: s, reason: "partially received, see send -clean-partial"})
+		case info.receivedUUID == "-" && !reversed:
+			drifts = append(drifts, drift{snapshot: s, reason: "not received"})
+		case !unchanged[s] && !reversed && sourceUUIDs[s] != "" && info.receivedUUID != sourceUUIDs[s]:
+			drifts = append(drifts, drift{snapshot: s, reason: fmt.Sprintf("received from %s instead of the source snapshot %s", info.receivedUUID, sourceUUIDs[s])})
+		case modified:
+			drifts = append(drifts, drift{snapshot: s, reason: fmt.Sprintf("modified after it was received, generation %d advanced from %d", info.generation, generations[s])})
+		case isWritable[s]:
+			drifts = append(drifts, drift{snapshot: s, reason: "writable, changes break incremental transfers based on it", resealable: generations[s] != 0})
+		case generations != nil && generations[s] == 0:
+			generations[s] = info.generation
+		}
+		if verified != nil && len(drifts) == n {
+			verified[s] = now
+		}
+	}
+	present := make(map[string]bool)
+	for _, s := range destinationSnapshots {
+		present[s] = true
+	}
+	for s := range generations {
+		if !present[s] {
+			delete(generations, s)
+		}
+	}
+	for s := range verified {
+		if !present[s] {
+			delete(verified, s)
+		}
+	}
+	st.setGenerations(&j.destination, generations)
+	st.setVerified(&j.destination, verified)
+	return drifts, sourceSnapshots, destinationSnapshots, nil
+}
+
+// findInfo returns the sub-volume at p relative to the mount point.
+func findInfo(infos []subvolumeInfo, p string) (subvolumeInfo, bool) {
+	for _, info := range infos {
+		if path.Clean(info.path) == path.Clean(p) {
+			return info, true
+		}
+	}
+	return subvolumeInfo{}, false
+}
+
+// statusCommand reports the replication status of every job and the result of its last run recorded in the state.
+func statusCommand(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	fs.Parse(args)
+	jf.setup()
+
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	st := jf.loadState()
+	failed := 0
+	for i := range jobs {
+		j := &jobs[i]
+		j.source.executor = observerExecutor{j.source.executor}
+		j.destination.executor = observerExecutor{j.destination.executor}
+		if err := j.observe(false, time.Now()); err != nil {
+			log.Printf("Job %s failed: %v", j.name, err)
+			failed++
+			continue
+		}
+		if st != nil {
+			log.Printf("%s: %s", j.name, describeRun(st.Runs[j.key()]))
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(jobs))
+	}
+}
+
+// describeRun summarizes a run recorded in the state.
+func describeRun(r *runRecord) string {
+	switch {
+	case r == nil:
+		return "no run recorded"
+	case r.Finished.IsZero():
+		return fmt.Sprintf("last run started %s was interrupted after sending %d of %d snapshots",
+			r.Started.Format(time.RFC3339), len(r.Completed), len(r.Planned))
+	default:
+		return fmt.Sprintf("last run finished %s, sent %d snapshots, %s transmitted",
+			r.Finished.Format(time.RFC3339), len(r.Completed), formatBytes(r.Transmitted))
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestList(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                       "ID 1 gen 1 top level 5 path snapshot/2\nID 2 gen 2 top level 5 path snapshot/3\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup": "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+	st := &state{Holds: map[string]map[string]string{j.destination.key(): {"1": "audit"}}}
+
+	var buf bytes.Buffer
+	if err := j.list(&buf, st); err != nil {
+		t.Fatal(err)
+	}
+	want := "1\t-\tdestination\theld at destination: audit\n2\tsource\tdestination\n3\tsource\t-\n"
+	if buf.String() != want {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestVerify(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                             "ID 1 gen 1 top level 5 path snapshot/2\nID 2 gen 2 top level 5 path snapshot/3\n",
+		"btrfs subvolume list -u -R /mnt":                       "ID 1 gen 1 top level 5 received_uuid - uuid a2 path snapshot/2\nID 2 gen 2 top level 5 received_uuid - uuid a3 path snapshot/3\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":       "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+		"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup": "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid a2 uuid b2 path laptop/2\n",
+		"ssh -C -p22 nas -- btrfs subvolume list -r /backup":    "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: observerExecutor{e}},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: observerExecutor{e}},
+	}
+	if err := j.verify(nil, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// the generations are recorded on the first verification
+	st := &state{}
+	if err := j.verify(st, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if g := st.Generations["nas:22/backup/laptop"]; !reflect.DeepEqual(g, map[string]int{"1": 1, "2": 2}) {
+		t.Errorf("unexpected generations: %v", st.Generations)
+	}
+
+	// 2 was modified after it was received
+	e.out["ssh -C -p22 nas -- btrfs subvolume list -u -R /backup"] = "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 7 top level 5 received_uuid a2 uuid b2 path laptop/2\n"
+	if err := j.verify(st, false); err == nil {
+		t.Error("expected error but succeeded")
+	}
+
+	// 2 is writable
+	e.out["ssh -C -p22 nas -- btrfs subvolume list -r /backup"] = "ID 1 gen 1 top level 5 path laptop/1\n"
+	if err := j.verify(nil, false); err == nil {
+		t.Error("expected error but succeeded")
+	}
+	e.out["ssh -C -p22 nas -- btrfs subvolume list -r /backup"] = "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n"
+
+	// 2 was received from another snapshot, 1 was created locally
+	e.out["ssh -C -p22 nas -- btrfs subvolume list -u -R /backup"] = "ID 1 gen 1 top level 5 received_uuid - uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid a3 uuid b2 path laptop/2\n"
+	if err := j.verify(nil, false); err == nil {
+		t.Error("expected error but succeeded")
+	}
+}
+
+func TestVerifyJobs(t *testing.T) {
+	r := regexp.MustCompile(`^\d$`)
+	var jobs []job
+	for _, host := range []string{"nas", "usb", "offsite"} {
+		received := "a1"
+		if host == "usb" {
+			received = "-"
+		}
+		e := &mapExecutor{out: map[string]string{
+			"btrfs subvolume list /mnt":                                      "ID 1 gen 1 top level 5 path snapshot/1\n",
+			"btrfs subvolume list -u -R /mnt":                                "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\n",
+			"ssh -C -p22 " + host + " -- btrfs subvolume list /backup":       "ID 1 gen 3 top level 5 path laptop/1\n",
+			"ssh -C -p22 " + host + " -- btrfs subvolume list -u -R /backup": "ID 1 gen 3 top level 5 received_uuid " + received + " uuid b1 path laptop/1\n",
+			"ssh -C -p22 " + host + " -- btrfs subvolume list -r /backup":    "ID 1 gen 3 top level 5 path laptop/1\n",
+		}}
+		jobs = append(jobs, job{
+			name:        host,
+			source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+			destination: node{address: host, sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+		})
+	}
+
+	for _, parallel := range []int{1, 2, 3} {
+		st := &state{}
+		if failed := verifyJobs(jobs, st, parallel, false); failed != 1 {
+			t.Errorf("parallel %d: unexpected number of failed jobs: %d", parallel, failed)
+		}
+		for _, host := range []string{"nas", "offsite"} {
+			if g := st.Generations[host+":22/backup/laptop"]; !reflect.DeepEqual(g, map[string]int{"1": 3}) {
+				t.Errorf("parallel %d: unexpected generations of %s: %v", parallel, host, g)
+			}
+		}
+	}
+}
+
+func TestVerifyDifferential(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                             "ID 1 gen 1 top level 5 path snapshot/1\nID 2 gen 2 top level 5 path snapshot/2\n",
+		"btrfs subvolume list -u -R /mnt":                       "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\nID 2 gen 2 top level 5 received_uuid - uuid a2 path snapshot/2\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":       "ID 1 gen 1 top level 5 path laptop/1\n",
+		"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup": "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\n",
+		"ssh -C -p22 nas -- btrfs subvolume list -r /backup":    "ID 1 gen 1 top level 5 path laptop/1\n",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+	st := &state{}
+	if err := j.verify(st, false); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if v := st.Verified["nas:22/backup/laptop"]; len(v) != 1 || v["1"].IsZero() {
+		t.Errorf("unexpected verified snapshots: %v", st.Verified)
+	}
+
+	// 1 is unchanged since it was verified, the source UUIDs aren't listed again
+	sourceUUIDs := "btrfs subvolume list -u -R /mnt"
+	if err := j.verify(st, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if e.calls[sourceUUIDs] != 1 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+	if err := j.verify(st, true); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if e.calls[sourceUUIDs] != 2 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+
+	// 2 is new and received from another snapshot
+	e.out["ssh -C -p22 nas -- btrfs subvolume list /backup"] = "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n"
+	e.out["ssh -C -p22 nas -- btrfs subvolume list -u -R /backup"] = "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid a9 uuid b2 path laptop/2\n"
+	e.out["ssh -C -p22 nas -- btrfs subvolume list -r /backup"] = "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n"
+	if err := j.verify(st, false); err == nil {
+		t.Error("expected error but succeeded")
+	}
+	if e.calls[sourceUUIDs] != 3 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+	if v := st.Verified["nas:22/backup/laptop"]; len(v) != 1 {
+		t.Errorf("unexpected verified snapshots: %v", v)
+	}
+}
+
+func TestDescribeRun(t *testing.T) {
+	started := time.Date(2024, 6, 1, 3, 0, 0, 0, time.UTC)
+	data := []struct {
+		run  *runRecord
+		want string
+	}{
+		{nil, "no run recorded"},
+		{&runRecord{Started: started, Planned: []string{"1", "2"}, Completed: []string{"1"}}, "last run started 2024-06-01T03:00:00Z was interrupted after sending 1 of 2 snapshots"},
+		{&runRecord{Started: started, Finished: started.Add(time.Minute), Planned: []string{"1"}, Completed: []string{"1"}, Transmitted: 1024}, "last run finished 2024-06-01T03:01:00Z, sent 1 snapshots, 1.0 kiB transmitted"},
+	}
+	for di, d := range data {
+		if res := describeRun(d.run); res != d.want {
+			t.Errorf("%d: unexpected result: %s", di, res)
+		}
+	}
+}
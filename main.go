@@ -10,9 +10,11 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
-	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -20,56 +22,1062 @@ import (
 type node struct {
 	address       string         // address of the system (either IP or hostname)
 	sshPort       int            // SSH port (0 for localhost)
+	conn          *connection    // connection profile providing address and sshPort, nil if they are given directly
+	ssh           sshOptions     // ssh options, overriding the ones of conn
 	mountPoint    string         // BTRFS mount point
 	snapshotPath  string         // directory containing snapshots relative to mount point
 	snapshotRegex *regexp.Regexp // used to match snapshots
+	timeLayout    string         // layout of the time in snapshot names matched by snapshotRegex, empty if names sort chronologically
+	nameLayout    string         // time layout of the names of snapshots created by this tool, empty for the default naming
+	origin        string         // subvolume snapshotted when creating snapshots, empty for /
 	executor      executor       // used to run commands
+	bwLimit       int            // maximum bytes per second sent to this node, 0 means unlimited
+	cryptDevice   string         // unlocked device which must be mounted at mountPoint, empty if not encrypted
+	cleanup       string         // handling of snapshots whose receive failed, defaults to cleanupDelete
+	quarantineDir string         // directory relative to mount point receiving quarantined snapshots
+	incomingDir   string         // directory relative to mount point receiving snapshots before they are moved into place, empty receives in place
+	subvolume     string         // subvolume inside each snapshot directory, eg. @ for Timeshift, empty if snapshots are subvolumes
+	wrapper       string         // command forced by authorized_keys, remote commands are sent to it on stdin
+	filters       []filter       // applied to the stream sent to this node
+	compress      string         // compression of the stream sent to this node over ssh: zstd, gzip or empty
+	archive       bool           // streams sent to this node are stored as files instead of being received
+	encryption    encryption     // recipients the streams stored in an archive are encrypted for
+	fullEvery     time.Duration  // interval after which a snapshot is sent to an archive in full instead of incrementally
+	fullTag       string         // snapshots with this tag are sent to an archive in full
+	maxChain      int            // maximum number of incremental streams following a full send in an archive
+	weight        int            // share of the total bandwidth relative to other destinations, 0 counts as 1
+	s3            *s3Bucket      // bucket holding the archive, nil unless the node is an archive in object storage
+	stagingDir    string         // local directory staging streams sent to this node, empty disables staging
+	stagingMax    int            // maximum number of bytes in stagingDir, 0 means unlimited
+	uploadRetries int            // number of times an interrupted upload of a staged stream is resumed within a run
+	sendRetries   int            // number of times a transfer failing with a retryable error is retried, see retryable
+	sendArgs      []string       // additional arguments of btrfs send of streams sent to this node, see sendFlags
+	receiveArgs   []string       // additional arguments of btrfs receive at this node, see receiveFlags
+	onBattery     usagePolicy    // how jobs sending to this node run while the local host is on battery
+	onMetered     usagePolicy    // how jobs sending to this node run while the local host is on a metered connection
+}
+
+const (
+	cleanupDelete     = "delete"     // delete the partially received snapshot
+	cleanupKeep       = "keep"       // keep the partially received snapshot for inspection
+	cleanupRename     = "rename"     // rename the partially received snapshot to <name>.partial
+	cleanupQuarantine = "quarantine" // move the partially received snapshot to the quarantine directory
+)
+
+const defaultQuarantineDir = ".quarantine"
+
+// job replicates the snapshots of a source node to a destination node.
+type job struct {
+	name        string
+	source      node
+	destination node
+}
+
+// options control how jobs are run.
+type options struct {
+	dryRun          bool
+	checkRemote     bool   // run side effect free commands on the nodes during a dry run
+	generationOrder string // handling of snapshots whose generation contradicts their name
+	matchUUID       bool   // match destination snapshots to source snapshots by UUID instead of by name
+	maxClockSkew    time.Duration
+	clockSkewAction string // what to do if the clock skew of a remote node exceeds maxClockSkew
+	snapshot        string // if set, only this snapshot is sent
+	order           string // order in which missing snapshots are sent
+	backfill        bool   // send historical snapshots missing at the destination after the recent ones
+	backfillBudget  int    // maximum bytes sent per run when backfilling, 0 means unlimited
+	backfillWindow  *timeWindow
+	verbose         bool
+	notify          string            // URL receiving a report of every run
+	sendBatch       int               // maximum number of consecutive snapshots sent with one btrfs send invocation
+	createBefore    bool              // create a snapshot of the origin of the source before sending
+	repairReadOnly  bool              // make unmodified writable source snapshots read-only before sending
+	cleanPartial    bool              // dispose of partial receives at the destination before sending
+	saveMetadata    bool              // store the metadata of the source at the destination after sending
+	conditions      conditions        // runs are deferred unless these are met
+	bootstrap       string            // bootstrapOldest or bootstrapNewest to initialize an empty destination, empty fails instead
+	prune           retention         // prunes the nodes of each job selected by pruneOn after its transfers, empty disables pruning
+	pruneOn         string            // pruneDestination, pruneSource or pruneBoth
+	sched           *scheduler        // coordinates prunes with transfers, nil if prunes are disabled
+	pause           *pauser           // pauses transfers between snapshots, nil if the daemon cannot be paused
+	metrics         *metrics          // collects run statistics, nil disables them
+	metricsFile     string            // metrics are written to this file after every run, empty disables it
+	transfers       *transferRegistry // in-flight transfers which can be cancelled, nil if they cannot be cancelled
+	parallel        int               // number of destinations sent to concurrently, 0 or 1 sends to one at a time
+	totalBWLimit    int               // maximum bytes per second of all transfers together, shared by weight, 0 means unlimited
+}
+
+// commands are the subcommands with a short description, in the order they are listed by help.
+var commands = [][2]string{
+	{"send", "send missing snapshots to the destination (default)"},
+	{"list", "list snapshots and where they are present"},
+	{"create", "create a snapshot, alias of snapshot"},
+	{"snapshot", "create a tagged snapshot and optionally send it"},
+	{"prune", "delete old snapshots at the destination"},
+	{"verify", "check that destination snapshots were received from the source"},
+	{"reseal", "repair destination snapshots which were made writable or modified"},
+	{"metadata", "print the metadata of the source stored at the destination"},
+	{"status", "report the replication status and the last run"},
+	{"observe", "report the replication status without modifying any node"},
+	{"restore", "restore a snapshot from the destination"},
+	{"restore-file", "restore single files from a destination snapshot"},
+	{"dr-restore", "restore the source onto a blank file system after losing it"},
+	{"promote", "create a writable clone of a destination snapshot for failover"},
+	{"reverse-sync", "send the changes made to a promoted clone back to the source"},
+	{"receive-archive", "receive the streams of an archive without a job"},
+	{"retention", "simulate retention policies"},
+	{"plan", "write a plan of sends and prunes for review"},
+	{"apply", "execute a plan"},
+	{"adopt", "adopt existing backups"},
+	{"migrate", "print the configuration file equivalent to the flags"},
+	{"selftest", "send a temporary snapshot to test the setup"},
+	{"hold", "pin snapshots against pruning"},
+	{"release", "remove holds"},
+	{"repair-readonly", "make writable source snapshots read-only if they are unmodified"},
+	{"pause", "pause the transfers of a daemon after the current snapshot"},
+	{"resume", "resume the transfers of a paused daemon"},
+	{"cancel", "cancel the in-flight transfer of a job of a daemon"},
+	{"queue", "show the pending, running and recently finished transfers of a daemon"},
+	{"receive-server", "receive snapshots as a command forced by authorized_keys"},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: btrfs-backup [command] [flags]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-15s %s\n", c[0], c[1])
+	}
+	fmt.Fprintf(os.Stderr, "\nRun btrfs-backup <command> -h for the flags of a command.\n")
 }
 
 func main() {
-	dryRun := flag.Bool("n", false, "dry run")
-	dst := flag.String("dst", "", "destination host:port/path")
-	dstSnapshotPath := flag.String("dst-snapshot-path", "", "directory containing snapshots relative to mount point")
-	verbose := flag.Bool("v", false, "verbose output")
-	progress := flag.Bool("progress", false, "show transfer progress")
-	flag.Parse()
-
-	defaultExecutor.verbose = *verbose
-	defaultExecutor.logProgress = *progress
-
-	snapshotRegex := regexp.MustCompile(`^\d\d\d\d-\d\d-\d\d_\d\d-\d\d$`)
-	source := node{
-		address:       "localhost",
-		sshPort:       0,
-		mountPoint:    "/mnt",
-		snapshotPath:  "snapshot",
-		snapshotRegex: snapshotRegex,
-		executor:      defaultExecutor,
-	}
-
-	destination, err := parseNode(*dst)
+	args := os.Args[1:]
+	command := "send"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
+	switch command {
+	case "send":
+		sendCommand(args)
+	case "list":
+		listCommand(args)
+	case "create", "snapshot":
+		snapshotCommand(args)
+	case "verify":
+		verifyCommand(args)
+	case "status":
+		statusCommand(args)
+	case "restore":
+		restoreCommand(args)
+	case "restore-file":
+		restoreFileCommand(args)
+	case "dr-restore":
+		drRestoreCommand(args)
+	case "promote":
+		promoteCommand(args)
+	case "reverse-sync":
+		reverseSyncCommand(args)
+	case "prune":
+		pruneCommand(args)
+	case "retention":
+		retentionCommand(args)
+	case "plan":
+		planCommand(args)
+	case "apply":
+		applyCommand(args)
+	case "adopt":
+		adoptCommand(args)
+	case "migrate":
+		migrateCommand(args)
+	case "observe":
+		observeCommand(args)
+	case "receive-server":
+		receiveServerCommand(args)
+	case "receive-archive":
+		receiveArchiveCommand(args)
+	case "selftest":
+		selftestCommand(args)
+	case "hold":
+		holdCommand(args)
+	case "release":
+		releaseCommand(args)
+	case "reseal":
+		resealCommand(args)
+	case "metadata":
+		metadataCommand(args)
+	case "repair-readonly":
+		repairReadOnlyCommand(args)
+	case "pause":
+		pauseCommand(args)
+	case "resume":
+		resumeCommand(args)
+	case "cancel":
+		cancelCommand(args)
+	case "queue":
+		queueCommand(args)
+	case "help":
+		usage()
+	default:
+		usage()
+		log.Fatalf("unknown command: %s", command)
+	}
+	if defaultExecutor.ssh != nil {
+		defaultExecutor.ssh.close()
+	}
+}
+
+// jobFlags are the flags shared by all commands operating on jobs.
+type jobFlags struct {
+	dst              *string
+	dstSnapshotPath  *string
+	src              *string
+	dstCryptDevice   *string
+	cleanup          *string
+	quarantineDir    *string
+	incomingDir      *string
+	dstWrapper       *string
+	filter           *string
+	compress         *string
+	archive          *bool
+	ageRecipients    *string
+	gpgRecipients    *string
+	fullEvery        *string
+	fullTag          *string
+	s3Endpoint       *string
+	s3Profile        *string
+	s3StorageClass   *string
+	maxChain         *int
+	stagingDir       *string
+	stagingMax       *string
+	uploadRetries    *int
+	sendRetries      *int
+	sendArgs         *string
+	receiveArgs      *string
+	bwLimit          *string
+	onBattery        *string
+	onMetered        *string
+	sshUser          *string
+	sshKey           *string
+	sshKnownHosts    *string
+	sshStrict        *string
+	sshCompression   *string
+	sshTimeout       *time.Duration
+	sshArgs          *string
+	nativeSSH        *bool
+	snapshotPattern  *string
+	timeLayout       *string
+	nameLayout       *string
+	allow            *string
+	record           *string
+	replay           *string
+	inventory        *string
+	config           *string
+	profile          *string
+	state            *string
+	verbose          *bool
+	progress         *bool
+	progressInterval *time.Duration
+	commandTimeout   *time.Duration
+	listTimeout      *time.Duration
+	stallTimeout     *time.Duration
+	units            *string
+	precision        *int
+}
+
+func addJobFlags(fs *flag.FlagSet) *jobFlags {
+	return &jobFlags{
+		dst:              fs.String("dst", "", "comma separated list of destinations host:port/path, every snapshot is sent to all of them"),
+		dstSnapshotPath:  fs.String("dst-snapshot-path", "", "directory containing snapshots relative to mount point"),
+		src:              fs.String("src", "localhost:0/mnt", "comma separated list of sources host:port/path, a path is local; snapshots of several sources are kept in a directory per host"),
+		dstCryptDevice:   fs.String("dst-crypt-device", "", "unlocked encrypted device, eg. /dev/mapper/backup, which must be mounted at the destination"),
+		cleanup:          fs.String("cleanup", cleanupDelete, "handling of snapshots whose receive failed: delete, keep, rename (to <name>.partial) or quarantine"),
+		dstWrapper:       fs.String("dst-wrapper", "", "command forced by authorized_keys at the destination, eg. \"btrfs-backup receive-server\""),
+		stagingDir:       fs.String("staging-dir", "", "local directory to write streams to before uploading them resumably to the destination"),
+		stagingMax:       fs.String("staging-max", "", "maximum size of the staging directory, eg. 100GiB"),
+		sendArgs:         fs.String("send-args", "", "space separated additional arguments of btrfs send, eg. \"--proto 2 --compressed-data\""),
+		receiveArgs:      fs.String("receive-args", "", "space separated additional arguments of btrfs receive at the destination, eg. \"--max-errors 10\""),
+		uploadRetries:    fs.Int("upload-retries", 0, "number of times an interrupted upload of a staged stream is resumed within a run"),
+		sendRetries:      fs.Int("send-retries", 0, "number of times a transfer failing transiently, eg. on a reset ssh connection, is retried with exponential backoff"),
+		bwLimit:          fs.String("bwlimit", "", "maximum rate sent to the destination of every job, eg. 20MiB/s, overriding the configuration"),
+		onBattery:        fs.String("dst-on-battery", usageRun, "how jobs run while on battery: run, skip or a maximum rate like 1MB/s"),
+		onMetered:        fs.String("dst-on-metered", usageRun, "how jobs run while on a metered connection: run, skip or a maximum rate like 1MB/s"),
+		sshUser:          fs.String("ssh-user", "", "ssh login name at the destination, eg. a dedicated backup user"),
+		sshKey:           fs.String("ssh-key", "", "ssh identity file used to connect to the destination"),
+		sshKnownHosts:    fs.String("ssh-known-hosts", "", "known_hosts file used to verify the destination"),
+		sshStrict:        fs.String("ssh-strict-host-key-checking", "", "ssh host key checking of the destination: yes, no or accept-new"),
+		sshCompression:   fs.String("ssh-compression", "", "ssh compression of the connection to the destination: yes or no, by default unless -compress is set"),
+		sshTimeout:       fs.Duration("ssh-connect-timeout", 0, "timeout for establishing ssh connections to the destination, in whole seconds"),
+		sshArgs:          fs.String("ssh-args", "", "space separated additional ssh arguments, eg. \"-o ServerAliveInterval=30\""),
+		nativeSSH:        fs.Bool("native-ssh", false, "run remote commands with the built-in ssh client instead of the ssh binary, ignoring the ssh client configuration"),
+		compress:         fs.String("compress", "", "compress the stream sent to a remote destination and decompress it before btrfs receive: zstd (falling back to gzip if unavailable) or gzip"),
+		archive:          fs.Bool("archive", false, "store the streams sent to the destination as files instead of receiving them"),
+		ageRecipients:    fs.String("age-recipients", "", "with -archive: comma separated age recipients the stored streams are encrypted for"),
+		gpgRecipients:    fs.String("gpg-recipients", "", "with -archive: comma separated GPG keys the stored streams are encrypted for"),
+		s3Endpoint:       fs.String("s3-endpoint", "", "with an s3:// destination: endpoint URL of S3-compatible storage"),
+		s3Profile:        fs.String("s3-profile", "", "with an s3:// destination: aws CLI profile holding the credentials"),
+		s3StorageClass:   fs.String("s3-storage-class", "", "with an s3:// destination: storage class of uploaded streams, eg. STANDARD_IA"),
+		fullEvery:        fs.String("full-every", "", "with -archive: send a snapshot in full once the last full send is older than this, eg. 30d"),
+		fullTag:          fs.String("full-tag", "", "with -archive: send snapshots with this tag in full, eg. monthly"),
+		maxChain:         fs.Int("max-chain", 0, "with -archive: send a snapshot in full once this many incremental streams follow the last full send"),
+		filter:           fs.String("filter", "", "comma separated chain of filters applied to the stream sent to the destination, eg. \"exec:zstd -c\""),
+		snapshotPattern:  fs.String("snapshot-pattern", "", "regular expression matching snapshot names, the first group captures the time parsed with -snapshot-time-layout"),
+		timeLayout:       fs.String("snapshot-time-layout", "", "Go time layout of the time in snapshot names, eg. 2006-01-02T15:04:05Z07:00; snapshots are ordered by it"),
+		nameLayout:       fs.String("snapshot-name-layout", "", "Go time layout of the names of created snapshots, eg. root.2006-01-02T15:04:05Z07:00; defaults to -snapshot-time-layout"),
+		allow:            fs.String("allow", "", "comma separated list of directories the tool may read, receive into or delete under"),
+		quarantineDir:    fs.String("quarantine-dir", defaultQuarantineDir, "directory relative to the destination mount point receiving quarantined snapshots"),
+		incomingDir:      fs.String("incoming-dir", "", "directory relative to the destination mount point receiving snapshots, which are moved into place once complete, eg. .incoming"),
+		inventory:        fs.String("inventory", "", "inventory file defining one job per host"),
+		config:           fs.String("config", "", "configuration file defining jobs"),
+		profile:          fs.String("profile", "", "with -config: only use the jobs, retention and schedule of this profile"),
+		state:            fs.String("state", "", "state file used to cache destination listings between runs"),
+		verbose:          fs.Bool("v", false, "verbose output"),
+		progress:         fs.Bool("progress", false, "show transfer progress"),
+		commandTimeout:   fs.Duration("command-timeout", 0, "stop commands running longer, eg. 12h: SIGTERM, SIGKILL after 10s and killing their remote processes; 0 disables the timeout"),
+		listTimeout:      fs.Duration("list-timeout", 0, "stop commands transferring no stream, eg. listing or deleting snapshots, running longer, eg. 10m; 0 applies -command-timeout"),
+		stallTimeout:     fs.Duration("stall-timeout", 0, "stop transfers which make no progress for this long, eg. 15m; 0 disables the watchdog"),
+		progressInterval: fs.Duration("progress-interval", time.Minute, "time between progress log lines if stderr is not a terminal, at least 10s"),
+		record:           fs.String("record", "", "record the results of all commands to this file"),
+		replay:           fs.String("replay", "", "replay the results of commands recorded with -record instead of running them"),
+		units:            fs.String("units", "iec", "units used to print sizes: iec (MiB) or si (MB)"),
+		precision:        fs.Int("precision", 1, "number of decimal places used to print sizes"),
+	}
+}
+
+// setup applies the output flags.
+func (f *jobFlags) setup() {
+	defaultExecutor.verbose = *f.verbose
+	defaultExecutor.logProgress = *f.progress
+	defaultExecutor.progressInterval = *f.progressInterval
+	defaultExecutor.timeout = *f.commandTimeout
+	defaultExecutor.listTimeout = *f.listTimeout
+	defaultExecutor.stallTimeout = *f.stallTimeout
+	if defaultExecutor.ssh != nil {
+		defaultExecutor.ssh.close()
+		defaultExecutor.ssh = nil
+	}
+	if *f.nativeSSH {
+		defaultExecutor.ssh = newNativeSSH()
+	}
+
+	if *f.units != "iec" && *f.units != "si" {
+		log.Fatalf("invalid -units: %s", *f.units)
+	}
+	if *f.precision < 0 {
+		log.Fatalf("invalid -precision: %d", *f.precision)
+	}
+	defaultByteFormat = byteFormat{si: *f.units == "si", precision: *f.precision}
+}
+
+// loadJobs returns the jobs defined by the configuration file, the inventory or the flags, in this order.
+func (f *jobFlags) loadJobs() ([]job, error) {
+	var jobs []job
+	allowlist := splitList(*f.allow)
+	var rec *recording
+	var replay executor
+	if *f.record != "" && *f.replay != "" {
+		return nil, fmt.Errorf("-record and -replay are mutually exclusive")
+	}
+	if *f.record != "" {
+		rec = &recording{path: *f.record}
+	}
+	if *f.replay != "" {
+		r, err := loadRecording(*f.replay)
+		if err != nil {
+			return nil, err
+		}
+		replay = newReplayExecutor(r)
+	}
+	if configPath := f.configPath(); configPath != "" {
+		c, err := loadConfig(configPath)
+		if err != nil {
+			return nil, err
+		}
+		allowlist = append(allowlist, c.Allow...)
+		if *f.profile != "" {
+			jobs, err = c.profileJobs(*f.profile)
+		} else {
+			jobs, err = c.jobs()
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if *f.profile != "" {
+		return nil, fmt.Errorf("-profile requires -config")
+	} else if *f.inventory != "" {
+		inv, err := loadInventory(*f.inventory)
+		if err != nil {
+			return nil, err
+		}
+		jobs, err = inv.jobs()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		source := node{
+			address:      "localhost",
+			sshPort:      0,
+			mountPoint:   "/mnt",
+			snapshotPath: "snapshot",
+		}
+		if *f.snapshotPattern != "" {
+			r, err := regexp.Compile(*f.snapshotPattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid -snapshot-pattern: %v", err)
+			}
+			source.snapshotRegex = r
+		}
+		if *f.timeLayout != "" && *f.snapshotPattern == "" {
+			return nil, fmt.Errorf("-snapshot-time-layout requires -snapshot-pattern")
+		}
+		source.timeLayout = *f.timeLayout
+		source.nameLayout = *f.nameLayout
+
+		sources, err := parseSources(*f.src)
+		if err != nil {
+			return nil, err
+		}
+		var destinations []node
+		names := make(map[string]bool)
+		for _, dst := range splitList(*f.dst) {
+			destination, err := f.destinationNode(dst)
+			if err != nil {
+				return nil, err
+			}
+			destination.snapshotRegex, destination.timeLayout = source.snapshotRegex, source.timeLayout
+			if names[destination.name()] {
+				return nil, fmt.Errorf("duplicate destination: %s", destination.name())
+			}
+			names[destination.name()] = true
+			destinations = append(destinations, destination)
+		}
+		if len(destinations) == 0 {
+			return nil, fmt.Errorf("no destination, use -dst")
+		}
+		// every snapshot is sent to all destinations, see runJobs
+		for _, s := range sources {
+			for _, destination := range destinations {
+				j := job{source: source, destination: destination}
+				j.source.address, j.source.sshPort, j.source.mountPoint = s.address, s.sshPort, s.mountPoint
+				var name []string
+				// the backup server pulling from several hosts keeps their snapshots apart
+				if len(sources) > 1 {
+					name = append(name, s.address)
+					j.destination.snapshotPath = path.Join(destination.snapshotPath, s.address)
+				}
+				if len(destinations) > 1 {
+					name = append(name, destination.name())
+				}
+				j.name = strings.Join(name, "-")
+				if j.name == "" {
+					j.name = "default"
+				}
+				jobs = append(jobs, j)
+			}
+		}
+	}
+
+	var bwLimit int
+	if *f.bwLimit != "" {
+		var err error
+		if bwLimit, err = parseRate(*f.bwLimit); err != nil {
+			return nil, fmt.Errorf("invalid -bwlimit: %v", err)
+		}
+	}
+
+	for i := range jobs {
+		j := &jobs[i]
+		if bwLimit > 0 {
+			j.destination.bwLimit = bwLimit
+		}
+		switch j.destination.cleanup {
+		case "":
+			j.destination.cleanup = cleanupDelete
+		case cleanupDelete, cleanupKeep, cleanupRename, cleanupQuarantine:
+		default:
+			return nil, fmt.Errorf("job %s: invalid cleanup: %s", j.name, j.destination.cleanup)
+		}
+		if j.destination.quarantineDir == "" {
+			j.destination.quarantineDir = defaultQuarantineDir
+		}
+		// quarantined snapshots must never be mistaken for regular ones
+		if path.Clean(j.destination.quarantineDir) == path.Clean(j.destination.snapshotPath) {
+			return nil, fmt.Errorf("job %s: quarantine directory must differ from the snapshot directory", j.name)
+		}
+		if j.destination.incomingDir != "" {
+			if d := path.Clean(j.destination.incomingDir); d == path.Clean(j.destination.snapshotPath) || d == path.Clean(j.destination.quarantineDir) {
+				return nil, fmt.Errorf("job %s: incoming directory must differ from the snapshot and quarantine directories", j.name)
+			}
+			// archives and receive-server already never expose incomplete snapshots, staged streams are received as they are uploaded
+			if j.destination.archive || j.destination.wrapper != "" || j.destination.stagingDir != "" {
+				return nil, fmt.Errorf("job %s: an incoming directory cannot be combined with an archive, a wrapper or staging", j.name)
+			}
+		}
+		// staged streams are uploaded verbatim with plain commands
+		if j.destination.stagingDir != "" && (j.destination.wrapper != "" || len(j.destination.filters) > 0) {
+			return nil, fmt.Errorf("job %s: staging cannot be combined with a wrapper or filters", j.name)
+		}
+		if !validCompression(j.destination.compress) {
+			return nil, fmt.Errorf("job %s: invalid compression: %s", j.name, j.destination.compress)
+		}
+		if j.destination.encryption.enabled() && !j.destination.archive {
+			return nil, fmt.Errorf("job %s: encryption requires an archive destination", j.name)
+		}
+		if err := j.destination.encryption.validate(); err != nil {
+			return nil, fmt.Errorf("job %s: %v", j.name, err)
+		}
+		if j.destination.maxChain < 0 {
+			return nil, fmt.Errorf("job %s: invalid maximum chain length: %d", j.name, j.destination.maxChain)
+		}
+		if (j.destination.fullEvery > 0 || j.destination.fullTag != "" || j.destination.maxChain > 0) && !j.destination.archive {
+			return nil, fmt.Errorf("job %s: forced full sends require an archive destination", j.name)
+		}
+		if j.destination.fullTag != "" && !tagRegex.MatchString(j.destination.fullTag) {
+			return nil, fmt.Errorf("job %s: invalid full tag: %s", j.name, j.destination.fullTag)
+		}
+		if j.destination.archive && (j.destination.stagingDir != "" || j.destination.wrapper != "" || j.destination.compress != "") {
+			return nil, fmt.Errorf("job %s: an archive cannot be combined with staging, a wrapper or compression", j.name)
+		}
+		// the decompressing receive pipeline is run by the remote shell
+		if j.destination.compress != "" && (j.destination.stagingDir != "" || j.destination.wrapper != "") {
+			return nil, fmt.Errorf("job %s: compression cannot be combined with staging or a wrapper", j.name)
+		}
+		if j.destination.compress != "" && j.destination.sshOptions().compression == "yes" {
+			return nil, fmt.Errorf("job %s: compression cannot be combined with ssh compression", j.name)
+		}
+		if err := checkBtrfsArgs(j.destination.sendArgs, sendFlags); err != nil {
+			return nil, fmt.Errorf("job %s: send arguments: %v", j.name, err)
+		}
+		if err := checkBtrfsArgs(j.destination.receiveArgs, receiveFlags); err != nil {
+			return nil, fmt.Errorf("job %s: receive arguments: %v", j.name, err)
+		}
+		// the receive server only runs the arguments it knows
+		if (len(j.destination.sendArgs) > 0 || len(j.destination.receiveArgs) > 0) && j.destination.wrapper != "" {
+			return nil, fmt.Errorf("job %s: additional send or receive arguments cannot be combined with a wrapper", j.name)
+		}
+		if len(j.destination.receiveArgs) > 0 && j.destination.archive {
+			return nil, fmt.Errorf("job %s: an archive receives nothing, remove the receive arguments", j.name)
+		}
+		for _, n := range []*node{&j.source, &j.destination} {
+			if n.conn != nil {
+				e := n.conn.endpoint()
+				n.address, n.sshPort = e.address, e.sshPort
+			}
+			// the built-in ssh client rejects the options it doesn't implement
+			if defaultExecutor.ssh != nil && n.sshPort != 0 {
+				if _, _, err := parseSSHCommand(append(sshArgs(n), "true")); err != nil {
+					return nil, fmt.Errorf("job %s: %v", j.name, err)
+				}
+			}
+		}
+		if j.source.snapshotRegex == nil {
+			j.source.snapshotRegex = defaultSnapshotRegex
+		}
+		if j.destination.snapshotRegex == nil {
+			j.destination.snapshotRegex = defaultSnapshotRegex
+		}
+		sourceExecutor := defaultExecutor
+		sourceExecutor.bwLimit = j.destination.bwLimit
+		sourceExecutor.filters = j.destination.streamFilters()
+		j.source.executor = sourceExecutor
+		j.destination.executor = defaultExecutor
+		if rec != nil {
+			// all jobs append to the same recording
+			j.source.executor = recordExecutor{sourceExecutor, rec}
+			j.destination.executor = recordExecutor{defaultExecutor, rec}
+		}
+		if replay != nil {
+			j.source.executor = replay
+			j.destination.executor = replay
+		}
+
+		if len(allowlist) > 0 {
+			for _, n := range []*node{&j.source, &j.destination} {
+				// the paths of object storage are keys in a bucket
+				if n.s3 != nil {
+					continue
+				}
+				if p := path.Join(n.mountPoint, n.snapshotPath); !allowedDir(n.mountPoint, allowlist) || !allowedDir(p, allowlist) {
+					return nil, fmt.Errorf("job %s: %s:%s is not in the allowlist", j.name, n.address, p)
+				}
+			}
+			j.source.executor = allowlistExecutor{j.source.executor, allowlist}
+			j.destination.executor = allowlistExecutor{j.destination.executor, allowlist}
+		}
+	}
+	return jobs, nil
+}
+
+// destinationNode returns the destination dst configured by the flags.
+func (f *jobFlags) destinationNode(dst string) (node, error) {
+	destination, err := parseNode(dst)
+	if err != nil {
+		return destination, err
+	}
+	destination.snapshotPath = *f.dstSnapshotPath
+	destination.cryptDevice = *f.dstCryptDevice
+	destination.cleanup = *f.cleanup
+	destination.quarantineDir = *f.quarantineDir
+	destination.incomingDir = *f.incomingDir
+	destination.wrapper = *f.dstWrapper
+	destination.compress = *f.compress
+	destination.archive = destination.archive || *f.archive
+	if destination.s3 != nil {
+		destination.s3.endpoint = *f.s3Endpoint
+		destination.s3.profile = *f.s3Profile
+		destination.s3.storageClass = *f.s3StorageClass
+	} else if *f.s3Endpoint != "" || *f.s3Profile != "" || *f.s3StorageClass != "" {
+		return destination, fmt.Errorf("-s3-endpoint, -s3-profile and -s3-storage-class require an s3:// destination")
+	}
+	destination.encryption = encryption{age: splitList(*f.ageRecipients), gpg: splitList(*f.gpgRecipients)}
+	if *f.fullEvery != "" {
+		if destination.fullEvery, err = parseAge(*f.fullEvery); err != nil {
+			return destination, fmt.Errorf("invalid -full-every: %v", err)
+		}
+	}
+	destination.fullTag = *f.fullTag
+	destination.maxChain = *f.maxChain
+	destination.filters, err = parseFilters(splitList(*f.filter))
+	if err != nil {
+		return destination, err
+	}
+	destination.stagingDir = *f.stagingDir
+	destination.uploadRetries = *f.uploadRetries
+	destination.sendRetries = *f.sendRetries
+	destination.sendArgs = strings.Fields(*f.sendArgs)
+	destination.receiveArgs = strings.Fields(*f.receiveArgs)
+	destination.ssh = sshOptions{
+		user:                  *f.sshUser,
+		key:                   *f.sshKey,
+		knownHosts:            *f.sshKnownHosts,
+		strictHostKeyChecking: *f.sshStrict,
+		compression:           *f.sshCompression,
+		connectTimeout:        *f.sshTimeout,
+		extraArgs:             strings.Fields(*f.sshArgs),
+	}
+	if err := destination.ssh.validate(); err != nil {
+		return destination, err
+	}
+	if destination.onBattery, err = parseUsagePolicy(*f.onBattery); err != nil {
+		return destination, fmt.Errorf("invalid -dst-on-battery: %v", err)
+	}
+	if destination.onMetered, err = parseUsagePolicy(*f.onMetered); err != nil {
+		return destination, fmt.Errorf("invalid -dst-on-metered: %v", err)
+	}
+	if *f.stagingMax != "" {
+		destination.stagingMax, err = parseBytes(*f.stagingMax)
+		if err != nil {
+			return destination, fmt.Errorf("invalid -staging-max: %v", err)
+		}
+	}
+	return destination, nil
+}
+
+// defaultConfigPath is the configuration file used if no jobs are given by flags.
+const defaultConfigPath = "/etc/btrfs-backup/config.yaml"
+
+// configPath returns the configuration file defining the jobs. Without -config, -inventory and -dst the default
+// configuration file is used if it exists.
+func (f *jobFlags) configPath() string {
+	if *f.config != "" || *f.inventory != "" || *f.dst != "" {
+		return *f.config
+	}
+	if _, err := os.Stat(defaultConfigPath); err == nil {
+		return defaultConfigPath
+	}
+	return ""
+}
+
+// loadProfile returns the profile selected by the flags or nil if none is selected.
+func (f *jobFlags) loadProfile() *profileConfig {
+	if *f.profile == "" {
+		return nil
+	}
+	configPath := f.configPath()
+	if configPath == "" {
+		log.Fatal("-profile requires -config")
+	}
+	c, err := loadConfig(configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p, err := c.profile(*f.profile)
 	if err != nil {
 		log.Fatal(err)
 	}
+	return p
+}
 
-	destination.snapshotPath = *dstSnapshotPath
-	destination.snapshotRegex = snapshotRegex
-	destination.executor = defaultExecutor
+// retention returns the retention given by keep and windows or, if both are unset, the one of the selected profile.
+func (f *jobFlags) retention(keep int, windows string) (retention, error) {
+	if p := f.loadProfile(); p != nil && keep == 0 && windows == "" {
+		keep, windows = p.Keep, p.Retention
+	}
+	return parseRetention(keep, windows)
+}
 
-	sourceSnapshots, err := source.getSnapshots()
+// loadState returns the state file given by the flags or nil if none is given.
+func (f *jobFlags) loadState() *state {
+	if *f.state == "" {
+		return nil
+	}
+	st, err := loadState(*f.state)
 	if err != nil {
-		log.Fatalf("failed to get local snapshots: %v", err)
+		log.Fatal(err)
 	}
-	destinationSnapshots, err := destination.getSnapshots()
+	return st
+}
+
+// defaultSnapshotRegex matches snapshot names like 2019-01-01_03-00, optionally followed by a tag, eg.
+// 2019-01-01_03-00_pre-upgrade.
+var defaultSnapshotRegex = regexp.MustCompile(`^\d\d\d\d-\d\d-\d\d_\d\d-\d\d(_[a-zA-Z0-9-]+)?$`)
+
+func sendCommand(args []string) {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	checkRemote := fs.Bool("check-remote", false, "with -n: additionally check versions, permissions and free space on the nodes")
+	generationOrder := fs.String("generation-order", generationOrderWarn, "handling of snapshots whose generation contradicts their name: warn or parent (pick parents by generation)")
+	matchUUID := fs.Bool("match-uuid", false, "match destination snapshots to the source snapshots they were received from by UUID instead of by name")
+	maxClockSkew := fs.Duration("max-clock-skew", time.Minute, "maximum tolerated clock difference to remote nodes, 0 disables the check")
+	clockSkewAction := fs.String("clock-skew", clockSkewWarn, "action if -max-clock-skew is exceeded: warn or abort")
+	interval := fs.Duration("interval", 0, "run as daemon and repeat all jobs at this interval, reload configuration on SIGHUP")
+	catchUpDelay := fs.Duration("catch-up-delay", 0, "with -interval: delay of the first run at startup if a run was missed, eg. while the machine was off")
+	order := fs.String("order", orderOldestFirst, "order in which missing snapshots are sent: oldest-first or newest-first")
+	backfill := fs.Bool("backfill", false, "afterwards send older snapshots missing at the destination")
+	backfillBudget := fs.String("backfill-budget", "", "maximum amount of data sent per run when backfilling, eg. 50GiB")
+	backfillWindow := fs.String("backfill-window", "", "daily time window for backfilling, eg. 01:00-06:00")
+	snapshot := fs.String("snapshot", "", "only send this snapshot, relative to the newest older snapshot present on both nodes")
+	sendBatch := fs.Int("send-batch", 0, "send up to this many consecutive snapshots with a single btrfs send invocation, 0 sends one at a time")
+	notify := fs.String("notify", "", "URL to post a JSON report of every run to, distinguishing success, partial success and failure")
+	metricsFile := fs.String("metrics-file", "", "write Prometheus metrics to this file after every run, eg. for the textfile collector of the node exporter")
+	listen := fs.String("listen", "", "with -interval: serve a read-only API for browsing destination snapshots on this address, eg. localhost:8080")
+	apiTokenFile := fs.String("api-token-file", "", "with -listen: require the token contained in this file from every API request, needed to listen on other than loopback addresses")
+	requireAC := fs.Bool("require-ac", false, "defer the run unless on AC power")
+	requireNetwork := fs.String("require-network", "", "defer the run unless connected to one of these comma separated wireless networks (SSIDs)")
+	requireReachable := fs.Bool("require-reachable", false, "defer the run unless all destinations are reachable")
+	requireIdle := fs.Duration("require-idle", 0, "defer the run unless all user sessions have been idle for this long")
+	createBefore := fs.Bool("create-before-send", false, "create a snapshot of the origin subvolume of each source before sending")
+	repairReadOnly := fs.Bool("repair-readonly", false, "make writable source snapshots read-only before sending unless they were modified")
+	cleanPartial := fs.Bool("clean-partial", false, "dispose of snapshots left at the destination by failed receives before sending according to -cleanup")
+	saveMetadata := fs.Bool("save-metadata", false, "store the properties, quota limits and mount options of the source next to the snapshots at the destination after sending")
+	bootstrap := fs.String("bootstrap", "", "initialize an empty destination with a full send of the oldest (followed by all newer snapshots) or newest snapshot: oldest or newest")
+	keep := fs.Int("keep", 0, "prune the destination of each job after sending, keeping this number of most recent snapshots")
+	windows := fs.String("retention", "", "prune the destination of each job after sending, keeping snapshots by age, eg. 7d,daily:90d,monthly:2y")
+	parallel := fs.Int("parallel", 0, "send to up to this many destinations concurrently, jobs of the same destination run one after another")
+	totalBWLimit := fs.String("total-bwlimit", "", "maximum rate of all transfers together, shared among concurrent transfers by the weights of their destinations, eg. 50MiB/s")
+	pruneOn := fs.String("prune-on", pruneDestination, "with -keep or -retention: nodes pruned after sending: destination, source or both")
+	fs.Parse(args)
+	jf.setup()
+
+	jobs, err := jf.loadJobs()
 	if err != nil {
-		log.Fatalf("failed to get remote snapshots: %v", err)
+		log.Fatal(err)
+	}
+	st := jf.loadState()
+	if p := jf.loadProfile(); p != nil && p.Interval != "" && *interval == 0 {
+		*interval, _ = time.ParseDuration(p.Interval) // validated by loadProfile
 	}
 
-	if len(destinationSnapshots) == 0 {
-		log.Fatalf("No destination snapshots yet. Please perform an initial backup first.")
+	if *generationOrder != generationOrderWarn && *generationOrder != generationOrderParent {
+		log.Fatalf("invalid -generation-order: %s", *generationOrder)
+	}
+	if *order != orderOldestFirst && *order != orderNewestFirst {
+		log.Fatalf("invalid -order: %s", *order)
+	}
+	if *clockSkewAction != clockSkewWarn && *clockSkewAction != clockSkewAbort {
+		log.Fatalf("invalid -clock-skew: %s", *clockSkewAction)
+	}
+	if *bootstrap != "" && *bootstrap != bootstrapOldest && *bootstrap != bootstrapNewest {
+		log.Fatalf("invalid -bootstrap: %s", *bootstrap)
 	}
 
-	if *verbose {
+	// pruning after sending follows the profile like the prune command
+	r, err := jf.retention(*keep, *windows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !validPruneTarget(*pruneOn) {
+		log.Fatalf("invalid -prune-on: %s", *pruneOn)
+	}
+
+	opts := options{
+		dryRun:          *dryRun,
+		checkRemote:     *checkRemote,
+		generationOrder: *generationOrder,
+		matchUUID:       *matchUUID,
+		maxClockSkew:    *maxClockSkew,
+		clockSkewAction: *clockSkewAction,
+		snapshot:        *snapshot,
+		order:           *order,
+		backfill:        *backfill,
+		verbose:         *jf.verbose,
+		notify:          *notify,
+		sendBatch:       *sendBatch,
+		prune:           r,
+		pruneOn:         *pruneOn,
+		createBefore:    *createBefore,
+		repairReadOnly:  *repairReadOnly,
+		cleanPartial:    *cleanPartial,
+		saveMetadata:    *saveMetadata,
+		parallel:        *parallel,
+		conditions: conditions{
+			ac:        *requireAC,
+			networks:  splitList(*requireNetwork),
+			reachable: *requireReachable,
+			idle:      *requireIdle,
+			local:     node{address: "localhost", executor: defaultExecutor},
+		},
+		bootstrap: *bootstrap,
+	}
+	if *parallel < 0 {
+		log.Fatalf("invalid -parallel: %d", *parallel)
+	}
+	if *totalBWLimit != "" {
+		if opts.totalBWLimit, err = parseRate(*totalBWLimit); err != nil {
+			log.Fatalf("invalid -total-bwlimit: %v", err)
+		}
+	}
+	if *backfillBudget != "" {
+		opts.backfillBudget, err = parseBytes(*backfillBudget)
+		if err != nil {
+			log.Fatalf("invalid -backfill-budget: %v", err)
+		}
+	}
+	if *backfillWindow != "" {
+		w, err := parseTimeWindow(*backfillWindow)
+		if err != nil {
+			log.Fatalf("invalid -backfill-window: %v", err)
+		}
+		opts.backfillWindow = &w
+	}
+
+	if *metricsFile != "" {
+		if opts.metrics, err = loadMetrics(*metricsFile); err != nil {
+			log.Fatal(err)
+		}
+		opts.metricsFile = *metricsFile
+	}
+
+	if *interval > 0 {
+		apiToken, err := readAPIToken(*apiTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *listen != "" {
+			if err := checkListenAddress(*listen, apiToken); err != nil {
+				log.Fatal(err)
+			}
+			opts.pause = newPauser()
+			opts.transfers = newTransferRegistry()
+			if opts.metrics == nil {
+				opts.metrics = newMetrics()
+			}
+		}
+		handleSignals()
+		d := &daemon{load: jf.loadJobs, jobs: jobs, interval: *interval, settle: *catchUpDelay, st: st, opts: opts}
+		if *listen != "" {
+			api := &browseAPI{jobs: d.currentJobs, token: apiToken, pause: opts.pause, transfers: opts.transfers, metrics: opts.metrics}
+			go api.serve(*listen)
+		}
+		d.run()
+		return
+	}
+
+	handleSignals()
+	if failed := runJobs(jobs, st, opts).failed(); failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(jobs))
+	}
+}
+
+// runJobs runs all jobs sequentially, or with opts.parallel the jobs of up to that many destinations concurrently, and
+// returns a report of their results. The report is sent to opts.notify if set.
+// If opts.conditions aren't met, no job runs and the report's outcome is outcomeDeferred. Jobs are skipped or throttled
+// according to the battery and metered connection policies of their destinations.
+// With opts.createBefore, a snapshot of every source is created first, once per source shared by several jobs.
+// With opts.prune, the nodes selected by opts.pruneOn of each successful job are pruned while the following jobs run.
+func runJobs(jobs []job, st *state, opts options) *runReport {
+	report := &runReport{Started: time.Now()}
+	// the best endpoint of a connection may have changed since the last run, the jobs may be shared with other goroutines
+	jobs = append([]job(nil), jobs...)
+	reprobeConnections(jobs)
+	if opts.conditions.enabled() {
+		if reason := opts.conditions.unmet(jobs, report.Started); reason != "" {
+			log.Printf("Deferring run: %s", reason)
+			report.Outcome = outcomeDeferred
+			report.Finished = time.Now()
+			return report
+		}
+	}
+	if !opts.prune.empty() {
+		opts.sched = newScheduler()
+	}
+	errs := make([]error, len(jobs))
+	skipped := applyUsagePolicies(jobs, &opts.conditions.local)
+	var created map[string]error
+	if opts.createBefore {
+		created = createSnapshots(jobs, time.Now(), opts.dryRun)
+	}
+	opts.transfers.enqueue(jobs, skipped)
+	if opts.totalBWLimit > 0 {
+		share := newBandwidthShare(opts.totalBWLimit)
+		for i := range jobs {
+			weight := jobs[i].destination.weight
+			jobs[i].source.executor = withExecutorImpl(jobs[i].source.executor, func(e *executorImpl) { e.share, e.weight = share, weight })
+		}
+	}
+	var prunes sync.WaitGroup
+	runJob := func(i int) {
+		j := &jobs[i]
+		if len(jobs) > 1 {
+			log.Printf("Running job %s", j.name)
+		}
+		opts.pause.wait()
+		if isInterrupted() {
+			errs[i] = errInterrupted
+			log.Printf("Skipping job %s: %v", j.name, errs[i])
+			return
+		}
+		if reason, ok := skipped[i]; ok {
+			log.Printf("Skipping job %s: %s", j.name, reason)
+			return
+		}
+		if errs[i] = created[j.source.key()]; errs[i] != nil {
+			opts.transfers.finish(j, errs[i])
+			log.Printf("Job %s failed: %v", j.name, errs[i])
+			return
+		}
+		started := time.Now()
+		opts.transfers.start(j)
+		if opts.sched == nil {
+			errs[i] = j.run(st, opts)
+		} else {
+			opts.sched.startJob(j)
+			errs[i] = j.run(st, opts)
+			opts.sched.finishJob(j)
+		}
+		opts.transfers.finish(j, errs[i])
+		opts.metrics.finished(j, time.Since(started), errs[i], time.Now())
+		if errs[i] != nil {
+			log.Printf("Job %s failed: %v", j.name, errs[i])
+			return
+		}
+		if opts.sched != nil {
+			prunes.Add(1)
+			go func(i int) {
+				defer prunes.Done()
+				deleted, err := opts.sched.prune(&jobs[i], jobs, st, opts.prune, opts.pruneOn, opts.dryRun)
+				opts.metrics.pruned(&jobs[i], deleted, err)
+				if errs[i] = err; errs[i] != nil {
+					log.Printf("Job %s failed: %v", jobs[i].name, errs[i])
+				}
+			}(i)
+		}
+	}
+	if opts.parallel > 1 {
+		// up to opts.parallel destinations at once, the jobs of a destination one after another
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, opts.parallel)
+		for _, group := range destinationGroups(jobs) {
+			wg.Add(1)
+			go func(group []int) {
+				defer wg.Done()
+				slots <- struct{}{}
+				defer func() { <-slots }()
+				for _, i := range group {
+					runJob(i)
+				}
+			}(group)
+		}
+		wg.Wait()
+	} else {
+		for i := range jobs {
+			runJob(i)
+		}
+	}
+	prunes.Wait()
+	for i := range jobs {
+		report.add(&jobs[i], errs[i])
+	}
+	report.finish(time.Now())
+	if opts.metricsFile != "" && !opts.dryRun {
+		if err := opts.metrics.save(opts.metricsFile); err != nil {
+			log.Print(err)
+		}
+	}
+	if opts.notify != "" && !opts.dryRun {
+		if err := report.notify(opts.notify); err != nil {
+			log.Print(err)
+		}
+	}
+	return report
+}
+
+// run transmits all missing snapshots from source to destination. The progress is recorded in st so that an
+// interrupted run can be resumed. A nil state disables caching and progress tracking.
+func (j *job) run(st *state, opts options) error {
+	// never write to the directory underneath the mount point of a locked destination
+	if err := j.destination.checkUnlocked(); err != nil {
+		return err
+	}
+	j.resolveCompression()
+	if err := j.checkBtrfsVersions(); err != nil {
+		return err
+	}
+	if opts.repairReadOnly {
+		if _, err := j.repairReadOnly(opts.dryRun); err != nil {
+			return err
+		}
+	}
+	if opts.cleanPartial {
+		if _, err := j.cleanPartial(opts.dryRun); err != nil {
+			return err
+		}
+	}
+
+	sourceSnapshots, generations, err := j.source.listSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to get local snapshots: %v", err)
+	}
+	destinationSnapshots, err := j.destination.getSnapshotsCached(st)
+	if err != nil {
+		return fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+	// the cached listing keeps the names of the destination snapshots
+	listed := append([]string(nil), destinationSnapshots...)
+	if opts.matchUUID {
+		if destinationSnapshots, err = j.correlateSnapshots(sourceSnapshots, destinationSnapshots); err != nil {
+			return err
+		}
+	}
+
+	if misordered := misorderedSnapshots(sourceSnapshots, generations); len(misordered) > 0 {
+		log.Printf("Warning: generations of snapshots %s contradict the order of their names", strings.Join(misordered, ", "))
+		if opts.generationOrder == generationOrderParent {
+			sourceSnapshots = orderByGeneration(sourceSnapshots, generations)
+			destinationSnapshots = orderLike(destinationSnapshots, sourceSnapshots)
+		}
+	}
+
+	if opts.maxClockSkew > 0 {
+		if err := j.checkClockSkew(opts.maxClockSkew, opts.clockSkewAction); err != nil {
+			return err
+		}
+	}
+
+	if opts.dryRun && opts.checkRemote {
+		if err := j.checkRemote(); err != nil {
+			return err
+		}
+	}
+
+	bootstrap := len(destinationSnapshots) == 0
+	if bootstrap && opts.bootstrap == "" {
+		return fmt.Errorf("no destination snapshots yet, use -bootstrap to send an initial full snapshot")
+	}
+	if bootstrap && len(sourceSnapshots) == 0 {
+		return fmt.Errorf("no source snapshots to bootstrap the destination from")
+	}
+
+	if opts.verbose {
 		var buf bytes.Buffer
 		fmt.Fprintf(&buf, "Source snapshots:\n")
 		for _, s := range sourceSnapshots {
@@ -82,12 +1090,120 @@ func main() {
 		log.Println(buf.String())
 	}
 
-	if err := transmitSnapshots(&source, &destination, sourceSnapshots, destinationSnapshots, *dryRun); err != nil {
-		log.Fatal(err)
+	var prev *runRecord
+	resumedFrom := ""
+	if st != nil && !opts.dryRun {
+		if r := st.run(j.key()); r != nil && r.Finished.IsZero() && len(r.Completed) > 0 {
+			prev = r
+			resumedFrom = r.Completed[len(r.Completed)-1]
+			log.Printf("Resuming interrupted run after snapshot %s", resumedFrom)
+		}
+	}
+
+	var transfers []transfer
+	if opts.snapshot != "" {
+		transfers, err = planSnapshotTransfer(sourceSnapshots, destinationSnapshots, opts.snapshot)
+		if err != nil {
+			return err
+		}
+	} else if bootstrap {
+		transfers = planBootstrap(sourceSnapshots, opts.bootstrap)
+		log.Printf("Destination is empty, bootstrapping it with a full send of %s", transfers[0].snapshot)
+	} else {
+		missing := snapshotsOf(planTransfers(sourceSnapshots, destinationSnapshots))
+		if prev != nil {
+			// snapshots older than the most recent remote one which an interrupted newest-first run didn't send yet
+			missing = append(pendingSnapshots(prev.Planned, sourceSnapshots, destinationSnapshots), missing...)
+		}
+		transfers = orderTransfers(missing, sourceSnapshots, destinationSnapshots, opts.order)
+	}
+
+	if j.destination.forcesFullSends() {
+		archive, err := j.destination.listArchive()
+		if err != nil {
+			return err
+		}
+		transfers = j.destination.fullSends(transfers, archive)
+	}
+
+	// matching by UUID already dropped destination snapshots which weren't received from the source
+	if !opts.matchUUID {
+		if err := j.checkParents(transfers, destinationSnapshots); err != nil {
+			return err
+		}
+	}
+
+	// backfill picks its parents later, so the source stays locked against prunes
+	if opts.sched != nil && !opts.backfill {
+		opts.sched.pinTransfers(j, transfers)
+	}
+	opts.transfers.plan(j, transfers)
+
+	var record *runRecord
+	if st != nil && !opts.dryRun {
+		record = st.startRun(j.key(), transfers)
+		if err := st.save(); err != nil {
+			log.Print(err)
+		}
 	}
+
+	transmitted := 0
+	updateListing := func(snapshot string) {
+		destinationSnapshots = append(destinationSnapshots, snapshot)
+		listed = append(listed, snapshot)
+		if st != nil && !opts.dryRun {
+			st.updateListing(&j.destination, listed)
+			if err := st.save(); err != nil {
+				log.Print(err)
+			}
+		}
+		// a paused daemon waits before sending the next snapshot
+		opts.pause.wait()
+	}
+	sent, err := sendTransferBatches(&j.source, &j.destination, transfers, opts.sendBatch, opts.dryRun, func(t transfer, n int) {
+		transmitted += n
+		opts.metrics.sent(j, n)
+		opts.transfers.sent(j, t.snapshot, n)
+		if record != nil {
+			st.completed(record, t.snapshot, n)
+		}
+		updateListing(t.snapshot)
+	})
+	if err == nil && opts.backfill && opts.snapshot == "" {
+		err = j.backfill(sourceSnapshots, destinationSnapshots, opts.backfillBudget, opts.backfillWindow, opts.dryRun, func(t transfer, n int) {
+			transmitted += n
+			opts.metrics.sent(j, n)
+			opts.transfers.sent(j, t.snapshot, n)
+			updateListing(t.snapshot)
+		})
+	}
+	if err == nil && opts.saveMetadata {
+		err = j.saveMetadata(time.Now(), opts.dryRun)
+	}
+	if record != nil && err == nil {
+		st.finishRun(record, time.Now())
+		if err := st.save(); err != nil {
+			log.Print(err)
+		}
+	}
+
+	summary := fmt.Sprintf("Sent %d of %d snapshots, %s transmitted", len(sent), len(transfers), formatBytes(transmitted))
+	if resumedFrom != "" {
+		summary += fmt.Sprintf(", resumed from snapshot %s", resumedFrom)
+	}
+	log.Print(summary)
+	return err
+}
+
+// key identifies the job by its source and destination.
+func (j *job) key() string {
+	return j.source.key() + " -> " + j.destination.key()
 }
 
 func parseNode(str string) (node, error) {
+	if strings.HasPrefix(str, "s3://") {
+		return parseS3Node(str)
+	}
 	destinationRegexp := regexp.MustCompile(`^([a-z0-9\-\.]+):([0-9]+)(\/[a-zA-Z0-9\-_\.\/]+)$`)
 	matches := destinationRegexp.FindStringSubmatch(str)
 	if len(matches) != 4 {
@@ -106,60 +1222,284 @@ func parseNode(str string) (node, error) {
 	}, nil
 }
 
-func transmitSnapshots(source, destination *node, localSnapshots, remoteSnapshots []string, dryRun bool) error {
+// parseSources parses a comma separated list of source nodes. A plain path is a local source. Several sources must be
+// on distinct hosts.
+func parseSources(str string) ([]node, error) {
+	var sources []node
+	hosts := make(map[string]bool)
+	for _, s := range splitList(str) {
+		if strings.HasPrefix(s, "/") {
+			s = "localhost:0" + s
+		}
+		n, err := parseNode(s)
+		if err != nil {
+			return nil, err
+		}
+		if n.s3 != nil {
+			return nil, fmt.Errorf("invalid source: %s", s)
+		}
+		if hosts[n.address] {
+			return nil, fmt.Errorf("duplicate source host: %s", n.address)
+		}
+		hosts[n.address] = true
+		sources = append(sources, n)
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no source")
+	}
+	return sources, nil
+}
+
+// transfer is a snapshot which is sent incrementally relative to its parent.
+type transfer struct {
+	snapshot string
+	parent   string
+}
+
+// planTransfers returns the transfers required to send all local snapshots newer than the most recent remote snapshot.
+func planTransfers(localSnapshots, remoteSnapshots []string) []transfer {
+	if len(remoteSnapshots) == 0 {
+		return nil
+	}
 	mostRecentRemote := remoteSnapshots[len(remoteSnapshots)-1]
 	previousSnapshot := ""
+	var transfers []transfer
 
 	for _, snapshot := range localSnapshots {
 		if previousSnapshot != "" {
-			err := sendSnapshot(source, destination, snapshot, previousSnapshot, dryRun)
-			if err != nil {
-				log.Printf("Sending %s failed. Attempting to delete snapshot at destination...", snapshot)
-				if err := destination.deleteSnapshots([]string{snapshot}); err != nil {
-					log.Printf("Deleting snasphot failed: %v", err)
-				}
-				return fmt.Errorf("transmitSnapshots: %v", err)
-			}
+			transfers = append(transfers, transfer{snapshot: snapshot, parent: previousSnapshot})
 			previousSnapshot = snapshot
 		} else if snapshot == mostRecentRemote {
 			previousSnapshot = mostRecentRemote
 		}
 	}
 
-	return nil
+	return transfers
+}
+
+const (
+	bootstrapOldest = "oldest" // send all local snapshots starting with a full send of the oldest one
+	bootstrapNewest = "newest" // only send the newest local snapshot
+)
+
+// planBootstrap returns the transfers initializing an empty destination: a full send of the oldest or newest local
+// snapshot followed by incremental sends of all newer ones.
+func planBootstrap(localSnapshots []string, from string) []transfer {
+	start := 0
+	if from == bootstrapNewest {
+		start = len(localSnapshots) - 1
+	}
+	transfers := []transfer{{snapshot: localSnapshots[start]}}
+	for i := start + 1; i < len(localSnapshots); i++ {
+		transfers = append(transfers, transfer{snapshot: localSnapshots[i], parent: localSnapshots[i-1]})
+	}
+	return transfers
+}
+
+const (
+	orderOldestFirst = "oldest-first" // build a complete chain starting at the most recent remote snapshot
+	orderNewestFirst = "newest-first" // send the newest snapshot first to get a recent restore point quickly
+)
+
+// orderTransfers returns the transfers required to send the missing snapshots in the given order. Every snapshot is
+// sent relative to the newest older local snapshot which is present remotely at that time.
+func orderTransfers(missing, localSnapshots, remoteSnapshots []string, order string) []transfer {
+	isMissing := make(map[string]bool)
+	for _, s := range missing {
+		isMissing[s] = true
+	}
+	var sorted []string
+	for _, s := range localSnapshots {
+		if isMissing[s] {
+			sorted = append(sorted, s)
+		}
+	}
+	if order == orderNewestFirst && len(sorted) > 1 {
+		sorted = append([]string{sorted[len(sorted)-1]}, sorted[:len(sorted)-1]...)
+	}
+
+	present := make(map[string]bool)
+	for _, s := range remoteSnapshots {
+		present[s] = true
+	}
+
+	var res []transfer
+	for _, snapshot := range sorted {
+		parent := ""
+		for _, s := range localSnapshots {
+			if s == snapshot {
+				break
+			}
+			if present[s] {
+				parent = s
+			}
+		}
+		res = append(res, transfer{snapshot: snapshot, parent: parent})
+		present[snapshot] = true
+	}
+	return res
+}
+
+// pendingSnapshots returns the planned snapshots which exist locally but not remotely.
+func pendingSnapshots(planned, localSnapshots, remoteSnapshots []string) []string {
+	local := make(map[string]bool)
+	for _, s := range localSnapshots {
+		local[s] = true
+	}
+	remote := make(map[string]bool)
+	for _, s := range remoteSnapshots {
+		remote[s] = true
+	}
+	var res []string
+	for _, s := range planned {
+		if local[s] && !remote[s] {
+			res = append(res, s)
+		}
+	}
+	return res
 }
 
-func sendSnapshot(source, destination *node, snapshot, previousSnapshot string, dryRun bool) error {
-	p := path.Join(source.mountPoint, source.snapshotPath, previousSnapshot)
-	s := path.Join(source.mountPoint, source.snapshotPath, snapshot)
+func snapshotsOf(transfers []transfer) []string {
+	var res []string
+	for _, t := range transfers {
+		res = append(res, t.snapshot)
+	}
+	return res
+}
+
+// planSnapshotTransfer returns the transfer required to send snapshot relative to the newest older local snapshot
+// which is also present remotely. No transfer is needed if the snapshot is already present remotely.
+func planSnapshotTransfer(localSnapshots, remoteSnapshots []string, snapshot string) ([]transfer, error) {
+	remote := make(map[string]bool)
+	for _, s := range remoteSnapshots {
+		remote[s] = true
+	}
+	if remote[snapshot] {
+		log.Printf("Snapshot %s is already present at the destination", snapshot)
+		return nil, nil
+	}
+
+	parent := ""
+	for _, s := range localSnapshots {
+		if s == snapshot {
+			if parent == "" {
+				return nil, fmt.Errorf("planSnapshotTransfer: no parent for %s present on both nodes", snapshot)
+			}
+			return []transfer{{snapshot: snapshot, parent: parent}}, nil
+		}
+		if remote[s] {
+			parent = s
+		}
+	}
+	return nil, fmt.Errorf("planSnapshotTransfer: unknown snapshot: %s", snapshot)
+}
+
+// transmitSnapshots sends all local snapshots newer than the most recent remote snapshot. It returns the snapshots
+// which have been sent successfully.
+func transmitSnapshots(source, destination *node, localSnapshots, remoteSnapshots []string, dryRun bool) ([]string, error) {
+	return sendTransfers(source, destination, planTransfers(localSnapshots, remoteSnapshots), dryRun, nil)
+}
+
+// sendTransfers executes the transfers in order and stops at the first failure. It returns the snapshots which have
+// been sent successfully. If done is not nil, it is called after every successful transfer with the number of bytes
+// transmitted.
+func sendTransfers(source, destination *node, transfers []transfer, dryRun bool, done func(t transfer, transmitted int)) ([]string, error) {
+	var sent []string
+
+	for _, t := range transfers {
+		if isInterrupted() {
+			return sent, errInterrupted
+		}
+		transmitted, err := sendSnapshotRetrying(source, destination, t, dryRun)
+		if err != nil {
+			return sent, fmt.Errorf("transmitSnapshots: %v", err)
+		}
+		sent = append(sent, t.snapshot)
+		if done != nil {
+			done(t, transmitted)
+		}
+	}
 
-	sendCmd := []string{"btrfs", "send", "--quiet", "-p", p, s}
+	return sent, nil
+}
+
+// sendSnapshot sends snapshot incrementally relative to previousSnapshot and returns the number of bytes transmitted.
+// The complete snapshot is sent if previousSnapshot is empty.
+func sendSnapshot(source, destination *node, snapshot, previousSnapshot string, dryRun bool) (int, error) {
+	p := path.Join(source.mountPoint, source.snapshotPath, previousSnapshot, source.subvolume)
+	s := path.Join(source.mountPoint, source.snapshotPath, snapshot, source.subvolume)
+
+	sendCmd := destination.sendCommand("-p", p, s)
+	if previousSnapshot == "" {
+		sendCmd = destination.sendCommand(s)
+	}
 	if source.sshPort != 0 {
 		sendCmd = sshCmd(source, sendCmd)
 	}
-	receiveCmd := []string{"btrfs", "receive", destination.mountPoint}
-	if destination.sshPort != 0 {
-		receiveCmd = sshCmd(destination, receiveCmd)
+	dir := destination.receiveDir(snapshot)
+	if destination.incomingDir != "" {
+		dir = destination.incomingPath(snapshot)
 	}
+	receiveCmd := destination.receiveCommand(dir)
 
 	log.Printf("Sending %s", snapshot)
 
 	if dryRun {
-		return nil
+		return 0, nil
 	}
 
-	_, transmitted, err := source.executor.exec([][]string{sendCmd, receiveCmd})
+	if destination.incomingDir != "" {
+		if err := destination.prepareIncoming(snapshot); err != nil {
+			return 0, fmt.Errorf("sendSnapshot: %v", err)
+		}
+	} else if destination.subvolume != "" && !destination.archive {
+		if _, err := destination.run("mkdir", "-p", destination.receiveDir(snapshot)); err != nil {
+			return 0, fmt.Errorf("sendSnapshot: %v", err)
+		}
+	}
+	var transmitted int
+	var err error
+	if destination.archive {
+		transmitted, err = archiveSnapshot(source, destination, sendCmd, snapshot, previousSnapshot)
+	} else if destination.stagingDir != "" {
+		transmitted, err = stagedSend(source, destination, sendCmd, snapshot, previousSnapshot)
+	} else {
+		_, transmitted, err = source.executor.exec([][]string{sendCmd, receiveCmd})
+	}
 	if err != nil {
-		return fmt.Errorf("sendSnapshot: %v", err)
+		return transmitted, fmt.Errorf("sendSnapshot: %w", err)
+	}
+	if destination.incomingDir != "" {
+		if err := destination.moveIncoming(snapshot); err != nil {
+			return transmitted, fmt.Errorf("sendSnapshot: %v", err)
+		}
 	}
 
 	log.Printf("Sending %s done: %s transmitted", snapshot, formatBytes(transmitted))
 
-	return nil
+	return transmitted, nil
 }
 
 // getSnapshots returns a sorted list of snapshots.
 func (n *node) getSnapshots() ([]string, error) {
+	snapshots, _, err := n.listSnapshots()
+	return snapshots, err
+}
+
+// listSnapshots returns a sorted list of snapshots as well as their generations. The generations of archived
+// snapshots are unknown.
+func (n *node) listSnapshots() ([]string, map[string]int, error) {
+	if n.archive {
+		archive, err := n.listArchive()
+		if err != nil {
+			return nil, nil, err
+		}
+		var snapshots []string
+		for _, f := range archive {
+			snapshots = append(snapshots, f.snapshot)
+		}
+		return snapshots, map[string]int{}, nil
+	}
 	cmd := []string{"btrfs", "subvolume", "list", n.mountPoint}
 	if n.sshPort != 0 {
 		cmd = sshCmd(n, cmd)
@@ -167,29 +1507,178 @@ func (n *node) getSnapshots() ([]string, error) {
 
 	out, _, err := n.executor.exec([][]string{cmd})
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	subVolumes, err := parseSubVolumes(out)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if n.subvolume != "" {
+		subVolumes = nestedSnapshots(subVolumes, n.subvolume)
 	}
 	snapshots := filterSnapshots(subVolumes, n.snapshotPath, n.snapshotRegex)
-	sort.Strings(snapshots)
+	n.sortSnapshots(snapshots)
+
+	generations := make(map[string]int)
+	for p, gen := range parseGenerations(out) {
+		generations[path.Clean(p)] = gen
+	}
+	snapshotGenerations := make(map[string]int)
+	for _, s := range snapshots {
+		if gen, ok := generations[path.Join(n.snapshotPath, s, n.subvolume)]; ok {
+			snapshotGenerations[s] = gen
+		}
+	}
+	return snapshots, snapshotGenerations, nil
+}
+
+// getSnapshotsCached returns the listing cached in s if a cheap probe of the snapshot directory indicates that it is
+// still current. Otherwise it performs a full listing and updates the cache. A nil state disables caching.
+func (n *node) getSnapshotsCached(s *state) ([]string, error) {
+	if s == nil {
+		return n.getSnapshots()
+	}
+
+	if cached, ok := s.listing(n.key()); ok {
+		count, newest, err := n.probeSnapshots()
+		if err != nil {
+			log.Printf("Probing snapshots on %s failed, performing full listing: %v", n.address, err)
+		} else if count == len(cached.Snapshots) && (count == 0 || newest == cached.Snapshots[count-1]) {
+			return cached.Snapshots, nil
+		}
+	}
+
+	snapshots, err := n.getSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	s.updateListing(n, snapshots)
 	return snapshots, nil
 }
 
-func (n *node) deleteSnapshots(snapshots []string) error {
-	if len(snapshots) == 0 {
-		return nil
+// probeSnapshots lists the snapshot directory without involving btrfs and returns the number of entries matching the
+// snapshot regex as well as the newest one.
+func (n *node) probeSnapshots() (int, string, error) {
+	if n.s3 != nil {
+		archive, err := n.listArchive()
+		if err != nil || len(archive) == 0 {
+			return 0, "", err
+		}
+		return len(archive), archive[len(archive)-1].snapshot, nil
 	}
-	cmd := []string{"btrfs", "subvolume", "delete"}
-	cmd = append(cmd, snapshots...)
+	cmd := []string{"ls", "-1", path.Join(n.mountPoint, n.snapshotPath)}
 	if n.sshPort != 0 {
 		cmd = sshCmd(n, cmd)
 	}
-	_, _, err := n.executor.exec([][]string{cmd})
-	return err
+
+	out, _, err := n.executor.exec([][]string{cmd})
+	if err != nil {
+		return 0, "", err
+	}
+
+	var names []string
+	for _, name := range strings.Split(out, "\n") {
+		if f, ok := parseArchiveName(name); ok && n.archive {
+			name = f.snapshot
+		}
+		if name != "" && n.snapshotRegex.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return 0, "", nil
+	}
+	n.sortSnapshots(names)
+	return len(names), names[len(names)-1], nil
+}
+
+// key identifies the snapshot directory of the node. Nodes reached via a connection profile are identified by its name
+// so that the key doesn't depend on the endpoint in use.
+func (n *node) key() string {
+	if n.s3 != nil {
+		return n.s3.url(path.Join(n.mountPoint, n.snapshotPath))
+	}
+	if n.conn != nil {
+		return fmt.Sprintf("@%s%s", n.conn.name, path.Join(n.mountPoint, n.snapshotPath))
+	}
+	return fmt.Sprintf("%s:%d%s", n.address, n.sshPort, path.Join(n.mountPoint, n.snapshotPath))
+}
+
+// name returns a short name of the node for job names: its host, the bucket of an archive in object storage or the last
+// element of the mount point of a local node, eg. usb for localhost:0/media/usb.
+func (n *node) name() string {
+	switch {
+	case n.s3 != nil:
+		return n.s3.bucket
+	case n.sshPort == 0:
+		return path.Base(n.mountPoint)
+	}
+	return n.address
+}
+
+// receiveDir returns the directory in which btrfs receive creates snapshot sent to n. Nested snapshots are received
+// into their snapshot directory.
+func (n *node) receiveDir(snapshot string) string {
+	if n.subvolume != "" {
+		return path.Join(n.mountPoint, n.snapshotPath, snapshot)
+	}
+	return n.mountPoint
+}
+
+// cleanupReceive handles the snapshot created by a failed receive according to n.cleanup.
+func (n *node) cleanupReceive(snapshot string) error {
+	if n.s3 != nil {
+		// incomplete multipart uploads are not listed, a lifecycle rule of the bucket removes them
+		return nil
+	}
+	if n.archive {
+		log.Printf("Deleting partially archived %s", n.partialArchive(snapshot))
+		_, err := n.run("rm", "-f", n.partialArchive(snapshot))
+		return err
+	}
+	dir := n.receiveDir(snapshot)
+	if n.incomingDir != "" {
+		dir = n.incomingPath(snapshot)
+	}
+	return n.disposePartial(path.Join(dir, n.receivedName(snapshot)))
+}
+
+// disposePartial handles the partially received sub-volume at p according to n.cleanup.
+func (n *node) disposePartial(p string) error {
+	switch n.cleanup {
+	case cleanupKeep:
+		log.Printf("Keeping partially received %s", p)
+		return nil
+	case cleanupRename:
+		log.Printf("Renaming partially received %s to %s.partial", p, p)
+		_, err := n.run("mv", "-T", p, p+".partial")
+		return err
+	case cleanupQuarantine:
+		return n.quarantine(p, time.Now())
+	default:
+		log.Printf("Deleting partially received %s", p)
+		_, err := n.run("btrfs", "subvolume", "delete", p)
+		return err
+	}
+}
+
+// quarantine moves the subvolume at p into the quarantine directory of n by snapshotting and deleting it. The name of
+// the quarantined snapshot is suffixed with t so that repeated failures do not collide.
+func (n *node) quarantine(p string, t time.Time) error {
+	dir := path.Join(n.mountPoint, n.quarantineDir)
+	q := path.Join(dir, path.Base(p)+"."+t.Format("20060102T150405"))
+	log.Printf("Moving %s to quarantine at %s", p, q)
+	if _, err := n.run("mkdir", "-p", dir); err != nil {
+		return fmt.Errorf("quarantine: %v", err)
+	}
+	if _, err := n.run("btrfs", "subvolume", "snapshot", "-r", p, q); err != nil {
+		return fmt.Errorf("quarantine: %v", err)
+	}
+	if _, err := n.run("btrfs", "subvolume", "delete", p); err != nil {
+		return fmt.Errorf("quarantine: %v", err)
+	}
+	return nil
 }
 
 // parseSubVolumes extracts the sub-volume names from the "btrfs subvolume list" command.
@@ -226,61 +1715,183 @@ func filterSnapshots(subVolumes []string, snapshotDir string, r *regexp.Regexp)
 	return snapshots
 }
 
+// nestedSnapshots returns the directories of all sub-volumes named subvolume, eg. snapshots/1 for snapshots/1/@.
+func nestedSnapshots(subVolumes []string, subvolume string) []string {
+	var res []string
+	for _, volume := range subVolumes {
+		if dir, name := path.Split(volume); name == subvolume && dir != "" {
+			res = append(res, path.Clean(dir))
+		}
+	}
+	return res
+}
+
 // executor allows to execute commands as new processes. Its main purpose is to mock execution for testing.
 type executor interface {
 	exec(cmds [][]string) (string, int, error)
 }
 
 type executorImpl struct {
-	verbose     bool
-	logProgress bool
+	verbose          bool
+	logProgress      bool
+	progressInterval time.Duration   // time between progress log lines if stderr is not a terminal
+	bwLimit          int             // maximum bytes per second transmitted through pipes, 0 means unlimited
+	share            *bandwidthShare // divides a total rate among concurrent transfers, nil if there is none
+	weight           int             // weight of the transfers in share
+	filters          []filter        // applied in order to the byte stream between commands, eg. compression
+	cancel           <-chan struct{} // kills running commands once closed, nil if commands cannot be cancelled
+	timeout          time.Duration   // kills commands running longer, 0 means no timeout
+	listTimeout      time.Duration   // kills single commands, eg. listing or deleting snapshots, running longer instead of timeout, 0 applies timeout
+	stallTimeout     time.Duration   // kills pipelines whose stream makes no progress for longer, 0 disables the watchdog
+	stdin            io.Reader       // input of the first command, see execInput
+	stdout           io.Writer       // receives the output of the last command instead of returning it, see execOutput
+	ssh              *nativeSSH      // runs remote commands instead of the ssh binary, nil uses the binary
 }
 
 var defaultExecutor = executorImpl{}
 
+// exec runs cmds as a pipeline and returns the output of the last command as well as the number of bytes transmitted
+// between commands. Instead of connecting the commands directly, the output of each command is copied to the input of
+// the next one so that the byte stream can be metered and filtered.
 func (e executorImpl) exec(cmds [][]string) (string, int, error) {
 	if e.verbose {
 		log.Printf("exec: %#v", cmds)
 	}
 
-	var cs []*exec.Cmd
+	if e.cancelled() {
+		return "", 0, errCancelled
+	}
+	interrupt := interruption()
+	timeout, stallTimeout := e.timeout, e.stallTimeout
+	if len(cmds) == 1 {
+		// a single command transfers no stream
+		if e.listTimeout > 0 {
+			timeout = e.listTimeout
+		}
+		stallTimeout = 0
+	}
+	stoppable := e.cancel != nil || timeout > 0 || stallTimeout > 0 || interrupt != nil
+	if stoppable {
+		// lets killRemote find the remote processes of this pipeline among the ones of other transfers
+		cmds = tagRemote(cmds, newTransferTag())
+	}
+
+	var cs []process
 	var out bytes.Buffer
-	var errs []error
+	var copies []func() error
+	var closers []io.Closer
 	var pipes []*meteredPipe
 
 	for i, cmd := range cmds {
-		c := exec.Command(cmd[0], cmd[1:]...)
+		var input io.Reader
+		var output io.Writer
+		if i == 0 {
+			input = e.stdin
+		}
+		if i == len(cmds)-1 {
+			output = &out
+			if e.stdout != nil {
+				output = e.stdout
+			}
+		}
+		c, err := e.command(cmd, input, output, stoppable)
+		if err != nil {
+			return "", 0, fmt.Errorf("execPipe: %v", err)
+		}
 
 		if len(cs) > 0 {
-			pipe, err := cs[len(cs)-1].StdoutPipe()
+			stdout, err := cs[len(cs)-1].StdoutPipe()
 			if err != nil {
 				return "", 0, fmt.Errorf("execPipe: StdoutPipe: %v", err)
 			}
-			meteredPipe := &meteredPipe{r: pipe, logProgress: e.logProgress}
+			stdin, err := c.StdinPipe()
+			if err != nil {
+				return "", 0, fmt.Errorf("execPipe: StdinPipe: %v", err)
+			}
+			closers = append(closers, stdout, stdin)
+			meteredPipe := &meteredPipe{r: stdout}
+			meteredPipe.lastRead.Store(time.Now().UnixNano())
+			if e.logProgress {
+				meteredPipe.progress = newProgressReporter(e.progressInterval)
+			}
+			if e.share != nil && len(pipes) == 0 {
+				// the first pipe carries the stream of the whole pipeline
+				meteredPipe.limiter = e.share.join(e.weight, e.bwLimit)
+				defer e.share.leave(meteredPipe.limiter)
+			} else if e.bwLimit > 0 {
+				meteredPipe.limiter = newRateLimiter(e.bwLimit)
+			}
 			pipes = append(pipes, meteredPipe)
-			c.Stdin = meteredPipe
-		}
-		if i == len(cmds)-1 {
-			c.Stdout = &out
+			copies = append(copies, func() error {
+				var w io.Writer = stdin
+				if meteredPipe.progress != nil {
+					w = &timedWriter{w: stdin, wait: &meteredPipe.progress.stats.writeWait}
+				}
+				err := copyFiltered(w, meteredPipe, e.filters)
+				// unblock the sender if the receiver or a filter stopped reading
+				stdout.Close()
+				if closeErr := stdin.Close(); err == nil {
+					err = closeErr
+				}
+				return err
+			})
 		}
-		c.Stderr = os.Stderr
 
 		cs = append(cs, c)
 	}
 
+	var errs []error
+	started := 0
 	for _, c := range cs {
 		if err := c.Start(); err != nil {
 			errs = append(errs, err)
+			break
 		}
+		started++
+	}
+	if started < len(cs) {
+		// the started commands may block on their pipes
+		for _, c := range closers {
+			c.Close()
+		}
+		for _, c := range cs[:started] {
+			c.Wait()
+		}
+		return "", 0, pipelineError(errs)
+	}
+
+	var finished, watched chan struct{}
+	var stopped error
+	if stoppable {
+		finished, watched = make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(watched)
+			stopped = e.watch(cmds, cs, closers, pipes, timeout, stallTimeout, interrupt, finished)
+		}()
 	}
 
-	// Wait() must be called in reverse because all reads from the stdout pipe must be completed before calling it.
-	// See StdoutPipe(): "[...] it is incorrect to call Wait before all reads from the pipe have completed."
+	copyErrs := make(chan error, len(copies))
+	for _, c := range copies {
+		go func(c func() error) {
+			copyErrs <- c()
+		}(c)
+	}
+	// all reads from the stdout pipes must be completed before calling Wait(), see StdoutPipe()
+	for range copies {
+		if err := <-copyErrs; err != nil {
+			errs = append(errs, err)
+		}
+	}
 	for i := len(cs) - 1; i >= 0; i-- {
 		if err := cs[i].Wait(); err != nil {
-			errs = append(errs, err)
+			errs = append(errs, sshFailure(cmds[i], err))
 		}
 	}
+	if finished != nil {
+		// wait for the remote commands of a stopped pipeline to be killed as well
+		close(finished)
+		<-watched
+	}
 
 	// take the maximum of data transmitted through the pipes
 	transmitted := 0
@@ -290,58 +1901,181 @@ func (e executorImpl) exec(cmds [][]string) (string, int, error) {
 		}
 	}
 
+	if len(errs) > 0 && e.cancelled() {
+		return "", transmitted, errCancelled
+	}
+	if len(errs) > 0 && interrupt != nil && isInterrupted() {
+		return "", transmitted, errInterrupted
+	}
+	if stopped != nil {
+		return "", transmitted, fmt.Errorf("%w: %v", stopped, pipelineError(errs))
+	}
 	if len(errs) > 0 {
-		return "", transmitted, fmt.Errorf("%+v", errs)
+		return "", transmitted, pipelineError(errs)
 	}
 
 	return out.String(), transmitted, nil
 }
 
+// pipelineError collects the errors of the commands of a pipeline. errors.Is and errors.As check each of them.
+type pipelineError []error
+
+func (e pipelineError) Error() string {
+	return fmt.Sprintf("%+v", []error(e))
+}
+
+func (e pipelineError) Unwrap() []error {
+	return e
+}
+
+// process is a command of a pipeline run by executorImpl.
+type process interface {
+	StdoutPipe() (io.ReadCloser, error)
+	StdinPipe() (io.WriteCloser, error)
+	Start() error
+	Wait() error
+	terminate() // asks the command to exit
+	kill()
+}
+
+// localProcess is a process running on this host.
+type localProcess struct {
+	*exec.Cmd
+}
+
+func (p localProcess) terminate() {
+	p.Process.Signal(syscall.SIGTERM)
+}
+
+func (p localProcess) kill() {
+	p.Process.Kill()
+}
+
+// command returns the process running cmd with the given input and output, nil meaning none. The remote command of an
+// ssh invocation runs over a connection of e.ssh if set, see nativeSSH, instead of the ssh binary.
+func (e executorImpl) command(cmd []string, stdin io.Reader, stdout io.Writer, stoppable bool) (process, error) {
+	if e.ssh != nil && isSSHCommand(cmd) {
+		return e.ssh.command(cmd, stdin, stdout, os.Stderr)
+	}
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = os.Stderr
+	if stoppable {
+		// children of a killed command may keep its output open
+		c.WaitDelay = killGrace
+	}
+	return localProcess{c}, nil
+}
+
+// copyFiltered copies r to w through filters. The filters are closed before it returns, so none of them reads r
+// afterwards.
+func copyFiltered(w io.Writer, r io.Reader, filters []filter) (err error) {
+	for _, f := range filters {
+		fr, err := f.wrap(r)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if closeErr := fr.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		r = fr
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
 type meteredPipe struct {
-	r     io.ReadCloser
+	r     io.Reader
 	meter int
 
-	// logging
-	logProgress  bool
-	lastLog      time.Time
-	lastLogMeter int
+	limiter *rateLimiter // optional
+
+	progress *progressReporter // optional
+
+	lastRead atomic.Int64 // unix nanoseconds of the last read returning data, see executorImpl.watch
 }
 
 func (m *meteredPipe) Read(p []byte) (int, error) {
+	if m.limiter != nil && len(p) > m.limiter.burst() {
+		p = p[:m.limiter.burst()]
+	}
+	start := time.Now()
 	n, err := m.r.Read(p)
-	m.meter += n
-
-	if !m.logProgress {
-		return n, err
+	if m.progress != nil {
+		m.progress.stats.readWait.Add(int64(time.Since(start)))
 	}
-	if m.lastLog.IsZero() {
-		m.lastLog = time.Now()
-		return n, err
+	m.meter += n
+	if n > 0 {
+		m.lastRead.Store(time.Now().UnixNano())
 	}
-	if time.Since(m.lastLog) > time.Second {
-		log.Printf("Transmitted %s", formatBytes(m.meter-m.lastLogMeter))
-		m.lastLogMeter = m.meter
-		m.lastLog = time.Now()
+	if m.limiter != nil {
+		m.limiter.wait(n)
 	}
 
+	if m.progress != nil {
+		m.progress.update(m.meter)
+		if err == io.EOF {
+			m.progress.done()
+		}
+	}
 	return n, err
 }
 
-func (m *meteredPipe) Close() error {
-	return m.r.Close()
+// run executes cmd on n and returns its output.
+func (n *node) run(cmd ...string) (string, error) {
+	out, _, err := n.executor.exec([][]string{n.command(cmd...)})
+	return out, err
+}
+
+// command returns cmd wrapped in ssh if n is a remote node.
+func (n *node) command(cmd ...string) []string {
+	if n.sshPort != 0 {
+		return sshCmd(n, cmd)
+	}
+	return cmd
+}
+
+// stdinCommand is like command for commands reading from stdin.
+func (n *node) stdinCommand(cmd ...string) []string {
+	if n.sshPort != 0 && n.wrapper != "" {
+		return sshWrapperCmd(n, cmd, true).args()
+	}
+	return n.command(cmd...)
 }
 
 func sshCmd(n *node, remoteCmd []string) []string {
-	cmd := []string{"ssh", "-C", fmt.Sprintf("-p%d", n.sshPort), n.address, "--"}
-	return append(cmd, remoteCmd...)
+	if n.wrapper != "" {
+		return sshWrapperCmd(n, remoteCmd, false).args()
+	}
+	return append(sshArgs(n), remoteCmd...)
+}
+
+// byteFormat controls how formatBytes renders sizes.
+type byteFormat struct {
+	si        bool // use powers of 1000 (MB) instead of powers of 1024 (MiB)
+	precision int  // number of decimal places
 }
 
+var defaultByteFormat = byteFormat{precision: 1}
+
 func formatBytes(b int) string {
+	return defaultByteFormat.format(b)
+}
+
+func (f byteFormat) format(b int) string {
 	units := []string{"B", "kiB", "MiB", "GiB", "TiB"}
+	factor := 1024.0
+	if f.si {
+		units = []string{"B", "kB", "MB", "GB", "TB"}
+		factor = 1000.0
+	}
 	bf := float64(b)
 	base := 0
-	for ; base < len(units)-1 && bf >= 1024; base++ {
-		bf /= 1024.0
+	for ; base < len(units)-1 && bf >= factor; base++ {
+		bf /= factor
 	}
-	return fmt.Sprintf("%.1f %s", bf, units[base])
+	return fmt.Sprintf("%.*f %s", f.precision, bf, units[base])
 }
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"reflect"
 	"regexp"
 	"testing"
+	"time"
 )
 
 func TestParseNode(t *testing.T) {
@@ -35,6 +37,47 @@ func TestParseNode(t *testing.T) {
 	}
 }
 
+func TestParseSources(t *testing.T) {
+	data := []struct {
+		in   string
+		want []string // address:port/path of every source
+		err  bool
+	}{
+		{in: "/mnt", want: []string{"localhost:0/mnt"}},
+		{in: "laptop:22/mnt, web:2222/data", want: []string{"laptop:22/mnt", "web:2222/data"}},
+		{in: "laptop:22/mnt,laptop:22/home", err: true},
+		{in: "s3://bucket/prefix", err: true},
+		{in: "", err: true},
+	}
+	for di, d := range data {
+		sources, err := parseSources(d.in)
+		if d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+		var res []string
+		for _, s := range sources {
+			res = append(res, fmt.Sprintf("%s:%d%s", s.address, s.sshPort, s.mountPoint))
+		}
+		if !d.err && !reflect.DeepEqual(res, d.want) {
+			t.Errorf("%d: unexpected sources: %v", di, res)
+		}
+	}
+
+	// a backup server pulling from several hosts keeps their snapshots apart
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	jf := addJobFlags(fs)
+	if err := fs.Parse([]string{"-src", "laptop:22/mnt,web:22/mnt", "-dst", "localhost:0/srv/backup", "-dst-snapshot-path", "hosts"}); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 2 || jobs[1].name != "web" || jobs[1].source.address != "web" || jobs[1].destination.snapshotPath != "hosts/web" {
+		t.Errorf("unexpected jobs: %+v", jobs)
+	}
+}
+
 // mockExecutor returns (res, err) if exec is invoked with cmd and returns an error otherwise.
 type mockExecutor struct {
 	cmds [][]string
@@ -352,7 +395,7 @@ func TestTransmitSnapshots(t *testing.T) {
 	for di, d := range data {
 		exec := &trackingExecutor{}
 		d.source.executor = exec
-		err := transmitSnapshots(&d.source, &d.destination, d.localSnapshots, d.remoteSnapshots, false)
+		_, err := transmitSnapshots(&d.source, &d.destination, d.localSnapshots, d.remoteSnapshots, false)
 		if err != nil {
 			t.Errorf("%d: unexpected error: %v", di, err)
 			continue
@@ -387,3 +430,209 @@ func TestFormatBytes(t *testing.T) {
 		})
 	}
 }
+
+func TestByteFormat(t *testing.T) {
+	data := []struct {
+		f   byteFormat
+		in  int
+		out string
+	}{
+		{byteFormat{si: true, precision: 1}, 999, "999.0 B"},
+		{byteFormat{si: true, precision: 1}, 1000, "1.0 kB"},
+		{byteFormat{si: true, precision: 2}, 1500000, "1.50 MB"},
+		{byteFormat{si: false, precision: 0}, 1536, "2 kiB"},
+		{byteFormat{si: false, precision: 3}, 1024 * 1024 * 1024, "1.000 GiB"},
+	}
+
+	for _, d := range data {
+		if out := d.f.format(d.in); out != d.out {
+			t.Errorf("%v: %s != %s", d, out, d.out)
+		}
+	}
+}
+
+func TestPlanSnapshotTransfer(t *testing.T) {
+	data := []struct {
+		localSnapshots  []string
+		remoteSnapshots []string
+		snapshot        string
+		transfers       []transfer
+		err             bool
+	}{
+		{[]string{"1", "2", "3", "4"}, []string{"1", "2"}, "4", []transfer{{snapshot: "4", parent: "2"}}, false},
+		{[]string{"1", "2", "3", "4"}, []string{"1", "3"}, "2", []transfer{{snapshot: "2", parent: "1"}}, false},
+		{[]string{"1", "2", "3"}, []string{"1", "2"}, "2", nil, false},
+		{[]string{"1", "2", "3"}, []string{"2"}, "1", nil, true},
+		{[]string{"1", "2", "3"}, []string{"1"}, "5", nil, true},
+	}
+
+	for di, d := range data {
+		res, err := planSnapshotTransfer(d.localSnapshots, d.remoteSnapshots, d.snapshot)
+		if d.err && err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+			continue
+		}
+		if !d.err && err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+			continue
+		}
+		if !reflect.DeepEqual(res, d.transfers) {
+			t.Errorf("%d: unexpected transfers: %#v", di, res)
+		}
+	}
+}
+
+func TestOrderTransfers(t *testing.T) {
+	local := []string{"1", "2", "3", "4", "5"}
+	data := []struct {
+		missing   []string
+		remote    []string
+		order     string
+		transfers []transfer
+	}{
+		{[]string{"2", "3", "4", "5"}, []string{"1"}, orderOldestFirst, []transfer{{"2", "1"}, {"3", "2"}, {"4", "3"}, {"5", "4"}}},
+		{[]string{"2", "3", "4", "5"}, []string{"1"}, orderNewestFirst, []transfer{{"5", "1"}, {"2", "1"}, {"3", "2"}, {"4", "3"}}},
+		{[]string{"5"}, []string{"4"}, orderNewestFirst, []transfer{{"5", "4"}}},
+		// resuming an interrupted newest-first run
+		{[]string{"3", "4", "2"}, []string{"1", "5"}, orderNewestFirst, []transfer{{"4", "1"}, {"2", "1"}, {"3", "2"}}},
+		{[]string{"3", "4", "2"}, []string{"1", "5"}, orderOldestFirst, []transfer{{"2", "1"}, {"3", "2"}, {"4", "3"}}},
+	}
+
+	for di, d := range data {
+		res := orderTransfers(d.missing, local, d.remote, d.order)
+		if !reflect.DeepEqual(res, d.transfers) {
+			t.Errorf("%d: unexpected transfers: %#v", di, res)
+		}
+	}
+}
+
+func TestPlanBootstrap(t *testing.T) {
+	local := []string{"1", "2", "3"}
+	if res := planBootstrap(local, bootstrapOldest); !reflect.DeepEqual(res, []transfer{{"1", ""}, {"2", "1"}, {"3", "2"}}) {
+		t.Errorf("unexpected transfers: %#v", res)
+	}
+	if res := planBootstrap(local, bootstrapNewest); !reflect.DeepEqual(res, []transfer{{"3", ""}}) {
+		t.Errorf("unexpected transfers: %#v", res)
+	}
+	if res := planTransfers(local, nil); res != nil {
+		t.Errorf("unexpected transfers to empty destination: %#v", res)
+	}
+}
+
+func TestRunBootstrap(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                                                                        "ID 1 gen 1 top level 5 path snapshot/1\nID 2 gen 2 top level 5 path snapshot/2\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":                                                  "",
+		"btrfs send --quiet /mnt/snapshot/1 | ssh -C -p22 nas -- btrfs receive /backup":                    "",
+		"btrfs send --quiet -p /mnt/snapshot/1 /mnt/snapshot/2 | ssh -C -p22 nas -- btrfs receive /backup": "",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+	if err := j.run(nil, options{}); err == nil {
+		t.Fatal("expected error without -bootstrap")
+	}
+	if err := j.run(nil, options{bootstrap: bootstrapOldest}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(e.calls) != 4 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
+
+func TestPendingSnapshots(t *testing.T) {
+	res := pendingSnapshots([]string{"5", "2", "3", "4", "6"}, []string{"1", "2", "3", "4", "5"}, []string{"1", "5", "2"})
+	if want := []string{"3", "4"}; !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected result: %#v", res)
+	}
+}
+
+func TestCleanupReceive(t *testing.T) {
+	send := "btrfs send --quiet -p /mnt/snapshot/1 /mnt/snapshot/2 | ssh -C -p22 nas -- btrfs receive /backup"
+	data := []struct {
+		cleanup string
+		cmd     string
+	}{
+		{cleanupDelete, "ssh -C -p22 nas -- btrfs subvolume delete /backup/2"},
+		{cleanupRename, "ssh -C -p22 nas -- mv -T /backup/2 /backup/2.partial"},
+		{cleanupKeep, ""},
+	}
+	for di, d := range data {
+		e := &mapExecutor{out: map[string]string{d.cmd: ""}}
+		source := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", executor: e}
+		destination := node{address: "nas", sshPort: 22, mountPoint: "/backup", cleanup: d.cleanup, executor: e}
+		if _, err := sendTransfers(&source, &destination, []transfer{{snapshot: "2", parent: "1"}}, false, nil); err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+		calls := 1
+		if d.cmd != "" {
+			calls = 2
+		}
+		if e.calls[send] != 1 || e.calls[d.cmd] != calls-1 || len(e.calls) != calls {
+			t.Errorf("%d: unexpected calls: %v", di, e.calls)
+		}
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"ssh -C -p22 nas -- mkdir -p /backup/.quarantine":                                                "",
+		"ssh -C -p22 nas -- btrfs subvolume snapshot -r /backup/2 /backup/.quarantine/2.20190102T030405": "",
+		"ssh -C -p22 nas -- btrfs subvolume delete /backup/2":                                            "",
+	}}
+	n := node{address: "nas", sshPort: 22, mountPoint: "/backup", quarantineDir: ".quarantine", executor: e}
+	if err := n.quarantine("/backup/2", time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(e.calls) != 3 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+
+	// the snapshot is not deleted if it could not be moved
+	delete(e.out, "ssh -C -p22 nas -- btrfs subvolume snapshot -r /backup/2 /backup/.quarantine/2.20190102T030405")
+	e.calls = nil
+	if err := n.quarantine("/backup/2", time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC)); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+	if e.calls["ssh -C -p22 nas -- btrfs subvolume delete /backup/2"] != 0 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
+
+func TestExecutorImpl(t *testing.T) {
+	upper := execFilter{[]string{"tr", "a-z", "A-Z"}}
+	data := []struct {
+		cmds        [][]string
+		filters     []filter
+		out         string
+		transmitted int
+		err         bool
+	}{
+		{cmds: [][]string{{"echo", "hello"}}, out: "hello\n"},
+		{cmds: [][]string{{"echo", "hello"}, {"cat"}}, out: "hello\n", transmitted: 6},
+		{cmds: [][]string{{"echo", "hello"}, {"cat"}, {"cat"}}, out: "hello\n", transmitted: 6},
+		{cmds: [][]string{{"echo", "hello"}, {"cat"}}, filters: []filter{upper}, out: "HELLO\n", transmitted: 6},
+		{cmds: [][]string{{"echo", "hello"}, {"cat"}}, filters: []filter{gzipFilter{}, meterFilter{}, gunzipFilter{}}, out: "hello\n", transmitted: 6},
+		{cmds: [][]string{{"echo", "hello"}, {"cat"}}, filters: []filter{execFilter{[]string{"false"}}}, err: true},
+		{cmds: [][]string{{"yes"}, {"cat"}}, filters: []filter{execFilter{[]string{"head", "-c", "1"}}}, err: true},
+		{cmds: [][]string{{"echo", "hello"}, {"false"}}, err: true},
+		{cmds: [][]string{{"false"}, {"cat"}}, err: true},
+		{cmds: [][]string{{"yes"}, {"head", "-c", "1"}}, err: true},
+		{cmds: [][]string{{"yes"}, {"/nonexistent"}}, err: true},
+	}
+	for di, d := range data {
+		out, transmitted, err := executorImpl{filters: d.filters}.exec(d.cmds)
+		if d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+			continue
+		}
+		if d.err {
+			continue
+		}
+		if out != d.out || transmitted != d.transmitted {
+			t.Errorf("%d: unexpected result: %q, %d", di, out, transmitted)
+		}
+	}
+}
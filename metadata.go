@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// metadataFile is stored next to the snapshots at the destination.
+const metadataFile = "metadata.json"
+
+// metadata describes the file system layout of a source which the snapshots alone don't preserve, so that a restore
+// after losing the source can recreate it.
+type metadata struct {
+	Captured   time.Time         `json:"captured"`
+	Source     string            `json:"source"`                      // key of the source
+	Subvolume  string            `json:"subvolume"`                   // origin of the snapshots
+	Properties map[string]string `json:"properties,omitempty"`        // btrfs properties of the origin, eg. compression
+	Default    string            `json:"default_subvolume,omitempty"` // default sub-volume of the file system
+	QGroups    []string          `json:"qgroups,omitempty"`           // qgroups with their limits, empty if quotas are disabled
+	Mounts     []string          `json:"mounts,omitempty"`            // source, file system type and options of the mounts
+	Fstab      []string          `json:"fstab,omitempty"`             // btrfs entries of /etc/fstab
+}
+
+// captureMetadata collects the metadata of the source of j. Quotas and fstab entries are optional.
+func (j *job) captureMetadata(now time.Time) (*metadata, error) {
+	n := &j.source
+	m := &metadata{Captured: now, Source: n.key(), Subvolume: n.originOrRoot(), Properties: make(map[string]string)}
+
+	out, err := n.run("btrfs", "property", "get", m.Subvolume)
+	if err != nil {
+		return nil, fmt.Errorf("captureMetadata: %v", err)
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if k, v, ok := strings.Cut(strings.TrimSpace(line), "="); ok {
+			m.Properties[k] = v
+		}
+	}
+	if out, err = n.run("btrfs", "subvolume", "get-default", n.mountPoint); err != nil {
+		return nil, fmt.Errorf("captureMetadata: %v", err)
+	}
+	m.Default = strings.TrimSpace(out)
+	for _, p := range []string{n.mountPoint, m.Subvolume} {
+		out, err := n.run("findmnt", "-n", "-o", "TARGET,SOURCE,FSTYPE,OPTIONS", "-T", p)
+		if err != nil {
+			return nil, fmt.Errorf("captureMetadata: %v", err)
+		}
+		if mount := strings.Join(strings.Fields(out), " "); mount != "" && (len(m.Mounts) == 0 || m.Mounts[0] != mount) {
+			m.Mounts = append(m.Mounts, mount)
+		}
+	}
+
+	if out, err := n.run("btrfs", "qgroup", "show", "-re", "--raw", n.mountPoint); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "-") {
+				m.QGroups = append(m.QGroups, line)
+			}
+		}
+	}
+	if out, err := n.run("cat", "/etc/fstab"); err == nil {
+		for _, line := range strings.Split(out, "\n") {
+			fields := strings.Fields(line)
+			if len(fields) >= 3 && !strings.HasPrefix(fields[0], "#") && fields[2] == "btrfs" {
+				m.Fstab = append(m.Fstab, strings.Join(fields, " "))
+			}
+		}
+	}
+	return m, nil
+}
+
+// saveMetadata captures the metadata of the source of j and stores it next to the snapshots at the destination.
+func (j *job) saveMetadata(now time.Time, dryRun bool) error {
+	if j.destination.wrapper != "" {
+		log.Printf("Metadata cannot be stored through a wrapper, skipping it")
+		return nil
+	}
+	m, err := j.captureMetadata(now)
+	if err != nil {
+		return err
+	}
+	p := path.Join(j.destination.mountPoint, j.destination.snapshotPath, metadataFile)
+	log.Printf("Saving metadata of %s to %s", m.Subvolume, p)
+	if dryRun {
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("saveMetadata: %v", err)
+	}
+	if err := j.destination.writeFile(p, append(data, '\n')); err != nil {
+		return fmt.Errorf("saveMetadata: %v", err)
+	}
+	return nil
+}
+
+// metadataCommand prints the metadata stored at the destination of a job, see saveMetadata.
+func metadataCommand(args []string) {
+	fs := flag.NewFlagSet("metadata", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	jobName := fs.String("job", "", "job to print the metadata of, required if several jobs are defined")
+	fs.Parse(args)
+	jf.setup()
+
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	j, err := selectJob(jobs, *jobName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, err := j.destination.readMetadata()
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.WriteString(out)
+}
+
+// readMetadata returns the metadata stored at n, see saveMetadata.
+func (n *node) readMetadata() (string, error) {
+	p := path.Join(n.mountPoint, n.snapshotPath, metadataFile)
+	read := n.command("cat", p)
+	if n.s3 != nil {
+		read = n.s3.download(p)
+	}
+	out, _, err := n.executor.exec([][]string{read})
+	if err != nil {
+		return "", fmt.Errorf("readMetadata: no metadata at %s: %v", p, err)
+	}
+	return out, nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSaveMetadata(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs property get /home":                            "ro=false\ncompression=zstd:3\n",
+		"btrfs subvolume get-default /mnt":                    "ID 5 (FS_TREE)\n",
+		"findmnt -n -o TARGET,SOURCE,FSTYPE,OPTIONS -T /mnt":  "/mnt /dev/sda2 btrfs rw,noatime,subvolid=5\n",
+		"findmnt -n -o TARGET,SOURCE,FSTYPE,OPTIONS -T /home": "/home /dev/sda2[/@home] btrfs rw,noatime,compress=zstd:3,subvol=/@home\n",
+		"btrfs qgroup show -re --raw /mnt":                    "qgroupid rfer excl max_rfer max_excl\n-------- ---- ---- -------- --------\n0/257 16384 16384 10737418240 none\n",
+		"cat /etc/fstab":                                      "# comment\nUUID=abc / ext4 defaults 0 1\nUUID=def /home btrfs subvol=@home,compress=zstd:3 0 0\n",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", origin: "/home", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	m, err := j.captureMetadata(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &metadata{
+		Captured:   now,
+		Source:     j.source.key(),
+		Subvolume:  "/home",
+		Properties: map[string]string{"ro": "false", "compression": "zstd:3"},
+		Default:    "ID 5 (FS_TREE)",
+		QGroups:    []string{"qgroupid rfer excl max_rfer max_excl", "0/257 16384 16384 10737418240 none"},
+		Mounts:     []string{"/mnt /dev/sda2 btrfs rw,noatime,subvolid=5", "/home /dev/sda2[/@home] btrfs rw,noatime,compress=zstd:3,subvol=/@home"},
+		Fstab:      []string{"UUID=def /home btrfs subvol=@home,compress=zstd:3 0 0"},
+	}
+	if !reflect.DeepEqual(m, want) {
+		t.Errorf("unexpected metadata: %+v", m)
+	}
+
+	// quotas and fstab are optional
+	delete(e.out, "btrfs qgroup show -re --raw /mnt")
+	delete(e.out, "cat /etc/fstab")
+	if m, err = j.captureMetadata(now); err != nil || m.QGroups != nil || m.Fstab != nil {
+		t.Errorf("unexpected metadata %+v, error %v", m, err)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := "printf %s " + string(data) + "\n | ssh -C -p22 nas -- dd of=/backup/laptop/.metadata.json.partial status=none"
+	move := "ssh -C -p22 nas -- mv -T /backup/laptop/.metadata.json.partial /backup/laptop/metadata.json"
+	e.out[write], e.out[move] = "", ""
+	if err := j.saveMetadata(now, false); err != nil {
+		t.Fatal(err)
+	}
+	if e.calls[write] != 1 || e.calls[move] != 1 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
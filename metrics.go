@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metrics are the statistics of the runs of every job in the Prometheus text format. A daemon serves them on /metrics,
+// one-shot runs write them to a file read by the textfile collector of the node exporter.
+type metrics struct {
+	mu   sync.Mutex
+	jobs map[string]*jobMetrics // by job name
+}
+
+// jobMetrics are the statistics of a job. Counters accumulate over all runs.
+type jobMetrics struct {
+	lastSuccess  time.Time     // end of the last successful run
+	duration     time.Duration // duration of the transfers of the last run
+	transmitted  int           // bytes sent
+	sent         int           // snapshots sent
+	deleted      int           // snapshots deleted by prunes
+	failures     int           // failed runs and prunes
+	lastFinished time.Time     // end of the last run
+}
+
+// metricNames are the exported metrics in the order they are written with their help text and type.
+var metricNames = [][3]string{
+	{"btrfs_backup_last_success_timestamp_seconds", "Time of the last successful run.", "gauge"},
+	{"btrfs_backup_last_run_timestamp_seconds", "Time of the last run.", "gauge"},
+	{"btrfs_backup_transfer_duration_seconds", "Duration of the transfers of the last run.", "gauge"},
+	{"btrfs_backup_transmitted_bytes_total", "Bytes sent to the destination.", "counter"},
+	{"btrfs_backup_snapshots_sent_total", "Snapshots sent to the destination.", "counter"},
+	{"btrfs_backup_snapshots_deleted_total", "Snapshots deleted by prunes.", "counter"},
+	{"btrfs_backup_failures_total", "Failed runs and prunes.", "counter"},
+}
+
+func newMetrics() *metrics {
+	return &metrics{jobs: make(map[string]*jobMetrics)}
+}
+
+// job returns the statistics of j. m must be locked.
+func (m *metrics) job(j *job) *jobMetrics {
+	jm := m.jobs[j.name]
+	if jm == nil {
+		jm = &jobMetrics{}
+		m.jobs[j.name] = jm
+	}
+	return jm
+}
+
+// sent records a snapshot of j sent with the given number of bytes. Like all methods recording statistics, it does
+// nothing on a nil metrics.
+func (m *metrics) sent(j *job, transmitted int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jm := m.job(j)
+	jm.sent++
+	jm.transmitted += transmitted
+}
+
+// finished records the end of a run of j which took d.
+func (m *metrics) finished(j *job, d time.Duration, err error, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jm := m.job(j)
+	jm.duration, jm.lastFinished = d, now
+	if err != nil {
+		jm.failures++
+	} else {
+		jm.lastSuccess = now
+	}
+}
+
+// pruned records a prune of j which deleted the given number of snapshots.
+func (m *metrics) pruned(j *job, deleted int, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jm := m.job(j)
+	jm.deleted += deleted
+	if err != nil {
+		jm.failures++
+	}
+}
+
+// values returns the value of every metric in the order of metricNames.
+func (jm *jobMetrics) values() []float64 {
+	timestamp := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixNano()) / 1e9
+	}
+	return []float64{
+		timestamp(jm.lastSuccess),
+		timestamp(jm.lastFinished),
+		jm.duration.Seconds(),
+		float64(jm.transmitted),
+		float64(jm.sent),
+		float64(jm.deleted),
+		float64(jm.failures),
+	}
+}
+
+// write writes m in the Prometheus text format.
+func (m *metrics) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for name := range m.jobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	values := make(map[string][]float64)
+	for _, name := range names {
+		values[name] = m.jobs[name].values()
+	}
+	bw := bufio.NewWriter(w)
+	for i, metric := range metricNames {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", metric[0], metric[1], metric[0], metric[2])
+		for _, name := range names {
+			fmt.Fprintf(bw, "%s{job=%q} %s\n", metric[0], name, strconv.FormatFloat(values[name][i], 'f', -1, 64))
+		}
+	}
+	return bw.Flush()
+}
+
+func (m *metrics) handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+var metricLineRegex = regexp.MustCompile(`^(btrfs_backup_[a-z_]+)\{job="([^"\\]*)"\} (\S+)$`)
+
+// loadMetrics reads metrics written to path by a previous run so that counters continue to accumulate. A missing file
+// yields empty metrics.
+func loadMetrics(path string) (*metrics, error) {
+	m := newMetrics()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loadMetrics: %v", err)
+	}
+	index := make(map[string]int)
+	for i, metric := range metricNames {
+		index[metric[0]] = i
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		match := metricLineRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		i, ok := index[match[1]]
+		v, err := strconv.ParseFloat(match[3], 64)
+		if !ok || err != nil {
+			continue
+		}
+		jm := m.jobs[match[2]]
+		if jm == nil {
+			jm = &jobMetrics{}
+			m.jobs[match[2]] = jm
+		}
+		timestamp := func() time.Time {
+			if v == 0 {
+				return time.Time{}
+			}
+			return time.Unix(0, int64(v*1e9))
+		}
+		switch i {
+		case 0:
+			jm.lastSuccess = timestamp()
+		case 1:
+			jm.lastFinished = timestamp()
+		case 2:
+			jm.duration = time.Duration(v * float64(time.Second))
+		case 3:
+			jm.transmitted = int(v)
+		case 4:
+			jm.sent = int(v)
+		case 5:
+			jm.deleted = int(v)
+		case 6:
+			jm.failures = int(v)
+		}
+	}
+	return m, nil
+}
+
+// save writes m to path atomically so that the textfile collector never reads a partial file.
+func (m *metrics) save(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("saveMetrics: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if err := m.write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("saveMetrics: %v", err)
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return fmt.Errorf("saveMetrics: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("saveMetrics: %v", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("saveMetrics: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	now := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	a, b := &job{name: "a"}, &job{name: "b"}
+	m := newMetrics()
+	m.sent(a, 100)
+	m.sent(a, 50)
+	m.finished(a, 90*time.Second, nil, now)
+	m.pruned(a, 3, nil)
+	m.finished(b, time.Second, errors.New("mock error"), now)
+	var none *metrics
+	none.sent(a, 1) // nil metrics are disabled
+
+	var buf bytes.Buffer
+	if err := m.write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`btrfs_backup_last_success_timestamp_seconds{job="a"} 1546398000`,
+		`btrfs_backup_last_success_timestamp_seconds{job="b"} 0`,
+		`btrfs_backup_transfer_duration_seconds{job="a"} 90`,
+		`btrfs_backup_transmitted_bytes_total{job="a"} 150`,
+		`btrfs_backup_snapshots_sent_total{job="a"} 2`,
+		`btrfs_backup_snapshots_deleted_total{job="a"} 3`,
+		`btrfs_backup_failures_total{job="b"} 1`,
+		`# TYPE btrfs_backup_failures_total counter`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("missing line %q in:\n%s", line, buf.String())
+		}
+	}
+
+	// counters of one-shot runs accumulate in the file
+	path := filepath.Join(t.TempDir(), "btrfs-backup.prom")
+	if err := m.save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadMetrics(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.jobs["a"].values(), m.jobs["a"].values()) || !reflect.DeepEqual(loaded.jobs["b"].values(), m.jobs["b"].values()) {
+		t.Errorf("unexpected metrics: %+v, %+v", loaded.jobs["a"], loaded.jobs["b"])
+	}
+	loaded.sent(a, 10)
+	if jm := loaded.jobs["a"]; jm.sent != 3 || jm.transmitted != 160 {
+		t.Errorf("unexpected metrics: %+v", jm)
+	}
+	if empty, err := loadMetrics(filepath.Join(t.TempDir(), "missing.prom")); err != nil || len(empty.jobs) != 0 {
+		t.Errorf("unexpected result: %v, %v", empty, err)
+	}
+
+	h := (&browseAPI{jobs: func() []job { return nil }, metrics: m}).handler()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != buf.String() {
+		t.Errorf("unexpected response %d: %s", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+
+	"gopkg.in/yaml.v3"
+)
+
+// migrateCommand prints the configuration file equivalent to the jobs given by the flags or an inventory.
+func migrateCommand(args []string) {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	out := fs.String("out", "", "file to write the configuration to instead of stdout")
+	fs.Parse(args)
+	jf.setup()
+
+	if jf.configPath() != "" {
+		log.Fatal("jobs are already defined by a configuration file")
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	buf, err := yaml.Marshal(configFromJobs(jobs))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *out == "" {
+		os.Stdout.Write(buf)
+		return
+	}
+	if err := os.WriteFile(*out, buf, 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Configuration written to %s, use it with: btrfs-backup -config %s", *out, *out)
+}
+
+// configFromJobs returns a configuration defining jobs. Destinations are named after their address, settings equal to
+// their default are left out.
+func configFromJobs(jobs []job) *config {
+	snapshotPath := "snapshot"
+	c := &config{
+		Defaults:     settings{SnapshotPath: &snapshotPath},
+		Destinations: make(map[string]*destinationConfig),
+		Jobs:         make(map[string]*jobConfig),
+	}
+	for _, j := range jobs {
+		dst := j.destination
+		dc := &destinationConfig{
+			Address:       fmt.Sprintf("%s:%d%s", dst.address, dst.sshPort, dst.mountPoint),
+			CryptDevice:   dst.cryptDevice,
+			Wrapper:       dst.wrapper,
+			Filters:       filterSpecs(dst.filters),
+			Compress:      dst.compress,
+			Archive:       dst.archive,
+			AgeRecipients: dst.encryption.age,
+			GPGRecipients: dst.encryption.gpg,
+			FullTag:       dst.fullTag,
+			MaxChain:      dst.maxChain,
+			Weight:        dst.weight,
+			StagingDir:    dst.stagingDir,
+			IncomingDir:   dst.incomingDir,
+			SSH:           dst.ssh.sshConfig(),
+		}
+		if dst.s3 != nil {
+			dc.Address, dc.Archive = dst.s3.url(dst.mountPoint), false
+			if dst.s3.endpoint != "" || dst.s3.profile != "" || dst.s3.storageClass != "" {
+				dc.S3 = &s3Config{Endpoint: dst.s3.endpoint, Profile: dst.s3.profile, StorageClass: dst.s3.storageClass}
+			}
+		}
+		if dst.stagingMax > 0 {
+			dc.StagingMax = fmt.Sprintf("%dB", dst.stagingMax)
+		}
+		dc.UploadRetries = dst.uploadRetries
+		dc.SendRetries = dst.sendRetries
+		dc.SendArgs, dc.ReceiveArgs = dst.sendArgs, dst.receiveArgs
+		if dst.fullEvery > 0 {
+			dc.FullEvery = fmt.Sprintf("%dh", int(dst.fullEvery.Hours()))
+		}
+		if dst.bwLimit > 0 {
+			dc.BWLimit = fmt.Sprintf("%dB/s", dst.bwLimit)
+		}
+		if dst.cleanup != cleanupDelete {
+			dc.Cleanup = dst.cleanup
+		}
+		if dst.quarantineDir != defaultQuarantineDir {
+			dc.QuarantineDir = dst.quarantineDir
+		}
+		name := c.destinationName(dst.address, dc)
+		c.Destinations[name] = dc
+
+		jc := &jobConfig{
+			Source:      fmt.Sprintf("%s:%d%s", j.source.address, j.source.sshPort, j.source.mountPoint),
+			Destination: name,
+		}
+		if j.source.snapshotPath != snapshotPath {
+			p := j.source.snapshotPath
+			jc.SnapshotPath = &p
+		}
+		if dst.snapshotPath != "" {
+			p := dst.snapshotPath
+			jc.DstSnapshotPath = &p
+		}
+		if j.source.snapshotRegex != nil && j.source.snapshotRegex != defaultSnapshotRegex {
+			r := j.source.snapshotRegex.String()
+			jc.SnapshotRegex = &r
+		}
+		if j.source.timeLayout != "" {
+			l := j.source.timeLayout
+			jc.TimeLayout = &l
+		}
+		c.Jobs[j.name] = jc
+	}
+	return c
+}
+
+// destinationName returns the name of the destination equal to dc or a new unique name based on address.
+func (c *config) destinationName(address string, dc *destinationConfig) string {
+	name := address
+	for i := 2; ; i++ {
+		existing, ok := c.Destinations[name]
+		if !ok || reflect.DeepEqual(existing, dc) {
+			return name
+		}
+		name = fmt.Sprintf("%s-%d", address, i)
+	}
+}
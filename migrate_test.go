@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestConfigFromJobs(t *testing.T) {
+	inv, err := parseInventory(strings.NewReader(`
+[clients]
+laptop
+desktop snapshot_path=.snapshots
+server dst=nas:2222/backup
+
+[clients:vars]
+dst=nas:22/backup
+dst_snapshot_path={{.host}}
+bwlimit=8MB/s
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := inv.jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf, err := yaml.Marshal(configFromJobs(jobs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(p, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := loadConfig(p)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, buf)
+	}
+	if len(c.Destinations) != 2 {
+		t.Errorf("unexpected destinations:\n%s", buf)
+	}
+	migrated, err := c.jobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the configuration contains the same jobs sorted by name
+	want := map[string]job{}
+	for _, j := range jobs {
+		want[j.name] = j
+	}
+	for _, j := range migrated {
+		if !reflect.DeepEqual(j, want[j.name]) {
+			t.Errorf("unexpected job:\n%#v\nwant:\n%#v", j, want[j.name])
+		}
+	}
+	if len(migrated) != len(jobs) {
+		t.Errorf("unexpected jobs:\n%s", buf)
+	}
+}
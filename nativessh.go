@@ -0,0 +1,555 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// nativeSSH runs the remote commands of ssh invocations, see sshArgs and sshWrapperCmd, with the built-in ssh client
+// instead of the ssh binary. Commands reaching the same host share a connection, which is dialled again if it broke.
+// The ssh client configuration, eg. ~/.ssh/config, does not apply, only the options of the invocation do.
+type nativeSSH struct {
+	mu      sync.Mutex
+	clients map[sshTarget]*ssh.Client
+
+	agentMu   sync.Mutex
+	agentConn net.Conn    // connection to the ssh agent, dialled on first use
+	agent     agent.Agent // client using agentConn
+}
+
+func newNativeSSH() *nativeSSH {
+	return &nativeSSH{clients: make(map[sshTarget]*ssh.Client)}
+}
+
+// close closes the connections to all hosts and to the ssh agent.
+func (s *nativeSSH) close() {
+	s.mu.Lock()
+	for t, c := range s.clients {
+		c.Close()
+		delete(s.clients, t)
+	}
+	s.mu.Unlock()
+
+	s.agentMu.Lock()
+	if s.agentConn != nil {
+		s.agentConn.Close()
+		s.agentConn, s.agent = nil, nil
+	}
+	s.agentMu.Unlock()
+}
+
+// knownHostsMu serializes the updates of known_hosts files, see hostKeyCallback.
+var knownHostsMu sync.Mutex
+
+// sshTarget is the host reached by an ssh invocation and the options of the connection.
+type sshTarget struct {
+	address               string
+	port                  int
+	user                  string
+	key                   string
+	jump                  string
+	knownHosts            string
+	strictHostKeyChecking string
+	connectTimeout        time.Duration
+}
+
+// isSSHCommand returns true if cmd is an ssh invocation created by sshCmd or sshWrapperCmd.
+func isSSHCommand(cmd []string) bool {
+	if _, ok := parseWrapperCmd(cmd); ok {
+		return true
+	}
+	return len(cmd) > 0 && cmd[0] == "ssh"
+}
+
+// parseSSHCommand returns the target and the remote command of the ssh invocation cmd created by sshArgs. Options the
+// built-in client doesn't implement are rejected. Compression (-C) is ignored.
+func parseSSHCommand(cmd []string) (sshTarget, []string, error) {
+	var t sshTarget
+	if len(cmd) == 0 || cmd[0] != "ssh" {
+		return t, nil, fmt.Errorf("parseSSHCommand: not an ssh command: %v", cmd)
+	}
+	t.port = 22
+	for i := 1; i < len(cmd); i++ {
+		arg := cmd[i]
+		value := func() (string, error) {
+			if i+1 >= len(cmd) {
+				return "", fmt.Errorf("parseSSHCommand: %s requires a value", arg)
+			}
+			i++
+			return cmd[i], nil
+		}
+		var err error
+		switch {
+		case arg == "--":
+			if t.address == "" {
+				return t, nil, fmt.Errorf("parseSSHCommand: no address: %v", cmd)
+			}
+			return t, cmd[i+1:], nil
+		case t.address != "":
+			return t, nil, fmt.Errorf("parseSSHCommand: unexpected argument after the address: %s", arg)
+		case arg == "-C":
+		case strings.HasPrefix(arg, "-p") && len(arg) > 2:
+			if t.port, err = strconv.Atoi(arg[2:]); err != nil {
+				return t, nil, fmt.Errorf("parseSSHCommand: invalid port: %s", arg)
+			}
+		case arg == "-l":
+			t.user, err = value()
+		case arg == "-i":
+			t.key, err = value()
+		case arg == "-J":
+			t.jump, err = value()
+		case arg == "-o":
+			var o string
+			if o, err = value(); err == nil {
+				err = t.setOption(o)
+			}
+		case strings.HasPrefix(arg, "-"):
+			return t, nil, fmt.Errorf("parseSSHCommand: %s is not supported by the built-in ssh client", arg)
+		default:
+			t.address = arg
+		}
+		if err != nil {
+			return t, nil, err
+		}
+	}
+	return t, nil, fmt.Errorf("parseSSHCommand: no remote command: %v", cmd)
+}
+
+// setOption sets an option given as -o Name=value, see sshOptions.args.
+func (t *sshTarget) setOption(o string) error {
+	name, value, _ := strings.Cut(o, "=")
+	switch name {
+	case "UserKnownHostsFile":
+		t.knownHosts = value
+	case "StrictHostKeyChecking":
+		t.strictHostKeyChecking = value
+	case "ConnectTimeout":
+		seconds, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("setOption: invalid connect timeout: %s", value)
+		}
+		t.connectTimeout = time.Duration(seconds) * time.Second
+	default:
+		return fmt.Errorf("setOption: -o %s is not supported by the built-in ssh client", o)
+	}
+	return nil
+}
+
+// jumpTarget returns the target of the jump host of t, given as [user@]host[:port] like ssh -J.
+func (t sshTarget) jumpTarget() (sshTarget, error) {
+	j := sshTarget{port: 22, key: t.key, knownHosts: t.knownHosts, strictHostKeyChecking: t.strictHostKeyChecking, connectTimeout: t.connectTimeout}
+	host := t.jump
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		j.user, host = host[:i], host[i+1:]
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		if j.port, err = strconv.Atoi(p); err != nil {
+			return j, fmt.Errorf("jumpTarget: invalid port: %s", t.jump)
+		}
+		host = h
+	}
+	if host == "" || strings.Contains(host, ",") {
+		return j, fmt.Errorf("jumpTarget: unsupported jump host: %s", t.jump)
+	}
+	j.address = host
+	return j, nil
+}
+
+// command returns the process running the remote command of the ssh invocation cmd.
+func (s *nativeSSH) command(cmd []string, stdin io.Reader, stdout, stderr io.Writer) (process, error) {
+	p := &remoteProcess{ssh: s, stdin: stdin, stdout: stdout, stderr: stderr}
+	if w, ok := parseWrapperCmd(cmd); ok {
+		// the request line precedes the input of the wrapper
+		p.prefix = wrapperRequest(w.request) + "\n"
+		p.discardInput = !w.stdin
+		cmd = w.ssh
+	}
+	t, remote, err := parseSSHCommand(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("command: %v", err)
+	}
+	if len(remote) == 0 {
+		return nil, fmt.Errorf("command: no remote command: %v", cmd)
+	}
+	p.target = t
+	// like the ssh binary, the arguments are joined and interpreted by the remote shell
+	p.cmd = strings.Join(remote, " ")
+	return p, nil
+}
+
+// session opens a session on the connection to t. A broken connection, eg. after the host moved to another network,
+// is dialled again.
+func (s *nativeSSH) session(t sshTarget) (*ssh.Session, error) {
+	c, err := s.client(t)
+	if err != nil {
+		return nil, err
+	}
+	session, err := c.NewSession()
+	if err == nil {
+		return session, nil
+	}
+	s.drop(t, c)
+	if c, err = s.client(t); err != nil {
+		return nil, err
+	}
+	return c.NewSession()
+}
+
+// client returns the connection to t, dialling it unless there is one already.
+func (s *nativeSSH) client(t sshTarget) (*ssh.Client, error) {
+	s.mu.Lock()
+	c := s.clients[t]
+	s.mu.Unlock()
+	if c != nil {
+		return c, nil
+	}
+	c, err := s.dial(t)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing := s.clients[t]; existing != nil {
+		// dialled concurrently by another command
+		c.Close()
+		return existing, nil
+	}
+	s.clients[t] = c
+	return c, nil
+}
+
+// drop closes and forgets the connection c to t.
+func (s *nativeSSH) drop(t sshTarget, c *ssh.Client) {
+	c.Close()
+	s.mu.Lock()
+	if s.clients[t] == c {
+		delete(s.clients, t)
+	}
+	s.mu.Unlock()
+}
+
+// dial connects to t, through the connection to its jump host if it has one.
+func (s *nativeSSH) dial(t sshTarget) (*ssh.Client, error) {
+	config, err := s.clientConfig(t)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %v", err)
+	}
+	addr := net.JoinHostPort(t.address, strconv.Itoa(t.port))
+	var conn net.Conn
+	if t.jump != "" {
+		jump, err := t.jumpTarget()
+		if err != nil {
+			return nil, fmt.Errorf("dial: %v", err)
+		}
+		c, err := s.client(jump)
+		if err != nil {
+			return nil, connectionError(fmt.Errorf("dial: jump host %s: %v", t.jump, err), err)
+		}
+		if conn, err = c.Dial("tcp", addr); err != nil {
+			s.drop(jump, c)
+			return nil, transientError{fmt.Errorf("dial: %s through %s: %v", addr, t.jump, err)}
+		}
+	} else {
+		timeout := t.connectTimeout
+		if timeout == 0 {
+			timeout = time.Minute
+		}
+		if conn, err = dialTimeout("tcp", addr, timeout); err != nil {
+			return nil, transientError{fmt.Errorf("dial: %v", err)}
+		}
+	}
+	if t.connectTimeout > 0 {
+		// limits the handshake as well
+		conn.SetDeadline(time.Now().Add(t.connectTimeout))
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, connectionError(fmt.Errorf("dial: %v", err), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// clientConfig returns the configuration of connections to t. The keys of a running ssh agent are offered first, then
+// the identity file of t or, if it has none, the default identity files without a passphrase.
+func (s *nativeSSH) clientConfig(t sshTarget) (*ssh.ClientConfig, error) {
+	name := t.user
+	if name == "" {
+		u, err := user.Current()
+		if err != nil {
+			return nil, fmt.Errorf("clientConfig: %v", err)
+		}
+		name = u.Username
+	}
+	var signers []ssh.Signer
+	if t.key != "" {
+		signer, err := loadSigner(t.key)
+		if err != nil {
+			return nil, fmt.Errorf("clientConfig: %v", err)
+		}
+		signers = append(signers, signer)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		for _, f := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			if signer, err := loadSigner(filepath.Join(home, ".ssh", f)); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+	hostKeyCallback, err := hostKeyCallback(t)
+	if err != nil {
+		return nil, fmt.Errorf("clientConfig: %v", err)
+	}
+	return &ssh.ClientConfig{
+		User: name,
+		// a single method since the client tries every method once only
+		Auth: []ssh.AuthMethod{ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			return append(s.agentSigners(), signers...), nil
+		})},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// loadSigner reads the private key in file, which must not be protected by a passphrase.
+func loadSigner(file string) (ssh.Signer, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("loadSigner: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("loadSigner: %s: %v", file, err)
+	}
+	return signer, nil
+}
+
+// agentSigners returns the keys of the ssh agent at SSH_AUTH_SOCK, none if there is no agent. The connection to the
+// agent is shared by all authentications, the signers use it during the handshake. A broken connection, eg. after the
+// agent restarted, is dialled again by the next authentication.
+func (s *nativeSSH) agentSigners() []ssh.Signer {
+	s.agentMu.Lock()
+	defer s.agentMu.Unlock()
+	if s.agent == nil {
+		sock := os.Getenv("SSH_AUTH_SOCK")
+		if sock == "" {
+			return nil
+		}
+		conn, err := net.Dial("unix", sock)
+		if err != nil {
+			return nil
+		}
+		s.agentConn, s.agent = conn, agent.NewClient(conn)
+	}
+	signers, err := s.agent.Signers()
+	if err != nil {
+		s.agentConn.Close()
+		s.agentConn, s.agent = nil, nil
+		return nil
+	}
+	return signers
+}
+
+// hostKeyCallback checks the host keys of t against its known_hosts file, ~/.ssh/known_hosts by default, according to
+// StrictHostKeyChecking: no accepts any key, accept-new adds the keys of unknown hosts to the file and any other value
+// rejects them.
+func hostKeyCallback(t sshTarget) (ssh.HostKeyCallback, error) {
+	if t.strictHostKeyChecking == "no" {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	file := t.knownHosts
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("hostKeyCallback: %v", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	if t.strictHostKeyChecking != "accept-new" {
+		callback, err := knownhosts.New(file)
+		if err != nil {
+			return nil, fmt.Errorf("hostKeyCallback: %v", err)
+		}
+		return callback, nil
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+		// read for every connection since another one may have added the host
+		callback, err := knownhosts.New(file)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("hostKeyCallback: %v", err)
+		}
+		if err == nil {
+			var keyErr *knownhosts.KeyError
+			if err := callback(hostname, remote, key); !errors.As(err, &keyErr) || len(keyErr.Want) > 0 {
+				return err
+			}
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return fmt.Errorf("hostKeyCallback: %v", err)
+		}
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("hostKeyCallback: %v", err)
+		}
+		defer f.Close()
+		if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+			return fmt.Errorf("hostKeyCallback: %v", err)
+		}
+		return nil
+	}, nil
+}
+
+// remoteProcess is a process running the remote command of an ssh invocation in a session of nativeSSH.
+type remoteProcess struct {
+	ssh          *nativeSSH
+	target       sshTarget
+	cmd          string
+	prefix       string // sent before the input
+	discardInput bool   // only prefix is sent
+	stdin        io.Reader
+	stdout       io.Writer
+	stderr       io.Writer
+
+	inputPipe  *io.PipeReader // set by StdinPipe
+	outputPipe *io.PipeWriter // set by StdoutPipe
+
+	session    *ssh.Session
+	inputDone  chan struct{}
+	outputDone chan struct{}
+}
+
+func (p *remoteProcess) StdinPipe() (io.WriteCloser, error) {
+	if p.stdin != nil {
+		return nil, fmt.Errorf("StdinPipe: stdin already set")
+	}
+	r, w := io.Pipe()
+	p.stdin, p.inputPipe = r, r
+	return w, nil
+}
+
+func (p *remoteProcess) StdoutPipe() (io.ReadCloser, error) {
+	if p.stdout != nil {
+		return nil, fmt.Errorf("StdoutPipe: stdout already set")
+	}
+	r, w := io.Pipe()
+	p.stdout, p.outputPipe = w, w
+	return remoteOutput{r, p}, nil
+}
+
+// remoteOutput is the output of a remoteProcess.
+type remoteOutput struct {
+	*io.PipeReader
+	p *remoteProcess
+}
+
+// Close stops the command of the process if it is still sending output, like closing the reading end of a pipe.
+func (o remoteOutput) Close() error {
+	if o.p.outputDone != nil {
+		select {
+		case <-o.p.outputDone:
+		default:
+			o.p.session.Close()
+		}
+	}
+	return o.PipeReader.Close()
+}
+
+func (p *remoteProcess) Start() error {
+	session, err := p.ssh.session(p.target)
+	if err != nil {
+		return connectionError(fmt.Errorf("ssh %s: %v", p.target.address, err), err)
+	}
+	session.Stderr = p.stderr
+	in, err := session.StdinPipe()
+	if err != nil {
+		session.Close()
+		return fmt.Errorf("ssh %s: %v", p.target.address, err)
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return fmt.Errorf("ssh %s: %v", p.target.address, err)
+	}
+	if err := session.Start(p.cmd); err != nil {
+		session.Close()
+		return connectionError(fmt.Errorf("ssh %s: %v", p.target.address, err), err)
+	}
+	p.session = session
+	p.inputDone, p.outputDone = make(chan struct{}), make(chan struct{})
+
+	go func() {
+		defer close(p.inputDone)
+		var r io.Reader = strings.NewReader(p.prefix)
+		if p.stdin != nil && !p.discardInput {
+			r = io.MultiReader(r, p.stdin)
+		}
+		io.Copy(in, r)
+		in.Close()
+		if p.inputPipe != nil {
+			// the writer fails once the command stopped reading, like with a closed pipe
+			p.inputPipe.CloseWithError(io.ErrClosedPipe)
+		}
+	}()
+	go func() {
+		defer close(p.outputDone)
+		w := p.stdout
+		if w == nil {
+			w = io.Discard
+		}
+		_, err := io.Copy(w, out)
+		if p.outputPipe != nil {
+			p.outputPipe.CloseWithError(err)
+		}
+	}()
+	return nil
+}
+
+func (p *remoteProcess) Wait() error {
+	err := p.session.Wait()
+	<-p.outputDone
+	if p.inputPipe != nil {
+		p.inputPipe.CloseWithError(io.ErrClosedPipe)
+	}
+	p.session.Close()
+	<-p.inputDone
+	if err != nil {
+		return connectionError(fmt.Errorf("ssh %s: %v", p.target.address, err), err)
+	}
+	return nil
+}
+
+// connectionError returns err as a transientError if its cause is a failed or lost connection, like the ssh binary
+// exiting with status 255. A missing exit status means the connection was lost while the command was running.
+func connectionError(err, cause error) error {
+	var transient transientError
+	var netErr net.Error
+	var exitMissing *ssh.ExitMissingError
+	if errors.As(cause, &transient) || errors.As(cause, &netErr) || errors.As(cause, &exitMissing) ||
+		errors.Is(cause, io.EOF) || errors.Is(cause, syscall.ECONNRESET) {
+		return transientError{err}
+	}
+	return err
+}
+
+func (p *remoteProcess) terminate() {
+	p.session.Signal(ssh.SIGTERM)
+}
+
+func (p *remoteProcess) kill() {
+	p.session.Close()
+}
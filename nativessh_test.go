@@ -0,0 +1,282 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshServer runs the commands of its sessions with sh and counts the connections.
+type sshServer struct {
+	listener    net.Listener
+	config      *ssh.ServerConfig
+	connections atomic.Int32
+}
+
+func newSSHServer(t *testing.T, clientKey ssh.PublicKey) *sshServer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "backup" || string(key.Marshal()) != string(clientKey.Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &sshServer{listener: l, config: config}
+	go s.serve()
+	return s
+}
+
+func (s *sshServer) port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *sshServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+			if err != nil {
+				return
+			}
+			s.connections.Add(1)
+			go ssh.DiscardRequests(reqs)
+			for c := range chans {
+				go s.session(c)
+			}
+		}()
+	}
+}
+
+func (s *sshServer) session(c ssh.NewChannel) {
+	ch, reqs, err := c.Accept()
+	if err != nil {
+		return
+	}
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+		cmd := exec.Command("sh", "-c", payload.Command)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = ch, ch, ch.Stderr()
+		status := 0
+		if err := cmd.Run(); err != nil {
+			status = 1
+		}
+		ch.CloseWrite()
+		ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+		return
+	}
+}
+
+func TestNativeSSH(t *testing.T) {
+	dir := t.TempDir()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := filepath.Join(dir, "id_ed25519")
+	if err := os.WriteFile(key, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newSSHServer(t, clientKey)
+	knownHosts := filepath.Join(dir, "known_hosts")
+	n := &node{
+		address: "127.0.0.1",
+		sshPort: server.port(),
+		ssh:     sshOptions{user: "backup", key: key, knownHosts: knownHosts, strictHostKeyChecking: "accept-new"},
+	}
+	e := executorImpl{ssh: newNativeSSH()}
+	defer e.ssh.close()
+	n.executor = e
+
+	out, err := n.run("echo", "hello")
+	if err != nil || out != "hello\n" {
+		t.Fatalf("unexpected result: %q, %v", out, err)
+	}
+	if buf, err := os.ReadFile(knownHosts); err != nil || !strings.Contains(string(buf), "[127.0.0.1]:"+strconv.Itoa(n.sshPort)) {
+		t.Errorf("host key not added: %q, %v", buf, err)
+	}
+
+	// the stream passes through the pipeline
+	out, transmitted, err := e.exec([][]string{{"printf", "foo"}, n.stdinCommand("tr", "a-z", "A-Z"), {"cat"}})
+	if err != nil || out != "FOO" || transmitted != 3 {
+		t.Errorf("unexpected result: %q, %d, %v", out, transmitted, err)
+	}
+
+	// the exit status of the remote command is passed on, failing commands aren't retried
+	if _, err := n.run("false"); err == nil || retryable(err) {
+		t.Errorf("unexpected result: %v", err)
+	}
+
+	// the wrapper receives the request followed by the input
+	n.wrapper = "cat"
+	out, _, err = e.exec([][]string{{"printf", "foo"}, n.stdinCommand("btrfs", "receive", "/backup")})
+	if want := wrapperRequest([]string{"btrfs", "receive", "/backup"}) + "\nfoo"; err != nil || out != want {
+		t.Errorf("unexpected result: %q, %v", out, err)
+	}
+	n.wrapper = ""
+
+	if c := server.connections.Load(); c != 1 {
+		t.Errorf("connection not reused: %d connections", c)
+	}
+
+	// known hosts are checked
+	n.ssh.strictHostKeyChecking = "yes"
+	if err := os.WriteFile(knownHosts, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	n.executor = executorImpl{ssh: newNativeSSH()}
+	if _, err := n.run("true"); err == nil || !strings.Contains(err.Error(), "knownhosts") || retryable(err) {
+		t.Errorf("expected unknown host error, got %v", err)
+	}
+
+	// refused connections may be retried
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.sshPort = l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	if _, err := n.run("true"); err == nil || !retryable(err) {
+		t.Errorf("expected retryable error, got %v", err)
+	}
+}
+
+func TestNativeSSHAgent(t *testing.T) {
+	dir := t.TempDir()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: private}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var dialled atomic.Int32
+	served := make(chan struct{})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			dialled.Add(1)
+			go func() {
+				agent.ServeAgent(keyring, conn)
+				served <- struct{}{}
+			}()
+		}
+	}()
+	t.Setenv("SSH_AUTH_SOCK", sock)
+
+	clientKey, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newSSHServer(t, clientKey)
+	s := newNativeSSH()
+	e := executorImpl{ssh: s}
+	// different known_hosts files make different connections, each authenticating with the agent
+	for _, f := range []string{"known_hosts", "known_hosts2"} {
+		n := &node{address: "127.0.0.1", sshPort: server.port(), executor: e,
+			ssh: sshOptions{user: "backup", knownHosts: filepath.Join(dir, f), strictHostKeyChecking: "accept-new"}}
+		if out, err := n.run("echo", "hello"); err != nil || out != "hello\n" {
+			t.Fatalf("unexpected result: %q, %v", out, err)
+		}
+	}
+	if c := server.connections.Load(); c != 2 {
+		t.Errorf("unexpected number of connections: %d", c)
+	}
+	if c := dialled.Load(); c != 1 {
+		t.Errorf("agent dialled %d times", c)
+	}
+	s.close()
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Error("agent connection not closed")
+	}
+}
+
+func TestParseSSHCommand(t *testing.T) {
+	data := []struct {
+		cmd    string
+		target sshTarget
+		remote string
+		err    bool
+	}{
+		{cmd: "ssh -C -p2222 nas -- ls -1 /backup", target: sshTarget{address: "nas", port: 2222}, remote: "ls -1 /backup"},
+		{cmd: "ssh -p22 -l backup -i /key -J jump:2022 -o UserKnownHostsFile=/kh -o StrictHostKeyChecking=accept-new -o ConnectTimeout=5 nas -- true",
+			target: sshTarget{address: "nas", port: 22, user: "backup", key: "/key", jump: "jump:2022", knownHosts: "/kh", strictHostKeyChecking: "accept-new", connectTimeout: 5e9}, remote: "true"},
+		{cmd: "ssh -p22 -o ServerAliveInterval=30 nas -- true", err: true},
+		{cmd: "ssh -p22 -v nas -- true", err: true},
+		{cmd: "ssh -p22 nas true", err: true},
+		{cmd: "ssh -p22 -- true", err: true},
+	}
+	for _, d := range data {
+		target, remote, err := parseSSHCommand(strings.Fields(d.cmd))
+		if d.err {
+			if err == nil {
+				t.Errorf("%s: expected error but succeeded", d.cmd)
+			}
+			continue
+		}
+		if err != nil || target != d.target || strings.Join(remote, " ") != d.remote {
+			t.Errorf("%s: unexpected result: %+v, %v, %v", d.cmd, target, remote, err)
+		}
+	}
+
+	j, err := sshTarget{jump: "admin@gateway:2022", key: "/key"}.jumpTarget()
+	if err != nil || j != (sshTarget{address: "gateway", port: 2022, user: "admin", key: "/key"}) {
+		t.Errorf("unexpected jump target: %+v, %v", j, err)
+	}
+}
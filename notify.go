@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	outcomeSuccess  = "success"  // all jobs succeeded
+	outcomePartial  = "partial"  // some jobs failed
+	outcomeFailure  = "failure"  // all jobs failed
+	outcomeDeferred = "deferred" // the conditions of opportunistic mode weren't met, no job ran
+)
+
+// runReport is the result of running all jobs once. It is the payload of notifications.
+type runReport struct {
+	Outcome  string      `json:"outcome"` // success, partial or failure
+	Started  time.Time   `json:"started"`
+	Finished time.Time   `json:"finished"`
+	Jobs     []jobResult `json:"jobs"`
+}
+
+// jobResult is the result of a single job, ie. one subvolume replicated to one destination.
+type jobResult struct {
+	Job         string `json:"job"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Error       string `json:"error,omitempty"` // empty if the job succeeded
+}
+
+// add records the result of j.
+func (r *runReport) add(j *job, err error) {
+	res := jobResult{Job: j.name, Source: j.source.key(), Destination: j.destination.key()}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	r.Jobs = append(r.Jobs, res)
+}
+
+// finish sets the outcome according to the results of the jobs.
+func (r *runReport) finish(t time.Time) {
+	r.Finished = t
+	switch failed := r.failed(); {
+	case failed == 0:
+		r.Outcome = outcomeSuccess
+	case failed < len(r.Jobs):
+		r.Outcome = outcomePartial
+	default:
+		r.Outcome = outcomeFailure
+	}
+}
+
+// failed returns the number of failed jobs.
+func (r *runReport) failed() int {
+	failed := 0
+	for _, j := range r.Jobs {
+		if j.Error != "" {
+			failed++
+		}
+	}
+	return failed
+}
+
+// notify posts r as JSON to url, eg. a webhook of a monitoring system.
+func (r *runReport) notify(url string) error {
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("notify: %v", err)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("notify: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("notify: %s: %s", url, resp.Status)
+	}
+	return nil
+}
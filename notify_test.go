@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunReport(t *testing.T) {
+	jobs := []job{
+		{name: "root", source: node{address: "localhost", mountPoint: "/mnt"}, destination: node{address: "nas", sshPort: 22, mountPoint: "/backup"}},
+		{name: "home", source: node{address: "localhost", mountPoint: "/home"}, destination: node{address: "nas", sshPort: 22, mountPoint: "/backup"}},
+	}
+	data := []struct {
+		errs    []error
+		outcome string
+	}{
+		{[]error{nil, nil}, outcomeSuccess},
+		{[]error{nil, errors.New("ssh failed")}, outcomePartial},
+		{[]error{errors.New("ssh failed"), errors.New("ssh failed")}, outcomeFailure},
+	}
+	for di, d := range data {
+		var received runReport
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+				t.Errorf("%d: %v", di, err)
+			}
+		}))
+
+		r := &runReport{Started: time.Date(2019, 1, 1, 3, 0, 0, 0, time.UTC)}
+		for i := range jobs {
+			r.add(&jobs[i], d.errs[i])
+		}
+		r.finish(r.Started.Add(time.Minute))
+		if r.Outcome != d.outcome {
+			t.Errorf("%d: unexpected outcome: %s", di, r.Outcome)
+		}
+		if err := r.notify(srv.URL); err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+		if !reflect.DeepEqual(&received, r) {
+			t.Errorf("%d: unexpected payload: %+v", di, received)
+		}
+		srv.Close()
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	if err := (&runReport{}).notify(srv.URL); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+}
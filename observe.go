@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// observerExecutor only runs commands without side effects and rejects all others. It protects observers, eg.
+// monitoring hosts, against accidentally modifying the nodes.
+type observerExecutor struct {
+	executor executor
+}
+
+func (e observerExecutor) exec(cmds [][]string) (string, int, error) {
+	for _, cmd := range cmds {
+		if !readOnlyCommand(cmd) {
+			return "", 0, fmt.Errorf("observer mode: refusing to run %s", strings.Join(cmd, " "))
+		}
+	}
+	return e.executor.exec(cmds)
+}
+
+// readOnlyCommand reports whether cmd, possibly wrapped in ssh, is known to have no side effects.
+func readOnlyCommand(cmd []string) bool {
+	cmd = unwrapCommand(cmd)
+	if len(cmd) == 0 {
+		return false
+	}
+	switch cmd[0] {
+	case "ls", "df", "date", "test", "findmnt", "stat", "realpath":
+		return true
+	case "find":
+		for _, arg := range cmd[1:] {
+			switch arg {
+			case "-delete", "-exec", "-execdir", "-ok", "-okdir", "-fprint", "-fprint0", "-fprintf", "-fls":
+				return false
+			}
+		}
+		return true
+	case "aws":
+		// listing an archive in object storage
+		for _, arg := range cmd[1:] {
+			if arg == "list-objects-v2" {
+				return true
+			}
+		}
+	case "btrfs":
+		if len(cmd) == 2 && cmd[1] == "--version" {
+			return true
+		}
+		if len(cmd) >= 3 {
+			switch cmd[1] + " " + cmd[2] {
+			case "subvolume list", "subvolume show", "filesystem df", "filesystem show", "filesystem usage", "qgroup show":
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// observeCommand reports the replication status of every job without modifying any node.
+func observeCommand(args []string) {
+	fs := flag.NewFlagSet("observe", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	check := fs.Bool("check", false, "additionally check versions, permissions and free space on the nodes")
+	fs.Parse(args)
+	jf.setup()
+
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	failed := 0
+	for i := range jobs {
+		j := &jobs[i]
+		j.source.executor = observerExecutor{j.source.executor}
+		j.destination.executor = observerExecutor{j.destination.executor}
+		if err := j.observe(*check, time.Now()); err != nil {
+			log.Printf("Job %s failed: %v", j.name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(jobs))
+	}
+}
+
+// observe logs the number of snapshots on both nodes, the snapshots still to be sent and the age of the most recent
+// snapshot at the destination.
+func (j *job) observe(check bool, now time.Time) error {
+	sourceSnapshots, err := j.source.getSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to get local snapshots: %v", err)
+	}
+	destinationSnapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+
+	present := make(map[string]bool)
+	for _, s := range destinationSnapshots {
+		present[s] = true
+	}
+	pending := 0
+	common := newestCommonSnapshot(sourceSnapshots, destinationSnapshots)
+	afterCommon := common == ""
+	for _, s := range sourceSnapshots {
+		if afterCommon && !present[s] {
+			pending++
+		}
+		afterCommon = afterCommon || s == common
+	}
+
+	newest := "none"
+	if len(destinationSnapshots) > 0 {
+		newest = destinationSnapshots[len(destinationSnapshots)-1]
+		if t, ok := j.destination.snapshotTime(newest); ok {
+			newest += fmt.Sprintf(" (%v old)", now.Sub(t).Truncate(time.Minute))
+		}
+	}
+	log.Printf("%s: %d snapshots at source, %d at destination, %d pending, most recent at destination: %s",
+		j.name, len(sourceSnapshots), len(destinationSnapshots), pending, newest)
+
+	if check {
+		return j.checkRemote()
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadOnlyCommand(t *testing.T) {
+	data := []struct {
+		cmd string
+		res bool
+	}{
+		{"btrfs subvolume list /mnt", true},
+		{"ssh -C -p22 nas -- btrfs subvolume list /mnt", true},
+		{"btrfs --version", true},
+		{"ls -1 /mnt/snapshot", true},
+		{"find /mnt -maxdepth 1", true},
+		{"find /mnt -delete", false},
+		{"ssh -C -p22 nas -- find /mnt -exec rm {} ;", false},
+		{"btrfs subvolume delete /mnt/snapshot/1", false},
+		{"btrfs send /mnt/snapshot/1", false},
+		{"btrfs receive /mnt", false},
+		{"mkdir -p /mnt/x", false},
+		{"ssh -C -p22 nas btrfs subvolume list /mnt", false},
+	}
+	for di, d := range data {
+		if res := readOnlyCommand(strings.Split(d.cmd, " ")); res != d.res {
+			t.Errorf("%d: unexpected result for %s: %v", di, d.cmd, res)
+		}
+	}
+}
+
+func TestObserve(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                       "ID 1 gen 1 top level 5 path snapshot/2019-01-01_03-00\nID 2 gen 2 top level 5 path snapshot/2019-01-02_03-00\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup": "ID 1 gen 1 top level 5 path laptop/2019-01-01_03-00\n",
+		"ssh -C -p22 nas -- btrfs subvolume delete /x":    "",
+	}}
+	r := regexp.MustCompile(`^\d\d\d\d-\d\d-\d\d_\d\d-\d\d$`)
+	o := observerExecutor{e}
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: o},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: o},
+	}
+	if err := j.observe(false, time.Now()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := j.destination.run("btrfs", "subvolume", "delete", "/x"); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+	if e.calls["ssh -C -p22 nas -- btrfs subvolume delete /x"] != 0 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
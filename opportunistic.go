@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// conditions must be met before a run starts in opportunistic mode, which makes it safe to schedule runs frequently on
+// a laptop. If one isn't met, the run is deferred to the next scheduled one.
+type conditions struct {
+	ac        bool          // require AC power
+	networks  []string      // SSIDs of the wireless networks runs are allowed on, empty allows any network
+	reachable bool          // require the destinations to be reachable
+	idle      time.Duration // require all sessions to be idle for this long, 0 disables the check
+	local     node          // runs the commands checking the conditions
+}
+
+// powerSupplyDir is the sysfs directory listing the power supplies. It is replaced by tests.
+var powerSupplyDir = "/sys/class/power_supply"
+
+// enabled reports whether any condition is set.
+func (c conditions) enabled() bool {
+	return c.ac || len(c.networks) > 0 || c.reachable || c.idle > 0
+}
+
+// unmet returns why a run of jobs must be deferred at now or an empty string if all conditions are met.
+func (c conditions) unmet(jobs []job, now time.Time) string {
+	if c.ac {
+		ac, err := onACPower()
+		if err != nil {
+			return fmt.Sprintf("cannot determine the power source: %v", err)
+		}
+		if !ac {
+			return "running on battery"
+		}
+	}
+	if len(c.networks) > 0 {
+		ssid := c.local.currentSSID()
+		allowed := false
+		for _, n := range c.networks {
+			allowed = allowed || n == ssid
+		}
+		if !allowed {
+			if ssid == "" {
+				return "not connected to an allowed network"
+			}
+			return fmt.Sprintf("connected to %s which is not an allowed network", ssid)
+		}
+	}
+	if c.reachable {
+		for i := range jobs {
+			if n := &jobs[i].destination; !reachable(n) {
+				return fmt.Sprintf("destination %s is unreachable", n.address)
+			}
+		}
+	}
+	if c.idle > 0 {
+		since, err := c.local.idleSince()
+		if err != nil {
+			return fmt.Sprintf("cannot determine whether the user is idle: %v", err)
+		}
+		if since.IsZero() || now.Sub(since) < c.idle {
+			return "the user is active"
+		}
+	}
+	return ""
+}
+
+// onACPower reports whether a mains power supply is online. Hosts without a mains power supply in sysfs, eg. desktops
+// reporting none, are assumed to be on AC power.
+func onACPower() (bool, error) {
+	entries, err := os.ReadDir(powerSupplyDir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("onACPower: %v", err)
+	}
+	mains := false
+	for _, e := range entries {
+		typ, err := os.ReadFile(filepath.Join(powerSupplyDir, e.Name(), "type"))
+		if err != nil || strings.TrimSpace(string(typ)) != "Mains" {
+			continue
+		}
+		mains = true
+		online, err := os.ReadFile(filepath.Join(powerSupplyDir, e.Name(), "online"))
+		if err != nil {
+			return false, fmt.Errorf("onACPower: %v", err)
+		}
+		if strings.TrimSpace(string(online)) == "1" {
+			return true, nil
+		}
+	}
+	return !mains, nil
+}
+
+// currentSSID returns the SSID of the wireless network n is connected to or an empty string if it isn't connected to
+// one.
+func (n *node) currentSSID() string {
+	out, err := n.run("iwgetid", "-r")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+// reachable reports whether the ssh port of n accepts connections. Local nodes and nodes behind a jump host are
+// assumed to be reachable.
+func reachable(n *node) bool {
+	if n.sshPort == 0 || n.sshOptions().jump != "" {
+		return true
+	}
+	return probeEndpoint(endpoint{address: n.address, sshPort: n.sshPort}) >= 0
+}
+
+// idleSince returns since when all sessions managed by logind on n are idle, or the zero time if one of them is
+// active.
+func (n *node) idleSince() (time.Time, error) {
+	out, err := n.run("loginctl", "list-sessions", "--no-legend")
+	if err != nil {
+		return time.Time{}, fmt.Errorf("idleSince: %v", err)
+	}
+	var since time.Time
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		out, err := n.run("loginctl", "show-session", fields[0], "-p", "IdleHint", "-p", "IdleSinceHint")
+		if err != nil {
+			return time.Time{}, fmt.Errorf("idleSince: %v", err)
+		}
+		props := make(map[string]string)
+		for _, prop := range strings.Split(out, "\n") {
+			if k, v, ok := strings.Cut(prop, "="); ok {
+				props[k] = v
+			}
+		}
+		if props["IdleHint"] != "yes" {
+			return time.Time{}, nil
+		}
+		usec, err := strconv.ParseInt(props["IdleSinceHint"], 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("idleSince: unexpected IdleSinceHint: %s", props["IdleSinceHint"])
+		}
+		if t := time.UnixMicro(usec); t.After(since) {
+			since = t
+		}
+	}
+	if since.IsZero() {
+		// nobody is logged in
+		return time.Unix(0, 0), nil
+	}
+	return since, nil
+}
+
+const (
+	usageRun  = "run"  // run jobs as usual
+	usageSkip = "skip" // skip jobs
+)
+
+// usagePolicy is how jobs sending to a destination are run while the local host is on battery or on a metered
+// connection. The zero value runs them as usual.
+type usagePolicy struct {
+	skip    bool // skip the jobs
+	bwLimit int  // maximum bytes per second sent to the destination, 0 means unlimited
+}
+
+// parseUsagePolicy parses "run", "skip" or a maximum rate like 1MB/s. An empty string runs jobs as usual.
+func parseUsagePolicy(s string) (usagePolicy, error) {
+	switch s {
+	case "", usageRun:
+		return usagePolicy{}, nil
+	case usageSkip:
+		return usagePolicy{skip: true}, nil
+	}
+	limit, err := parseRate(s)
+	if err != nil || limit <= 0 {
+		return usagePolicy{}, fmt.Errorf("invalid usage policy: %s", s)
+	}
+	return usagePolicy{bwLimit: limit}, nil
+}
+
+// metered reports whether NetworkManager on n considers the primary connection metered, including guesses.
+func (n *node) metered() (bool, error) {
+	out, err := n.run("busctl", "get-property", "org.freedesktop.NetworkManager", "/org/freedesktop/NetworkManager",
+		"org.freedesktop.NetworkManager", "Metered")
+	if err != nil {
+		return false, fmt.Errorf("metered: %v", err)
+	}
+	fields := strings.Fields(out)
+	if len(fields) != 2 || fields[0] != "u" {
+		return false, fmt.Errorf("metered: unexpected output: %s", out)
+	}
+	// NM_METERED_YES and NM_METERED_GUESS_YES
+	return fields[1] == "1" || fields[1] == "3", nil
+}
+
+// applyUsagePolicies applies the battery and metered connection policies of the destinations of jobs to the state of
+// the local host. Jobs are throttled in place. It returns why jobs are skipped by index. If the state cannot be
+// determined, jobs run as usual.
+func applyUsagePolicies(jobs []job, local *node) map[int]string {
+	needed := false
+	for i := range jobs {
+		needed = needed || jobs[i].destination.onBattery != (usagePolicy{}) || jobs[i].destination.onMetered != (usagePolicy{})
+	}
+	if !needed {
+		return nil
+	}
+	ac, err := onACPower()
+	if err != nil {
+		log.Printf("Warning: assuming AC power: %v", err)
+		ac = true
+	}
+	metered, err := local.metered()
+	if err != nil {
+		log.Printf("Warning: assuming an unmetered connection: %v", err)
+	}
+
+	skipped := make(map[int]string)
+	for i := range jobs {
+		j := &jobs[i]
+		var policies []usagePolicy
+		var reasons []string
+		if !ac {
+			policies, reasons = append(policies, j.destination.onBattery), append(reasons, "on battery")
+		}
+		if metered {
+			policies, reasons = append(policies, j.destination.onMetered), append(reasons, "on a metered connection")
+		}
+		limit := j.destination.bwLimit
+		for k, p := range policies {
+			if p.skip {
+				skipped[i] = reasons[k]
+				break
+			}
+			if p.bwLimit > 0 && (limit == 0 || p.bwLimit < limit) {
+				limit = p.bwLimit
+			}
+		}
+		if _, ok := skipped[i]; !ok && limit != j.destination.bwLimit {
+			log.Printf("Job %s: limiting the transfer rate to %s/s", j.name, formatBytes(limit))
+			j.destination.bwLimit = limit
+			j.source.executor = withBWLimit(j.source.executor, limit)
+		}
+	}
+	return skipped
+}
+
+// withBWLimit returns e limiting the rate of its pipes to limit bytes per second.
+func withBWLimit(e executor, limit int) executor {
+	return withExecutorImpl(e, func(e *executorImpl) { e.bwLimit = limit })
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestOnACPower(t *testing.T) {
+	defer func(dir string) { powerSupplyDir = dir }(powerSupplyDir)
+	data := []struct {
+		files map[string]string
+		ac    bool
+	}{
+		{map[string]string{"AC/type": "Mains\n", "AC/online": "1\n", "BAT0/type": "Battery\n"}, true},
+		{map[string]string{"AC/type": "Mains\n", "AC/online": "0\n", "BAT0/type": "Battery\n"}, false},
+		{map[string]string{"ADP0/type": "Mains\n", "ADP0/online": "0\n", "ADP1/type": "Mains\n", "ADP1/online": "1\n"}, true},
+		{map[string]string{"BAT0/type": "Battery\n"}, true},
+	}
+	for di, d := range data {
+		powerSupplyDir = writeFiles(t, d.files)
+		if ac, err := onACPower(); err != nil || ac != d.ac {
+			t.Errorf("%d: unexpected result: %v, %v", di, ac, err)
+		}
+	}
+	powerSupplyDir = "/nonexistent"
+	if ac, err := onACPower(); err != nil || !ac {
+		t.Errorf("unexpected result without power supplies: %v, %v", ac, err)
+	}
+}
+
+func TestConditions(t *testing.T) {
+	defer func(d func(string, string, time.Duration) (net.Conn, error)) { dialTimeout = d }(dialTimeout)
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, errors.New("no route to host")
+	}
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	e := &mapExecutor{out: map[string]string{
+		"iwgetid -r":                         "home\n",
+		"loginctl list-sessions --no-legend": "2 1000 alice seat0 tty2\n",
+		"loginctl show-session 2 -p IdleHint -p IdleSinceHint": "IdleHint=yes\nIdleSinceHint=" +
+			strconv.FormatInt(now.Add(-20*time.Minute).UnixMicro(), 10) + "\n",
+	}}
+	local := node{address: "localhost", executor: e}
+	jobs := []job{{name: "a", destination: node{address: "nas", sshPort: 22}}}
+	data := []struct {
+		c     conditions
+		unmet bool
+	}{
+		{conditions{networks: []string{"office", "home"}}, false},
+		{conditions{networks: []string{"office"}}, true},
+		{conditions{idle: 10 * time.Minute}, false},
+		{conditions{idle: 30 * time.Minute}, true},
+		{conditions{reachable: true}, true},
+	}
+	for di, d := range data {
+		d.c.local = local
+		if reason := d.c.unmet(jobs, now); (reason != "") != d.unmet {
+			t.Errorf("%d: unexpected result: %q", di, reason)
+		}
+	}
+
+	e.out["loginctl show-session 2 -p IdleHint -p IdleSinceHint"] = "IdleHint=no\nIdleSinceHint=0\n"
+	if reason := (conditions{idle: time.Minute, local: local}).unmet(jobs, now); reason != "the user is active" {
+		t.Errorf("unexpected result: %q", reason)
+	}
+}
+
+func TestParseUsagePolicy(t *testing.T) {
+	data := []struct {
+		s   string
+		res usagePolicy
+		err bool
+	}{
+		{"", usagePolicy{}, false},
+		{"run", usagePolicy{}, false},
+		{"skip", usagePolicy{skip: true}, false},
+		{"1MiB/s", usagePolicy{bwLimit: 1 << 20}, false},
+		{"0", usagePolicy{}, true},
+		{"sometimes", usagePolicy{}, true},
+	}
+	for _, d := range data {
+		res, err := parseUsagePolicy(d.s)
+		if d.err != (err != nil) {
+			t.Errorf("%q: unexpected error: %v", d.s, err)
+			continue
+		}
+		if res != d.res {
+			t.Errorf("%q: unexpected result: %+v", d.s, res)
+		}
+	}
+}
+
+func TestApplyUsagePolicies(t *testing.T) {
+	defer func(dir string) { powerSupplyDir = dir }(powerSupplyDir)
+	powerSupplyDir = writeFiles(t, map[string]string{"AC/type": "Mains\n", "AC/online": "0\n"})
+	busctl := "busctl get-property org.freedesktop.NetworkManager /org/freedesktop/NetworkManager org.freedesktop.NetworkManager Metered"
+	e := &mapExecutor{out: map[string]string{busctl: "u 4\n"}}
+	local := &node{address: "localhost", executor: e}
+	newJobs := func() []job {
+		return []job{
+			{name: "usb", source: node{executor: executorImpl{}}, destination: node{}},
+			{name: "nas", source: node{executor: executorImpl{}}, destination: node{bwLimit: 4 << 20, onBattery: usagePolicy{bwLimit: 1 << 20}, onMetered: usagePolicy{skip: true}}},
+			{name: "cloud", source: node{executor: executorImpl{}}, destination: node{onBattery: usagePolicy{skip: true}}},
+		}
+	}
+
+	// on battery
+	jobs := newJobs()
+	skipped := applyUsagePolicies(jobs, local)
+	if len(skipped) != 1 || skipped[2] == "" {
+		t.Errorf("unexpected skipped jobs: %v", skipped)
+	}
+	if jobs[1].destination.bwLimit != 1<<20 || jobs[1].source.executor.(executorImpl).bwLimit != 1<<20 {
+		t.Errorf("job not throttled: %+v", jobs[1])
+	}
+
+	// on battery and a metered connection
+	e.out[busctl] = "u 1\n"
+	jobs = newJobs()
+	if skipped := applyUsagePolicies(jobs, local); len(skipped) != 2 || skipped[1] == "" || skipped[2] == "" {
+		t.Errorf("unexpected skipped jobs: %v", skipped)
+	}
+
+	// on AC power
+	powerSupplyDir = writeFiles(t, map[string]string{"AC/type": "Mains\n", "AC/online": "1\n"})
+	e.out[busctl] = "u 2\n"
+	jobs = newJobs()
+	if skipped := applyUsagePolicies(jobs, local); len(skipped) != 0 || jobs[1].destination.bwLimit != 4<<20 {
+		t.Errorf("unexpected result: %v, %+v", skipped, jobs[1])
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"io"
+)
+
+// outputExecutor is implemented by executors which can write the output of the last command of a pipeline to a writer
+// while it runs instead of collecting it in memory.
+type outputExecutor interface {
+	execOutput(w io.Writer, cmds [][]string) (int, error)
+}
+
+// execOutput runs cmds with e like exec and writes the output of the last command to w. Executors not implementing
+// outputExecutor collect the output first and write it once the commands finished.
+func execOutput(e executor, w io.Writer, cmds [][]string) (int, error) {
+	if oe, ok := e.(outputExecutor); ok {
+		return oe.execOutput(w, cmds)
+	}
+	out, transmitted, err := e.exec(cmds)
+	if err != nil {
+		return transmitted, err
+	}
+	_, err = io.WriteString(w, out)
+	return transmitted, err
+}
+
+// runOutput runs cmd at n and writes its output to w.
+func (n *node) runOutput(w io.Writer, cmd ...string) error {
+	_, err := execOutput(n.executor, w, [][]string{n.command(cmd...)})
+	return err
+}
+
+func (e executorImpl) execOutput(w io.Writer, cmds [][]string) (int, error) {
+	e.stdout = w
+	_, transmitted, err := e.exec(cmds)
+	return transmitted, err
+}
+
+func (e allowlistExecutor) execOutput(w io.Writer, cmds [][]string) (int, error) {
+	if err := e.check(cmds); err != nil {
+		return 0, err
+	}
+	return execOutput(e.executor, w, cmds)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExecOutput(t *testing.T) {
+	var buf bytes.Buffer
+	transmitted, err := execOutput(executorImpl{}, &buf, [][]string{{"printf", "foo"}, {"tr", "a-z", "A-Z"}})
+	if err != nil || buf.String() != "FOO" || transmitted != 3 {
+		t.Errorf("unexpected result: %q, %d, %v", buf.String(), transmitted, err)
+	}
+
+	// executors without support get the collected output
+	buf.Reset()
+	e := &mapExecutor{out: map[string]string{"cat /backup/file": "data"}}
+	if _, err := execOutput(e, &buf, [][]string{{"cat", "/backup/file"}}); err != nil || buf.String() != "data" {
+		t.Errorf("unexpected result: %q, %v", buf.String(), err)
+	}
+
+	// the allowlist is checked before running anything
+	buf.Reset()
+	if _, err := execOutput(allowlistExecutor{executorImpl{}, []string{"/backup"}}, &buf, [][]string{{"cat", "/etc/passwd"}}); err == nil || buf.Len() != 0 {
+		t.Errorf("expected error but got %q, %v", buf.String(), err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// checkParents verifies that the destination copy of every parent of an incremental transfer which the destination
+// already has was received from the source parent. btrfs receive looks up the parent by the received UUID, so a
+// destination snapshot which was made writable and changed, replaced or created locally fails the transfer with
+// "cannot find parent subvolume" or, worse, applies the stream to a different sub-volume. Parents sent in the same
+// run were received from the source just before and aren't checked.
+func (j *job) checkParents(transfers []transfer, destinationSnapshots []string) error {
+	if j.destination.archive {
+		return nil
+	}
+	present := make(map[string]bool)
+	for _, s := range destinationSnapshots {
+		present[s] = true
+	}
+	var parents []string
+	checked := make(map[string]bool)
+	for _, t := range transfers {
+		if t.parent != "" && present[t.parent] && !checked[t.parent] {
+			checked[t.parent] = true
+			parents = append(parents, t.parent)
+		}
+	}
+	if len(parents) == 0 {
+		return nil
+	}
+
+	sourceInfos, err := j.source.listSubvolumeInfo()
+	if err != nil {
+		return fmt.Errorf("checkParents: %v", err)
+	}
+	destinationInfos, err := j.destination.listSubvolumeInfo()
+	if err != nil {
+		return fmt.Errorf("checkParents: %v", err)
+	}
+	for _, p := range parents {
+		source, ok := findInfo(sourceInfos, path.Join(j.source.snapshotPath, p, j.source.subvolume))
+		if !ok {
+			return fmt.Errorf("checkParents: parent snapshot %s not found at the source", p)
+		}
+		want := sentUUID(source)
+		destination, ok := findInfo(destinationInfos, path.Join(j.destination.snapshotPath, p, j.destination.subvolume))
+		switch {
+		case !ok:
+			return fmt.Errorf("checkParents: parent snapshot %s not found at the destination", p)
+		case sameSnapshot(source, destination):
+		case destination.receivedUUID == "" || destination.receivedUUID == "-":
+			return fmt.Errorf("checkParents: parent snapshot %s at the destination has no received UUID, it was created or changed there, see reseal", p)
+		case destination.receivedUUID != want:
+			return fmt.Errorf("checkParents: parent snapshot %s at the destination was received from %s instead of %s, see reseal", p, destination.receivedUUID, want)
+		}
+	}
+	return nil
+}
+
+// sentUUID returns the UUID which sub-volumes received from the source sub-volume info carry as their received UUID. A
+// source which received the sub-volume itself sends the UUID it was received from.
+func sentUUID(info subvolumeInfo) string {
+	if info.receivedUUID != "" && info.receivedUUID != "-" {
+		return info.receivedUUID
+	}
+	return info.uuid
+}
+
+// sameSnapshot reports whether the source sub-volume info and the destination sub-volume info are copies of the same
+// snapshot: the destination received it from the source or, after a failover, the source received it from the
+// destination, see reverseSync.
+func sameSnapshot(source, destination subvolumeInfo) bool {
+	if destination.receivedUUID != "" && destination.receivedUUID != "-" {
+		return destination.receivedUUID == sentUUID(source)
+	}
+	return source.receivedUUID == destination.uuid
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCheckParents(t *testing.T) {
+	tests := []struct {
+		name        string
+		source      string
+		destination string
+		transfers   []transfer
+		err         string
+	}{
+		{
+			name:        "received",
+			source:      "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\n",
+			destination: "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\n",
+			transfers:   []transfer{{snapshot: "2", parent: "1"}, {snapshot: "3", parent: "2"}},
+		},
+		{
+			name:        "pulled",
+			source:      "ID 1 gen 1 top level 5 received_uuid c1 uuid a1 path snapshot/1\n",
+			destination: "ID 1 gen 1 top level 5 received_uuid c1 uuid b1 path laptop/1\n",
+			transfers:   []transfer{{snapshot: "2", parent: "1"}},
+		},
+		{
+			name:        "sent back after a failover",
+			source:      "ID 1 gen 1 top level 5 received_uuid b1 uuid a1 path snapshot/1\n",
+			destination: "ID 1 gen 1 top level 5 received_uuid - uuid b1 path laptop/1\n",
+			transfers:   []transfer{{snapshot: "2", parent: "1"}},
+		},
+		{
+			name:      "full",
+			transfers: []transfer{{snapshot: "2"}},
+		},
+		{
+			name:        "not received",
+			source:      "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\n",
+			destination: "ID 1 gen 1 top level 5 received_uuid - uuid b1 path laptop/1\n",
+			transfers:   []transfer{{snapshot: "2", parent: "1"}},
+			err:         "has no received UUID",
+		},
+		{
+			name:        "received from another snapshot",
+			source:      "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\n",
+			destination: "ID 1 gen 1 top level 5 received_uuid a0 uuid b1 path laptop/1\n",
+			transfers:   []transfer{{snapshot: "2", parent: "1"}},
+			err:         "received from a0 instead of a1",
+		},
+		{
+			name:        "missing",
+			source:      "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\n",
+			destination: "ID 2 gen 1 top level 5 received_uuid a0 uuid b0 path laptop/0\n",
+			transfers:   []transfer{{snapshot: "2", parent: "1"}},
+			err:         "not found at the destination",
+		},
+	}
+
+	r := regexp.MustCompile(`^\d$`)
+	for _, test := range tests {
+		e := &mapExecutor{out: map[string]string{
+			"btrfs subvolume list -u -R /mnt":                       test.source,
+			"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup": test.destination,
+		}}
+		j := job{
+			source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+			destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+		}
+		err := j.checkParents(test.transfers, []string{"1"})
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+		if test.name == "full" && len(e.calls) != 0 {
+			t.Errorf("%s: unexpected calls: %v", test.name, e.calls)
+		}
+	}
+}
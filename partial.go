@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+)
+
+// cleanPartial disposes of the snapshots at the destination of j left behind by failed receives according to the
+// cleanup setting of the destination and returns them. btrfs receive sets the received UUID and makes the snapshot
+// read-only once the stream is complete, so a writable snapshot without a received UUID is a partial receive. It
+// blocks receiving the snapshot again and must not serve as a parent. A destination snapshot named like a source
+// snapshot but received from another sub-volume is a collision which isn't removed automatically: it fails the job.
+func (j *job) cleanPartial(dryRun bool) ([]string, error) {
+	if j.destination.archive {
+		// archives are written to hidden partial files which never show up as snapshots
+		return nil, nil
+	}
+	partial, collisions, err := j.partialReceives()
+	if err != nil {
+		return nil, err
+	}
+	if len(collisions) > 0 {
+		return nil, fmt.Errorf("cleanPartial: destination snapshots %v weren't received from the source snapshots of the same name, move them away", collisions)
+	}
+	var cleaned []string
+	for _, s := range partial {
+		log.Printf("%s: %s at the destination is a partial receive", j.name, s)
+		if dryRun {
+			continue
+		}
+		if err := j.destination.disposePartial(j.destination.snapshotSubvolume(s)); err != nil {
+			return cleaned, fmt.Errorf("cleanPartial: %v", err)
+		}
+		cleaned = append(cleaned, s)
+	}
+	return cleaned, nil
+}
+
+// partialReceives returns the destination snapshots of j which are partial receives, see cleanPartial, and the
+// destination snapshots which collide with a source snapshot of the same name.
+func (j *job) partialReceives() (partial, collisions []string, err error) {
+	sourceSnapshots, err := j.source.getSnapshots()
+	if err != nil {
+		return nil, nil, fmt.Errorf("partialReceives: %v", err)
+	}
+	destinationSnapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		return nil, nil, fmt.Errorf("partialReceives: %v", err)
+	}
+	if len(destinationSnapshots) == 0 {
+		return nil, nil, nil
+	}
+	sourceInfos, err := j.source.listSubvolumeInfo()
+	if err != nil {
+		return nil, nil, fmt.Errorf("partialReceives: %v", err)
+	}
+	destinationInfos, err := j.destination.listSubvolumeInfo()
+	if err != nil {
+		return nil, nil, fmt.Errorf("partialReceives: %v", err)
+	}
+	writable, err := j.destination.writableSnapshots()
+	if err != nil {
+		return nil, nil, fmt.Errorf("partialReceives: %v", err)
+	}
+	isWritable := make(map[string]bool)
+	for _, s := range writable {
+		isWritable[s] = true
+	}
+	sourceUUIDs := make(map[string]string)
+	for _, s := range sourceSnapshots {
+		if info, ok := findInfo(sourceInfos, path.Join(j.source.snapshotPath, s, j.source.subvolume)); ok {
+			sourceUUIDs[s] = sentUUID(info)
+		}
+	}
+
+	for _, s := range destinationSnapshots {
+		info, ok := findInfo(destinationInfos, path.Join(j.destination.snapshotPath, s, j.destination.subvolume))
+		switch {
+		case !ok:
+			continue
+		case info.receivedUUID == "-" && isWritable[s]:
+			partial = append(partial, s)
+		case info.receivedUUID != "-" && sourceUUIDs[s] != "" && info.receivedUUID != sourceUUIDs[s]:
+			collisions = append(collisions, s)
+		}
+	}
+	return partial, collisions, nil
+}
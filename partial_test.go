@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestCleanPartial(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		readOnly    string
+		cleanup     string
+		dryRun      bool
+		cleaned     []string
+		cmd         string
+		err         string
+	}{
+		{
+			name:        "intact",
+			destination: "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid a2 uuid b2 path laptop/2\n",
+			readOnly:    "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+		},
+		{
+			name:        "partial",
+			destination: "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid - uuid b2 path laptop/2\n",
+			readOnly:    "ID 1 gen 1 top level 5 path laptop/1\n",
+			cleaned:     []string{"2"},
+			cmd:         "ssh -C -p22 nas -- btrfs subvolume delete /backup/laptop/2",
+		},
+		{
+			name:        "partial renamed",
+			destination: "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid - uuid b2 path laptop/2\n",
+			readOnly:    "ID 1 gen 1 top level 5 path laptop/1\n",
+			cleanup:     cleanupRename,
+			cleaned:     []string{"2"},
+			cmd:         "ssh -C -p22 nas -- mv -T /backup/laptop/2 /backup/laptop/2.partial",
+		},
+		{
+			name:        "dry run",
+			destination: "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid - uuid b2 path laptop/2\n",
+			readOnly:    "ID 1 gen 1 top level 5 path laptop/1\n",
+			dryRun:      true,
+		},
+		{
+			// created at the destination and made read-only, left to verify
+			name:        "not received",
+			destination: "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid - uuid b2 path laptop/2\n",
+			readOnly:    "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+		},
+		{
+			name:        "collision",
+			destination: "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid c2 uuid b2 path laptop/2\n",
+			readOnly:    "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+			err:         "[2]",
+		},
+	}
+
+	r := regexp.MustCompile(`^\d$`)
+	for _, test := range tests {
+		var listing strings.Builder
+		for _, line := range strings.Split(strings.TrimSpace(test.destination), "\n") {
+			i := strings.Index(line, " received_uuid")
+			listing.WriteString(line[:i] + line[strings.Index(line, " path"):] + "\n")
+		}
+		e := &mapExecutor{out: map[string]string{
+			"btrfs subvolume list /mnt":                             "ID 1 gen 1 top level 5 path snapshot/1\nID 2 gen 2 top level 5 path snapshot/2\n",
+			"btrfs subvolume list -u -R /mnt":                       "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\nID 2 gen 2 top level 5 received_uuid - uuid a2 path snapshot/2\n",
+			"ssh -C -p22 nas -- btrfs subvolume list /backup":       listing.String(),
+			"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup": test.destination,
+			"ssh -C -p22 nas -- btrfs subvolume list -r /backup":    test.readOnly,
+		}}
+		if test.cmd != "" {
+			e.out[test.cmd] = ""
+		}
+		j := job{
+			name:        "a",
+			source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+			destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e, cleanup: test.cleanup},
+		}
+		cleaned, err := j.cleanPartial(test.dryRun)
+		if test.err == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+		if !reflect.DeepEqual(cleaned, test.cleaned) {
+			t.Errorf("%s: unexpected cleaned snapshots: %v", test.name, cleaned)
+		}
+		if test.cmd != "" && e.calls[test.cmd] != 1 {
+			t.Errorf("%s: %s not run, calls %v", test.name, test.cmd, e.calls)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// pauser lets a running daemon be paused, eg. while all the bandwidth is needed for something else. A paused daemon
+// finishes the snapshot it is sending and waits before sending the next one.
+type pauser struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	until  time.Time   // zero if paused until resumed
+	timer  *time.Timer // resumes at until
+}
+
+func newPauser() *pauser {
+	p := &pauser{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// pause pauses transfers for d or until resumed if d is 0.
+func (p *pauser) pause(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.paused, p.until = true, time.Time{}
+	if d > 0 {
+		p.until = time.Now().Add(d)
+		p.timer = time.AfterFunc(d, p.resume)
+	}
+}
+
+// resume continues paused transfers.
+func (p *pauser) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	p.paused, p.until = false, time.Time{}
+	p.cond.Broadcast()
+}
+
+// wait blocks while transfers are paused. A nil pauser never blocks.
+func (p *pauser) wait() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused {
+		log.Printf("Paused, waiting to be resumed")
+		for p.paused {
+			p.cond.Wait()
+		}
+		log.Printf("Resumed")
+	}
+}
+
+// pauseStatus is the response of the pause API.
+type pauseStatus struct {
+	Paused bool       `json:"paused"`
+	Until  *time.Time `json:"until,omitempty"` // nil if paused until resumed
+}
+
+func (p *pauser) status() pauseStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := pauseStatus{Paused: p.paused}
+	if p.paused && !p.until.IsZero() {
+		until := p.until
+		s.Until = &until
+	}
+	return s
+}
+
+// handlePause serves GET /api/pause returning the status and POST /api/pause?for=DURATION pausing transfers.
+func (p *pauser) handlePause(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var d time.Duration
+		if s := r.URL.Query().Get("for"); s != "" {
+			var err error
+			if d, err = time.ParseDuration(s); err != nil || d < 0 {
+				http.Error(w, fmt.Sprintf("invalid duration: %s", s), http.StatusBadRequest)
+				return
+			}
+		}
+		p.pause(d)
+		log.Printf("Pausing after the current snapshot")
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, p.status())
+}
+
+// handleResume serves POST /api/resume.
+func (p *pauser) handleResume(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	p.resume()
+	writeJSON(w, p.status())
+}
+
+// pauseCommand pauses a daemon serving its API with -listen.
+func pauseCommand(args []string) {
+	fs := flag.NewFlagSet("pause", flag.ExitOnError)
+	api := addAPIFlags(fs)
+	d := fs.Duration("for", 0, "resume automatically after this duration, 0 pauses until resumed")
+	fs.Parse(args)
+
+	q := url.Values{}
+	if *d > 0 {
+		q.Set("for", d.String())
+	}
+	addr, token := api()
+	if err := postControl(os.Stdout, addr, token, "/api/pause", q); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// resumeCommand resumes a daemon paused with the pause command.
+func resumeCommand(args []string) {
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	api := addAPIFlags(fs)
+	fs.Parse(args)
+
+	addr, token := api()
+	if err := postControl(os.Stdout, addr, token, "/api/resume", nil); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// postControl posts to the control endpoint p of the daemon API at addr and copies the response to w. A non-empty
+// token authenticates the request.
+func postControl(w io.Writer, addr, token, p string, q url.Values) error {
+	u := url.URL{Scheme: "http", Host: addr, Path: p, RawQuery: q.Encode()}
+	req, err := http.NewRequest(http.MethodPost, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("postControl: %v", err)
+	}
+	resp, err := doAPIRequest(req, token)
+	if err != nil {
+		return fmt.Errorf("postControl: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("postControl: %s: %s", resp.Status, body)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPauser(t *testing.T) {
+	var p *pauser
+	p.wait() // a nil pauser never blocks
+
+	p = newPauser()
+	p.pause(0)
+	resumed := make(chan bool)
+	go func() {
+		p.wait()
+		close(resumed)
+	}()
+	select {
+	case <-resumed:
+		t.Fatal("wait returned while paused")
+	case <-time.After(50 * time.Millisecond):
+	}
+	p.resume()
+	select {
+	case <-resumed:
+	case <-time.After(time.Second):
+		t.Fatal("wait didn't return after resume")
+	}
+
+	p.pause(10 * time.Millisecond)
+	if s := p.status(); !s.Paused || s.Until == nil {
+		t.Errorf("unexpected status: %+v", s)
+	}
+	p.wait()
+	if s := p.status(); s.Paused {
+		t.Errorf("not resumed automatically: %+v", s)
+	}
+}
+
+func TestPauseAPI(t *testing.T) {
+	p := newPauser()
+	srv := httptest.NewServer((&browseAPI{jobs: func() []job { return nil }, pause: p}).handler())
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	var out bytes.Buffer
+	if err := postControl(&out, addr, "", "/api/pause", url.Values{"for": {"1h"}}); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.status(); !s.Paused || s.Until == nil || !strings.Contains(out.String(), `"paused":true`) {
+		t.Errorf("unexpected status: %+v, %s", s, out.String())
+	}
+	if err := postControl(&out, addr, "", "/api/pause", url.Values{"for": {"soon"}}); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+	if err := postControl(&out, addr, "", "/api/resume", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.status(); s.Paused {
+		t.Errorf("unexpected status: %+v", s)
+	}
+
+	resp, err := http.Get(srv.URL + "/api/resume")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	// without a pauser the control endpoints are not served
+	h := (&browseAPI{jobs: func() []job { return nil }}).handler()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/pause", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("unexpected status: %d", rec.Code)
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// plan is a reviewable description of the snapshots which will be sent and deleted. It is written by the plan
+// command and executed by the apply command.
+type plan struct {
+	Created time.Time `json:"created"`
+	Jobs    []jobPlan `json:"jobs"`
+}
+
+// jobPlan contains the intended actions of one job.
+type jobPlan struct {
+	Job    string        `json:"job"`
+	Key    string        `json:"key"` // detects changes of the job's nodes between plan and apply
+	Sends  []plannedSend `json:"sends"`
+	Prunes []string      `json:"prunes"` // snapshots deleted at the destination after sending
+}
+
+type plannedSend struct {
+	Snapshot string `json:"snapshot"`
+	Parent   string `json:"parent"` // empty for a full send
+}
+
+// planCommand writes a plan file containing the intended sends and prunes of every job.
+func planCommand(args []string) {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	out := fs.String("out", "", "plan file to write")
+	order := fs.String("order", orderOldestFirst, "order in which missing snapshots are sent: oldest-first or newest-first")
+	keep := fs.Int("keep", 0, "number of most recent snapshots kept at the destination, 0 disables pruning")
+	windows := fs.String("retention", "", "comma separated windows of snapshots kept by age, eg. 7d,daily:90d,monthly:2y")
+	fs.Parse(args)
+	jf.setup()
+
+	if *out == "" {
+		log.Fatal("-out is required")
+	}
+	if *order != orderOldestFirst && *order != orderNewestFirst {
+		log.Fatalf("invalid -order: %s", *order)
+	}
+	r, err := jf.retention(*keep, *windows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	st := jf.loadState()
+
+	p := plan{Created: time.Now()}
+	for i := range jobs {
+		jp, err := jobs[i].plan(*order, r, p.Created)
+		if err != nil {
+			log.Fatalf("Job %s failed: %v", jobs[i].name, err)
+		}
+		jp.Prunes = withoutHeld(jp.Prunes, st.holds(&jobs[i].destination))
+		for _, s := range jp.Sends {
+			log.Printf("%s: send %s", jp.Job, s.Snapshot)
+		}
+		for _, s := range jp.Prunes {
+			log.Printf("%s: delete %s", jp.Job, s)
+		}
+		if len(jp.Prunes) > 0 {
+			jobs[i].destination.reportReclaimable(jp.Prunes)
+		}
+		p.Jobs = append(p.Jobs, jp)
+	}
+	if err := p.save(*out); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Plan written to %s, execute it with: btrfs-backup apply -plan %s", *out, *out)
+}
+
+// applyCommand executes a plan file written by the plan command.
+func applyCommand(args []string) {
+	fs := flag.NewFlagSet("apply", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	planFile := fs.String("plan", "", "plan file to execute")
+	fs.Parse(args)
+	jf.setup()
+
+	if *planFile == "" {
+		log.Fatal("-plan is required")
+	}
+	p, err := loadPlan(*planFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	failed := 0
+	for _, jp := range p.Jobs {
+		j, err := selectJob(jobs, jp.Job)
+		if err == nil {
+			err = j.apply(jp, *dryRun)
+		}
+		if err != nil {
+			log.Printf("Job %s failed: %v", jp.Job, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(p.Jobs))
+	}
+}
+
+// plan returns the sends required to transfer all missing snapshots in the given order followed by the prunes of the
+// snapshots at the destination not kept by r at now. An empty retention disables pruning.
+func (j *job) plan(order string, r retention, now time.Time) (jobPlan, error) {
+	jp := jobPlan{Job: j.name, Key: j.key()}
+	sourceSnapshots, err := j.source.getSnapshots()
+	if err != nil {
+		return jp, fmt.Errorf("failed to get local snapshots: %v", err)
+	}
+	destinationSnapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		return jp, fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+	if len(destinationSnapshots) == 0 {
+		return jp, fmt.Errorf("no snapshots at destination, initial transfer must be done manually")
+	}
+
+	missing := snapshotsOf(planTransfers(sourceSnapshots, destinationSnapshots))
+	for _, t := range orderTransfers(missing, sourceSnapshots, destinationSnapshots, order) {
+		jp.Sends = append(jp.Sends, plannedSend{Snapshot: t.snapshot, Parent: t.parent})
+	}
+	if r.empty() {
+		return jp, nil
+	}
+
+	// prune the destination as it will be after sending
+	after := append(append([]string(nil), destinationSnapshots...), missing...)
+	j.destination.sortSnapshots(after)
+	protected := make(map[string]bool)
+	if common := newestCommonSnapshot(sourceSnapshots, after); common != "" {
+		protected[common] = true
+	}
+	for _, s := range missing {
+		protected[s] = true
+	}
+	jp.Prunes = planPrune(after, r.forNode(&j.destination), now, protected)
+	return jp, nil
+}
+
+// apply executes jp after verifying that it still matches the job and the snapshots at the destination.
+func (j *job) apply(jp jobPlan, dryRun bool) error {
+	if jp.Key != j.key() {
+		return fmt.Errorf("apply: job changed since planning: %s, was %s", j.key(), jp.Key)
+	}
+	destinationSnapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+	present := make(map[string]bool)
+	for _, s := range destinationSnapshots {
+		present[s] = true
+	}
+	for _, s := range jp.Sends {
+		if present[s.Snapshot] {
+			return fmt.Errorf("apply: stale plan: %s already exists at destination", s.Snapshot)
+		}
+		if s.Parent != "" && !present[s.Parent] {
+			return fmt.Errorf("apply: stale plan: parent %s of %s missing at destination", s.Parent, s.Snapshot)
+		}
+		present[s.Snapshot] = true
+	}
+	for _, s := range jp.Prunes {
+		if !present[s] {
+			return fmt.Errorf("apply: stale plan: %s missing at destination", s)
+		}
+	}
+
+	var transfers []transfer
+	for _, s := range jp.Sends {
+		transfers = append(transfers, transfer{snapshot: s.Snapshot, parent: s.Parent})
+	}
+	if _, err := sendTransfers(&j.source, &j.destination, transfers, dryRun, nil); err != nil {
+		return err
+	}
+	if len(jp.Prunes) == 0 {
+		return nil
+	}
+	for _, s := range jp.Prunes {
+		log.Printf("Deleting %s", s)
+	}
+	if dryRun {
+		return nil
+	}
+	if err := j.destination.deleteSnapshots(jp.Prunes, deleteBatches{}); err != nil {
+		return fmt.Errorf("apply: %v", err)
+	}
+	return nil
+}
+
+func loadPlan(path string) (*plan, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadPlan: %v", err)
+	}
+	var p plan
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return nil, fmt.Errorf("loadPlan: %s: %v", path, err)
+	}
+	return &p, nil
+}
+
+func (p *plan) save(path string) error {
+	buf, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return fmt.Errorf("savePlan: %v", err)
+	}
+	if err := os.WriteFile(path, buf, 0644); err != nil {
+		return fmt.Errorf("savePlan: %v", err)
+	}
+	return nil
+}
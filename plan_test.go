@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestPlanApply(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                       "ID 1 gen 1 top level 5 path snapshot/2\nID 2 gen 2 top level 5 path snapshot/3\nID 3 gen 3 top level 5 path snapshot/4\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup": "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+		"btrfs send --quiet -p /mnt/snapshot/2 /mnt/snapshot/3 | ssh -C -p22 nas -- btrfs receive /backup": "",
+		"btrfs send --quiet -p /mnt/snapshot/3 /mnt/snapshot/4 | ssh -C -p22 nas -- btrfs receive /backup": "",
+		"ssh -C -p22 nas -- btrfs subvolume delete /backup/laptop/1 /backup/laptop/2":                      "",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		name:        "laptop",
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+
+	jp, err := j.plan(orderOldestFirst, retention{keep: 2}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := jobPlan{
+		Job:    "laptop",
+		Key:    j.key(),
+		Sends:  []plannedSend{{"3", "2"}, {"4", "3"}},
+		Prunes: []string{"1", "2"},
+	}
+	if !reflect.DeepEqual(jp, want) {
+		t.Fatalf("unexpected plan: %#v", jp)
+	}
+
+	p := filepath.Join(t.TempDir(), "plan.json")
+	if err := (&plan{Jobs: []jobPlan{jp}}).save(p); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadPlan(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := j.apply(loaded.Jobs[0], false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(e.calls) != 5 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+
+	// a plan is rejected if the destination changed in the meantime
+	e.out["ssh -C -p22 nas -- btrfs subvolume list /backup"] += "ID 3 gen 3 top level 5 path laptop/3\n"
+	if err := j.apply(jp, false); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+
+	// or if the job changed
+	j.destination.mountPoint = "/other"
+	if err := j.apply(jp, false); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+}
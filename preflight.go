@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	clockSkewWarn  = "warn"  // log a warning if the clock skew exceeds the threshold
+	clockSkewAbort = "abort" // abort the job if the clock skew exceeds the threshold
+)
+
+// checkRemote runs cheap, side effect free commands on the source and destination node to detect authentication,
+// permission and compatibility problems during a dry run.
+func (j *job) checkRemote() error {
+	var errs []string
+	for _, n := range []*node{&j.source, &j.destination} {
+		// archives store streams as files and need no btrfs
+		if n.archive {
+			continue
+		}
+		version, err := n.btrfsVersion()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: btrfs version: %v", n.address, err))
+		} else {
+			log.Printf("%s: %s", n.address, version)
+		}
+	}
+
+	if j.destination.s3 != nil {
+		if _, err := j.destination.listArchive(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", j.destination.key(), err))
+		}
+	} else {
+		dir := path.Join(j.destination.mountPoint, j.destination.snapshotPath)
+		if _, err := j.destination.run("test", "-d", dir, "-a", "-w", dir); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s is not a writable directory: %v", j.destination.address, dir, err))
+		}
+
+		free, err := j.destination.freeSpace()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: free space: %v", j.destination.address, err))
+		} else {
+			log.Printf("%s: %s free on %s", j.destination.address, formatBytes(free), j.destination.mountPoint)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("checkRemote: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// btrfsVersion returns the output of "btrfs --version", eg. "btrfs-progs v6.2".
+func (n *node) btrfsVersion() (string, error) {
+	out, err := n.run("btrfs", "--version")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// freeSpace returns the number of bytes available on the filesystem mounted at the mount point of n.
+func (n *node) freeSpace() (int, error) {
+	return n.df("avail")
+}
+
+// usedSpace returns the number of bytes used on the filesystem mounted at the mount point of n.
+func (n *node) usedSpace() (int, error) {
+	return n.df("used")
+}
+
+// df returns the number of bytes of the filesystem mounted at the mount point of n in field, eg. avail.
+func (n *node) df(field string) (int, error) {
+	out, err := n.run("df", "--output="+field, "-B1", n.mountPoint)
+	if err != nil {
+		return 0, err
+	}
+	lines := strings.Fields(out)
+	if len(lines) != 2 {
+		return 0, fmt.Errorf("unexpected df output: %s", out)
+	}
+	res, err := strconv.Atoi(lines[1])
+	if err != nil {
+		return 0, fmt.Errorf("unexpected df output: %s", out)
+	}
+	return res, nil
+}
+
+// checkClockSkew compares the clocks of all remote nodes with the local clock. Retention and the choice of the most
+// recent snapshot rely on timestamps in snapshot names which may have been created on different hosts.
+func (j *job) checkClockSkew(max time.Duration, action string) error {
+	for _, n := range []*node{&j.source, &j.destination} {
+		if n.sshPort == 0 {
+			continue
+		}
+		skew, err := n.clockSkew()
+		if err != nil {
+			return fmt.Errorf("checkClockSkew: %s: %v", n.address, err)
+		}
+		if skew > max || skew < -max {
+			if action == clockSkewAbort {
+				return fmt.Errorf("checkClockSkew: clock of %s is off by %v", n.address, skew.Round(time.Second))
+			}
+			log.Printf("Warning: clock of %s is off by %v", n.address, skew.Round(time.Second))
+		}
+	}
+	return nil
+}
+
+// clockSkew returns how far the clock of n is ahead of the local clock. The round trip time is accounted for by
+// comparing with the middle of the command execution.
+func (n *node) clockSkew() (time.Duration, error) {
+	before := time.Now()
+	out, err := n.run("date", "+%s")
+	if err != nil {
+		return 0, err
+	}
+	after := time.Now()
+
+	sec, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unexpected date output: %s", out)
+	}
+	local := before.Add(after.Sub(before) / 2)
+	return time.Unix(sec, 0).Sub(local), nil
+}
+
+// checkUnlocked verifies that the encrypted device of n is unlocked and mounted at its mount point. If it is not, the
+// mount point is a plain directory on the parent file system and received snapshots would be stored unencrypted.
+func (n *node) checkUnlocked() error {
+	if n.cryptDevice == "" {
+		return nil
+	}
+	if _, err := n.run("test", "-b", n.cryptDevice); err != nil {
+		return fmt.Errorf("checkUnlocked: %s: %s is not unlocked: %v", n.address, n.cryptDevice, err)
+	}
+	out, err := n.run("findmnt", "-n", "-o", "SOURCE", "--mountpoint", n.mountPoint)
+	if err != nil {
+		return fmt.Errorf("checkUnlocked: %s: nothing mounted at %s: %v", n.address, n.mountPoint, err)
+	}
+	for _, source := range strings.Split(strings.TrimSpace(out), "\n") {
+		// btrfs subvolume mounts are reported as device[/subvolume]
+		if i := strings.Index(source, "["); i >= 0 {
+			source = source[:i]
+		}
+		if source == n.cryptDevice {
+			return nil
+		}
+	}
+	return fmt.Errorf("checkUnlocked: %s: %s is not mounted from %s but from %s", n.address, n.mountPoint, n.cryptDevice, strings.TrimSpace(out))
+}
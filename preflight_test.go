@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCheckRemote(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs --version":                    "btrfs-progs v6.2\n",
+		"ssh -C -p22 nas -- btrfs --version": "btrfs-progs v5.10\n",
+		"ssh -C -p22 nas -- test -d /backup/laptop -a -w /backup/laptop": "",
+		"ssh -C -p22 nas -- df --output=avail -B1 /backup":               "    Avail\n1073741824\n",
+		"ssh -C -p22 other -- btrfs --version":                           "btrfs-progs v5.10\n",
+		"ssh -C -p22 other -- df --output=avail -B1 /backup":             "    Avail\n1073741824\n",
+	}}
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", executor: e},
+	}
+	if err := j.checkRemote(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// the snapshot directory is not writable on other
+	j.destination.address = "other"
+	if err := j.checkRemote(); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	data := []struct {
+		out  string
+		free int
+		err  bool
+	}{
+		{"Avail\n123\n", 123, false},
+		{"Avail\n", 0, true},
+		{"Avail\nfoo\n", 0, true},
+	}
+
+	for di, d := range data {
+		n := node{mountPoint: "/mnt", executor: mockExecutor{[][]string{{"df", "--output=avail", "-B1", "/mnt"}}, d.out, nil}}
+		free, err := n.freeSpace()
+		if d.err && err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+			continue
+		}
+		if !d.err && err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+			continue
+		}
+		if free != d.free {
+			t.Errorf("%d: unexpected result: %d", di, free)
+		}
+	}
+}
+
+func TestCheckClockSkew(t *testing.T) {
+	now := fmt.Sprint(time.Now().Unix())
+	late := fmt.Sprint(time.Now().Add(-time.Hour).Unix())
+	e := &mapExecutor{out: map[string]string{
+		"ssh -C -p22 good -- date +%s": now + "\n",
+		"ssh -C -p22 bad -- date +%s":  late + "\n",
+		"ssh -C -p22 err -- date +%s":  "foo\n",
+	}}
+
+	data := []struct {
+		address string
+		action  string
+		err     bool
+	}{
+		{"good", clockSkewAbort, false},
+		{"bad", clockSkewWarn, false},
+		{"bad", clockSkewAbort, true},
+		{"err", clockSkewWarn, true},
+	}
+
+	for di, d := range data {
+		j := job{
+			source:      node{address: "localhost", executor: e},
+			destination: node{address: d.address, sshPort: 22, executor: e},
+		}
+		err := j.checkClockSkew(time.Minute, d.action)
+		if d.err && err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+		if !d.err && err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+	}
+}
+
+func TestCheckUnlocked(t *testing.T) {
+	test := "ssh -C -p22 nas -- test -b /dev/mapper/backup"
+	findmnt := "ssh -C -p22 nas -- findmnt -n -o SOURCE --mountpoint /backup"
+	data := []struct {
+		out map[string]string
+		err bool
+	}{
+		{map[string]string{test: "", findmnt: "/dev/mapper/backup\n"}, false},
+		{map[string]string{test: "", findmnt: "/dev/mapper/backup[/@backup]\n"}, false},
+		{map[string]string{findmnt: "/dev/mapper/backup\n"}, true}, // locked
+		{map[string]string{test: ""}, true},                        // not mounted
+		{map[string]string{test: "", findmnt: "/dev/sda2\n"}, true},
+	}
+	for di, d := range data {
+		n := node{address: "nas", sshPort: 22, mountPoint: "/backup", cryptDevice: "/dev/mapper/backup", executor: &mapExecutor{out: d.out}}
+		err := n.checkUnlocked()
+		if d.err && err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+		if !d.err && err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+	}
+
+	// nodes without encrypted device are not checked
+	n := node{executor: &mapExecutor{}}
+	if err := n.checkUnlocked(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// minProgressInterval is the minimum time between two progress log lines when not writing to a terminal so that logs,
+// eg. journald, are not flooded during day-long transfers.
+const minProgressInterval = 10 * time.Second
+
+// progressReporter prints the progress of a transfer. On a terminal a single line is updated every second, otherwise
+// a log line is written every interval.
+type progressReporter struct {
+	w        io.Writer
+	tty      bool
+	interval time.Duration
+	now      func() time.Time // replaced in tests
+
+	stats transferStats
+
+	start     time.Time
+	last      time.Time
+	lastMeter int
+	lastStats [2]time.Duration // read and write wait at last
+}
+
+// transferStats is the time a transfer spent waiting for either end. Waiting for the sender means that btrfs send or
+// the source disk is the bottleneck, waiting for the receiver means that the network or the destination disk is.
+type transferStats struct {
+	readWait  atomic.Int64 // nanoseconds spent reading from the sender
+	writeWait atomic.Int64 // nanoseconds spent writing to the receiver
+}
+
+func (s *transferStats) waits() (time.Duration, time.Duration) {
+	return time.Duration(s.readWait.Load()), time.Duration(s.writeWait.Load())
+}
+
+// bottleneck describes the end of the transfer which was waited for longer.
+func bottleneck(read, write time.Duration) string {
+	if read > write {
+		return "source (btrfs send or source disk)"
+	}
+	return "destination (network or destination disk)"
+}
+
+// timedWriter measures the time spent writing to w.
+type timedWriter struct {
+	w    io.Writer
+	wait *atomic.Int64
+}
+
+func (t *timedWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.w.Write(p)
+	t.wait.Add(int64(time.Since(start)))
+	return n, err
+}
+
+func newProgressReporter(interval time.Duration) *progressReporter {
+	if interval < minProgressInterval {
+		interval = minProgressInterval
+	}
+	return &progressReporter{w: os.Stderr, tty: isTerminal(os.Stderr), interval: interval, now: time.Now}
+}
+
+// isTerminal reports whether f is a character device, eg. a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// update reports that meter bytes have been transmitted so far.
+func (p *progressReporter) update(meter int) {
+	now := p.now()
+	if p.start.IsZero() {
+		p.start, p.last = now, now
+		return
+	}
+	interval := p.interval
+	if p.tty {
+		interval = time.Second
+	}
+	elapsed := now.Sub(p.last)
+	if elapsed < interval {
+		return
+	}
+	rate := formatBytes(int(float64(meter-p.lastMeter) / elapsed.Seconds()))
+	read, write := p.stats.waits()
+	msg := fmt.Sprintf("Transmitted %s, %s/s, waiting for source %d%%, destination %d%%", formatBytes(meter), rate,
+		percent(read-p.lastStats[0], elapsed), percent(write-p.lastStats[1], elapsed))
+	if p.tty {
+		fmt.Fprintf(p.w, "\r\033[K%s", msg)
+	} else {
+		log.New(p.w, "", log.LstdFlags).Print(msg)
+	}
+	p.last, p.lastMeter, p.lastStats = now, meter, [2]time.Duration{read, write}
+}
+
+// done ends the progress line on a terminal and reports the bottleneck of the transfer.
+func (p *progressReporter) done() {
+	if p.tty && p.lastMeter > 0 {
+		fmt.Fprintf(p.w, "\n")
+	}
+	read, write := p.stats.waits()
+	log.New(p.w, "", log.LstdFlags).Printf("Waited %v for the source and %v for the destination, bottleneck: %s",
+		read.Round(time.Millisecond), write.Round(time.Millisecond), bottleneck(read, write))
+}
+
+// percent returns d as a percentage of total.
+func percent(d, total time.Duration) int {
+	if total <= 0 {
+		return 0
+	}
+	return int(100 * d / total)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressReporter(t *testing.T) {
+	data := []struct {
+		tty      bool
+		interval time.Duration
+		lines    int // number of progress lines written during 60 seconds
+	}{
+		{tty: true, interval: time.Minute, lines: 60},
+		{tty: false, interval: 10 * time.Second, lines: 6},
+		{tty: false, interval: time.Minute, lines: 1},
+	}
+	for di, d := range data {
+		var buf bytes.Buffer
+		now := time.Date(2019, 1, 1, 3, 0, 0, 0, time.UTC)
+		p := &progressReporter{w: &buf, tty: d.tty, interval: d.interval, now: func() time.Time { return now }}
+		p.update(0)
+		for i := 0; i < 600; i++ {
+			now = now.Add(100 * time.Millisecond)
+			p.update((i + 1) * 1024)
+		}
+		p.done()
+		lines := strings.Count(buf.String(), "Transmitted")
+		if lines != d.lines {
+			t.Errorf("%d: unexpected number of lines: %d: %q", di, lines, buf.String())
+		}
+		if d.tty != strings.Contains(buf.String(), "\r") {
+			t.Errorf("%d: unexpected output: %q", di, buf.String())
+		}
+	}
+
+	if p := newProgressReporter(time.Second); p.interval != minProgressInterval {
+		t.Errorf("interval not clamped: %v", p.interval)
+	}
+}
+
+func TestProgressBottleneck(t *testing.T) {
+	var buf bytes.Buffer
+	now := time.Date(2019, 1, 1, 3, 0, 0, 0, time.UTC)
+	p := &progressReporter{w: &buf, interval: 10 * time.Second, now: func() time.Time { return now }}
+	p.update(0)
+	now = now.Add(10 * time.Second)
+	p.stats.readWait.Add(int64(2 * time.Second))
+	p.stats.writeWait.Add(int64(7 * time.Second))
+	p.update(1024)
+	p.done()
+	for _, s := range []string{"waiting for source 20%, destination 70%", "bottleneck: destination"} {
+		if !strings.Contains(buf.String(), s) {
+			t.Errorf("missing %q in output: %q", s, buf.String())
+		}
+	}
+
+	var w bytes.Buffer
+	tw := &timedWriter{w: &w, wait: &p.stats.writeWait}
+	if _, err := tw.Write([]byte("x")); err != nil || w.String() != "x" || p.stats.writeWait.Load() < int64(7*time.Second) {
+		t.Errorf("unexpected write: %q, %v", w.String(), err)
+	}
+	if b := bottleneck(time.Second, time.Millisecond); !strings.HasPrefix(b, "source") {
+		t.Errorf("unexpected bottleneck: %s", b)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// promoteCommand creates a writable clone of a snapshot at the destination so that the backup server can take over
+// serving the data after the source failed.
+func promoteCommand(args []string) {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	snapshot := fs.String("snapshot", "", "snapshot to promote, defaults to the newest one")
+	target := fs.String("path", "", "path of the writable clone relative to the destination mount point, eg. live/home")
+	setDefault := fs.Bool("set-default", false, "make the clone the default sub-volume of the destination file system")
+	jobName := fs.String("job", "", "job to promote a snapshot of, required if several jobs are defined")
+	fs.Parse(args)
+	jf.setup()
+
+	if *target == "" {
+		log.Fatal("-path is required")
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	j, err := selectJob(jobs, *jobName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	clone, err := j.promote(*snapshot, *target, *setDefault, *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(clone)
+}
+
+// promote creates a writable snapshot of snapshot, by default the newest one at the destination of j, at target
+// relative to the destination mount point and returns its path. The received snapshot stays untouched so that backups
+// resume incrementally once the source is back. With setDefault, the clone becomes the default sub-volume which is
+// mounted if no subvol option is given.
+func (j *job) promote(snapshot, target string, setDefault, dryRun bool) (string, error) {
+	n := &j.destination
+	clone, err := n.clonePath(target)
+	if err != nil {
+		return "", fmt.Errorf("promote: %v", err)
+	}
+	if snapshot == "" {
+		snapshots, err := n.getSnapshots()
+		if err != nil {
+			return "", fmt.Errorf("promote: %v", err)
+		}
+		if len(snapshots) == 0 {
+			return "", fmt.Errorf("promote: no snapshots at %s", n.key())
+		}
+		snapshot = snapshots[len(snapshots)-1]
+	}
+	received := n.snapshotSubvolume(snapshot)
+	if _, err := n.run("btrfs", "subvolume", "show", received); err != nil {
+		return "", fmt.Errorf("promote: %s: %v", snapshot, err)
+	}
+	if _, err := n.run("test", "-e", clone); err == nil {
+		return "", fmt.Errorf("promote: %s already exists", clone)
+	}
+
+	log.Printf("Promoting %s to %s", snapshot, clone)
+	if setDefault {
+		log.Printf("Making %s the default sub-volume", clone)
+	}
+	if dryRun {
+		return clone, nil
+	}
+	if _, err := n.run("mkdir", "-p", path.Dir(clone)); err != nil {
+		return "", fmt.Errorf("promote: %v", err)
+	}
+	if _, err := n.run("btrfs", "subvolume", "snapshot", received, clone); err != nil {
+		return "", fmt.Errorf("promote: %v", err)
+	}
+	if setDefault {
+		if _, err := n.run("btrfs", "subvolume", "set-default", clone); err != nil {
+			return "", fmt.Errorf("promote: %v", err)
+		}
+	}
+	return clone, nil
+}
+
+// clonePath returns the absolute path of the writable clone at target relative to the mount point of n, see promote.
+func (n *node) clonePath(target string) (string, error) {
+	if n.archive || n.s3 != nil {
+		return "", fmt.Errorf("%s stores streams, receive them with restore or receive-archive", n.key())
+	}
+	if n.wrapper != "" {
+		return "", fmt.Errorf("%s only accepts the commands of its wrapper", n.key())
+	}
+	target = path.Clean(target)
+	if path.IsAbs(target) || target == "." || strings.HasPrefix(target, "../") {
+		return "", fmt.Errorf("invalid path %s, must be relative to the mount point", target)
+	}
+	dir := path.Clean(n.snapshotPath)
+	if target == dir || strings.HasPrefix(target, dir+"/") || dir == "." && !strings.Contains(target, "/") {
+		return "", fmt.Errorf("invalid path %s, must be outside of the snapshot directory", target)
+	}
+	return path.Join(n.mountPoint, target), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestPromote(t *testing.T) {
+	r := regexp.MustCompile(`^\d$`)
+	newJob := func(e executor) job {
+		return job{
+			source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+			destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+		}
+	}
+
+	e := &mapExecutor{out: map[string]string{
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":                                "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+		"ssh -C -p22 nas -- btrfs subvolume show /backup/laptop/2":                       "",
+		"ssh -C -p22 nas -- mkdir -p /backup/live":                                       "",
+		"ssh -C -p22 nas -- btrfs subvolume snapshot /backup/laptop/2 /backup/live/home": "",
+		"ssh -C -p22 nas -- btrfs subvolume set-default /backup/live/home":               "",
+	}}
+	j := newJob(e)
+	clone, err := j.promote("", "live/home", true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clone != "/backup/live/home" {
+		t.Errorf("unexpected clone: %s", clone)
+	}
+	for cmd := range e.out {
+		if e.calls[cmd] == 0 {
+			t.Errorf("%s not run", cmd)
+		}
+	}
+
+	// an existing clone is never replaced
+	e.out["ssh -C -p22 nas -- test -e /backup/live/home"] = ""
+	if _, err := j.promote("2", "live/home", false, false); err == nil {
+		t.Error("expected error but succeeded")
+	}
+
+	for _, target := range []string{"/live", "../live", ".", "laptop/home", "laptop"} {
+		e := &mapExecutor{}
+		j := newJob(e)
+		if _, err := j.promote("2", target, false, false); err == nil {
+			t.Errorf("%s: expected error but succeeded", target)
+		}
+		if len(e.calls) != 0 {
+			t.Errorf("%s: unexpected commands: %v", target, e.calls)
+		}
+	}
+
+	// flat layouts keep the snapshots at the top level
+	flat := node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotRegex: r}
+	if _, err := flat.clonePath("home"); err == nil {
+		t.Error("expected error but succeeded")
+	}
+	if clone, err := flat.clonePath("live/home"); err != nil || clone != "/backup/live/home" {
+		t.Errorf("unexpected clone: %s, %v", clone, err)
+	}
+}
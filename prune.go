@@ -0,0 +1,293 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"time"
+)
+
+// deleteBatches controls how many snapshots are deleted at once. Deleting hundreds of snapshots in one go leaves the
+// btrfs cleaner with a lot of work which can saturate the destination for a long time.
+type deleteBatches struct {
+	size       int           // maximum number of snapshots deleted by one command, 0 means unlimited
+	pause      time.Duration // pause between two batches
+	commitEach bool          // wait for the transaction commit after deleting each snapshot
+}
+
+const (
+	referencedKeep = "keep" // never delete snapshots referenced by other jobs or held in the state
+	referencedWarn = "warn" // delete referenced snapshots not kept by the retention, logging a warning
+)
+
+const (
+	pruneDestination = "destination" // prune the destination of each job
+	pruneSource      = "source"      // prune the source of each job
+	pruneBoth        = "both"        // prune the source and the destination of each job
+)
+
+// references are the snapshots at the destination of a job which are needed by something else than the job itself.
+type references struct {
+	reasons map[string]string // why a snapshot is referenced by snapshot
+	action  string            // referencedKeep or referencedWarn, empty means referencedKeep
+}
+
+// pruneCommand deletes old snapshots at the destination, the source or both nodes of every job.
+func pruneCommand(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	keep := fs.Int("keep", 0, "number of most recent snapshots kept at the destination")
+	windows := fs.String("retention", "", "comma separated windows of snapshots kept by age, eg. 7d,daily:90d,monthly:2y")
+	batchSize := fs.Int("batch-size", 0, "maximum number of snapshots deleted at once, 0 means unlimited")
+	batchPause := fs.Duration("batch-pause", 0, "pause between two batches of deletions")
+	commitEach := fs.Bool("commit-each", false, "wait for the transaction commit after deleting each snapshot")
+	sync := fs.Bool("sync", false, "wait until the deleted snapshots are cleaned up and report the reclaimed space")
+	referenced := fs.String("referenced", referencedKeep, "handling of snapshots needed by other jobs or held in the state: keep or warn (delete them anyway)")
+	on := fs.String("on", pruneDestination, "nodes pruned: destination, source or both")
+	fs.Parse(args)
+	jf.setup()
+
+	r, err := jf.retention(*keep, *windows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if r.empty() {
+		log.Fatal("-keep or -retention is required")
+	}
+	if *referenced != referencedKeep && *referenced != referencedWarn {
+		log.Fatalf("invalid -referenced: %s", *referenced)
+	}
+	if *batchSize < 0 {
+		log.Fatalf("invalid -batch-size: %d", *batchSize)
+	}
+	if !validPruneTarget(*on) {
+		log.Fatalf("invalid -on: %s", *on)
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	st := jf.loadState()
+
+	batches := deleteBatches{size: *batchSize, pause: *batchPause, commitEach: *commitEach}
+	failed := 0
+	for i := range jobs {
+		j := &jobs[i]
+		if len(jobs) > 1 {
+			log.Printf("Pruning job %s", j.name)
+		}
+		for _, n := range j.pruneTargets(*on) {
+			reasons, err := j.referencedSnapshots(n, jobs, st)
+			if err != nil {
+				log.Printf("Job %s failed: %v", j.name, err)
+				failed++
+				break
+			}
+			refs := references{reasons: reasons, action: *referenced}
+			if _, err := j.pruneNode(n, r, batches, refs, *sync, *dryRun); err != nil {
+				log.Printf("Job %s failed: %v", j.name, err)
+				failed++
+				break
+			}
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(jobs))
+	}
+}
+
+func validPruneTarget(on string) bool {
+	return on == pruneDestination || on == pruneSource || on == pruneBoth
+}
+
+// pruneTargets returns the nodes of j pruned by on.
+func (j *job) pruneTargets(on string) []*node {
+	switch on {
+	case pruneSource:
+		return []*node{&j.source}
+	case pruneBoth:
+		return []*node{&j.source, &j.destination}
+	default:
+		return []*node{&j.destination}
+	}
+}
+
+// prune deletes all snapshots at the destination which are not kept by r, see pruneNode.
+func (j *job) prune(r retention, batches deleteBatches, refs references, sync, dryRun bool) error {
+	_, err := j.pruneNode(&j.destination, r, batches, refs, sync, dryRun)
+	return err
+}
+
+// pruneNode deletes all snapshots of n, the source or the destination of j, which are not kept by r. The most recent
+// snapshot present on both nodes is never deleted because it is the parent of the next incremental transfer. At the
+// source, snapshots not present at the destination are never deleted as they haven't been sent yet. Deleted snapshots
+// only free space once the btrfs cleaner has processed them. With sync, pruneNode waits for the cleaner and reports the
+// reclaimed space. Snapshots in refs are kept unless its action is referencedWarn. Archives are pruned by pruneArchive.
+func (j *job) pruneNode(n *node, r retention, batches deleteBatches, refs references, sync, dryRun bool) (int, error) {
+	sourceSnapshots, err := j.source.getSnapshots()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get local snapshots: %v", err)
+	}
+	destinationSnapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get remote snapshots: %v", err)
+	}
+
+	protected := make(map[string]bool)
+	if common := newestCommonSnapshot(sourceSnapshots, destinationSnapshots); common != "" {
+		protected[common] = true
+	}
+	candidates := destinationSnapshots
+	if n == &j.source {
+		candidates = sourceSnapshots
+		sent := make(map[string]bool)
+		for _, s := range destinationSnapshots {
+			sent[s] = true
+		}
+		for _, s := range sourceSnapshots {
+			if !sent[s] {
+				protected[s] = true
+			}
+		}
+	}
+	var snapshots []string
+	for _, s := range planPrune(candidates, r.forNode(n), time.Now(), protected) {
+		reason, ok := refs.reasons[s]
+		switch {
+		case !ok:
+			snapshots = append(snapshots, s)
+		case refs.action == referencedWarn:
+			log.Printf("Warning: deleting %s although it is %s", s, reason)
+			snapshots = append(snapshots, s)
+		default:
+			log.Printf("Keeping %s because it is %s", s, reason)
+		}
+	}
+	if n.archive {
+		return n.pruneArchive(snapshots, dryRun)
+	}
+	if len(snapshots) == 0 {
+		log.Printf("Nothing to prune")
+		return 0, nil
+	}
+	for _, s := range snapshots {
+		log.Printf("Deleting %s", s)
+	}
+	if dryRun {
+		n.reportReclaimable(snapshots)
+		return 0, nil
+	}
+
+	var freeBefore int
+	if sync {
+		if freeBefore, err = n.freeSpace(); err != nil {
+			return 0, fmt.Errorf("prune: free space: %v", err)
+		}
+	}
+	if err := n.deleteSnapshots(snapshots, batches); err != nil {
+		return 0, fmt.Errorf("prune: %v", err)
+	}
+	if !sync {
+		log.Printf("Deleted %d snapshots, space is reclaimed in the background", len(snapshots))
+		return len(snapshots), nil
+	}
+
+	log.Printf("Deleted %d snapshots, waiting for the cleaner", len(snapshots))
+	if _, err := n.run("btrfs", "subvolume", "sync", n.mountPoint); err != nil {
+		return len(snapshots), fmt.Errorf("prune: subvolume sync: %v", err)
+	}
+	freeAfter, err := n.freeSpace()
+	if err != nil {
+		return len(snapshots), fmt.Errorf("prune: free space: %v", err)
+	}
+	log.Printf("Reclaimed %s, %s free on %s", formatBytes(freeAfter-freeBefore), formatBytes(freeAfter), n.mountPoint)
+	return len(snapshots), nil
+}
+
+// referencedSnapshots returns the snapshots of n, the source or the destination of j, which are held in st or which
+// other jobs reading or writing the same snapshot directory need as parent of their next incremental transfer, mapped
+// to the reason. A nil state contains no holds.
+func (j *job) referencedSnapshots(n *node, jobs []job, st *state) (map[string]string, error) {
+	reasons := make(map[string]string)
+	key := n.key()
+	for i := range jobs {
+		other := &jobs[i]
+		if other.key() == j.key() || (other.source.key() != key && other.destination.key() != key) {
+			continue
+		}
+		sourceSnapshots, err := other.source.getSnapshots()
+		if err != nil {
+			return nil, fmt.Errorf("referencedSnapshots: job %s: %v", other.name, err)
+		}
+		destinationSnapshots, err := other.destination.getSnapshots()
+		if err != nil {
+			return nil, fmt.Errorf("referencedSnapshots: job %s: %v", other.name, err)
+		}
+		if common := newestCommonSnapshot(sourceSnapshots, destinationSnapshots); common != "" {
+			reasons[common] = fmt.Sprintf("the parent of the next transfer of job %s", other.name)
+		}
+	}
+	for s, reason := range st.holds(n) {
+		reasons[s] = fmt.Sprintf("held: %s", reason)
+	}
+	return reasons, nil
+}
+
+// planPrune returns the snapshots to delete so that the snapshots kept by r at now remain. Protected snapshots are
+// never deleted. snapshots must be sorted.
+func planPrune(snapshots []string, r retention, now time.Time, protected map[string]bool) []string {
+	kept := r.kept(snapshots, now)
+	var res []string
+	for _, s := range snapshots {
+		if !kept[s] && !protected[s] {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// newestCommonSnapshot returns the most recent snapshot present in both sorted lists or an empty string.
+func newestCommonSnapshot(a, b []string) string {
+	present := make(map[string]bool)
+	for _, s := range b {
+		present[s] = true
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		if present[a[i]] {
+			return a[i]
+		}
+	}
+	return ""
+}
+
+// deleteSnapshots deletes snapshots in batches, pausing in between.
+func (n *node) deleteSnapshots(snapshots []string, batches deleteBatches) error {
+	size := batches.size
+	if size <= 0 {
+		size = len(snapshots)
+	}
+	for i := 0; i < len(snapshots); i += size {
+		if i > 0 && batches.pause > 0 {
+			log.Printf("Pausing for %v before deleting the next batch", batches.pause)
+			time.Sleep(batches.pause)
+		}
+		end := i + size
+		if end > len(snapshots) {
+			end = len(snapshots)
+		}
+		cmd := []string{"btrfs", "subvolume", "delete"}
+		if batches.commitEach {
+			cmd = append(cmd, "--commit-each")
+		}
+		for _, s := range snapshots[i:end] {
+			cmd = append(cmd, path.Join(n.mountPoint, n.snapshotPath, s))
+		}
+		if _, err := n.run(cmd...); err != nil {
+			return fmt.Errorf("deleteSnapshots: %v", err)
+		}
+	}
+	return nil
+}
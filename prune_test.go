@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestPlanPrune(t *testing.T) {
+	data := []struct {
+		snapshots []string
+		keep      int
+		protected map[string]bool
+		res       []string
+	}{
+		{[]string{"1", "2", "3"}, 3, nil, nil},
+		{[]string{"1", "2", "3"}, 5, nil, nil},
+		{[]string{"1", "2", "3"}, 1, nil, []string{"1", "2"}},
+		{[]string{"1", "2", "3"}, 1, map[string]bool{"1": true}, []string{"2"}},
+	}
+	for di, d := range data {
+		res := planPrune(d.snapshots, retention{keep: d.keep}, time.Time{}, d.protected)
+		if !reflect.DeepEqual(res, d.res) {
+			t.Errorf("%d: unexpected result: %#v", di, res)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                       "ID 1 gen 1 top level 5 path snapshot/2\nID 2 gen 2 top level 5 path snapshot/6\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup": "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\nID 3 gen 3 top level 5 path laptop/3\nID 4 gen 4 top level 5 path laptop/4\nID 5 gen 5 top level 5 path laptop/5\n",
+		"ssh -C -p22 nas -- btrfs subvolume delete --commit-each /backup/laptop/1 /backup/laptop/3": "",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+
+	// 2 is kept as the parent of the next transfer
+	if err := j.prune(retention{keep: 2}, deleteBatches{size: 2, commitEach: true}, references{}, false, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	e.out["ssh -C -p22 nas -- btrfs subvolume delete /backup/laptop/1"] = ""
+	e.out["ssh -C -p22 nas -- btrfs subvolume delete /backup/laptop/3"] = ""
+	e.calls = nil
+	if err := j.prune(retention{keep: 2}, deleteBatches{size: 1}, references{}, false, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(e.calls) != 4 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
+
+func TestPruneSource(t *testing.T) {
+	del := "btrfs subvolume delete /mnt/snapshot/1"
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                       "ID 1 gen 1 top level 5 path snapshot/1\nID 2 gen 2 top level 5 path snapshot/2\nID 3 gen 3 top level 5 path snapshot/3\nID 4 gen 4 top level 5 path snapshot/4\nID 5 gen 5 top level 5 path snapshot/5\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup": "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/3\n",
+		del: "",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+
+	// 3 is the parent of the next transfer, 2, 4 and 5 haven't been sent
+	if _, err := j.pruneNode(&j.source, retention{keep: 1}, deleteBatches{}, references{}, false, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if e.calls[del] != 1 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+	if targets := j.pruneTargets(pruneBoth); len(targets) != 2 || targets[0] != &j.source || targets[1] != &j.destination {
+		t.Errorf("unexpected targets: %v", targets)
+	}
+}
+
+func TestPruneSync(t *testing.T) {
+	df := "ssh -C -p22 nas -- df --output=avail -B1 /backup"
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                                  "ID 1 gen 1 top level 5 path snapshot/2\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":            "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+		"ssh -C -p22 nas -- btrfs subvolume delete /backup/laptop/1": "",
+		"ssh -C -p22 nas -- btrfs subvolume sync /backup":            "",
+		df: "Avail\n1000\n",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+	if err := j.prune(retention{keep: 1}, deleteBatches{}, references{}, true, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if e.calls["ssh -C -p22 nas -- btrfs subvolume sync /backup"] != 1 || e.calls[df] != 2 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
+
+func TestPruneReferenced(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                          "ID 1 gen 1 top level 5 path snapshot/5\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":    "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\nID 3 gen 3 top level 5 path laptop/3\nID 4 gen 4 top level 5 path laptop/4\nID 5 gen 5 top level 5 path laptop/5\n",
+		"ssh -C -p22 offsite -- btrfs subvolume list /store": "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	laptop := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e}
+	nas := node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e}
+	offsite := node{address: "offsite", sshPort: 22, mountPoint: "/store", snapshotPath: "laptop", snapshotRegex: r, executor: e}
+	jobs := []job{{name: "nas", source: laptop, destination: nas}, {name: "offsite", source: nas, destination: offsite}}
+	st := &state{Holds: map[string]map[string]string{nas.key(): {"3": "audit"}}}
+
+	reasons, err := jobs[0].referencedSnapshots(&jobs[0].destination, jobs, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"2": "the parent of the next transfer of job offsite", "3": "held: audit"}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("unexpected references: %#v", reasons)
+	}
+
+	e.out["ssh -C -p22 nas -- btrfs subvolume delete /backup/laptop/1 /backup/laptop/4"] = ""
+	if err := jobs[0].prune(retention{keep: 1}, deleteBatches{}, references{reasons: reasons}, false, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	e.out["ssh -C -p22 nas -- btrfs subvolume delete /backup/laptop/1 /backup/laptop/2 /backup/laptop/3 /backup/laptop/4"] = ""
+	e.calls = nil
+	if err := jobs[0].prune(retention{keep: 1}, deleteBatches{}, references{reasons: reasons, action: referencedWarn}, false, false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if e.calls["ssh -C -p22 nas -- btrfs subvolume delete /backup/laptop/1 /backup/laptop/2 /backup/laptop/3 /backup/laptop/4"] != 1 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"time"
+)
+
+// recentTransfers is the number of finished jobs kept in the queue.
+const recentTransfers = 20
+
+// Job states in the queue.
+const (
+	queuePending   = "pending"
+	queueRunning   = "running"
+	queueSucceeded = "succeeded"
+	queueFailed    = "failed"
+	queueCancelled = "cancelled"
+)
+
+// queueEntry describes a job in the queue of a daemon.
+type queueEntry struct {
+	Job         string           `json:"job"`
+	State       string           `json:"state"`
+	Started     *time.Time       `json:"started,omitempty"`
+	Finished    *time.Time       `json:"finished,omitempty"`
+	Snapshots   []queuedSnapshot `json:"snapshots,omitempty"` // unknown until the job has listed its nodes
+	Transmitted int              `json:"transmitted"`         // bytes
+	Remaining   int              `json:"remaining"`           // estimated bytes, 0 if unknown
+	ETA         *time.Time       `json:"eta,omitempty"`       // estimated end of the transfers of a running job
+	Error       string           `json:"error,omitempty"`
+}
+
+// queuedSnapshot is a snapshot planned or sent by a job. The size of a snapshot not sent yet is estimated by the average
+// size of the snapshots sent by the job before, 0 if none was sent yet.
+type queuedSnapshot struct {
+	Snapshot string `json:"snapshot"`
+	Size     int    `json:"size"` // bytes
+	Sent     bool   `json:"sent"`
+}
+
+// sizeHistory accumulates the sizes of the snapshots sent by a job.
+type sizeHistory struct {
+	bytes int
+	count int
+}
+
+func (h sizeHistory) average() int {
+	if h.count == 0 {
+		return 0
+	}
+	return h.bytes / h.count
+}
+
+// enqueue registers the jobs of a run which haven't started yet, except the skipped ones by index. It does nothing on a
+// nil registry.
+func (r *transferRegistry) enqueue(jobs []job, skipped map[int]string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pending = nil
+	for i := range jobs {
+		if _, ok := skipped[i]; !ok {
+			r.pending = append(r.pending, jobs[i].name)
+		}
+	}
+}
+
+// dequeue removes a job from the pending ones. r must be locked.
+func (r *transferRegistry) dequeue(name string) {
+	for i, p := range r.pending {
+		if p == name {
+			r.pending = append(r.pending[:i:i], r.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// plan records the snapshots j is going to send.
+func (r *transferRegistry) plan(j *job, transfers []transfer) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.transfers[j.name]
+	if !ok {
+		return
+	}
+	t.snapshots = nil
+	for _, s := range snapshotsOf(transfers) {
+		t.snapshots = append(t.snapshots, queuedSnapshot{Snapshot: s})
+	}
+}
+
+// sent records a snapshot of j sent with the given number of bytes. Snapshots which weren't planned, eg. sent by a
+// backfill, are added.
+func (r *transferRegistry) sent(j *job, snapshot string, transmitted int) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := r.sizes[j.name]
+	h.bytes += transmitted
+	h.count++
+	r.sizes[j.name] = h
+	t, ok := r.transfers[j.name]
+	if !ok {
+		return
+	}
+	t.transmitted += transmitted
+	for i := range t.snapshots {
+		if t.snapshots[i].Snapshot == snapshot {
+			t.snapshots[i].Size, t.snapshots[i].Sent = transmitted, true
+			return
+		}
+	}
+	t.snapshots = append(t.snapshots, queuedSnapshot{Snapshot: snapshot, Size: transmitted, Sent: true})
+}
+
+// recordFinished adds the result of a run of a job to the finished ones. t is nil if the job failed before starting.
+// r must be locked.
+func (r *transferRegistry) recordFinished(name string, t *inflightTransfer, err error) {
+	now := time.Now()
+	e := queueEntry{Job: name, State: queueSucceeded, Finished: &now}
+	if t != nil {
+		started := t.started
+		e.Started = &started
+		e.Snapshots = append([]queuedSnapshot(nil), t.snapshots...)
+		e.Transmitted = t.transmitted
+	}
+	switch {
+	case t != nil && t.cancelled:
+		e.State = queueCancelled
+	case err != nil:
+		e.State = queueFailed
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.finished = append(r.finished, e)
+	if len(r.finished) > recentTransfers {
+		r.finished = r.finished[len(r.finished)-recentTransfers:]
+	}
+}
+
+// queue returns the finished, running and pending jobs in this order. The remaining bytes and the end of the transfers
+// of running jobs are estimated at now from the sizes of the snapshots sent before and the rate of the current run.
+func (r *transferRegistry) queue(now time.Time) []queueEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := append([]queueEntry{}, r.finished...)
+	var running []queueEntry
+	for name, t := range r.transfers {
+		started := t.started
+		e := queueEntry{Job: name, State: queueRunning, Started: &started, Transmitted: t.transmitted}
+		average := r.sizes[name].average()
+		for _, s := range t.snapshots {
+			if !s.Sent {
+				s.Size = average
+				e.Remaining += s.Size
+			}
+			e.Snapshots = append(e.Snapshots, s)
+		}
+		if elapsed := now.Sub(t.started); e.Remaining > 0 && t.transmitted > 0 && elapsed > 0 {
+			eta := now.Add(time.Duration(float64(elapsed) * float64(e.Remaining) / float64(t.transmitted)))
+			e.ETA = &eta
+		}
+		running = append(running, e)
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].Job < running[j].Job })
+	res = append(res, running...)
+	for _, name := range r.pending {
+		res = append(res, queueEntry{Job: name, State: queuePending})
+	}
+	return res
+}
+
+// handleQueue serves GET /api/queue.
+func (r *transferRegistry) handleQueue(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, r.queue(time.Now()))
+}
+
+// queueCommand shows the pending, running and recently finished jobs of a daemon serving its API with -listen.
+func queueCommand(args []string) {
+	fs := flag.NewFlagSet("queue", flag.ExitOnError)
+	api := addAPIFlags(fs)
+	jsonOutput := fs.Bool("json", false, "print the queue as JSON")
+	fs.Parse(args)
+
+	var entries []queueEntry
+	addr, token := api()
+	if err := getControl(addr, token, "/api/queue", &entries); err != nil {
+		log.Fatal(err)
+	}
+	if *jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+		return
+	}
+	writeQueue(os.Stdout, entries, time.Now())
+}
+
+// getControl gets the endpoint p of the daemon API at addr and decodes the JSON response into v. A non-empty token
+// authenticates the request.
+func getControl(addr, token, p string, v interface{}) error {
+	u := url.URL{Scheme: "http", Host: addr, Path: p}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return fmt.Errorf("getControl: %v", err)
+	}
+	resp, err := doAPIRequest(req, token)
+	if err != nil {
+		return fmt.Errorf("getControl: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("getControl: %s: %s", resp.Status, body)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("getControl: %v", err)
+	}
+	return nil
+}
+
+// writeQueue writes a line per job followed by its snapshots.
+func writeQueue(w io.Writer, entries []queueEntry, now time.Time) {
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "queue is empty")
+		return
+	}
+	for _, e := range entries {
+		sent := 0
+		for _, s := range e.Snapshots {
+			if s.Sent {
+				sent++
+			}
+		}
+		switch e.State {
+		case queuePending:
+			fmt.Fprintf(w, "%s: pending\n", e.Job)
+			continue
+		case queueRunning:
+			line := fmt.Sprintf("%s: running, sent %d of %d snapshots, %s transmitted", e.Job, sent, len(e.Snapshots), formatBytes(e.Transmitted))
+			if e.Remaining > 0 {
+				line += fmt.Sprintf(", ~%s remaining", formatBytes(e.Remaining))
+			}
+			if e.ETA != nil {
+				line += fmt.Sprintf(", ETA %s (in %s)", e.ETA.Local().Format("15:04"), e.ETA.Sub(now).Round(time.Minute))
+			}
+			fmt.Fprintln(w, line)
+		default:
+			line := fmt.Sprintf("%s: %s", e.Job, e.State)
+			if e.Finished != nil {
+				line += " " + e.Finished.Local().Format(time.RFC3339)
+			}
+			line += fmt.Sprintf(", sent %d snapshots, %s transmitted", sent, formatBytes(e.Transmitted))
+			if e.Error != "" {
+				line += ": " + e.Error
+			}
+			fmt.Fprintln(w, line)
+		}
+		for _, s := range e.Snapshots {
+			switch {
+			case s.Sent:
+				fmt.Fprintf(w, "  %s: sent, %s\n", s.Snapshot, formatBytes(s.Size))
+			case e.State != queueRunning:
+				fmt.Fprintf(w, "  %s: not sent\n", s.Snapshot)
+			case s.Size > 0:
+				fmt.Fprintf(w, "  %s: pending, ~%s\n", s.Snapshot, formatBytes(s.Size))
+			default:
+				fmt.Fprintf(w, "  %s: pending, size unknown\n", s.Snapshot)
+			}
+		}
+	}
+}
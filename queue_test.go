@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransferQueue(t *testing.T) {
+	jobs := []job{{name: "a"}, {name: "b"}, {name: "c"}}
+	r := newTransferRegistry()
+	r.enqueue(jobs, map[int]string{2: "on battery"})
+	r.start(&jobs[0])
+	r.plan(&jobs[0], []transfer{{snapshot: "s1"}, {snapshot: "s2", parent: "s1"}, {snapshot: "s3", parent: "s2"}})
+	r.sent(&jobs[0], "s1", 100)
+
+	started := time.Date(2019, 1, 2, 3, 0, 0, 0, time.UTC)
+	r.transfers["a"].started = started
+	now := started.Add(10 * time.Second)
+	eta := now.Add(20 * time.Second)
+	expected := []queueEntry{
+		{Job: "a", State: queueRunning, Started: &started, Transmitted: 100, Remaining: 200, ETA: &eta, Snapshots: []queuedSnapshot{
+			{Snapshot: "s1", Size: 100, Sent: true},
+			{Snapshot: "s2", Size: 100},
+			{Snapshot: "s3", Size: 100},
+		}},
+		{Job: "b", State: queuePending},
+	}
+	if q := r.queue(now); !reflect.DeepEqual(q, expected) {
+		t.Errorf("unexpected queue: %+v", q)
+	}
+
+	var buf bytes.Buffer
+	writeQueue(&buf, expected, now)
+	for _, line := range []string{
+		"a: running, sent 1 of 3 snapshots, 100.0 B transmitted, ~200.0 B remaining, ETA ",
+		"  s1: sent, 100.0 B\n",
+		"  s2: pending, ~100.0 B\n",
+		"b: pending\n",
+	} {
+		if !strings.Contains(buf.String(), line) {
+			t.Errorf("missing %q in:\n%s", line, buf.String())
+		}
+	}
+
+	r.cancel("a")
+	r.finish(&jobs[0], errCancelled)
+	r.finish(&jobs[1], errors.New("mock error")) // failed before starting
+	q := r.queue(now)
+	if len(q) != 2 || q[0].State != queueCancelled || q[0].Transmitted != 100 || q[1].State != queueFailed || q[1].Error != "mock error" {
+		t.Errorf("unexpected queue: %+v", q)
+	}
+
+	// the sizes of the first run estimate the snapshots of the next one
+	r.enqueue(jobs[:1], nil)
+	r.start(&jobs[0])
+	r.plan(&jobs[0], []transfer{{snapshot: "s2"}})
+	srv := httptest.NewServer((&browseAPI{jobs: func() []job { return nil }, transfers: r}).handler())
+	defer srv.Close()
+	var entries []queueEntry
+	if err := getControl(strings.TrimPrefix(srv.URL, "http://"), "", "/api/queue", &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[2].State != queueRunning || entries[2].Remaining != 100 || entries[2].ETA != nil {
+		t.Errorf("unexpected queue: %+v", entries)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rateLimiter is a token bucket limiting a byte stream to rate bytes per second. It allows bursts of up to one second
+// worth of data.
+type rateLimiter struct {
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+	sleep  func(time.Duration) // replaced in tests
+	rateOf func() float64      // re-evaluates the rate before every wait if set, eg. for a share of a total rate
+}
+
+func newRateLimiter(rate int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), sleep: time.Sleep}
+}
+
+// burst returns the maximum number of bytes which should be requested at once.
+func (l *rateLimiter) burst() int {
+	if l.rate < 1 {
+		return 1
+	}
+	return int(l.rate)
+}
+
+// wait blocks until n bytes may pass.
+func (l *rateLimiter) wait(n int) {
+	if l.rateOf != nil {
+		l.rate = l.rateOf()
+	}
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = l.rate
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		l.sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+}
+
+// parseBytes parses sizes like "512", "20M", "8MB" or "1.5GiB". Single letter suffixes and IEC units are powers of 1024,
+// SI units are powers of 1000.
+func parseBytes(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	i := len(s)
+	for i > 0 && (s[i-1] < '0' || s[i-1] > '9') {
+		i--
+	}
+	num, unit := s[:i], strings.TrimSpace(s[i:])
+
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+
+	factors := map[string]float64{
+		"": 1, "B": 1,
+		"k": 1 << 10, "K": 1 << 10, "KiB": 1 << 10, "kiB": 1 << 10, "kB": 1e3, "KB": 1e3,
+		"M": 1 << 20, "MiB": 1 << 20, "MB": 1e6,
+		"G": 1 << 30, "GiB": 1 << 30, "GB": 1e9,
+		"T": 1 << 40, "TiB": 1 << 40, "TB": 1e12,
+	}
+	f, ok := factors[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return int(v * f), nil
+}
+
+// parseRate parses a transfer rate like "8MB/s" or "20MiB/s". The "/s" suffix is optional.
+func parseRate(s string) (int, error) {
+	return parseBytes(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+}
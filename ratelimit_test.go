@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	data := []struct {
+		in  string
+		out int
+		err bool
+	}{
+		{"0", 0, false},
+		{"512", 512, false},
+		{"8MB/s", 8000000, false},
+		{"20MiB/s", 20 * 1024 * 1024, false},
+		{"1.5k", 1536, false},
+		{" 2 GB/s ", 2000000000, false},
+		{"", 0, true},
+		{"MB/s", 0, true},
+		{"10XB/s", 0, true},
+		{"-1", 0, true},
+	}
+
+	for _, d := range data {
+		out, err := parseRate(d.in)
+		if d.err && err == nil {
+			t.Errorf("%q: expected error but succeeded", d.in)
+			continue
+		}
+		if !d.err && err != nil {
+			t.Errorf("%q: unexpected error: %v", d.in, err)
+			continue
+		}
+		if out != d.out {
+			t.Errorf("%q: %d != %d", d.in, out, d.out)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var slept time.Duration
+	l := newRateLimiter(1000)
+	l.sleep = func(d time.Duration) { slept += d }
+
+	// the first second worth of data passes immediately
+	l.wait(1000)
+	if slept != 0 {
+		t.Errorf("unexpected sleep: %v", slept)
+	}
+
+	// afterwards the limiter has to wait
+	l.wait(500)
+	if slept < 400*time.Millisecond || slept > 500*time.Millisecond {
+		t.Errorf("unexpected sleep: %v", slept)
+	}
+
+	if b := newRateLimiter(0).burst(); b != 1 {
+		t.Errorf("unexpected burst: %d", b)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// repairReadOnlyCommand makes writable snapshots at the source read-only so that they can be sent, eg. after the
+// read-only property was cleared accidentally. Snapshots which were modified since they were created are left alone:
+// they no longer correspond to the state they are named after.
+func repairReadOnlyCommand(args []string) {
+	fs := flag.NewFlagSet("repair-readonly", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	fs.Parse(args)
+	jf.setup()
+
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	failed := 0
+	for i := range jobs {
+		if _, err := jobs[i].repairReadOnly(*dryRun); err != nil {
+			log.Printf("Job %s failed: %v", jobs[i].name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(jobs))
+	}
+}
+
+// repairReadOnly makes the unmodified writable snapshots at the source of j read-only and returns them. Modified
+// snapshots are logged.
+func (j *job) repairReadOnly(dryRun bool) ([]string, error) {
+	writable, err := j.source.writableSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	var repaired []string
+	for _, s := range writable {
+		changed, err := j.source.snapshotChanged(s)
+		if err != nil {
+			return repaired, err
+		}
+		if changed {
+			log.Printf("%s: %s is writable and was modified since it was created, leaving it writable", j.name, s)
+			continue
+		}
+		log.Printf("%s: making %s read-only", j.name, s)
+		if dryRun {
+			continue
+		}
+		if _, err := j.source.run("btrfs", "property", "set", "-ts", j.source.snapshotSubvolume(s), "ro", "true"); err != nil {
+			return repaired, fmt.Errorf("repairReadOnly: %v", err)
+		}
+		repaired = append(repaired, s)
+	}
+	return repaired, nil
+}
+
+// snapshotSubvolume returns the path of the sub-volume of snapshot s.
+func (n *node) snapshotSubvolume(s string) string {
+	return path.Join(n.mountPoint, n.snapshotPath, s, n.subvolume)
+}
+
+// writableSnapshots returns the snapshots of n which are not read-only.
+func (n *node) writableSnapshots() ([]string, error) {
+	snapshots, err := n.getSnapshots()
+	if err != nil {
+		return nil, fmt.Errorf("writableSnapshots: %v", err)
+	}
+	out, err := n.run("btrfs", "subvolume", "list", "-r", n.mountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("writableSnapshots: %v", err)
+	}
+	subVolumes, err := parseSubVolumes(out)
+	if err != nil {
+		return nil, fmt.Errorf("writableSnapshots: %v", err)
+	}
+	if n.subvolume != "" {
+		subVolumes = nestedSnapshots(subVolumes, n.subvolume)
+	}
+	readOnly := make(map[string]bool)
+	for _, s := range filterSnapshots(subVolumes, n.snapshotPath, n.snapshotRegex) {
+		readOnly[s] = true
+	}
+	var res []string
+	for _, s := range snapshots {
+		if !readOnly[s] {
+			res = append(res, s)
+		}
+	}
+	return res, nil
+}
+
+// snapshotChanged reports whether snapshot s of n was modified after it was created: every modification raises the
+// generation of a sub-volume above the generation it was created in.
+func (n *node) snapshotChanged(s string) (bool, error) {
+	out, err := n.run("btrfs", "subvolume", "show", n.snapshotSubvolume(s))
+	if err != nil {
+		return false, fmt.Errorf("snapshotChanged: %v", err)
+	}
+	gen, created := -1, -1
+	for _, line := range strings.Split(out, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		v, err := strconv.Atoi(strings.TrimSpace(value))
+		switch key {
+		case "Generation":
+			if err == nil {
+				gen = v
+			}
+		case "Gen at creation":
+			if err == nil {
+				created = v
+			}
+		}
+	}
+	if gen < 0 || created < 0 {
+		return false, fmt.Errorf("snapshotChanged: unexpected btrfs output for %s", s)
+	}
+	return gen != created, nil
+}
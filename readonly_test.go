@@ -0,0 +1,42 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRepairReadOnly(t *testing.T) {
+	show := func(gen, created string) string {
+		return "snapshot/x\n\tName: \t\t\tx\n\tGeneration: \t\t" + gen + "\n\tGen at creation: \t" + created + "\n\tFlags: \t\t\t-\n"
+	}
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                                     "ID 1 gen 1 top level 5 path snapshot/2019-01-01_00-00\nID 2 gen 2 top level 5 path snapshot/2019-01-02_00-00\nID 3 gen 3 top level 5 path snapshot/2019-01-03_00-00\n",
+		"btrfs subvolume list -r /mnt":                                  "ID 1 gen 1 top level 5 path snapshot/2019-01-01_00-00\n",
+		"btrfs subvolume show /mnt/snapshot/2019-01-02_00-00":           show("20", "20"),
+		"btrfs subvolume show /mnt/snapshot/2019-01-03_00-00":           show("25", "21"),
+		"btrfs property set -ts /mnt/snapshot/2019-01-02_00-00 ro true": "",
+	}}
+	j := job{name: "test", source: node{mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: defaultSnapshotRegex, executor: e}}
+
+	repaired, err := j.repairReadOnly(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repaired) != 0 || e.calls["btrfs property set -ts /mnt/snapshot/2019-01-02_00-00 ro true"] != 0 {
+		t.Errorf("dry run modified snapshots: %v", repaired)
+	}
+
+	// the modified snapshot stays writable
+	repaired, err = j.repairReadOnly(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(repaired, []string{"2019-01-02_00-00"}) {
+		t.Errorf("unexpected repaired snapshots: %v", repaired)
+	}
+
+	e.out["btrfs subvolume show /mnt/snapshot/2019-01-02_00-00"] = "garbage"
+	if _, err := j.repairReadOnly(false); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+)
+
+// anySnapshot matches every snapshot name, archives read without a job accept all streams.
+var anySnapshot = regexp.MustCompile(``)
+
+// receiveArchiveCommand replays the streams of an archive into a btrfs filesystem without a job, eg. from a USB drive
+// attached to a new machine.
+func receiveArchiveCommand(args []string) {
+	fs := flag.NewFlagSet("receive-archive", flag.ExitOnError)
+	from := fs.String("from", "", "archive directory, local, host:port/path or s3://bucket/prefix")
+	target := fs.String("target", "", "local btrfs directory receiving the snapshots")
+	snapshot := fs.String("snapshot", "", "only receive this snapshot and its missing parents, defaults to all snapshots")
+	identity := fs.String("identity", "", "age identity file decrypting streams encrypted with age")
+	s3Endpoint := fs.String("s3-endpoint", "", "with an s3:// archive: endpoint URL of S3-compatible storage")
+	s3Profile := fs.String("s3-profile", "", "with an s3:// archive: aws CLI profile holding the credentials")
+	dryRun := fs.Bool("n", false, "dry run")
+	verbose := fs.Bool("v", false, "verbose output")
+	fs.Parse(args)
+
+	if *from == "" || *target == "" {
+		log.Fatal("-from and -target are required")
+	}
+	archive, err := parseArchiveNode(*from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if archive.s3 != nil {
+		archive.s3.endpoint, archive.s3.profile = *s3Endpoint, *s3Profile
+	}
+	e := executorImpl{verbose: *verbose}
+	archive.executor = e
+	receiver := node{address: "localhost", mountPoint: *target, executor: e}
+	if _, err := receiveArchive(&archive, &receiver, *snapshot, *identity, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseArchiveNode parses an archive given as local directory, as host:port/path or as s3://bucket/prefix.
+func parseArchiveNode(s string) (node, error) {
+	n := node{address: "localhost", mountPoint: s}
+	if !strings.HasPrefix(s, "/") {
+		var err error
+		if n, err = parseNode(s); err != nil {
+			return node{}, err
+		}
+	}
+	n.archive = true
+	n.snapshotRegex = anySnapshot
+	return n, nil
+}
+
+// receiveArchive receives the streams of archive into receiver in parent order and returns the received snapshots.
+// Snapshots already present at the receiver are skipped and serve as parents. With snapshot, only it and the parents
+// it needs are received, otherwise every snapshot of the archive.
+func receiveArchive(archive, receiver *node, snapshot, identity string, dryRun bool) ([]string, error) {
+	files, err := archive.listArchive()
+	if err != nil {
+		return nil, fmt.Errorf("receiveArchive: %v", err)
+	}
+	out, err := receiver.run("ls", "-1", receiver.mountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("receiveArchive: %v", err)
+	}
+	present := make(map[string]bool)
+	for _, s := range strings.Split(out, "\n") {
+		if s != "" {
+			present[s] = true
+		}
+	}
+
+	var wanted []string
+	if snapshot != "" {
+		wanted = []string{snapshot}
+	} else {
+		for _, f := range files {
+			wanted = append(wanted, f.snapshot)
+		}
+	}
+	var received []string
+	for _, s := range wanted {
+		if present[s] {
+			log.Printf("Skipping %s, it is already present", s)
+			continue
+		}
+		chain, err := restoreChain(files, s, present)
+		if err != nil {
+			return received, fmt.Errorf("receiveArchive: %v", err)
+		}
+		if err := receiveStreams(archive, chain, receiver, identity, dryRun); err != nil {
+			return received, fmt.Errorf("receiveArchive: %v", err)
+		}
+		for _, f := range chain {
+			present[f.snapshot] = true
+			received = append(received, f.snapshot)
+		}
+	}
+	log.Printf("Received %d snapshots into %s", len(received), receiver.mountPoint)
+	return received, nil
+}
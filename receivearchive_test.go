@@ -0,0 +1,49 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReceiveArchive(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"ls -1 /media/usb/laptop": "1.btrfs\n2~1.btrfs\n3~2.btrfs.gpg\nmanifest.json\n",
+		"ls -1 /mnt/restore":      "1\n",
+		"cat /media/usb/laptop/2~1.btrfs | btrfs receive /mnt/restore":     "",
+		"cat /media/usb/laptop/3~2.btrfs.gpg | btrfs receive /mnt/restore": "",
+	}}
+	archive, err := parseArchiveNode("/media/usb/laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive.executor = e
+	receiver := node{address: "localhost", mountPoint: "/mnt/restore", executor: e}
+
+	received, err := receiveArchive(&archive, &receiver, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, []string{"2", "3"}) {
+		t.Errorf("unexpected snapshots: %v", received)
+	}
+
+	// a single snapshot with its missing parents
+	e.out["ls -1 /mnt/restore"] = ""
+	e.out["cat /media/usb/laptop/1.btrfs | btrfs receive /mnt/restore"] = ""
+	if received, err = receiveArchive(&archive, &receiver, "2", "", false); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, []string{"1", "2"}) {
+		t.Errorf("unexpected snapshots: %v", received)
+	}
+
+	// a broken chain
+	e.out["ls -1 /media/usb/laptop"] = "2~1.btrfs\n"
+	if _, err := receiveArchive(&archive, &receiver, "", "", false); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+
+	if n, err := parseArchiveNode("box:22/backup/laptop"); err != nil || n.address != "box" || n.mountPoint != "/backup/laptop" {
+		t.Errorf("unexpected node: %+v, %v", n, err)
+	}
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// serverCommand is a command accepted by the receive server.
+type serverCommand struct {
+	prefix     []string        // leading arguments identifying the command
+	args       map[string]bool // permitted non-path arguments
+	checkPaths bool            // paths must be located below a directory of the allowlist, otherwise they are not restricted
+	dirs       bool            // with checkPaths: the directories of the allowlist themselves are permitted, eg. to list them
+	devices    bool            // paths must be devices below /dev instead
+	nargs      int             // number of arguments following the prefix, 0 if not fixed
+}
+
+func argSet(args ...string) map[string]bool {
+	res := make(map[string]bool)
+	for _, a := range args {
+		res[a] = true
+	}
+	return res
+}
+
+// serverCommands are all commands the client runs at the destination.
+var serverCommands = []serverCommand{
+	{prefix: []string{"btrfs", "receive"}, checkPaths: true, dirs: true, nargs: 1},
+	{prefix: []string{"btrfs", "subvolume", "list"}, args: argSet("-u", "-R"), checkPaths: true, dirs: true},
+	{prefix: []string{"btrfs", "subvolume", "delete"}, args: argSet("--commit-each"), checkPaths: true},
+	{prefix: []string{"btrfs", "subvolume", "snapshot"}, args: argSet("-r"), checkPaths: true},
+	{prefix: []string{"btrfs", "subvolume", "sync"}, checkPaths: true, dirs: true},
+	{prefix: []string{"btrfs", "send"}, args: argSet("--quiet", "-p"), checkPaths: true},
+	{prefix: []string{"btrfs", "--version"}},
+	{prefix: []string{"ls"}, args: argSet("-1"), checkPaths: true, dirs: true},
+	{prefix: []string{"find"}, args: argSet("-mindepth", "-maxdepth", "0", "1", "-printf", findFormat), checkPaths: true, dirs: true},
+	{prefix: []string{"cat"}, checkPaths: true},
+	{prefix: []string{"realpath"}, args: argSet("-e"), checkPaths: true, dirs: true},
+	{prefix: []string{"mkdir"}, args: argSet("-p"), checkPaths: true, dirs: true},
+	{prefix: []string{"mv"}, args: argSet("-T"), checkPaths: true},
+	{prefix: []string{"df"}, args: argSet("--output=avail", "-B1")},
+	{prefix: []string{"test", "-b"}, devices: true, nargs: 1},
+	{prefix: []string{"test"}, args: argSet("-d", "-a", "-w", "-e"), checkPaths: true, dirs: true},
+	{prefix: []string{"findmnt"}, args: argSet("-n", "-o", "SOURCE", "--mountpoint")},
+	{prefix: []string{"date"}, args: argSet("+%s")},
+}
+
+// receiveServerCommand is meant to be the forced command of the backup key at the destination, eg. in
+// authorized_keys: command="btrfs-backup receive-server -allow /backup" ssh-ed25519 ... It reads a request as sent by
+// clients configured with a wrapper, validates it and runs it.
+func receiveServerCommand(args []string) {
+	fs := flag.NewFlagSet("receive-server", flag.ExitOnError)
+	allow := fs.String("allow", "", "comma separated list of directories which may be read, received into or deleted under")
+	logFile := fs.String("log", "", "file to log requests to, defaults to stderr")
+	fs.Parse(args)
+
+	logger := log.New(os.Stderr, "receive-server: ", log.LstdFlags)
+	if *logFile != "" {
+		f, err := os.OpenFile(*logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		logger = log.New(f, "", log.LstdFlags)
+	}
+	allowlist := splitList(*allow)
+	if len(allowlist) == 0 {
+		logger.Fatal("no directories allowed, use -allow")
+	}
+
+	err := serveRequest(os.Stdin, os.Stdout, os.Stderr, allowlist, logger, runLocal)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		os.Exit(exitErr.ExitCode())
+	}
+	if err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// commandRunner runs a command with the given standard streams.
+type commandRunner func(stdin io.Reader, stdout, stderr io.Writer, args ...string) error
+
+// runLocal runs a command on this host.
+func runLocal(stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin = stdin
+	c.Stdout = stdout
+	c.Stderr = stderr
+	return c.Run()
+}
+
+// serveRequest reads a request from r, validates it against the allowlist and runs it using run. The remaining input
+// is passed to the command. Receives are verified before the snapshot appears in the target directory.
+func serveRequest(r io.Reader, stdout, stderr io.Writer, allowlist []string, logger *log.Logger, run commandRunner) error {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("serveRequest: reading request: %v", err)
+	}
+	cmd, err := parseWrapperRequest(line)
+	if err != nil {
+		return err
+	}
+	if err := validateRequest(cmd, allowlist); err != nil {
+		logger.Printf("Rejected %s: %v", wrapperRequest(cmd), err)
+		return err
+	}
+	logger.Printf("Running %s", wrapperRequest(cmd))
+
+	if len(cmd) == 3 && cmd[0] == "btrfs" && cmd[1] == "receive" {
+		err = receiveVerified(cmd[2], br, stdout, stderr, logger, run)
+	} else {
+		err = run(br, stdout, stderr, cmd...)
+	}
+	if err != nil {
+		logger.Printf("Failed %s: %v", wrapperRequest(cmd), err)
+		return err
+	}
+	return nil
+}
+
+// receiveVerified receives a snapshot into a hidden temporary directory inside dir, verifies that the receive
+// completed and moves the snapshot into dir by renaming it, so that listings of dir never contain partially received
+// snapshots. btrfs receive verifies the checksums contained in the stream, the SHA-256 of the whole stream is logged
+// for auditing. Snapshots failing the verification are deleted.
+func receiveVerified(dir string, stdin io.Reader, stdout, stderr io.Writer, logger *log.Logger, run commandRunner) error {
+	tmp, err := os.MkdirTemp(dir, ".receiving-")
+	if err != nil {
+		return fmt.Errorf("receiveVerified: %v", err)
+	}
+	defer os.Remove(tmp)
+
+	h := sha256.New()
+	if err := run(io.TeeReader(stdin, h), stdout, stderr, "btrfs", "receive", tmp); err != nil {
+		removeReceived(tmp, stderr, logger, run)
+		return err
+	}
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		return fmt.Errorf("receiveVerified: %v", err)
+	}
+	if len(entries) != 1 {
+		removeReceived(tmp, stderr, logger, run)
+		return fmt.Errorf("receiveVerified: expected one received snapshot, found %d", len(entries))
+	}
+	name := entries[0].Name()
+	received := path.Join(tmp, name)
+
+	var out bytes.Buffer
+	if err := run(nil, &out, stderr, "btrfs", "subvolume", "show", received); err != nil {
+		removeReceived(tmp, stderr, logger, run)
+		return fmt.Errorf("receiveVerified: %v", err)
+	}
+	if err := verifyReceived(out.String()); err != nil {
+		removeReceived(tmp, stderr, logger, run)
+		return fmt.Errorf("receiveVerified: %s: %v", name, err)
+	}
+	if _, err := os.Lstat(path.Join(dir, name)); err == nil {
+		removeReceived(tmp, stderr, logger, run)
+		return fmt.Errorf("receiveVerified: %s already exists", path.Join(dir, name))
+	}
+	if err := os.Rename(received, path.Join(dir, name)); err != nil {
+		removeReceived(tmp, stderr, logger, run)
+		return fmt.Errorf("receiveVerified: %v", err)
+	}
+	logger.Printf("Received %s, stream SHA-256 %x", path.Join(dir, name), h.Sum(nil))
+	return nil
+}
+
+// verifyReceived checks the output of "btrfs subvolume show" of a received snapshot. btrfs receive sets the received
+// UUID and makes the snapshot read-only at the very end, so both are missing if the receive did not complete.
+func verifyReceived(show string) error {
+	receivedUUID, readOnly := "", false
+	for _, line := range strings.Split(show, "\n") {
+		fields := strings.Fields(line)
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(line), "Received UUID:") && len(fields) == 3:
+			receivedUUID = fields[2]
+		case strings.HasPrefix(strings.TrimSpace(line), "Flags:"):
+			for _, f := range fields[1:] {
+				if f == "readonly" {
+					readOnly = true
+				}
+			}
+		}
+	}
+	if receivedUUID == "" || receivedUUID == "-" {
+		return errors.New("no received UUID")
+	}
+	if !readOnly {
+		return errors.New("not read-only")
+	}
+	return nil
+}
+
+// removeReceived deletes all sub-volumes received into tmp.
+func removeReceived(tmp string, stderr io.Writer, logger *log.Logger, run commandRunner) {
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		logger.Printf("Cleaning up %s failed: %v", tmp, err)
+		return
+	}
+	for _, e := range entries {
+		p := path.Join(tmp, e.Name())
+		if err := run(nil, io.Discard, stderr, "btrfs", "subvolume", "delete", p); err != nil {
+			logger.Printf("Deleting %s failed: %v", p, err)
+		}
+	}
+}
+
+// validateRequest returns an error unless cmd is a known command whose arguments are permitted. Absolute paths must be
+// clean and located below a directory of the allowlist if the command checks paths. Symbolic links are resolved before
+// the check, so that links inside of received snapshots cannot point outside of the allowlist.
+func validateRequest(cmd []string, allowlist []string) error {
+	sc, ok := findServerCommand(cmd)
+	if !ok {
+		return fmt.Errorf("validateRequest: command not permitted: %s", strings.Join(cmd, " "))
+	}
+	args := cmd[len(sc.prefix):]
+	if sc.nargs > 0 && len(args) != sc.nargs {
+		return fmt.Errorf("validateRequest: %s requires %d arguments: %s", strings.Join(sc.prefix, " "), sc.nargs, strings.Join(cmd, " "))
+	}
+	var resolvedAllowlist []string
+	for _, dir := range allowlist {
+		if resolved, err := resolvePath(path.Clean(dir)); err == nil {
+			resolvedAllowlist = append(resolvedAllowlist, resolved)
+		}
+	}
+	for _, arg := range args {
+		if sc.args[arg] {
+			continue
+		}
+		if !strings.HasPrefix(arg, "/") {
+			return fmt.Errorf("validateRequest: argument not permitted: %q", arg)
+		}
+		if arg != path.Clean(arg) {
+			return fmt.Errorf("validateRequest: path not clean: %s", arg)
+		}
+		resolved, err := resolvePath(arg)
+		if err != nil {
+			return fmt.Errorf("validateRequest: %v", err)
+		}
+		if !sc.allowedPath(resolved, resolvedAllowlist) {
+			return fmt.Errorf("validateRequest: path not allowed: %s", arg)
+		}
+	}
+	return nil
+}
+
+// resolvePath returns the absolute path p with all symbolic links resolved. Components which do not exist yet, eg. the
+// target of mkdir, are appended to the resolved path of the longest existing prefix.
+func resolvePath(p string) (string, error) {
+	rest := ""
+	for dir := p; ; dir = path.Dir(dir) {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return path.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) || dir == "/" {
+			return "", fmt.Errorf("resolvePath: %v", err)
+		}
+		rest = path.Join(path.Base(dir), rest)
+	}
+}
+
+// findServerCommand returns the first of serverCommands whose prefix cmd starts with.
+func findServerCommand(cmd []string) (serverCommand, bool) {
+	for _, sc := range serverCommands {
+		if len(cmd) >= len(sc.prefix) && equalStrings(cmd[:len(sc.prefix)], sc.prefix) {
+			return sc, true
+		}
+	}
+	return serverCommand{}, false
+}
+
+// allowedPath reports whether the absolute path p may be an argument of sc.
+func (sc serverCommand) allowedPath(p string, allowlist []string) bool {
+	switch {
+	case sc.devices:
+		return strings.HasPrefix(path.Clean(p), "/dev/")
+	case !sc.checkPaths:
+		return true
+	case sc.dirs:
+		return allowedDir(p, allowlist)
+	}
+	return allowedPath(p, allowlist)
+}
+
+// checkAllowedPaths returns an error if cmd refers to an absolute path outside of the allowlist. Paths of known commands
+// which do not check paths, eg. df, are not restricted, the paths of unknown commands have to be located inside the
+// allowlist.
+func checkAllowedPaths(cmd []string, allowlist []string) error {
+	sc, ok := findServerCommand(cmd)
+	args := cmd
+	if ok {
+		args = cmd[len(sc.prefix):]
+	} else {
+		sc = serverCommand{checkPaths: true, dirs: true}
+	}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "/") && !sc.allowedPath(arg, allowlist) {
+			return fmt.Errorf("path not allowed: %s", arg)
+		}
+	}
+	return nil
+}
+
+// allowedPath reports whether p is located strictly below one of the directories of the allowlist. The directories
+// themselves are not included, so that they cannot be deleted or replaced.
+func allowedPath(p string, allowlist []string) bool {
+	p = path.Clean(p)
+	for _, dir := range allowlist {
+		if strings.HasPrefix(p, strings.TrimSuffix(path.Clean(dir), "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// allowedDir reports whether p is one of the directories of the allowlist or located inside of one.
+func allowedDir(p string, allowlist []string) bool {
+	p = path.Clean(p)
+	for _, dir := range allowlist {
+		if p == path.Clean(dir) {
+			return true
+		}
+	}
+	return allowedPath(p, allowlist)
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// splitList splits a comma separated list ignoring empty elements.
+func splitList(s string) []string {
+	var res []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			res = append(res, e)
+		}
+	}
+	return res
+}
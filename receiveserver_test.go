@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateRequest(t *testing.T) {
+	allow := []string{"/backup", "/srv/snapshots/"}
+	data := []struct {
+		cmd string
+		err bool
+	}{
+		{"btrfs receive /backup", false},
+		{"btrfs receive /backup/laptop", false},
+		{"btrfs receive /srv/snapshots/laptop", false},
+		{"btrfs subvolume list -u -R /backup", false},
+		{"btrfs subvolume delete --commit-each /backup/laptop/1 /backup/laptop/2", false},
+		{"df --output=avail -B1 /", false},
+		{"test -b /dev/mapper/backup", false},
+		{"btrfs --version", false},
+		{"btrfs receive /", true},
+		{"btrfs receive /backup2", true},
+		{"btrfs subvolume delete /backup/laptop/1 /etc", true},
+		{"btrfs subvolume delete /backup/../etc", true},
+		{"btrfs subvolume delete laptop/1", true},
+		{"btrfs filesystem resize max /backup", true},
+		{"rm -rf /backup", true},
+		{"ls -la /backup", true},
+		{"btrfs receive", true},
+		{"btrfs receive /backup/laptop /backup/other", true},
+		{"btrfs subvolume delete /backup", true},
+		{"btrfs subvolume delete /srv/snapshots", true},
+		{"mv -T /backup/laptop/.1.partial /backup", true},
+		{"test -e /backup/laptop/1", false},
+		{"test -d /backup -a -w /backup", false},
+		{"test -e /etc/shadow", true},
+		{"test -b /etc/passwd", true},
+		{"test -b /dev/mapper/backup /dev/sda", true},
+	}
+	for di, d := range data {
+		err := validateRequest(strings.Split(d.cmd, " "), allow)
+		if d.err && err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+		if !d.err && err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+	}
+}
+
+func TestValidateRequestSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	allowed := filepath.Join(dir, "backup")
+	if err := os.MkdirAll(filepath.Join(allowed, "snap"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/", filepath.Join(allowed, "snap", "x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(allowed, filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	data := []struct {
+		cmd   []string
+		allow string
+		err   bool
+	}{
+		{[]string{"cat", allowed + "/snap/x/etc/shadow"}, allowed, true},
+		{[]string{"find", allowed + "/snap/x/etc", "-maxdepth", "0"}, allowed, true},
+		{[]string{"btrfs", "subvolume", "delete", allowed + "/snap/x"}, allowed, true},
+		{[]string{"mv", "-T", allowed + "/snap/x/etc", allowed + "/etc"}, allowed, true},
+		{[]string{"ls", "-1", allowed + "/snap/x/.."}, allowed, true},
+		{[]string{"cat", allowed + "/snap/info"}, allowed, false},
+		{[]string{"mkdir", "-p", allowed + "/laptop/new"}, allowed, false},
+		{[]string{"cat", dir + "/link/snap/info"}, allowed, false},
+		{[]string{"cat", allowed + "/snap/info"}, dir + "/link", false},
+		{[]string{"cat", dir + "/link/snap/x/etc/shadow"}, dir + "/link", true},
+	}
+	for di, d := range data {
+		err := validateRequest(d.cmd, []string{d.allow})
+		if d.err && err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+		if !d.err && err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+	}
+}
+
+func TestServeRequest(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	dir := t.TempDir()
+
+	var stdout bytes.Buffer
+	in := wrapperRequest([]string{"cat", dir + "/../" + dir[1:]}) + "\n"
+	if err := serveRequest(strings.NewReader(in), &stdout, io.Discard, []string{dir}, logger, runLocal); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+
+	in = wrapperRequest([]string{"mkdir", "-p", dir + "/a"}) + "\n"
+	if err := serveRequest(strings.NewReader(in), &stdout, io.Discard, []string{dir}, logger, runLocal); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	in = wrapperRequest([]string{"ls", "-1", dir}) + "\n"
+	if err := serveRequest(strings.NewReader(in), &stdout, io.Discard, []string{dir}, logger, runLocal); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if stdout.String() != "a\n" {
+		t.Errorf("unexpected output: %q", stdout.String())
+	}
+}
+
+func TestReceiveVerified(t *testing.T) {
+	logger := log.New(io.Discard, "", 0)
+	show := map[bool]string{
+		true:  "snapshot\n\tName: \t\t\t1\n\tReceived UUID: \t\taaaa-bbbb\n\tFlags: \t\t\treadonly\n",
+		false: "snapshot\n\tName: \t\t\t1\n\tReceived UUID: \t\t-\n\tFlags: \t\t\t-\n",
+	}
+	data := []struct {
+		complete bool // whether the receive completes
+		exists   bool // whether the snapshot already exists
+		err      bool
+	}{
+		{complete: true},
+		{complete: false, err: true},
+		{complete: true, exists: true, err: true},
+	}
+	for di, d := range data {
+		dir := t.TempDir()
+		if d.exists {
+			if err := os.Mkdir(filepath.Join(dir, "1"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var deleted []string
+		// simulates btrfs by creating directories
+		run := func(stdin io.Reader, stdout, stderr io.Writer, args ...string) error {
+			switch strings.Join(args[:3], " ") {
+			case "btrfs receive " + args[2]:
+				if _, err := io.Copy(io.Discard, stdin); err != nil {
+					return err
+				}
+				return os.Mkdir(filepath.Join(args[2], "1"), 0755)
+			case "btrfs subvolume show":
+				io.WriteString(stdout, show[d.complete])
+				return nil
+			case "btrfs subvolume delete":
+				deleted = append(deleted, args[3])
+				return os.Remove(args[3])
+			}
+			return fmt.Errorf("unexpected command: %v", args)
+		}
+
+		in := wrapperRequest([]string{"btrfs", "receive", dir}) + "\nstream"
+		err := serveRequest(strings.NewReader(in), io.Discard, io.Discard, []string{dir}, logger, run)
+		if d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// only the snapshot remains, without temporary directories
+		if present := len(entries) == 1 && entries[0].Name() == "1"; present != (d.complete || d.exists) {
+			t.Errorf("%d: unexpected entries: %v", di, entries)
+		}
+		if d.err != (len(deleted) == 1) {
+			t.Errorf("%d: unexpected deletions: %v", di, deleted)
+		}
+	}
+}
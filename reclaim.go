@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// exclusiveSizes returns the exclusive size of each of the given snapshots of n by the qgroups of their subvolumes.
+// Quotas must be enabled on the file system.
+func (n *node) exclusiveSizes(snapshots []string) (map[string]int, error) {
+	out, err := n.run("btrfs", "subvolume", "list", n.mountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("exclusiveSizes: %v", err)
+	}
+	ids := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		tokens := strings.Fields(line)
+		if len(tokens) == 9 && tokens[0] == "ID" {
+			ids[path.Clean(tokens[8])] = tokens[1]
+		}
+	}
+
+	out, err = n.run("btrfs", "qgroup", "show", "--raw", n.mountPoint)
+	if err != nil {
+		return nil, fmt.Errorf("exclusiveSizes: %v", err)
+	}
+	exclusive := make(map[string]int)
+	for _, line := range strings.Split(out, "\n") {
+		tokens := strings.Fields(line)
+		if len(tokens) < 3 || !strings.HasPrefix(tokens[0], "0/") {
+			continue
+		}
+		excl, err := strconv.Atoi(tokens[2])
+		if err != nil {
+			return nil, fmt.Errorf("exclusiveSizes: unexpected qgroup output: %s", line)
+		}
+		exclusive[strings.TrimPrefix(tokens[0], "0/")] = excl
+	}
+
+	res := make(map[string]int)
+	for _, s := range snapshots {
+		id, ok := ids[path.Join(n.snapshotPath, s, n.subvolume)]
+		if !ok {
+			return nil, fmt.Errorf("exclusiveSizes: no subvolume %s", s)
+		}
+		excl, ok := exclusive[id]
+		if !ok {
+			return nil, fmt.Errorf("exclusiveSizes: no qgroup for %s", s)
+		}
+		res[s] = excl
+	}
+	return res, nil
+}
+
+// reportReclaimable logs the space which deleting snapshots of n reclaims. It is a lower bound as data shared only by
+// deleted snapshots is not exclusive to any of them. Errors are logged since the report is informational only.
+func (n *node) reportReclaimable(snapshots []string) {
+	sizes, err := n.exclusiveSizes(snapshots)
+	if err != nil {
+		log.Printf("Cannot estimate the reclaimed space on %s, are quotas enabled? %v", n.address, err)
+		return
+	}
+	total := 0
+	for _, s := range snapshots {
+		log.Printf("%s: %s exclusive", s, formatBytes(sizes[s]))
+		total += sizes[s]
+	}
+	log.Printf("Deleting %d snapshots on %s reclaims at least %s", len(snapshots), n.address, formatBytes(total))
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestExclusiveSizes(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"ssh -C -p22 nas -- btrfs subvolume list /backup": "ID 256 gen 1 top level 5 path laptop/1\nID 257 gen 2 top level 5 path laptop/2\nID 258 gen 3 top level 5 path other/1\n",
+		"ssh -C -p22 nas -- btrfs qgroup show --raw /backup": "qgroupid         rfer         excl \n" +
+			"--------         ----         ---- \n" +
+			"0/5             16384        16384 \n" +
+			"0/256         1048576       524288 \n" +
+			"0/257         1048576         4096 \n" +
+			"0/258         1048576      1048576 \n" +
+			"1/100         3145728      1576960 \n",
+	}}
+	n := &node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: regexp.MustCompile(`^\d$`), executor: e}
+
+	res, err := n.exclusiveSizes([]string{"1", "2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int{"1": 524288, "2": 4096}; !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected sizes: %v", res)
+	}
+	if _, err := n.exclusiveSizes([]string{"3"}); err == nil {
+		t.Error("expected error for missing snapshot")
+	}
+
+	// quotas disabled
+	e.out["ssh -C -p22 nas -- btrfs qgroup show --raw /backup"] = ""
+	if _, err := n.exclusiveSizes([]string{"1"}); err == nil {
+		t.Error("expected error without qgroups")
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// recording contains the results of commands run by the executor. Recordings of real runs allow reproducing planner
+// bugs by replaying them without access to the nodes.
+type recording struct {
+	path string
+
+	mu      sync.Mutex
+	Entries []recordedExec `json:"entries"`
+}
+
+// recordedExec is the result of one invocation of an executor.
+type recordedExec struct {
+	Cmds        [][]string `json:"cmds"`
+	Input       string     `json:"input,omitempty"`
+	Output      string     `json:"output"`
+	Transmitted int        `json:"transmitted"`
+	Error       string     `json:"error,omitempty"`
+}
+
+func loadRecording(path string) (*recording, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("loadRecording: %v", err)
+	}
+	r := &recording{path: path}
+	if err := json.Unmarshal(buf, r); err != nil {
+		return nil, fmt.Errorf("loadRecording: %s: %v", path, err)
+	}
+	return r, nil
+}
+
+// add appends an entry and saves the recording so that it is complete even if the process terminates early.
+func (r *recording) add(e recordedExec) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Entries = append(r.Entries, e)
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("saveRecording: %v", err)
+	}
+	if err := os.WriteFile(r.path, buf, 0600); err != nil {
+		return fmt.Errorf("saveRecording: %v", err)
+	}
+	return nil
+}
+
+// recordExecutor runs commands with executor and records their results.
+type recordExecutor struct {
+	executor executor
+	rec      *recording
+}
+
+func (e recordExecutor) exec(cmds [][]string) (string, int, error) {
+	out, transmitted, err := e.executor.exec(cmds)
+	entry := recordedExec{Cmds: cmds, Output: out, Transmitted: transmitted}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if recErr := e.rec.add(entry); recErr != nil {
+		return out, transmitted, recErr
+	}
+	return out, transmitted, err
+}
+
+// replayExecutor returns the recorded results instead of running commands. Results of a command are returned in the
+// order they were recorded, the last one is repeated if the command is run more often than during recording.
+type replayExecutor struct {
+	mu      sync.Mutex
+	results map[string][]recordedExec
+	next    map[string]int
+}
+
+func newReplayExecutor(r *recording) *replayExecutor {
+	e := &replayExecutor{results: make(map[string][]recordedExec), next: make(map[string]int)}
+	for _, entry := range r.Entries {
+		key := recordingKey(entry.Cmds)
+		e.results[key] = append(e.results[key], entry)
+	}
+	return e
+}
+
+func (e *replayExecutor) exec(cmds [][]string) (string, int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	key := recordingKey(cmds)
+	results := e.results[key]
+	if len(results) == 0 {
+		return "", 0, fmt.Errorf("replay: command not recorded: %s", key)
+	}
+	i := e.next[key]
+	if i < len(results)-1 {
+		e.next[key]++
+	}
+	res := results[i]
+	if res.Error != "" {
+		return res.Output, res.Transmitted, errors.New(res.Error)
+	}
+	return res.Output, res.Transmitted, nil
+}
+
+func recordingKey(cmds [][]string) string {
+	var parts []string
+	for _, cmd := range cmds {
+		parts = append(parts, strings.Join(cmd, " "))
+	}
+	return strings.Join(parts, " | ")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                       "ID 1 gen 1 top level 5 path snapshot/2019-01-01_03-00\nID 2 gen 2 top level 5 path snapshot/2019-01-02_03-00\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup": "ID 1 gen 1 top level 5 path laptop/2019-01-01_03-00\n",
+	}}
+	path := filepath.Join(t.TempDir(), "recording.json")
+	r := regexp.MustCompile(`^\d\d\d\d-\d\d-\d\d_\d\d-\d\d$`)
+	newJob := func(e executor) job {
+		return job{
+			source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+			destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+		}
+	}
+
+	recorded := newJob(recordExecutor{e, &recording{path: path}})
+	sourceSnapshots, err := recorded.source.getSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	destinationSnapshots, err := recorded.destination.getSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := recorded.destination.run("btrfs", "subvolume", "delete", "/x"); err == nil {
+		t.Fatalf("expected error but succeeded")
+	}
+
+	rec, err := loadRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Entries) != 3 {
+		t.Fatalf("unexpected number of entries: %d", len(rec.Entries))
+	}
+	replayed := newJob(newReplayExecutor(rec))
+	if res, err := replayed.source.getSnapshots(); err != nil || !reflect.DeepEqual(res, sourceSnapshots) {
+		t.Errorf("unexpected source snapshots: %v, %v", res, err)
+	}
+	if res, err := replayed.destination.getSnapshots(); err != nil || !reflect.DeepEqual(res, destinationSnapshots) {
+		t.Errorf("unexpected destination snapshots: %v, %v", res, err)
+	}
+	if _, err := replayed.destination.run("btrfs", "subvolume", "delete", "/x"); err == nil {
+		t.Errorf("expected recorded error but succeeded")
+	}
+	if _, err := replayed.destination.run("btrfs", "subvolume", "delete", "/y"); err == nil {
+		t.Errorf("expected error for command not recorded but succeeded")
+	}
+	if len(e.calls) != 3 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
+
+func TestRecordKeepsExecutor(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	jf := addJobFlags(fs)
+	path := filepath.Join(t.TempDir(), "recording.json")
+	if err := fs.Parse([]string{"-dst", "nas:22/backup", "-compress", "gzip", "-bwlimit", "1MiB/s", "-record", path}); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source, ok := jobs[0].source.executor.(recordExecutor)
+	if !ok {
+		t.Fatalf("source not recorded: %T", jobs[0].source.executor)
+	}
+	e := source.executor.(executorImpl)
+	if e.bwLimit != 1<<20 || len(e.filters) == 0 || e.filters[len(e.filters)-1] != (compressFilter{"gzip"}) {
+		t.Errorf("unexpected executor: %+v", e)
+	}
+	if _, ok := jobs[0].destination.executor.(recordExecutor); !ok {
+		t.Errorf("destination not recorded: %T", jobs[0].destination.executor)
+	}
+}
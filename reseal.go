@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// resealCommand repairs destination snapshots which drifted after they were received, see reseal.
+func resealCommand(args []string) {
+	fs := flag.NewFlagSet("reseal", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	fs.Parse(args)
+	jf.setup()
+
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	st := jf.loadState()
+	failed := 0
+	for i := range jobs {
+		if _, err := jobs[i].reseal(st, *dryRun); err != nil {
+			log.Printf("Job %s failed: %v", jobs[i].name, err)
+			failed++
+		}
+	}
+	if st != nil && !*dryRun {
+		if err := st.save(); err != nil {
+			log.Print(err)
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(jobs))
+	}
+}
+
+// reseal repairs the destination snapshots of j failing verification and returns the repaired ones. Writable
+// snapshots which are unmodified since their generation was recorded in st are made read-only again. All others are
+// moved to the quarantine directory for inspection and received again from the source, incrementally relative to the
+// newest older intact snapshot present on both nodes. Drifted snapshots the source no longer has cannot be repaired.
+func (j *job) reseal(st *state, dryRun bool) ([]string, error) {
+	drifts, sourceSnapshots, destinationSnapshots, err := j.checkSnapshots(st, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(drifts) == 0 {
+		log.Printf("All %d snapshots are intact", len(destinationSnapshots))
+		return nil, nil
+	}
+	intact := make(map[string]bool)
+	for _, s := range destinationSnapshots {
+		intact[s] = true
+	}
+	for _, d := range drifts {
+		intact[d.snapshot] = false
+	}
+	generations := st.generations(&j.destination)
+	defer st.setGenerations(&j.destination, generations)
+
+	var repaired []string
+	failed := 0
+	for _, d := range drifts {
+		log.Printf("%s: %s", d.snapshot, d.reason)
+		if d.resealable {
+			log.Printf("Making %s read-only again", d.snapshot)
+			if !dryRun {
+				if _, err := j.destination.run("btrfs", "property", "set", "-ts", j.destination.snapshotSubvolume(d.snapshot), "ro", "true"); err != nil {
+					return repaired, fmt.Errorf("reseal: %v", err)
+				}
+			}
+			intact[d.snapshot] = true
+			repaired = append(repaired, d.snapshot)
+			continue
+		}
+
+		parent, found := "", false
+		for _, s := range sourceSnapshots {
+			if s == d.snapshot {
+				found = true
+				break
+			}
+			if intact[s] {
+				parent = s
+			}
+		}
+		if !found {
+			log.Printf("Cannot repair %s, the source no longer has it", d.snapshot)
+			failed++
+			continue
+		}
+		log.Printf("Receiving %s again from the source", d.snapshot)
+		if !dryRun && !d.missing {
+			if err := j.destination.quarantine(j.destination.snapshotSubvolume(d.snapshot), time.Now()); err != nil {
+				return repaired, fmt.Errorf("reseal: %v", err)
+			}
+		}
+		if _, err := sendSnapshot(&j.source, &j.destination, d.snapshot, parent, dryRun); err != nil {
+			return repaired, fmt.Errorf("reseal: %v", err)
+		}
+		// the generation of the new snapshot is recorded by the next verification
+		delete(generations, d.snapshot)
+		intact[d.snapshot] = true
+		repaired = append(repaired, d.snapshot)
+	}
+	if failed > 0 {
+		return repaired, fmt.Errorf("reseal: %d of %d drifted snapshots cannot be repaired", failed, len(drifts))
+	}
+	return repaired, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestReseal(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                                          "ID 1 gen 1 top level 5 path snapshot/1\nID 2 gen 2 top level 5 path snapshot/2\nID 3 gen 3 top level 5 path snapshot/3\n",
+		"btrfs subvolume list -u -R /mnt":                                    "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\nID 2 gen 2 top level 5 received_uuid - uuid a2 path snapshot/2\nID 3 gen 3 top level 5 received_uuid - uuid a3 path snapshot/3\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":                    "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\nID 3 gen 3 top level 5 path laptop/3\n",
+		"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup":              "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid a2 uuid b2 path laptop/2\nID 3 gen 9 top level 5 received_uuid a3 uuid b3 path laptop/3\n",
+		"ssh -C -p22 nas -- btrfs subvolume list -r /backup":                 "ID 1 gen 1 top level 5 path laptop/1\nID 3 gen 9 top level 5 path laptop/3\n",
+		"ssh -C -p22 nas -- btrfs property set -ts /backup/laptop/2 ro true": "",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+	st := &state{Generations: map[string]map[string]int{"nas:22/backup/laptop": {"1": 1, "2": 2, "3": 3}}}
+
+	// 2 is writable but unmodified and made read-only again, 3 was modified and is received again
+	repaired, err := j.reseal(st, true)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(repaired, []string{"2", "3"}) {
+		t.Errorf("unexpected repaired snapshots: %v", repaired)
+	}
+	for c := range e.calls {
+		if strings.Contains(c, "property set") {
+			t.Errorf("unexpected call in dry run: %s", c)
+		}
+	}
+
+	// 3 is intact again
+	e.out["ssh -C -p22 nas -- btrfs subvolume list -u -R /backup"] = "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid a2 uuid b2 path laptop/2\nID 3 gen 3 top level 5 received_uuid a3 uuid b3 path laptop/3\n"
+	e.out["ssh -C -p22 nas -- btrfs subvolume list -r /backup"] = "ID 1 gen 1 top level 5 path laptop/1\nID 3 gen 3 top level 5 path laptop/3\n"
+	repaired, err = j.reseal(st, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(repaired, []string{"2"}) {
+		t.Errorf("unexpected repaired snapshots: %v", repaired)
+	}
+	if e.calls["ssh -C -p22 nas -- btrfs property set -ts /backup/laptop/2 ro true"] != 1 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+
+	// 1 was modified and the source no longer has it
+	e.out["btrfs subvolume list /mnt"] = "ID 2 gen 2 top level 5 path snapshot/2\nID 3 gen 3 top level 5 path snapshot/3\n"
+	e.out["ssh -C -p22 nas -- btrfs subvolume list -r /backup"] = "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\nID 3 gen 3 top level 5 path laptop/3\n"
+	e.out["ssh -C -p22 nas -- btrfs subvolume list -u -R /backup"] = "ID 1 gen 4 top level 5 received_uuid a1 uuid b1 path laptop/1\nID 2 gen 2 top level 5 received_uuid a2 uuid b2 path laptop/2\nID 3 gen 3 top level 5 received_uuid a3 uuid b3 path laptop/3\n"
+	if _, err := j.reseal(st, true); err == nil {
+		t.Error("expected error but succeeded")
+	}
+}
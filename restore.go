@@ -0,0 +1,170 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// restoreCommand sends a snapshot from the destination back to the source.
+func restoreCommand(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	snapshot := fs.String("snapshot", "", "snapshot to restore")
+	target := fs.String("target", "", "directory on the source receiving the snapshot, defaults to the snapshot directory")
+	clone := fs.String("clone", "", "create a writable snapshot of the restored snapshot at this path")
+	jobName := fs.String("job", "", "job to restore from, required if several jobs are defined")
+	identity := fs.String("identity", "", "age identity file decrypting the streams of an archive encrypted with age")
+	fs.Parse(args)
+	jf.setup()
+
+	if *snapshot == "" {
+		log.Fatal("-snapshot is required")
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	j, err := selectJob(jobs, *jobName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := j.restore(*snapshot, *target, *clone, *identity, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// restore sends snapshot from the destination back to the source. It is received into target which defaults to the
+// snapshot directory of the source, so files can be recovered without touching the live subvolume. If possible, the
+// snapshot is sent incrementally relative to the newest older snapshot present on both nodes. If clone is not empty, a
+// writable snapshot of the received snapshot is created at that path. Snapshots stored in an archive are received
+// from their streams, decrypted with identity if necessary, see restoreArchive.
+func (j *job) restore(snapshot, target, clone, identity string, dryRun bool) error {
+	remoteSnapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		return fmt.Errorf("restore: failed to get remote snapshots: %v", err)
+	}
+	localSnapshots, err := j.source.getSnapshots()
+	if err != nil {
+		return fmt.Errorf("restore: failed to get local snapshots: %v", err)
+	}
+
+	local := make(map[string]bool)
+	for _, s := range localSnapshots {
+		local[s] = true
+	}
+	if local[snapshot] && target == "" {
+		return fmt.Errorf("restore: %s still exists at the source, please specify -target", snapshot)
+	}
+
+	parent, found := "", false
+	for _, s := range remoteSnapshots {
+		if s == snapshot {
+			found = true
+			break
+		}
+		if local[s] {
+			parent = s
+		}
+	}
+	if !found {
+		return fmt.Errorf("restore: unknown snapshot: %s", snapshot)
+	}
+
+	receiver := j.source
+	receiver.snapshotPath = ""
+	receiver.mountPoint = target
+	if target == "" {
+		receiver.mountPoint = path.Join(j.source.mountPoint, j.source.snapshotPath)
+	}
+
+	if j.destination.archive {
+		if err := j.restoreArchive(snapshot, &receiver, local, identity, dryRun); err != nil {
+			return err
+		}
+	} else if _, err := sendSnapshot(&j.destination, &receiver, snapshot, parent, dryRun); err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
+
+	if clone == "" {
+		return nil
+	}
+	received := path.Join(receiver.mountPoint, snapshot)
+	log.Printf("Creating writable snapshot %s of %s", clone, received)
+	if dryRun {
+		return nil
+	}
+	if _, err := receiver.run("btrfs", "subvolume", "snapshot", received, clone); err != nil {
+		return fmt.Errorf("restore: %v", err)
+	}
+	return nil
+}
+
+// restoreFileCommand copies a single file or directory from a snapshot at the destination back to the source.
+func restoreFileCommand(args []string) {
+	fs := flag.NewFlagSet("restore-file", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	snapshot := fs.String("snapshot", "", "snapshot containing the file")
+	file := fs.String("path", "", "absolute path of the file or directory to restore, eg. /home/user/doc.txt")
+	subvol := fs.String("subvol", "/", "path at which the snapshotted subvolume is mounted on the source")
+	dir := fs.String("dir", "", "directory on the source receiving the file, defaults to its original directory")
+	force := fs.Bool("force", false, "overwrite an existing file")
+	jobName := fs.String("job", "", "job to restore from, required if several jobs are defined")
+	fs.Parse(args)
+	jf.setup()
+
+	if *snapshot == "" || *file == "" {
+		log.Fatal("-snapshot and -path are required")
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	j, err := selectJob(jobs, *jobName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := j.restoreFile(*snapshot, *file, *subvol, *dir, *force, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// restoreFile copies file from snapshot at the destination into dir on the source using tar, which preserves
+// permissions and also works for directories. subvol is the path at which the snapshotted subvolume is mounted, it is
+// used to locate file inside the snapshot.
+func (j *job) restoreFile(snapshot, file, subvol, dir string, force, dryRun bool) error {
+	file, subvol = path.Clean(file), path.Clean(subvol)
+	rel := strings.TrimPrefix(strings.TrimPrefix(file, subvol), "/")
+	if !path.IsAbs(file) || rel == "" || (subvol != "/" && !strings.HasPrefix(file, subvol+"/")) {
+		return fmt.Errorf("restoreFile: %s is not located in %s", file, subvol)
+	}
+	if dir == "" {
+		dir = path.Dir(file)
+	}
+
+	src := path.Join(j.destination.mountPoint, j.destination.snapshotPath, snapshot, rel)
+	if _, err := j.destination.run("test", "-e", src); err != nil {
+		return fmt.Errorf("restoreFile: %s not found at %s: %v", src, j.destination.address, err)
+	}
+	dst := path.Join(dir, path.Base(file))
+	if !force {
+		if _, err := j.source.run("test", "-e", dst); err == nil {
+			return fmt.Errorf("restoreFile: %s already exists, use -force to overwrite it", dst)
+		}
+	}
+
+	log.Printf("Restoring %s from %s to %s", file, snapshot, dst)
+	if dryRun {
+		return nil
+	}
+	sendCmd := j.destination.command("tar", "-C", path.Dir(src), "-cf", "-", path.Base(src))
+	receiveCmd := j.source.stdinCommand("tar", "-C", dir, "-xf", "-")
+	if _, _, err := j.destination.executor.exec([][]string{sendCmd, receiveCmd}); err != nil {
+		return fmt.Errorf("restoreFile: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRestore(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /mnt":                       "ID 1 gen 1 top level 5 path snapshot/1\nID 3 gen 3 top level 5 path snapshot/3\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup": "ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\nID 3 gen 3 top level 5 path laptop/3\n",
+		"ssh -C -p22 nas -- btrfs send --quiet -p /backup/laptop/1 /backup/laptop/2 | btrfs receive /mnt/restore": "",
+		"btrfs subvolume snapshot /mnt/restore/2 /mnt/restore/2-rw":                                               "",
+		"ssh -C -p22 nas -- btrfs send --quiet /backup/laptop/1 | btrfs receive /mnt/snapshot":                    "",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+	}
+
+	data := []struct {
+		snapshot string
+		target   string
+		clone    string
+		err      bool
+	}{
+		{"2", "/mnt/restore", "/mnt/restore/2-rw", false},
+		{"3", "", "", true},             // still exists at the source
+		{"4", "/mnt/restore", "", true}, // unknown
+	}
+	for di, d := range data {
+		err := j.restore(d.snapshot, d.target, d.clone, "", false)
+		if d.err && err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+		if !d.err && err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+	}
+
+	// without a common parent the snapshot is sent completely
+	e.out["btrfs subvolume list /mnt"] = ""
+	if err := j.restore("1", "", "", "", false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestRestoreFile(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"ssh -C -p22 nas -- test -e /backup/laptop/2/user/doc.txt":                                    "",
+		"test -e /home/user/old/doc.txt":                                                              "",
+		"ssh -C -p22 nas -- tar -C /backup/laptop/2/user -cf - doc.txt | tar -C /home/user -xf -":     "",
+		"ssh -C -p22 nas -- tar -C /backup/laptop/2/user -cf - doc.txt | tar -C /home/user/old -xf -": "",
+	}}
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", executor: e},
+	}
+
+	data := []struct {
+		snapshot string
+		file     string
+		subvol   string
+		dir      string
+		force    bool
+		err      bool
+	}{
+		{"2", "/home/user/doc.txt", "/home", "", false, false},
+		{"2", "/home/user/doc.txt", "/home", "/home/user/old", false, true}, // exists
+		{"2", "/home/user/doc.txt", "/home", "/home/user/old", true, false},
+		{"2", "/home/user/other.txt", "/home", "", false, true}, // not in snapshot
+		{"2", "/etc/fstab", "/home", "", false, true},           // not in subvolume
+		{"2", "/homer/doc.txt", "/home", "", false, true},       // not in subvolume
+	}
+	for di, d := range data {
+		err := j.restoreFile(d.snapshot, d.file, d.subvol, d.dir, d.force, false)
+		if d.err && err == nil {
+			t.Errorf("%d: expected error but succeeded", di)
+		}
+		if !d.err && err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retention selects the snapshots kept at the destination. A snapshot is kept if it is one of the keep most recent
+// snapshots or if any window keeps it.
+type retention struct {
+	keep    int               // number of most recent snapshots kept regardless of their age
+	windows []retentionWindow // snapshots kept by their age
+
+	snapshotTime func(name string) (time.Time, bool) // parses snapshot names, nil for the default naming
+}
+
+// retentionWindow keeps the snapshots younger than within. Unless every is "all", only the most recent snapshot of each
+// hour, day, week, month or year is kept. With a count instead of an age, the most recent snapshot of each of the count
+// most recent hours, days, weeks, months or years containing a snapshot is kept, regardless of their age.
+type retentionWindow struct {
+	every  string // all, hourly, daily, weekly, monthly or yearly
+	within time.Duration
+	count  int // number of periods kept, 0 if the window is limited by within
+}
+
+// retentionBuckets returns the key of the period containing t for every kind of window.
+var retentionBuckets = map[string]func(t time.Time) string{
+	"all":    func(t time.Time) string { return t.String() },
+	"hourly": func(t time.Time) string { return t.Format("2006-01-02 15") },
+	"daily":  func(t time.Time) string { return t.Format("2006-01-02") },
+	"weekly": func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	},
+	"monthly": func(t time.Time) string { return t.Format("2006-01") },
+	"yearly":  func(t time.Time) string { return t.Format("2006") },
+}
+
+// parseRetention parses windows like "7d,daily:90d,monthly:2y" which keep every snapshot of the last 7 days, one per day
+// of the last 90 days and one per month of the last 2 years. Windows like "daily:7,weekly:4,monthly:12" keep the most
+// recent snapshot of each of the 7 most recent days, 4 weeks and 12 months with snapshots.
+func parseRetention(keep int, spec string) (retention, error) {
+	r := retention{keep: keep}
+	if keep < 0 {
+		return r, fmt.Errorf("invalid keep: %d", keep)
+	}
+	for _, w := range splitList(spec) {
+		every, within := "all", w
+		if i := strings.Index(w, ":"); i >= 0 {
+			every, within = w[:i], w[i+1:]
+		}
+		if _, ok := retentionBuckets[every]; !ok {
+			return r, fmt.Errorf("invalid retention window: %s", w)
+		}
+		if count, err := strconv.Atoi(within); err == nil && every != "all" {
+			if count <= 0 {
+				return r, fmt.Errorf("invalid retention window: %s", w)
+			}
+			r.windows = append(r.windows, retentionWindow{every: every, count: count})
+			continue
+		}
+		d, err := parseAge(within)
+		if err != nil {
+			return r, fmt.Errorf("invalid retention window: %s: %v", w, err)
+		}
+		r.windows = append(r.windows, retentionWindow{every: every, within: d})
+	}
+	return r, nil
+}
+
+// parseAge parses durations like "36h", "7d", "2w", "3m" or "2y". Months have 30 and years 365 days.
+func parseAge(s string) (time.Duration, error) {
+	units := map[byte]time.Duration{
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'm': 30 * 24 * time.Hour,
+		'y': 365 * 24 * time.Hour,
+	}
+	if s == "" {
+		return 0, fmt.Errorf("empty duration")
+	}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, fmt.Errorf("invalid unit: %s", s)
+	}
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid duration: %s", s)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// empty reports whether r keeps nothing, ie. pruning is disabled.
+func (r retention) empty() bool {
+	return r.keep == 0 && len(r.windows) == 0
+}
+
+// forNode returns r evaluating the timestamps in the names of snapshots of n.
+func (r retention) forNode(n *node) retention {
+	r.snapshotTime = n.snapshotTime
+	return r
+}
+
+// kept returns the snapshots kept at now. Windows are evaluated against the timestamps in the snapshot names,
+// snapshots whose name contains no timestamp are always kept. snapshots must be sorted.
+func (r retention) kept(snapshots []string, now time.Time) map[string]bool {
+	res := make(map[string]bool)
+	for i := len(snapshots) - r.keep; i < len(snapshots); i++ {
+		if i >= 0 {
+			res[snapshots[i]] = true
+		}
+	}
+	if len(r.windows) == 0 {
+		return res
+	}
+	timeOf := r.snapshotTime
+	if timeOf == nil {
+		timeOf = snapshotTime
+	}
+	for _, w := range r.windows {
+		bucket := retentionBuckets[w.every]
+		seen := make(map[string]bool)
+		for i := len(snapshots) - 1; i >= 0; i-- {
+			t, ok := timeOf(snapshots[i])
+			if !ok {
+				res[snapshots[i]] = true
+				continue
+			}
+			if w.count > 0 && len(seen) >= w.count && !seen[bucket(t)] {
+				continue
+			}
+			if w.count == 0 && now.Sub(t) > w.within {
+				continue
+			}
+			if key := bucket(t); !seen[key] {
+				seen[key] = true
+				res[snapshots[i]] = true
+			}
+		}
+	}
+	return res
+}
+
+// retentionCommand evaluates retention policies, currently only with the simulate subcommand.
+func retentionCommand(args []string) {
+	if len(args) == 0 || args[0] != "simulate" {
+		log.Fatal("usage: btrfs-backup retention simulate [flags]")
+	}
+	fs := flag.NewFlagSet("retention simulate", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	keep := fs.Int("keep", 0, "number of most recent snapshots kept at the destination")
+	windows := fs.String("retention", "", "comma separated windows of snapshots kept by age, eg. 7d,daily:90d,monthly:2y")
+	days := fs.Int("days", 30, "number of days to simulate")
+	every := fs.Duration("every", 24*time.Hour, "interval in which new snapshots are assumed to arrive")
+	fs.Parse(args[1:])
+	jf.setup()
+
+	r, err := jf.retention(*keep, *windows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if r.empty() {
+		log.Fatal("-keep or -retention is required")
+	}
+	if *days < 0 || *every <= 0 {
+		log.Fatal("-days must not be negative and -every must be positive")
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	now := time.Now()
+	for _, j := range jobs {
+		snapshots, err := j.destination.getSnapshots()
+		if err != nil {
+			log.Fatalf("Job %s failed: %v", j.name, err)
+		}
+		fmt.Printf("%s:\n", j.name)
+		printRetentionSteps(os.Stdout, simulateRetention(&j.destination, snapshots, r, now, *days, *every))
+	}
+}
+
+// retentionStep is the state of the snapshots after pruning at a point in time of a simulation.
+type retentionStep struct {
+	time    time.Time
+	kept    []string
+	deleted []string
+}
+
+// simulateRetention prunes the snapshots of n by r now and then once a day for the given number of days. New snapshots
+// named like the ones of n are assumed to arrive in the given interval. The most recent snapshot is never deleted as it
+// is the parent of the next transfer.
+func simulateRetention(n *node, snapshots []string, r retention, now time.Time, days int, every time.Duration) []retentionStep {
+	r = r.forNode(n)
+	var steps []retentionStep
+	current := append([]string(nil), snapshots...)
+	next := now.Add(every)
+	for day := 0; day <= days; day++ {
+		t := now.AddDate(0, 0, day)
+		for ; !next.After(t); next = next.Add(every) {
+			if name, err := n.newSnapshotName(next, ""); err == nil {
+				current = append(current, name)
+			}
+		}
+		n.sortSnapshots(current)
+		protected := make(map[string]bool)
+		if len(current) > 0 {
+			protected[current[len(current)-1]] = true
+		}
+		deleted := planPrune(current, r, t, protected)
+		isDeleted := make(map[string]bool)
+		for _, s := range deleted {
+			isDeleted[s] = true
+		}
+		var kept []string
+		for _, s := range current {
+			if !isDeleted[s] {
+				kept = append(kept, s)
+			}
+		}
+		steps = append(steps, retentionStep{time: t, kept: kept, deleted: deleted})
+		current = kept
+	}
+	return steps
+}
+
+// printRetentionSteps lists the snapshots kept and deleted by the first step followed by a summary of every later step.
+func printRetentionSteps(w io.Writer, steps []retentionStep) {
+	if len(steps) == 0 {
+		return
+	}
+	for _, s := range steps[0].kept {
+		fmt.Fprintf(w, "  keep   %s\n", s)
+	}
+	for _, s := range steps[0].deleted {
+		fmt.Fprintf(w, "  delete %s\n", s)
+	}
+	for _, step := range steps[1:] {
+		oldest := "none"
+		if len(step.kept) > 0 {
+			oldest = step.kept[0]
+		}
+		fmt.Fprintf(w, "  %s: %d kept, %d deleted, oldest %s\n", step.time.Format("2006-01-02"), len(step.kept), len(step.deleted), oldest)
+	}
+}
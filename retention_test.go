@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestParseRetention(t *testing.T) {
+	data := []struct {
+		keep int
+		spec string
+		res  retention
+		err  bool
+	}{
+		{keep: 3, res: retention{keep: 3}},
+		{spec: "7d,daily:90d,monthly:2y", res: retention{windows: []retentionWindow{
+			{"all", 7 * 24 * time.Hour, 0},
+			{"daily", 90 * 24 * time.Hour, 0},
+			{"monthly", 2 * 365 * 24 * time.Hour, 0},
+		}}},
+		{keep: 1, spec: "weekly:8w", res: retention{keep: 1, windows: []retentionWindow{{"weekly", 8 * 7 * 24 * time.Hour, 0}}}},
+		{spec: "daily:7,weekly:4,yearly:10", res: retention{windows: []retentionWindow{
+			{"daily", 0, 7},
+			{"weekly", 0, 4},
+			{"yearly", 0, 10},
+		}}},
+		{spec: "daily:0", err: true},
+		{spec: "all:7", err: true},
+		{keep: -1, err: true},
+		{spec: "7", err: true},
+		{spec: "7s", err: true},
+		{spec: "fortnightly:7d", err: true},
+		{spec: "daily:", err: true},
+	}
+	for di, d := range data {
+		res, err := parseRetention(d.keep, d.spec)
+		if d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+			continue
+		}
+		if !d.err && !reflect.DeepEqual(res, d.res) {
+			t.Errorf("%d: unexpected result: %#v", di, res)
+		}
+	}
+}
+
+func TestPlanPruneRetention(t *testing.T) {
+	snapshots := []string{
+		"2018-06-15_03-00",
+		"2018-12-30_03-00",
+		"2018-12-31_03-00",
+		"2019-01-01_03-00",
+		"2019-01-01_15-00",
+		"2019-01-09_03-00",
+		"2019-01-09_15-00",
+		"2019-01-10_03-00",
+		"2019-01-10_15-00",
+		"manual",
+	}
+	now := time.Date(2019, 1, 10, 18, 0, 0, 0, time.Local)
+	data := []struct {
+		keep int
+		spec string
+		res  []string
+	}{
+		{spec: "2d", res: []string{"2018-06-15_03-00", "2018-12-30_03-00", "2018-12-31_03-00", "2019-01-01_03-00", "2019-01-01_15-00"}},
+		{spec: "daily:30d", res: []string{"2018-06-15_03-00", "2019-01-01_03-00", "2019-01-09_03-00", "2019-01-10_03-00"}},
+		{spec: "2d,monthly:1y", res: []string{"2018-12-30_03-00", "2019-01-01_03-00", "2019-01-01_15-00"}},
+		{keep: 3, spec: "yearly:2y", res: []string{"2018-06-15_03-00", "2018-12-30_03-00", "2019-01-01_03-00", "2019-01-01_15-00", "2019-01-09_03-00", "2019-01-09_15-00"}},
+		{spec: "daily:3", res: []string{"2018-06-15_03-00", "2018-12-30_03-00", "2018-12-31_03-00", "2019-01-01_03-00", "2019-01-09_03-00", "2019-01-10_03-00"}},
+		{spec: "daily:1,monthly:3", res: []string{"2018-12-30_03-00", "2019-01-01_03-00", "2019-01-01_15-00", "2019-01-09_03-00", "2019-01-09_15-00", "2019-01-10_03-00"}},
+	}
+	for di, d := range data {
+		r, err := parseRetention(d.keep, d.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := planPrune(snapshots, r, now, nil); !reflect.DeepEqual(res, d.res) {
+			t.Errorf("%d: unexpected result: %#v", di, res)
+		}
+	}
+}
+
+func TestSimulateRetention(t *testing.T) {
+	now := time.Date(2019, 1, 10, 3, 0, 0, 0, time.Local)
+	var snapshots []string
+	for i := 9; i >= 0; i-- {
+		name, _ := snapshotName(now.AddDate(0, 0, -i), "")
+		snapshots = append(snapshots, name)
+	}
+	r, err := parseRetention(0, "3d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &node{snapshotRegex: defaultSnapshotRegex}
+	steps := simulateRetention(n, snapshots, r, now, 5, 24*time.Hour)
+	if len(steps) != 6 {
+		t.Fatalf("unexpected number of steps: %d", len(steps))
+	}
+	if !reflect.DeepEqual(steps[0].kept, snapshots[6:]) || !reflect.DeepEqual(steps[0].deleted, snapshots[:6]) {
+		t.Errorf("unexpected first step: %v", steps[0])
+	}
+	for i, step := range steps[1:] {
+		newest, _ := snapshotName(now.AddDate(0, 0, i+1), "")
+		if len(step.kept) != 4 || len(step.deleted) != 1 || step.kept[3] != newest {
+			t.Errorf("%d: unexpected step: %v", i+1, step)
+		}
+	}
+
+	// the most recent snapshot survives even if it is older than all windows
+	steps = simulateRetention(n, snapshots, r, now.AddDate(1, 0, 0), 0, 24*time.Hour*365*2)
+	if !reflect.DeepEqual(steps[0].kept, snapshots[9:]) {
+		t.Errorf("unexpected kept snapshots: %v", steps[0].kept)
+	}
+
+	// names with a custom layout don't sort chronologically
+	n = &node{snapshotRegex: regexp.MustCompile(`^(\d\d\.\d\d\.\d\d\d\d)$`), timeLayout: "02.01.2006"}
+	now = time.Date(2019, 1, 31, 0, 0, 0, 0, time.Local)
+	snapshots = []string{"25.01.2019", "26.01.2019", "27.01.2019", "28.01.2019", "29.01.2019", "30.01.2019", "31.01.2019"}
+	steps = simulateRetention(n, snapshots, r, now, 2, 24*time.Hour)
+	if !reflect.DeepEqual(steps[0].kept, snapshots[3:]) || !reflect.DeepEqual(steps[0].deleted, snapshots[:3]) {
+		t.Errorf("unexpected first step: %v", steps[0])
+	}
+	if want := []string{"30.01.2019", "31.01.2019", "01.02.2019", "02.02.2019"}; !reflect.DeepEqual(steps[2].kept, want) {
+		t.Errorf("unexpected last step: %v", steps[2])
+	}
+}
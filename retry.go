@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+)
+
+// sendRetryDelay is the wait before the first retry of a failed transfer, doubled for every further attempt up to
+// sendRetryMaxDelay.
+var (
+	sendRetryDelay    = 30 * time.Second
+	sendRetryMaxDelay = 15 * time.Minute
+)
+
+// sendSnapshotRetrying sends t like sendSnapshot and retries it up to sendRetries times of destination with exponential
+// backoff if it fails with a retryable error. The failed receive is cleaned up after every attempt and the destination
+// is checked again before the next one: a transfer whose parent vanished or whose snapshot is still present cannot
+// succeed. It returns the number of bytes transmitted by all attempts.
+func sendSnapshotRetrying(source, destination *node, t transfer, dryRun bool) (int, error) {
+	total := 0
+	for attempt := 0; ; attempt++ {
+		transmitted, err := sendSnapshot(source, destination, t.snapshot, t.parent, dryRun)
+		total += transmitted
+		if err == nil {
+			return total, nil
+		}
+		log.Printf("Sending %s failed", t.snapshot)
+		if dryRun {
+			return total, err
+		}
+		if err := destination.cleanupReceive(t.snapshot); err != nil {
+			log.Printf("Cleaning up %s at destination failed: %v", t.snapshot, err)
+		}
+		if attempt >= destination.sendRetries || !retryable(err) {
+			return total, err
+		}
+
+		delay := sendRetryDelay << attempt
+		if delay > sendRetryMaxDelay || delay <= 0 {
+			delay = sendRetryMaxDelay
+		}
+		log.Printf("Retrying %s in %v (%d of %d): %v", t.snapshot, delay, attempt+1, destination.sendRetries, err)
+		select {
+		case <-interrupted:
+			return total, errInterrupted
+		case <-time.After(delay):
+		}
+		if recheck := destination.checkRetry(t); recheck != nil {
+			log.Printf("Not retrying %s: %v", t.snapshot, recheck)
+			return total, err
+		}
+	}
+}
+
+// checkRetry returns an error if sending t to n again cannot succeed. A destination which cannot be listed is
+// reachable again by the time of the next attempt.
+func (n *node) checkRetry(t transfer) error {
+	snapshots, err := n.getSnapshots()
+	if err != nil {
+		log.Printf("Listing snapshots at %s failed: %v", n.key(), err)
+		return nil
+	}
+	present := make(map[string]bool)
+	for _, s := range snapshots {
+		present[s] = true
+	}
+	if present[t.snapshot] {
+		return fmt.Errorf("%s is present at the destination, see cleanup", t.snapshot)
+	}
+	if t.parent != "" && !present[t.parent] {
+		return fmt.Errorf("parent %s is no longer present at the destination", t.parent)
+	}
+	return nil
+}
+
+// transientError marks failures which may not recur when the commands are run again: the ssh connection failed or
+// was lost, or the commands timed out or stalled.
+type transientError struct {
+	err error
+}
+
+func (e transientError) Error() string {
+	return e.err.Error()
+}
+
+func (e transientError) Unwrap() error {
+	return e.err
+}
+
+// sshFailure marks the error of cmd as transient if cmd is ssh exiting with status 255, which ssh reserves for its own
+// errors like a refused or reset connection.
+func sshFailure(cmd []string, err error) error {
+	var exitErr *exec.ExitError
+	if isSSHCommand(cmd) && errors.As(err, &exitErr) && exitErr.ExitCode() == 255 {
+		return transientError{err}
+	}
+	return err
+}
+
+// retryable reports whether a transfer which failed with err may succeed when retried, see transientError. Everything
+// else, eg. a failed receive, a missing parent, a full disk, a snapshot failing the verification or commands refused by
+// the allowlist, fails the same way again. Cancelled and interrupted transfers aren't retried either.
+func retryable(err error) bool {
+	if isInterrupted() || errors.Is(err, errCancelled) {
+		return false
+	}
+	var transient transientError
+	return errors.As(err, &transient)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyExecutor fails the commands in failures with the given errors in order before running them with mapExecutor.
+type flakyExecutor struct {
+	mapExecutor
+	failures map[string][]error
+}
+
+func (e *flakyExecutor) exec(cmds [][]string) (string, int, error) {
+	var parts []string
+	for _, cmd := range cmds {
+		parts = append(parts, strings.Join(cmd, " "))
+	}
+	key := strings.Join(parts, " | ")
+	if errs := e.failures[key]; len(errs) > 0 {
+		e.mapExecutor.exec(cmds)
+		e.failures[key] = errs[1:]
+		return "", 0, errs[0]
+	}
+	return e.mapExecutor.exec(cmds)
+}
+
+func TestSendSnapshotRetrying(t *testing.T) {
+	defer func(d time.Duration) { sendRetryDelay = d }(sendRetryDelay)
+	sendRetryDelay = time.Millisecond
+
+	const (
+		send    = "btrfs send --quiet -p /mnt/snapshot/1 /mnt/snapshot/2 | ssh -C -p22 nas -- btrfs receive /backup"
+		list    = "ssh -C -p22 nas -- btrfs subvolume list /backup"
+		cleanup = "ssh -C -p22 nas -- btrfs subvolume delete /backup/2"
+	)
+	reset := transientError{errors.New("[exit status 255]")}
+	data := []struct {
+		retries  int
+		failures []error
+		listing  string
+		sends    int
+		wantErr  bool
+	}{
+		{2, []error{reset}, "ID 1 gen 1 top level 5 path 1\n", 2, false},
+		{2, []error{reset, reset}, "ID 1 gen 1 top level 5 path 1\n", 3, false},
+		{1, []error{reset, reset}, "ID 1 gen 1 top level 5 path 1\n", 2, true},
+		{0, []error{reset}, "ID 1 gen 1 top level 5 path 1\n", 1, true},
+		// permanent errors aren't retried
+		{2, []error{errors.New("[exit status 1]")}, "ID 1 gen 1 top level 5 path 1\n", 1, true},
+		{2, []error{errors.New("[exit status 1]: ERROR: cannot find parent subvolume")}, "ID 1 gen 1 top level 5 path 1\n", 1, true},
+		{2, []error{errors.New("moveIncoming: 2: no received UUID")}, "ID 1 gen 1 top level 5 path 1\n", 1, true},
+		{2, []error{errors.New("allowlist: refusing to run btrfs receive /backup")}, "", 1, true},
+		{2, []error{errCancelled}, "", 1, true},
+		// the parent vanished from the destination
+		{2, []error{reset}, "", 1, true},
+	}
+	for di, d := range data {
+		e := &flakyExecutor{
+			mapExecutor: mapExecutor{out: map[string]string{send: "", list: d.listing, cleanup: ""}},
+			failures:    map[string][]error{send: d.failures},
+		}
+		r := regexp.MustCompile(`^\d$`)
+		source := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e}
+		destination := node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotRegex: r, executor: e, sendRetries: d.retries}
+		_, err := sendSnapshotRetrying(&source, &destination, transfer{snapshot: "2", parent: "1"}, false)
+		if (err != nil) != d.wantErr {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+		if e.calls[send] != d.sends {
+			t.Errorf("%d: sent %d times, want %d", di, e.calls[send], d.sends)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	data := []struct {
+		err  error
+		want bool
+	}{
+		{fmt.Errorf("sendSnapshot: %w", pipelineError{transientError{errors.New("exit status 255")}}), true},
+		{fmt.Errorf("sendSnapshot: %w", pipelineError{errors.New("exit status 1"), transientError{errors.New("exit status 255")}}), true},
+		{fmt.Errorf("sendSnapshot: %w: %v", transientError{errors.New("timed out after 1h0m0s")}, pipelineError{errors.New("signal: terminated")}), true},
+		{fmt.Errorf("sendSnapshot: %w", transientError{errors.New("stalled, no data for 15m0s")}), true},
+		{fmt.Errorf("sendSnapshot: %w", pipelineError{errors.New("exit status 1"), errors.New("exit status 1")}), false},
+		{errors.New("sendSnapshot: [exit status 255]"), false},
+		{errors.New("sendSnapshot: moveIncoming: 2: no received UUID"), false},
+		{fmt.Errorf("sendSnapshot: %w", errCancelled), false},
+		{errors.New("sendSnapshot: allowlist: refusing to run btrfs receive /data: exit status 1"), false},
+	}
+	for _, d := range data {
+		if res := retryable(d.err); res != d.want {
+			t.Errorf("%v: got %v", d.err, res)
+		}
+	}
+}
+
+func TestExecTransient(t *testing.T) {
+	// ssh exits with 255 if the connection fails, with the exit status of the remote command otherwise
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ssh"), []byte("#!/bin/sh\nexit $SSH_STATUS\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+":"+os.Getenv("PATH"))
+	n := &node{address: "nas", sshPort: 22}
+	data := []struct {
+		status string
+		want   bool
+	}{
+		{"255", true},
+		{"1", false},
+	}
+	for _, d := range data {
+		t.Setenv("SSH_STATUS", d.status)
+		_, _, err := executorImpl{}.exec([][]string{{"printf", "stream"}, n.command("btrfs", "receive", "/backup")})
+		if err == nil || retryable(err) != d.want {
+			t.Errorf("%s: unexpected result: %v, retryable %v", d.status, err, retryable(err))
+		}
+	}
+
+	// a local command exiting with 255 isn't an ssh failure
+	if _, _, err := (executorImpl{}).exec([][]string{{"sh", "-c", "exit 255"}}); err == nil || retryable(err) {
+		t.Errorf("unexpected result: %v", err)
+	}
+	_, _, err := executorImpl{timeout: 50 * time.Millisecond}.exec([][]string{{"sleep", "10"}, {"cat"}})
+	if err == nil || !retryable(err) {
+		t.Errorf("timeout not retryable: %v", err)
+	}
+}
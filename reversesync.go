@@ -0,0 +1,135 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+)
+
+// reverseSyncCommand sends the changes made to a promoted clone at the destination back to the source.
+func reverseSyncCommand(args []string) {
+	fs := flag.NewFlagSet("reverse-sync", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	target := fs.String("path", "", "path of the clone created by promote relative to the destination mount point, eg. live/home")
+	jobName := fs.String("job", "", "job to reverse, required if several jobs are defined")
+	fs.Parse(args)
+	jf.setup()
+
+	if *target == "" {
+		log.Fatal("-path is required")
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	j, err := selectJob(jobs, *jobName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	snapshot, err := j.reverseSync(*target, time.Now(), *dryRun)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s was received at the source, make a writable snapshot of it the live sub-volume, eg.\n", snapshot)
+	fmt.Printf("  btrfs subvolume snapshot %s %s\n", j.source.snapshotSubvolume(snapshot), j.source.originOrRoot())
+	fmt.Printf("after moving the old one away. The next send continues incrementally from %s.\n", snapshot)
+}
+
+// reverseSync sends the changes made to the clone at target, see promote, back to the source after a failover and
+// returns the name of the snapshot carrying them. A read-only snapshot of the clone is created in the snapshot
+// directory of the destination and sent to the source relative to the snapshot the clone was promoted from, which both
+// nodes still have. The source receives it with the UUID of the destination snapshot as its received UUID, so both
+// copies are recognized as the same snapshot, see sameSnapshot, and replication resumes incrementally from it without
+// sending it again.
+func (j *job) reverseSync(target string, now time.Time, dryRun bool) (string, error) {
+	n := &j.destination
+	clone, err := n.clonePath(target)
+	if err != nil {
+		return "", fmt.Errorf("reverseSync: %v", err)
+	}
+	out, err := n.run("btrfs", "subvolume", "show", clone)
+	if err != nil {
+		return "", fmt.Errorf("reverseSync: %v", err)
+	}
+	parentUUID := ""
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "Parent" && fields[1] == "UUID:" {
+			parentUUID = fields[2]
+		}
+	}
+
+	destinationSnapshots, err := n.getSnapshots()
+	if err != nil {
+		return "", fmt.Errorf("reverseSync: %v", err)
+	}
+	destinationInfos, err := n.listSubvolumeInfo()
+	if err != nil {
+		return "", fmt.Errorf("reverseSync: %v", err)
+	}
+	base, baseInfo := "", subvolumeInfo{}
+	for _, s := range destinationSnapshots {
+		if info, ok := findInfo(destinationInfos, path.Join(n.snapshotPath, s, n.subvolume)); ok && info.uuid == parentUUID {
+			base, baseInfo = s, info
+		}
+	}
+	if base == "" {
+		return "", fmt.Errorf("reverseSync: %s is not a clone of a snapshot at the destination, see promote", clone)
+	}
+
+	sourceSnapshots, err := j.source.getSnapshots()
+	if err != nil {
+		return "", fmt.Errorf("reverseSync: %v", err)
+	}
+	sourceInfos, err := j.source.listSubvolumeInfo()
+	if err != nil {
+		return "", fmt.Errorf("reverseSync: %v", err)
+	}
+	sourceInfo, ok := findInfo(sourceInfos, path.Join(j.source.snapshotPath, base, j.source.subvolume))
+	if !ok {
+		return "", fmt.Errorf("reverseSync: %s, which %s was promoted from, is gone at the source, the source has to be restored in full, see dr-restore", base, clone)
+	}
+	if !sameSnapshot(sourceInfo, baseInfo) {
+		return "", fmt.Errorf("reverseSync: %s at the source differs from the one at the destination, see verify", base)
+	}
+
+	snapshot, err := j.source.newSnapshotName(now, "")
+	if err != nil {
+		return "", fmt.Errorf("reverseSync: %v", err)
+	}
+	for _, s := range append(sourceSnapshots, destinationSnapshots...) {
+		if s == snapshot {
+			return "", fmt.Errorf("reverseSync: %s already exists", snapshot)
+		}
+	}
+
+	log.Printf("Snapshotting %s as %s at the destination and sending it back relative to %s", clone, snapshot, base)
+	if !dryRun {
+		if n.subvolume != "" {
+			if _, err := n.run("mkdir", "-p", n.receiveDir(snapshot)); err != nil {
+				return "", fmt.Errorf("reverseSync: %v", err)
+			}
+		}
+		if _, err := n.run("btrfs", "subvolume", "snapshot", "-r", clone, n.snapshotSubvolume(snapshot)); err != nil {
+			return "", fmt.Errorf("reverseSync: %v", err)
+		}
+	}
+
+	receiver := j.source
+	receiver.snapshotPath = ""
+	receiver.mountPoint = path.Join(j.source.mountPoint, j.source.snapshotPath)
+	if _, err := sendSnapshot(n, &receiver, snapshot, base, dryRun); err != nil {
+		// the snapshot carries nothing the clone doesn't, a later attempt creates a new one
+		if err := receiver.cleanupReceive(snapshot); err != nil {
+			log.Printf("Cleaning up %s at the source failed: %v", snapshot, err)
+		}
+		if _, err := n.run("btrfs", "subvolume", "delete", n.snapshotSubvolume(snapshot)); err != nil {
+			log.Printf("Deleting %s at the destination failed: %v", snapshot, err)
+		}
+		return "", fmt.Errorf("reverseSync: %v", err)
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestReverseSync(t *testing.T) {
+	const (
+		base     = "2026-10-01_00-00"
+		snapshot = "2026-10-16_12-00"
+	)
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.Local)
+	r := regexp.MustCompile(`^\d{4}-\d{2}-\d{2}_\d{2}-\d{2}$`)
+	newJob := func(e executor) job {
+		return job{
+			source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+			destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: e},
+		}
+	}
+	out := map[string]string{
+		"ssh -C -p22 nas -- btrfs subvolume show /backup/live/home":                                   "live/home\n\tUUID: \t\t\tc1\n\tParent UUID: \t\tr1\n\tReceived UUID: \t\t-\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /backup":                                             "ID 256 gen 5 top level 5 path laptop/" + base + "\nID 257 gen 9 top level 5 path live/home\n",
+		"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup":                                       "ID 256 gen 5 top level 5 received_uuid u1 uuid r1 path laptop/" + base + "\nID 257 gen 9 top level 5 received_uuid - uuid c1 path live/home\n",
+		"btrfs subvolume list /mnt":                                                                   "ID 256 gen 5 top level 5 path snapshot/" + base + "\n",
+		"btrfs subvolume list -u -R /mnt":                                                             "ID 256 gen 5 top level 5 received_uuid - uuid u1 path snapshot/" + base + "\n",
+		"ssh -C -p22 nas -- btrfs subvolume snapshot -r /backup/live/home /backup/laptop/" + snapshot: "",
+		"ssh -C -p22 nas -- btrfs send --quiet -p /backup/laptop/" + base + " /backup/laptop/" + snapshot + " | btrfs receive /mnt/snapshot": "",
+	}
+	e := &mapExecutor{out: out}
+	j := newJob(e)
+	res, err := j.reverseSync("live/home", now, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != snapshot {
+		t.Errorf("unexpected snapshot: %s", res)
+	}
+	for cmd := range e.out {
+		if e.calls[cmd] == 0 {
+			t.Errorf("%s not run", cmd)
+		}
+	}
+
+	// the snapshot the clone was promoted from must still be the same at the source
+	e = &mapExecutor{out: out}
+	e.out["btrfs subvolume list -u -R /mnt"] = "ID 256 gen 5 top level 5 received_uuid - uuid u2 path snapshot/" + base + "\n"
+	j = newJob(e)
+	if _, err := j.reverseSync("live/home", now, false); err == nil {
+		t.Error("expected error but succeeded")
+	}
+}
+
+func TestSameSnapshot(t *testing.T) {
+	data := []struct {
+		source, destination subvolumeInfo
+		want                bool
+	}{
+		{subvolumeInfo{uuid: "u1", receivedUUID: "-"}, subvolumeInfo{uuid: "r1", receivedUUID: "u1"}, true},
+		{subvolumeInfo{uuid: "u1", receivedUUID: "-"}, subvolumeInfo{uuid: "r1", receivedUUID: "u2"}, false},
+		// the source itself received the snapshot from elsewhere
+		{subvolumeInfo{uuid: "u1", receivedUUID: "x1"}, subvolumeInfo{uuid: "r1", receivedUUID: "x1"}, true},
+		// sent back to the source after a failover
+		{subvolumeInfo{uuid: "u1", receivedUUID: "r1"}, subvolumeInfo{uuid: "r1", receivedUUID: "-"}, true},
+		{subvolumeInfo{uuid: "u1", receivedUUID: "-"}, subvolumeInfo{uuid: "r1", receivedUUID: "-"}, false},
+	}
+	for di, d := range data {
+		if res := sameSnapshot(d.source, d.destination); res != d.want {
+			t.Errorf("%d: got %v", di, res)
+		}
+	}
+}
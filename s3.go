@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// s3Bucket is an S3-compatible object storage holding an archive. Objects are transferred with the local aws CLI,
+// which uploads streams of unknown size as multipart uploads and only creates the object once the stream is complete,
+// so no partial objects are ever listed.
+type s3Bucket struct {
+	bucket       string
+	endpoint     string // endpoint URL of S3-compatible storage other than AWS, eg. https://s3.example.com
+	profile      string // aws CLI profile holding the credentials
+	storageClass string // storage class of uploaded streams, eg. STANDARD_IA
+}
+
+var s3Regexp = regexp.MustCompile(`^s3://([a-z0-9][a-z0-9\-\.]+)(/[a-zA-Z0-9\-_\.\/]*)?$`)
+
+// parseS3Node parses an archive destination like s3://bucket/prefix. The archive directory of the node is the prefix
+// and commands are run locally.
+func parseS3Node(str string) (node, error) {
+	matches := s3Regexp.FindStringSubmatch(str)
+	if matches == nil {
+		return node{}, fmt.Errorf("invalid node: %s", str)
+	}
+	return node{
+		address:    "localhost",
+		mountPoint: path.Clean("/" + matches[2]),
+		archive:    true,
+		s3:         &s3Bucket{bucket: matches[1]},
+	}, nil
+}
+
+// aws returns the aws CLI command running cmd against b.
+func (b *s3Bucket) aws(cmd ...string) []string {
+	args := []string{"aws"}
+	if b.endpoint != "" {
+		args = append(args, "--endpoint-url", b.endpoint)
+	}
+	if b.profile != "" {
+		args = append(args, "--profile", b.profile)
+	}
+	return append(args, cmd...)
+}
+
+// url returns the URL of the object at p, an absolute path below the bucket.
+func (b *s3Bucket) url(p string) string {
+	return "s3://" + b.bucket + "/" + strings.TrimPrefix(p, "/")
+}
+
+// upload returns the command writing its input to the object at p. A stream is uploaded in at most 10,000 parts of
+// the chunk size of the aws CLI, 8MiB by default, unless its expectedSize in bytes is given, from which the CLI derives a
+// chunk size large enough. 0 means the size is unknown.
+func (b *s3Bucket) upload(p string, expectedSize int) []string {
+	cmd := b.aws("s3", "cp", "--only-show-errors")
+	if b.storageClass != "" {
+		cmd = append(cmd, "--storage-class", b.storageClass)
+	}
+	if expectedSize > 0 {
+		cmd = append(cmd, "--expected-size", strconv.Itoa(expectedSize))
+	}
+	return append(cmd, "-", b.url(p))
+}
+
+// download returns the command writing the object at p to its output.
+func (b *s3Bucket) download(p string) []string {
+	return b.aws("s3", "cp", "--only-show-errors", b.url(p), "-")
+}
+
+// remove returns the command deleting the object at p.
+func (b *s3Bucket) remove(p string) []string {
+	return b.aws("s3", "rm", "--only-show-errors", b.url(p))
+}
+
+// list returns the command listing the keys of the objects in dir, separated by white space.
+func (b *s3Bucket) list(dir string) []string {
+	prefix := strings.TrimPrefix(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return b.aws("s3api", "list-objects-v2", "--bucket", b.bucket, "--prefix", prefix, "--query", "Contents[].Key", "--output", "text")
+}
+
+// parseS3List returns the names of the objects directly in dir from the output of list, one per line like ls -1.
+func parseS3List(out, dir string) string {
+	prefix := strings.TrimPrefix(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	var names []string
+	for _, key := range strings.Fields(out) {
+		name := strings.TrimPrefix(key, prefix)
+		if key == "None" || name == key && prefix != "" || strings.Contains(name, "/") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return strings.Join(names, "\n")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func TestParseS3Node(t *testing.T) {
+	data := []struct {
+		in         string
+		mountPoint string
+		err        bool
+	}{
+		{"s3://backups/laptop", "/laptop", false},
+		{"s3://backups", "/", false},
+		{"s3://backups/", "/", false},
+		{"s3://Backups/laptop", "", true},
+		{"s3://backups/with space", "", true},
+	}
+	for di, d := range data {
+		n, err := parseNode(d.in)
+		if d.err {
+			if err == nil {
+				t.Errorf("%d: expected error but succeeded", di)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", di, err)
+			continue
+		}
+		if n.mountPoint != d.mountPoint || !n.archive || n.s3 == nil || n.s3.bucket != "backups" {
+			t.Errorf("%d: unexpected node: %+v", di, n)
+		}
+	}
+
+	n, _ := parseNode("s3://backups/hosts")
+	n.snapshotPath = "laptop"
+	if key := n.key(); key != "s3://backups/hosts/laptop" {
+		t.Errorf("unexpected key: %s", key)
+	}
+}
+
+func TestParseS3List(t *testing.T) {
+	out := "hosts/laptop/1.btrfs\thosts/laptop/2~1.btrfs\nhosts/laptop/manifest.json\thosts/laptop/old/1.btrfs\n"
+	if names := parseS3List(out, "/hosts/laptop"); names != "1.btrfs\n2~1.btrfs\nmanifest.json" {
+		t.Errorf("unexpected names: %q", names)
+	}
+	if names := parseS3List("None\n", "/hosts/laptop"); names != "" {
+		t.Errorf("unexpected names: %q", names)
+	}
+}
+
+func TestS3Archive(t *testing.T) {
+	list := "aws --endpoint-url https://s3.example.com s3api list-objects-v2 --bucket backups --prefix laptop/ --query Contents[].Key --output text"
+	e := &mapExecutor{out: map[string]string{
+		list:                        "laptop/1.btrfs.age\tlaptop/2~1.btrfs.age\tlaptop/3~2.btrfs.age\n",
+		"df --output=used -B1 /mnt": "Used\n80000000000\n",
+		// the size of the stream exceeds 10,000 default chunks, see s3Bucket.upload
+		"btrfs send --quiet -p /mnt/snapshot/3 /mnt/snapshot/4 | aws --endpoint-url https://s3.example.com s3 cp --only-show-errors --storage-class STANDARD_IA --expected-size 90000000000 - s3://backups/laptop/4~3.btrfs.age": "",
+		"aws --endpoint-url https://s3.example.com s3 rm --only-show-errors s3://backups/laptop/1.btrfs.age":                                                                                                                     "",
+		"aws --endpoint-url https://s3.example.com s3 rm --only-show-errors s3://backups/laptop/2~1.btrfs.age":                                                                                                                   "",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	destination, err := parseNode("s3://backups/laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	destination.s3.endpoint, destination.s3.storageClass = "https://s3.example.com", "STANDARD_IA"
+	destination.mountPoint, destination.snapshotPath = "/", "laptop"
+	destination.snapshotRegex, destination.executor = r, e
+	destination.encryption = encryption{age: []string{"age1abc"}}
+	j := job{
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: destination,
+	}
+
+	snapshots, err := j.destination.getSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(snapshots, []string{"1", "2", "3"}) {
+		t.Errorf("unexpected snapshots: %v", snapshots)
+	}
+	if _, err := sendTransfers(&j.source, &j.destination, []transfer{{snapshot: "4", parent: "3"}}, false, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new full send supersedes the chain of 1
+	e.out[list] = "laptop/1.btrfs.age\tlaptop/2~1.btrfs.age\tlaptop/3.btrfs.age\tlaptop/4~3.btrfs.age\n"
+	e.out["btrfs subvolume list /mnt"] = "ID 4 gen 4 top level 5 path snapshot/4\n"
+	if n, err := j.pruneNode(&j.destination, retention{keep: 2}, deleteBatches{}, references{}, false, false); err != nil || n != 2 {
+		t.Errorf("unexpected prune result: %d, %v", n, err)
+	}
+
+	e.out["aws --endpoint-url https://s3.example.com s3 cp --only-show-errors s3://backups/laptop/3.btrfs.age - | btrfs receive /mnt/restore"] = ""
+	e.out["aws --endpoint-url https://s3.example.com s3 cp --only-show-errors s3://backups/laptop/4~3.btrfs.age - | btrfs receive /mnt/restore"] = ""
+	if err := j.restore("4", "/mnt/restore", "", "key.txt", false); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	jf := addJobFlags(fs)
+	if err := fs.Parse([]string{"-dst", "s3://backups/hosts", "-s3-profile", "backup"}); err != nil {
+		t.Fatal(err)
+	}
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := jobs[0].destination; !d.archive || d.s3 == nil || d.s3.profile != "backup" {
+		t.Errorf("unexpected destination: %+v", d)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// scheduler lets prunes run while other jobs transfer snapshots. A node is never pruned while it receives snapshots or
+// while a job involving it hasn't planned its transfers yet. Nodes which only send snapshots may be pruned, except for
+// the snapshots being sent and their parents. A job doesn't start while one of its nodes is being pruned.
+type scheduler struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	locked  map[string]int                 // number of jobs preventing prunes by node key
+	pruning map[string]bool                // nodes being pruned by node key
+	pinned  map[string]map[string]int      // snapshots needed by in-flight sends by node key
+	jobs    map[string]*scheduledTransfers // in-flight jobs by job key
+}
+
+// scheduledTransfers is the part of a job's run relevant to prunes.
+type scheduledTransfers struct {
+	sourceLocked bool     // true until the transfers are planned
+	pins         []string // snapshots pinned at the source
+}
+
+func newScheduler() *scheduler {
+	s := &scheduler{
+		locked:  make(map[string]int),
+		pruning: make(map[string]bool),
+		pinned:  make(map[string]map[string]int),
+		jobs:    make(map[string]*scheduledTransfers),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// startJob waits until neither node of j is being pruned and locks both against prunes.
+func (s *scheduler) startJob(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.pruning[j.source.key()] || s.pruning[j.destination.key()] {
+		s.cond.Wait()
+	}
+	s.locked[j.source.key()]++
+	s.locked[j.destination.key()]++
+	s.jobs[j.key()] = &scheduledTransfers{sourceLocked: true}
+}
+
+// pinTransfers unlocks the source of j for prunes once its transfers are known. The snapshots sent and their parents
+// stay pinned until the job finishes.
+func (s *scheduler) pinTransfers(j *job, transfers []transfer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.jobs[j.key()]
+	if st == nil || !st.sourceLocked {
+		return
+	}
+	key := j.source.key()
+	if s.pinned[key] == nil {
+		s.pinned[key] = make(map[string]int)
+	}
+	for _, t := range transfers {
+		for _, snapshot := range []string{t.snapshot, t.parent} {
+			if snapshot != "" {
+				s.pinned[key][snapshot]++
+				st.pins = append(st.pins, snapshot)
+			}
+		}
+	}
+	st.sourceLocked = false
+	s.locked[key]--
+	s.cond.Broadcast()
+}
+
+// finishJob releases the locks and pins of j.
+func (s *scheduler) finishJob(j *job) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.jobs[j.key()]
+	if st == nil {
+		return
+	}
+	delete(s.jobs, j.key())
+	key := j.source.key()
+	if st.sourceLocked {
+		s.locked[key]--
+	}
+	s.locked[j.destination.key()]--
+	for _, snapshot := range st.pins {
+		if s.pinned[key][snapshot]--; s.pinned[key][snapshot] == 0 {
+			delete(s.pinned[key], snapshot)
+		}
+	}
+	s.cond.Broadcast()
+}
+
+// startPrune waits until n may be pruned and marks it as being pruned. It returns the reasons why snapshots of n must
+// be kept by snapshot.
+func (s *scheduler) startPrune(n *node) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := n.key()
+	for s.locked[key] > 0 || s.pruning[key] {
+		s.cond.Wait()
+	}
+	s.pruning[key] = true
+	reasons := make(map[string]string)
+	for snapshot := range s.pinned[key] {
+		reasons[snapshot] = "needed by an in-flight send"
+	}
+	return reasons
+}
+
+// finishPrune allows jobs involving n to start again.
+func (s *scheduler) finishPrune(n *node) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pruning, n.key())
+	s.cond.Broadcast()
+}
+
+// prune prunes the nodes of j selected by on by r as soon as the scheduler allows it. Snapshots referenced by other
+// jobs, held in st or needed by in-flight sends are kept. It returns the number of deleted snapshots.
+func (s *scheduler) prune(j *job, jobs []job, st *state, r retention, on string, dryRun bool) (int, error) {
+	total := 0
+	for _, n := range j.pruneTargets(on) {
+		deleted, err := s.pruneNode(j, n, jobs, st, r, dryRun)
+		total += deleted
+		if err != nil {
+			return total, fmt.Errorf("prune: %v", err)
+		}
+	}
+	return total, nil
+}
+
+func (s *scheduler) pruneNode(j *job, n *node, jobs []job, st *state, r retention, dryRun bool) (int, error) {
+	reasons, err := j.referencedSnapshots(n, jobs, st)
+	if err != nil {
+		return 0, err
+	}
+	pinned := s.startPrune(n)
+	defer s.finishPrune(n)
+	for snapshot, reason := range pinned {
+		reasons[snapshot] = reason
+	}
+	return j.pruneNode(n, r, deleteBatches{}, references{reasons: reasons}, false, dryRun)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// blocked reports whether f is still running after a short while. It waits for f to return otherwise.
+func blocked(f func()) (chan struct{}, bool) {
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return done, false
+	case <-time.After(50 * time.Millisecond):
+		return done, true
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	laptop := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot"}
+	nas := node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop"}
+	offsite := node{address: "offsite", sshPort: 22, mountPoint: "/store", snapshotPath: "laptop"}
+	a := &job{name: "a", source: laptop, destination: nas}
+	b := &job{name: "b", source: nas, destination: offsite}
+	s := newScheduler()
+
+	// nas receives, so it can't be pruned until a finishes
+	s.startJob(a)
+	s.pinTransfers(a, []transfer{{snapshot: "2", parent: "1"}})
+	var reasons map[string]string
+	done, ok := blocked(func() { reasons = s.startPrune(&nas) })
+	if !ok {
+		t.Fatal("pruned receiving node")
+	}
+	s.finishJob(a)
+	<-done
+	if len(reasons) != 0 {
+		t.Errorf("unexpected reasons: %v", reasons)
+	}
+
+	// b doesn't start while nas is pruned
+	done, ok = blocked(func() { s.startJob(b) })
+	if !ok {
+		t.Fatal("started job while its source is pruned")
+	}
+	s.finishPrune(&nas)
+	<-done
+
+	// until b planned its transfers, nas can't be pruned, afterwards only the pinned snapshots are kept
+	done, ok = blocked(func() { reasons = s.startPrune(&nas) })
+	if !ok {
+		t.Fatal("pruned node of unplanned job")
+	}
+	s.pinTransfers(b, []transfer{{snapshot: "3", parent: "2"}, {snapshot: "4", parent: "3"}})
+	<-done
+	want := map[string]string{"2": "needed by an in-flight send", "3": "needed by an in-flight send", "4": "needed by an in-flight send"}
+	if !reflect.DeepEqual(reasons, want) {
+		t.Errorf("unexpected reasons: %v", reasons)
+	}
+	s.finishPrune(&nas)
+	s.finishJob(b)
+	if reasons := s.startPrune(&nas); len(reasons) != 0 {
+		t.Errorf("unexpected reasons after finishing: %v", reasons)
+	}
+}
+
+func TestRunJobsPrune(t *testing.T) {
+	list := func(snapshots string) recordedExec {
+		return recordedExec{Cmds: [][]string{{"ssh", "-C", "-p22", "nas", "--", "btrfs", "subvolume", "list", "/backup"}}, Output: snapshots}
+	}
+	e := newReplayExecutor(&recording{Entries: []recordedExec{
+		{Cmds: [][]string{{"btrfs", "subvolume", "list", "/mnt"}}, Output: "ID 1 gen 1 top level 5 path snapshot/1\nID 2 gen 2 top level 5 path snapshot/2\n"},
+		list("ID 1 gen 1 top level 5 path laptop/1\n"),
+		{Cmds: [][]string{{"btrfs", "subvolume", "list", "-u", "-R", "/mnt"}}, Output: "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\n"},
+		{Cmds: [][]string{{"ssh", "-C", "-p22", "nas", "--", "btrfs", "subvolume", "list", "-u", "-R", "/backup"}}, Output: "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path laptop/1\n"},
+		list("ID 1 gen 1 top level 5 path laptop/1\nID 2 gen 2 top level 5 path laptop/2\n"),
+		{Cmds: [][]string{{"btrfs", "send", "--quiet", "-p", "/mnt/snapshot/1", "/mnt/snapshot/2"}, {"ssh", "-C", "-p22", "nas", "--", "btrfs", "receive", "/backup"}}},
+		{Cmds: [][]string{{"ssh", "-C", "-p22", "nas", "--", "btrfs", "subvolume", "delete", "/backup/laptop/1"}}},
+	}})
+	rec := &recording{path: filepath.Join(t.TempDir(), "recording.json")}
+	exec := recordExecutor{e, rec}
+	r := regexp.MustCompile(`^\d$`)
+	jobs := []job{{
+		name:        "a",
+		source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: exec},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", snapshotRegex: r, executor: exec},
+	}}
+
+	report := runJobs(jobs, nil, options{prune: retention{keep: 1}})
+	if report.failed() != 0 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if last := rec.Entries[len(rec.Entries)-1]; recordingKey(last.Cmds) != "ssh -C -p22 nas -- btrfs subvolume delete /backup/laptop/1" {
+		t.Errorf("unexpected last command: %v", last.Cmds)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"time"
+)
+
+// selftestCommand proves that snapshots can be sent to the destination before the first real transfer by sending a
+// tiny temporary snapshot.
+func selftestCommand(args []string) {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	fs.Parse(args)
+	jf.setup()
+
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	failed := 0
+	for i := range jobs {
+		j := &jobs[i]
+		if len(jobs) > 1 {
+			log.Printf("Testing job %s", j.name)
+		}
+		if err := j.selftest(time.Now()); err != nil {
+			log.Printf("Job %s failed: %v", j.name, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d jobs failed", failed, len(jobs))
+	}
+	log.Printf("Self-test passed")
+}
+
+// selftest creates an empty sub-volume at the source, snapshots it and sends the snapshot to the destination. The
+// received snapshot is verified by its received UUID. All temporary sub-volumes are deleted afterwards, even if the test
+// failed.
+func (j *job) selftest(now time.Time) (err error) {
+	if err := j.checkRemote(); err != nil {
+		return err
+	}
+
+	// the temporary snapshot is sent as a whole, never nested
+	source, destination := j.source, j.destination
+	source.subvolume, destination.subvolume = "", ""
+
+	name := "btrfs-backup-selftest." + now.Format("20060102T150405")
+	subvol := path.Join(source.mountPoint, "."+name)
+	snapshot := path.Join(source.mountPoint, source.snapshotPath, name)
+	received := path.Join(destination.receiveDir(name), name)
+
+	cleanup := func(n *node, p string) {
+		log.Printf("Deleting %s on %s", p, n.address)
+		if _, delErr := n.run("btrfs", "subvolume", "delete", p); delErr != nil && err == nil {
+			err = fmt.Errorf("selftest: cleanup: %v", delErr)
+		}
+	}
+
+	log.Printf("Creating %s", subvol)
+	if _, err := source.run("btrfs", "subvolume", "create", subvol); err != nil {
+		return fmt.Errorf("selftest: %v", err)
+	}
+	defer cleanup(&source, subvol)
+	if _, err := source.run("btrfs", "subvolume", "snapshot", "-r", subvol, snapshot); err != nil {
+		return fmt.Errorf("selftest: %v", err)
+	}
+	defer cleanup(&source, snapshot)
+
+	_, sendErr := sendSnapshot(&source, &destination, name, "", false)
+	// a failed receive may leave a partial snapshot behind
+	defer func() {
+		if _, testErr := destination.run("test", "-e", received); testErr == nil {
+			cleanup(&destination, received)
+		}
+	}()
+	if sendErr != nil {
+		return fmt.Errorf("selftest: %v", sendErr)
+	}
+
+	sourceInfo, err := source.findSubvolumeInfo(name)
+	if err != nil {
+		return fmt.Errorf("selftest: %v", err)
+	}
+	destinationInfo, err := destination.findSubvolumeInfo(name)
+	if err != nil {
+		return fmt.Errorf("selftest: %v", err)
+	}
+	if destinationInfo.receivedUUID != sourceInfo.uuid {
+		return fmt.Errorf("selftest: received snapshot has received UUID %s, expected %s", destinationInfo.receivedUUID, sourceInfo.uuid)
+	}
+	log.Printf("Verified %s at the destination", name)
+	return nil
+}
+
+// findSubvolumeInfo returns the sub-volume of n named name.
+func (n *node) findSubvolumeInfo(name string) (subvolumeInfo, error) {
+	infos, err := n.listSubvolumeInfo()
+	if err != nil {
+		return subvolumeInfo{}, err
+	}
+	for _, info := range infos {
+		if path.Base(info.path) == name {
+			return info, nil
+		}
+	}
+	return subvolumeInfo{}, fmt.Errorf("findSubvolumeInfo: %s not found on %s", name, n.address)
+}
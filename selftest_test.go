@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSelftest(t *testing.T) {
+	const (
+		subvol   = "/mnt/.btrfs-backup-selftest.20190101T030000"
+		snapshot = "/mnt/snapshot/btrfs-backup-selftest.20190101T030000"
+		received = "/backup/btrfs-backup-selftest.20190101T030000"
+		send     = "btrfs send --quiet " + snapshot + " | ssh -C -p22 nas -- btrfs receive /backup"
+	)
+	out := func(receivedUUID string) map[string]string {
+		return map[string]string{
+			"btrfs --version":                    "btrfs-progs v6.2\n",
+			"ssh -C -p22 nas -- btrfs --version": "btrfs-progs v6.2\n",
+			"ssh -C -p22 nas -- test -d /backup/laptop -a -w /backup/laptop": "",
+			"ssh -C -p22 nas -- df --output=avail -B1 /backup":               "Avail\n1000\n",
+			"btrfs subvolume create " + subvol:                               "",
+			"btrfs subvolume snapshot -r " + subvol + " " + snapshot:         "",
+			send:                                     "",
+			"ssh -C -p22 nas -- test -e " + received: "",
+			"btrfs subvolume list -u -R /mnt":        "ID 256 gen 7 top level 5 received_uuid - uuid aaaa path snapshot/btrfs-backup-selftest.20190101T030000\n",
+			"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup": "ID 256 gen 7 top level 5 received_uuid " + receivedUUID + " uuid bbbb path btrfs-backup-selftest.20190101T030000\n",
+			"btrfs subvolume delete " + subvol:                      "",
+			"btrfs subvolume delete " + snapshot:                    "",
+			"ssh -C -p22 nas -- btrfs subvolume delete " + received: "",
+		}
+	}
+	data := []struct {
+		receivedUUID string
+		fail         string // command which fails
+		err          bool
+	}{
+		{receivedUUID: "aaaa"},
+		{receivedUUID: "cccc", err: true},
+		{receivedUUID: "aaaa", fail: send, err: true},
+		{receivedUUID: "aaaa", fail: "btrfs subvolume snapshot -r " + subvol + " " + snapshot, err: true},
+	}
+	for di, d := range data {
+		e := &mapExecutor{out: out(d.receivedUUID)}
+		if d.fail != "" {
+			delete(e.out, d.fail)
+			delete(e.out, "ssh -C -p22 nas -- test -e "+received)
+		}
+		j := job{
+			source:      node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", executor: e},
+			destination: node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop", executor: e},
+		}
+		err := j.selftest(time.Date(2019, 1, 1, 3, 0, 0, 0, time.Local))
+		if d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+		if d.fail == "" && e.calls["ssh -C -p22 nas -- btrfs subvolume delete "+received] != 1 {
+			t.Errorf("%d: received snapshot not deleted: %v", di, e.calls)
+		}
+		if e.calls["btrfs subvolume delete "+subvol] != 1 {
+			t.Errorf("%d: temporary sub-volume not deleted: %v", di, e.calls)
+		}
+	}
+}
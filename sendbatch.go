@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+)
+
+// batchTransfers groups transfers into batches of at most size transfers. A batch is a chain in which every transfer
+// is relative to the previous one, so that it can be sent with a single btrfs send invocation. A full send is never
+// batched since btrfs send would send every snapshot of the batch in full.
+func batchTransfers(transfers []transfer, size int) [][]transfer {
+	var res [][]transfer
+	for i, t := range transfers {
+		n := len(res)
+		if i > 0 && len(res[n-1]) < size && res[n-1][0].parent != "" && t.parent != "" && t.parent == transfers[i-1].snapshot {
+			res[n-1] = append(res[n-1], t)
+			continue
+		}
+		res = append(res, []transfer{t})
+	}
+	return res
+}
+
+// canBatch reports whether several snapshots can be sent from source to destination in one stream.
+func canBatch(source, destination *node) bool {
+	return source.subvolume == "" && destination.subvolume == "" && destination.stagingDir == "" && destination.incomingDir == "" && !destination.archive
+}
+
+// sendTransferBatches is like sendTransfers but sends consecutive snapshots with one btrfs send invocation of up to
+// size snapshots, which saves a round trip per snapshot on high-latency links.
+func sendTransferBatches(source, destination *node, transfers []transfer, size int, dryRun bool, done func(t transfer, transmitted int)) ([]string, error) {
+	if size < 2 || !canBatch(source, destination) {
+		return sendTransfers(source, destination, transfers, dryRun, done)
+	}
+	var sent []string
+	for _, batch := range batchTransfers(transfers, size) {
+		if isInterrupted() {
+			return sent, errInterrupted
+		}
+		if len(batch) == 1 {
+			s, err := sendTransfers(source, destination, batch, dryRun, done)
+			sent = append(sent, s...)
+			if err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		transmitted, err := sendBatch(source, destination, batch, dryRun)
+		if err == nil {
+			for i, t := range batch {
+				sent = append(sent, t.snapshot)
+				if done != nil {
+					if i > 0 {
+						transmitted = 0 // the stream cannot be attributed to single snapshots
+					}
+					done(t, transmitted)
+				}
+			}
+			continue
+		}
+
+		log.Printf("Sending batch failed: %v", err)
+		if dryRun {
+			return sent, fmt.Errorf("transmitSnapshots: %v", err)
+		}
+		// snapshots preceding the failed one were received completely
+		complete, listErr := destination.receivedSnapshots()
+		for _, t := range batch {
+			if listErr == nil && complete[t.snapshot] {
+				sent = append(sent, t.snapshot)
+				if done != nil {
+					done(t, 0)
+				}
+				continue
+			}
+			if err := destination.cleanupReceive(t.snapshot); err != nil {
+				log.Printf("Cleaning up %s at destination failed: %v", t.snapshot, err)
+			}
+			break
+		}
+		return sent, fmt.Errorf("transmitSnapshots: %v", err)
+	}
+	return sent, nil
+}
+
+// sendBatch sends the snapshots of batch with a single btrfs send invocation. The first snapshot is sent relative to
+// its parent, each of the others relative to its predecessor.
+func sendBatch(source, destination *node, batch []transfer, dryRun bool) (int, error) {
+	sendCmd := destination.sendCommand()
+	if batch[0].parent != "" {
+		sendCmd = append(sendCmd, "-p", path.Join(source.mountPoint, source.snapshotPath, batch[0].parent))
+	}
+	var names []string
+	for _, t := range batch {
+		sendCmd = append(sendCmd, path.Join(source.mountPoint, source.snapshotPath, t.snapshot))
+		names = append(names, t.snapshot)
+	}
+	if source.sshPort != 0 {
+		sendCmd = sshCmd(source, sendCmd)
+	}
+	receiveCmd := destination.receiveCommand(destination.receiveDir(batch[0].snapshot))
+
+	log.Printf("Sending %s", strings.Join(names, ", "))
+	if dryRun {
+		return 0, nil
+	}
+	_, transmitted, err := source.executor.exec([][]string{sendCmd, receiveCmd})
+	if err != nil {
+		return transmitted, fmt.Errorf("sendBatch: %v", err)
+	}
+	log.Printf("Sending %s done: %s transmitted", strings.Join(names, ", "), formatBytes(transmitted))
+	return transmitted, nil
+}
+
+// receivedSnapshots returns the names of the sub-volumes of n which were received completely, ie. have a received
+// UUID.
+func (n *node) receivedSnapshots() (map[string]bool, error) {
+	infos, err := n.listSubvolumeInfo()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]bool)
+	for _, info := range infos {
+		if info.receivedUUID != "-" {
+			res[path.Base(info.path)] = true
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBatchTransfers(t *testing.T) {
+	transfers := []transfer{{"2", "1"}, {"3", "2"}, {"4", "3"}, {"6", "4"}, {"7", "6"}, {"8", ""}, {"9", "8"}}
+	data := []struct {
+		size int
+		res  [][]transfer
+	}{
+		{1, [][]transfer{{{"2", "1"}}, {{"3", "2"}}, {{"4", "3"}}, {{"6", "4"}}, {{"7", "6"}}, {{"8", ""}}, {{"9", "8"}}}},
+		{2, [][]transfer{{{"2", "1"}, {"3", "2"}}, {{"4", "3"}, {"6", "4"}}, {{"7", "6"}}, {{"8", ""}}, {{"9", "8"}}}},
+		{10, [][]transfer{{{"2", "1"}, {"3", "2"}, {"4", "3"}, {"6", "4"}, {"7", "6"}}, {{"8", ""}}, {{"9", "8"}}}},
+	}
+	for di, d := range data {
+		if res := batchTransfers(transfers, d.size); !reflect.DeepEqual(res, d.res) {
+			t.Errorf("%d: unexpected result: %v", di, res)
+		}
+	}
+}
+
+func TestSendTransferBatches(t *testing.T) {
+	const batch = "btrfs send --quiet -p /mnt/snapshot/1 /mnt/snapshot/2 /mnt/snapshot/3 | ssh -C -p22 nas -- btrfs receive /backup"
+	transfers := []transfer{{"2", "1"}, {"3", "2"}}
+	data := []struct {
+		fail bool
+		sent []string
+	}{
+		{fail: false, sent: []string{"2", "3"}},
+		{fail: true, sent: []string{"2"}},
+	}
+	for di, d := range data {
+		e := &mapExecutor{out: map[string]string{
+			"ssh -C -p22 nas -- btrfs subvolume list -u -R /backup": "ID 256 gen 7 top level 5 received_uuid aaaa uuid bbbb path 2\nID 257 gen 8 top level 5 received_uuid - uuid cccc path 3\n",
+			"ssh -C -p22 nas -- btrfs subvolume delete /backup/3":   "",
+		}}
+		if !d.fail {
+			e.out[batch] = ""
+		}
+		source := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", executor: e}
+		destination := node{address: "nas", sshPort: 22, mountPoint: "/backup", executor: e}
+		var done []string
+		sent, err := sendTransferBatches(&source, &destination, transfers, 5, false, func(t transfer, n int) {
+			done = append(done, t.snapshot)
+		})
+		if d.fail != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+		if !reflect.DeepEqual(sent, d.sent) || !reflect.DeepEqual(done, d.sent) {
+			t.Errorf("%d: unexpected result: %v, %v", di, sent, done)
+		}
+		if deleted := e.calls["ssh -C -p22 nas -- btrfs subvolume delete /backup/3"]; deleted != 0 != d.fail {
+			t.Errorf("%d: unexpected cleanup: %v", di, e.calls)
+		}
+	}
+}
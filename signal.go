@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// errInterrupted is returned by commands stopped and work skipped because the process received SIGINT or SIGTERM.
+var errInterrupted = errors.New("interrupted")
+
+// interrupted is closed on the first SIGINT or SIGTERM once handleSignals was called, nil before.
+var interrupted chan struct{}
+
+// handleSignals stops the running pipelines on the first SIGINT or SIGTERM like a cancelled transfer: their local
+// processes are terminated and waited for, their remote processes are killed and the partially received snapshots are
+// cleaned up. No further snapshots or jobs are started and the process exits once the cleanup is done. A second signal
+// exits immediately.
+func handleSignals() {
+	if interrupted != nil {
+		return
+	}
+	interrupted = make(chan struct{})
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		s := <-sig
+		log.Printf("Received %v, stopping the running commands and cleaning up, repeat to exit immediately", s)
+		close(interrupted)
+		s = <-sig
+		log.Fatalf("Received %v, exiting without cleaning up", s)
+	}()
+}
+
+// isInterrupted reports whether the process received SIGINT or SIGTERM.
+func isInterrupted() bool {
+	select {
+	case <-interrupted:
+		return true
+	default:
+		return false
+	}
+}
+
+// interruption returns the channel a pipeline started now is stopped by, nil if signals aren't handled or the process
+// was already interrupted: commands started after the interruption clean up and must complete.
+func interruption() <-chan struct{} {
+	if interrupted == nil || isInterrupted() {
+		return nil
+	}
+	return interrupted
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestInterrupt(t *testing.T) {
+	defer func(d time.Duration, c chan struct{}) { killGrace, interrupted = d, c }(killGrace, interrupted)
+	killGrace = 100 * time.Millisecond
+	interrupted = make(chan struct{})
+
+	e := &mapExecutor{}
+	r := regexp.MustCompile(`^\d$`)
+	source := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", snapshotRegex: r, executor: e}
+	destination := node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotRegex: r, executor: e}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(interrupted)
+	}()
+	start := time.Now()
+	_, _, err := executorImpl{}.exec([][]string{{"sleep", "10"}, {"cat"}})
+	if err != errInterrupted {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("commands not stopped, took %v", d)
+	}
+
+	// commands started after the interruption clean up and run to completion
+	if out, _, err := (executorImpl{}).exec([][]string{{"sh", "-c", "sleep 0.2; echo ok"}}); err != nil || out != "ok\n" {
+		t.Errorf("unexpected result: %q, %v", out, err)
+	}
+
+	// no further snapshots or jobs are started
+	sent, err := sendTransfers(&source, &destination, []transfer{{snapshot: "2", parent: "1"}, {snapshot: "3", parent: "2"}}, false, nil)
+	if err != errInterrupted || len(sent) != 0 || len(e.calls) != 0 {
+		t.Errorf("unexpected result: %v, %v, calls %v", sent, err, e.calls)
+	}
+	report := runJobs([]job{{name: "a", source: source, destination: destination}}, nil, options{})
+	if report.failed() != 1 || len(e.calls) != 0 {
+		t.Errorf("unexpected report %+v, calls %v", report, e.calls)
+	}
+}
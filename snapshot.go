@@ -0,0 +1,201 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// snapshotLayout is the time layout of snapshot names matched by defaultSnapshotRegex.
+const snapshotLayout = "2006-01-02_15-04"
+
+var tagRegex = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// snapshotCommand creates a tagged read-only snapshot right away, eg. before a risky upgrade, and optionally sends it
+// to the destination.
+func snapshotCommand(args []string) {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	jf := addJobFlags(fs)
+	dryRun := fs.Bool("n", false, "dry run")
+	tag := fs.String("tag", "", "tag appended to the snapshot name, eg. pre-upgrade")
+	subvol := fs.String("subvol", "", "subvolume to snapshot, defaults to the origin of the job or /")
+	jobName := fs.String("job", "", "job whose source receives the snapshot, required if several jobs are defined")
+	push := fs.Bool("push", false, "send the snapshot to the destination right away")
+	fs.Parse(args)
+	jf.setup()
+
+	jobs, err := jf.loadJobs()
+	if err != nil {
+		log.Fatal(err)
+	}
+	j, err := selectJob(jobs, *jobName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	name, err := j.source.newSnapshotName(time.Now(), *tag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *subvol == "" {
+		*subvol = j.source.originOrRoot()
+	}
+	if err := j.source.createSnapshot(*subvol, name, *dryRun); err != nil {
+		log.Fatal(err)
+	}
+
+	if !*push {
+		return
+	}
+	if *dryRun {
+		log.Printf("Sending %s", name)
+		return
+	}
+	handleSignals()
+	if err := j.run(jf.loadState(), options{snapshot: name, verbose: *jf.verbose}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// selectJob returns the job with the given name. An empty name selects the only job.
+func selectJob(jobs []job, name string) (*job, error) {
+	if name == "" {
+		if len(jobs) != 1 {
+			return nil, fmt.Errorf("%d jobs defined, please select one with -job", len(jobs))
+		}
+		return &jobs[0], nil
+	}
+	for i := range jobs {
+		if jobs[i].name == name {
+			return &jobs[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown job: %s", name)
+}
+
+// snapshotTime returns the time encoded in the name of a snapshot of n. With a time layout, the time is captured by the
+// first group of the snapshot regex or is the whole name if the regex has no groups.
+func (n *node) snapshotTime(name string) (time.Time, bool) {
+	if n.timeLayout == "" {
+		return snapshotTime(name)
+	}
+	value := name
+	if m := n.snapshotRegex.FindStringSubmatch(name); len(m) > 1 {
+		value = m[1]
+	}
+	t, err := time.ParseInLocation(n.timeLayout, value, time.Local)
+	return t, err == nil
+}
+
+// sortSnapshots sorts snapshots of n from oldest to newest. Without a time layout the names sort chronologically,
+// otherwise snapshots are ordered by their time and by name if it is equal. Snapshots without a time come first.
+func (n *node) sortSnapshots(snapshots []string) {
+	if n.timeLayout == "" {
+		sort.Strings(snapshots)
+		return
+	}
+	times := make(map[string]time.Time)
+	for _, s := range snapshots {
+		if t, ok := n.snapshotTime(s); ok {
+			times[s] = t
+		}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		ti, oki := times[snapshots[i]]
+		tj, okj := times[snapshots[j]]
+		if oki != okj {
+			return okj
+		}
+		if !ti.Equal(tj) {
+			return ti.Before(tj)
+		}
+		return snapshots[i] < snapshots[j]
+	})
+}
+
+// snapshotTime returns the time encoded in the name of a snapshot matched by defaultSnapshotRegex.
+func snapshotTime(name string) (time.Time, bool) {
+	if len(name) < len(snapshotLayout) {
+		return time.Time{}, false
+	}
+	t, err := time.ParseInLocation(snapshotLayout, name[:len(snapshotLayout)], time.Local)
+	return t, err == nil
+}
+
+// snapshotName returns the name of a snapshot taken at t with an optional tag.
+func snapshotName(t time.Time, tag string) (string, error) {
+	name := t.Format(snapshotLayout)
+	if tag == "" {
+		return name, nil
+	}
+	if !tagRegex.MatchString(tag) {
+		return "", fmt.Errorf("invalid tag: %s", tag)
+	}
+	return name + "_" + tag, nil
+}
+
+// newSnapshotName returns the name of a snapshot of n taken at t with an optional tag. The name is formatted with the
+// name layout, the time layout or the default naming, in this order, and must match the snapshot regex of n.
+func (n *node) newSnapshotName(t time.Time, tag string) (string, error) {
+	layout := n.nameLayout
+	if layout == "" {
+		layout = n.timeLayout
+	}
+	if layout == "" {
+		layout = snapshotLayout
+	}
+	if tag != "" && !tagRegex.MatchString(tag) {
+		return "", fmt.Errorf("invalid tag: %s", tag)
+	}
+	name := t.Format(layout)
+	if tag != "" {
+		name += "_" + tag
+	}
+	if n.snapshotRegex != nil && !n.snapshotRegex.MatchString(name) {
+		return "", fmt.Errorf("newSnapshotName: %s does not match the snapshot regex %s", name, n.snapshotRegex)
+	}
+	return name, nil
+}
+
+// originOrRoot returns the subvolume snapshotted when creating snapshots of n.
+func (n *node) originOrRoot() string {
+	if n.origin == "" {
+		return "/"
+	}
+	return n.origin
+}
+
+// createSnapshots creates a snapshot of the origin of every distinct source of jobs taken at t. It returns the errors
+// by source key.
+func createSnapshots(jobs []job, t time.Time, dryRun bool) map[string]error {
+	errs := make(map[string]error)
+	for i := range jobs {
+		n := &jobs[i].source
+		if _, done := errs[n.key()]; done {
+			continue
+		}
+		name, err := n.newSnapshotName(t, "")
+		if err == nil {
+			err = n.createSnapshot(n.originOrRoot(), name, dryRun)
+		}
+		errs[n.key()] = err
+	}
+	return errs
+}
+
+// createSnapshot creates a read-only snapshot of subvol named name in the snapshot directory of n.
+func (n *node) createSnapshot(subvol, name string, dryRun bool) error {
+	dst := path.Join(n.mountPoint, n.snapshotPath, name)
+	log.Printf("Creating snapshot %s of %s", dst, subvol)
+	if dryRun {
+		return nil
+	}
+	if _, err := n.run("btrfs", "subvolume", "snapshot", "-r", subvol, dst); err != nil {
+		return fmt.Errorf("createSnapshot: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestSnapshotName(t *testing.T) {
+	tm := time.Date(2024, 5, 1, 3, 4, 0, 0, time.UTC)
+	data := []struct {
+		tag  string
+		name string
+		err  bool
+	}{
+		{"", "2024-05-01_03-04", false},
+		{"pre-upgrade", "2024-05-01_03-04_pre-upgrade", false},
+		{"foo bar", "", true},
+		{"foo/bar", "", true},
+	}
+
+	for _, d := range data {
+		name, err := snapshotName(tm, d.tag)
+		if d.err && err == nil {
+			t.Errorf("%q: expected error but succeeded", d.tag)
+			continue
+		}
+		if !d.err && err != nil {
+			t.Errorf("%q: unexpected error: %v", d.tag, err)
+			continue
+		}
+		if name != d.name {
+			t.Errorf("%q: unexpected name: %s", d.tag, name)
+		}
+		if !d.err && !defaultSnapshotRegex.MatchString(name) {
+			t.Errorf("%q: %s doesn't match the snapshot regex", d.tag, name)
+		}
+	}
+}
+
+func TestSelectJob(t *testing.T) {
+	jobs := []job{{name: "a"}, {name: "b"}}
+	if j, err := selectJob(jobs, "b"); err != nil || j.name != "b" {
+		t.Errorf("unexpected result: %v, %v", j, err)
+	}
+	if _, err := selectJob(jobs, ""); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+	if _, err := selectJob(jobs, "c"); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+	if j, err := selectJob(jobs[:1], ""); err != nil || j.name != "a" {
+		t.Errorf("unexpected result: %v, %v", j, err)
+	}
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	n := node{
+		mountPoint:   "/mnt",
+		snapshotPath: "snapshot",
+		executor: mockExecutor{
+			[][]string{{"btrfs", "subvolume", "snapshot", "-r", "/", "/mnt/snapshot/2024-05-01_03-04_pre-upgrade"}},
+			"",
+			nil,
+		},
+	}
+	if err := n.createSnapshot("/", "2024-05-01_03-04_pre-upgrade", false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := n.createSnapshot("/home", "2024-05-01_03-04_pre-upgrade", false); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+}
+
+func TestNewSnapshotName(t *testing.T) {
+	tm := time.Date(2024, 5, 1, 3, 4, 0, 0, time.UTC)
+	data := []struct {
+		n    node
+		tag  string
+		name string
+		err  bool
+	}{
+		{node{}, "", "2024-05-01_03-04", false},
+		{node{}, "pre-upgrade", "2024-05-01_03-04_pre-upgrade", false},
+		{node{}, "foo bar", "", true},
+		{node{snapshotRegex: regexp.MustCompile(`^(.+)$`), timeLayout: time.RFC3339}, "", "2024-05-01T03:04:00Z", false},
+		{node{snapshotRegex: regexp.MustCompile(`^root\.(.+)$`), timeLayout: time.RFC3339, nameLayout: "root." + time.RFC3339}, "", "root.2024-05-01T03:04:00Z", false},
+		{node{snapshotRegex: regexp.MustCompile(`^root\.(.+)$`), timeLayout: time.RFC3339}, "", "", true},
+		{node{snapshotRegex: regexp.MustCompile(`^\d{4}-\d{2}-\d{2}_\d{2}-\d{2}$`)}, "pre-upgrade", "", true},
+	}
+	for di, d := range data {
+		name, err := d.n.newSnapshotName(tm, d.tag)
+		if d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+			continue
+		}
+		if name != d.name {
+			t.Errorf("%d: unexpected name: %s", di, name)
+		}
+	}
+}
+
+func TestCreateSnapshots(t *testing.T) {
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume snapshot -r / /mnt/snapshot/2024-05-01_03-04":          "",
+		"btrfs subvolume snapshot -r /home /mnt/home-snapshot/2024-05-01_03-04": "",
+	}}
+	root := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", executor: e}
+	home := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "home-snapshot", origin: "/home", executor: e}
+	broken := node{address: "localhost", mountPoint: "/data", snapshotPath: "snapshot", executor: e}
+	jobs := []job{{name: "a", source: root}, {name: "b", source: root}, {name: "c", source: home}, {name: "d", source: broken}}
+
+	errs := createSnapshots(jobs, time.Date(2024, 5, 1, 3, 4, 0, 0, time.Local), false)
+	if errs[root.key()] != nil || errs[home.key()] != nil || errs[broken.key()] == nil {
+		t.Errorf("unexpected errors: %v", errs)
+	}
+	// the source shared by a and b is only snapshotted once
+	if e.calls["btrfs subvolume snapshot -r / /mnt/snapshot/2024-05-01_03-04"] != 1 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
+
+func TestSnapshotTimeLayout(t *testing.T) {
+	n := &node{snapshotRegex: regexp.MustCompile(`^root\.(.+)$`), timeLayout: time.RFC3339}
+	snapshots := []string{"root.2024-06-01T03:00:00Z", "root.bogus", "root.2024-05-31T23:00:00-05:00", "root.2024-05-31T22:00:00Z"}
+	n.sortSnapshots(snapshots)
+	want := []string{"root.bogus", "root.2024-05-31T22:00:00Z", "root.2024-06-01T03:00:00Z", "root.2024-05-31T23:00:00-05:00"}
+	if !reflect.DeepEqual(snapshots, want) {
+		t.Errorf("unexpected order: %v", snapshots)
+	}
+	if tm, ok := n.snapshotTime("root.2024-06-01T03:00:00Z"); !ok || !tm.Equal(time.Date(2024, 6, 1, 3, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected time: %v, %v", tm, ok)
+	}
+	if _, ok := n.snapshotTime("root.bogus"); ok {
+		t.Errorf("parsed time of snapshot without time")
+	}
+
+	// without groups the whole name is the time
+	n = &node{snapshotRegex: regexp.MustCompile(`^\d{8}$`), timeLayout: "20060102"}
+	if tm, ok := n.snapshotTime("20240601"); !ok || tm.Day() != 1 {
+		t.Errorf("unexpected time: %v, %v", tm, ok)
+	}
+	r := retention{windows: []retentionWindow{{every: "daily", within: 48 * time.Hour}}}.forNode(n)
+	now := time.Date(2024, 6, 2, 12, 0, 0, 0, time.Local)
+	if res := planPrune([]string{"20240520", "20240601", "20240602"}, r, now, nil); !reflect.DeepEqual(res, []string{"20240520"}) {
+		t.Errorf("unexpected prunes: %v", res)
+	}
+}
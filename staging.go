@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stagingRemoteDir is the directory relative to the destination mount point receiving staged streams.
+const stagingRemoteDir = ".staging"
+
+// stagingRetryDelay is the wait before resuming an interrupted upload, multiplied by the number of the attempt.
+var stagingRetryDelay = 30 * time.Second
+
+// stagingName returns the file name of the stream of snapshot sent relative to parent from source to destination.
+func stagingName(source, destination *node, snapshot, parent string) string {
+	h := fnv.New32a()
+	h.Write([]byte(source.key() + " -> " + destination.key()))
+	if parent == "" {
+		parent = "full"
+	}
+	return fmt.Sprintf("%08x_%s_%s.btrfs", h.Sum32(), snapshot, parent)
+}
+
+// stagedSend writes the output of sendCmd to a file in the staging directory of destination, uploads the file to the
+// destination and receives it from there. btrfs send cannot resume, but an interrupted upload continues at the size
+// the file at the destination already has, so flaky links only cost the data in flight. Interrupted uploads are resumed
+// up to uploadRetries times within the run, later runs resume them as well. Staged files are kept until the snapshot
+// was received. Streams are written into a run directory first, see workDir.
+func stagedSend(source, destination *node, sendCmd []string, snapshot, parent string) (int, error) {
+	name := stagingName(source, destination, snapshot, parent)
+	local := filepath.Join(destination.stagingDir, name)
+
+	if _, err := os.Stat(local); os.IsNotExist(err) {
+		w := workDir{path: destination.stagingDir, maxSize: destination.stagingMax}
+		run, err := w.runDir()
+		if err != nil {
+			return 0, fmt.Errorf("stagedSend: %v", err)
+		}
+		defer os.RemoveAll(run)
+		if err := w.checkSpace(); err != nil {
+			return 0, fmt.Errorf("stagedSend: %v", err)
+		}
+		log.Printf("Staging %s in %s", snapshot, local)
+		part := filepath.Join(run, name)
+		if _, _, err := source.executor.exec([][]string{sendCmd, {"dd", "of=" + part, "bs=1M", "status=none"}}); err != nil {
+			return 0, fmt.Errorf("stagedSend: %v", err)
+		}
+		if err := os.Rename(part, local); err != nil {
+			return 0, fmt.Errorf("stagedSend: %v", err)
+		}
+	} else if err != nil {
+		return 0, fmt.Errorf("stagedSend: %v", err)
+	}
+	fi, err := os.Stat(local)
+	if err != nil {
+		return 0, fmt.Errorf("stagedSend: %v", err)
+	}
+	size := int(fi.Size())
+
+	transmitted := 0
+	remoteDir := path.Join(destination.mountPoint, stagingRemoteDir)
+	remote := path.Join(remoteDir, name)
+	if _, err := destination.run("mkdir", "-p", remoteDir); err != nil {
+		return 0, fmt.Errorf("stagedSend: %v", err)
+	}
+	offset, err := destination.fileSize(remote)
+	if err != nil {
+		return 0, fmt.Errorf("stagedSend: %v", err)
+	}
+	if offset > size {
+		log.Printf("Staged file at the destination is larger than %s, uploading it again", local)
+		if _, err := destination.run("rm", remote); err != nil {
+			return 0, fmt.Errorf("stagedSend: %v", err)
+		}
+		offset = 0
+	}
+	transmitted, err = uploadStaged(source, destination, local, remote, snapshot, offset, size)
+	for attempt := 1; err != nil && attempt <= destination.uploadRetries; attempt++ {
+		delay := time.Duration(attempt) * stagingRetryDelay
+		log.Printf("Upload of %s failed, retrying in %v (%d of %d): %v", snapshot, delay, attempt, destination.uploadRetries, err)
+		time.Sleep(delay)
+		if offset, err = destination.fileSize(remote); err != nil {
+			return transmitted, fmt.Errorf("stagedSend: %v", err)
+		}
+		if offset > size {
+			return transmitted, fmt.Errorf("stagedSend: staged file at the destination is larger than %s", local)
+		}
+		var t int
+		t, err = uploadStaged(source, destination, local, remote, snapshot, offset, size)
+		transmitted += t
+	}
+	if err != nil {
+		return transmitted, fmt.Errorf("stagedSend: %v", err)
+	}
+
+	if _, err := destination.run(destination.btrfsReceive("-f", remote, destination.receiveDir(snapshot))...); err != nil {
+		return transmitted, fmt.Errorf("stagedSend: %v", err)
+	}
+	if _, err := destination.run("rm", remote); err != nil {
+		log.Printf("Removing staged file at the destination failed: %v", err)
+	}
+	if err := os.Remove(local); err != nil {
+		log.Printf("Removing staged file failed: %v", err)
+	}
+	return transmitted, nil
+}
+
+// uploadStaged appends the staged file local to remote at destination starting at offset and checks that remote has
+// the size of local afterwards.
+func uploadStaged(source, destination *node, local, remote, snapshot string, offset, size int) (int, error) {
+	if offset >= size {
+		return 0, nil
+	}
+	if offset > 0 {
+		log.Printf("Resuming upload of %s at %s of %s", snapshot, formatBytes(offset), formatBytes(size))
+	}
+	upload := [][]string{
+		{"tail", "-c", "+" + strconv.Itoa(offset+1), local},
+		destination.command("dd", "of="+remote, "bs=1M", "oflag=append", "conv=notrunc", "status=none"),
+	}
+	_, transmitted, err := source.executor.exec(upload)
+	if err != nil {
+		return transmitted, fmt.Errorf("upload: %v", err)
+	}
+	uploaded, err := destination.fileSize(remote)
+	if err != nil {
+		return transmitted, err
+	}
+	if uploaded != size {
+		return transmitted, fmt.Errorf("uploaded %d of %d bytes", uploaded, size)
+	}
+	return transmitted, nil
+}
+
+// fileSize returns the size of the file at p on n or 0 if it does not exist.
+func (n *node) fileSize(p string) (int, error) {
+	if _, err := n.run("test", "-e", p); err != nil {
+		return 0, nil
+	}
+	out, err := n.run("stat", "-c", "%s", p)
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.Atoi(strings.TrimSpace(out))
+	if err != nil {
+		return 0, fmt.Errorf("unexpected stat output: %s", out)
+	}
+	return size, nil
+}
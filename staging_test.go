@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStagedSend(t *testing.T) {
+	source := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot"}
+	destination := node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop"}
+	name := stagingName(&source, &destination, "2", "1")
+	remote := "/backup/.staging/" + name
+	ssh := "ssh -C -p22 nas -- "
+	defer func(d time.Duration) { stagingRetryDelay = d }(stagingRetryDelay)
+	stagingRetryDelay = 0
+
+	data := []struct {
+		sizes       []string // sizes of the remote file reported by stat
+		upload      string   // offset passed to tail, empty if nothing is uploaded
+		retry       string   // offset passed to tail after the first upload was interrupted
+		retries     int
+		transmitted int
+		err         bool
+	}{
+		{sizes: []string{"4\n", "10\n"}, upload: "+5", transmitted: 6},
+		{sizes: []string{"10\n"}},
+		{sizes: []string{"12\n", "10\n"}, upload: "+1", transmitted: 10},
+		{sizes: []string{"4\n", "7\n"}, upload: "+5", transmitted: 3, err: true},
+		{sizes: []string{"4\n", "6\n", "10\n"}, upload: "+5", retry: "+7", retries: 1, transmitted: 6},
+		{sizes: []string{"4\n"}, upload: "+5", retry: "+7", transmitted: 2, err: true},
+	}
+	for di, d := range data {
+		destination.stagingDir = t.TempDir()
+		local := filepath.Join(destination.stagingDir, name)
+		if err := os.WriteFile(local, []byte("0123456789"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		rec := &recording{Entries: []recordedExec{
+			{Cmds: [][]string{strings.Split(ssh+"mkdir -p /backup/.staging", " ")}},
+			{Cmds: [][]string{strings.Split(ssh+"test -e "+remote, " ")}},
+			{Cmds: [][]string{strings.Split(ssh+"rm "+remote, " ")}},
+			{Cmds: [][]string{strings.Split(ssh+"btrfs receive -f "+remote+" /backup", " ")}},
+		}}
+		for _, size := range d.sizes {
+			rec.Entries = append(rec.Entries, recordedExec{Cmds: [][]string{strings.Split(ssh+"stat -c %s "+remote, " ")}, Output: size})
+		}
+		dd := strings.Split(ssh+"dd of="+remote+" bs=1M oflag=append conv=notrunc status=none", " ")
+		if d.retry != "" {
+			rec.Entries = append(rec.Entries,
+				recordedExec{Cmds: [][]string{{"tail", "-c", d.upload, local}, dd}, Transmitted: 2, Error: "connection reset"},
+				recordedExec{Cmds: [][]string{{"tail", "-c", d.retry, local}, dd}, Transmitted: d.transmitted - 2})
+		} else if d.upload != "" {
+			rec.Entries = append(rec.Entries, recordedExec{Cmds: [][]string{{"tail", "-c", d.upload, local}, dd}, Transmitted: d.transmitted})
+		}
+		e := newReplayExecutor(rec)
+		source.executor, destination.executor = e, e
+		destination.uploadRetries = d.retries
+
+		transmitted, err := stagedSend(&source, &destination, []string{"btrfs", "send", "--quiet"}, "2", "1")
+		if d.err != (err != nil) {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+		if transmitted != d.transmitted {
+			t.Errorf("%d: unexpected transmitted bytes: %d", di, transmitted)
+		}
+		// the staged file is only removed once the snapshot was received
+		if _, statErr := os.Stat(local); os.IsNotExist(statErr) != !d.err {
+			t.Errorf("%d: unexpected staged file: %v", di, statErr)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// state is persisted between runs. It is stored as JSON in a single file which several processes, eg. a daemon and
+// one-shot commands, may update concurrently, see save.
+type state struct {
+	path    string          // file the state is loaded from and saved to
+	mu      sync.Mutex      // guards listings and runs of jobs running concurrently
+	changed map[string]bool // entries changed since the state was loaded or saved by section and key, see touch
+
+	Listings map[string]listing           `json:"listings"`        // cached snapshot listings by node key
+	Runs     map[string]*runRecord        `json:"runs"`            // most recent run by job key
+	Holds    map[string]map[string]string `json:"holds,omitempty"` // reasons of held snapshots by node key and snapshot
+
+	// generations of destination snapshots when they were first verified by node key and snapshot
+	Generations map[string]map[string]int `json:"generations,omitempty"`
+	// last time destination snapshots passed verification by node key and snapshot
+	Verified map[string]map[string]time.Time `json:"verified,omitempty"`
+
+	LastDaemonRun time.Time `json:"last_daemon_run"` // end of the last run of a daemon which wasn't deferred
+}
+
+// listing is a cached snapshot listing of a node. It holds names only: the probe validating it, see
+// getSnapshotsCached, doesn't notice snapshots replaced under the same name, so the UUIDs the parent check and the
+// matching by UUID rely on are always listed.
+type listing struct {
+	Snapshots []string  `json:"snapshots"` // sorted list of snapshots
+	Updated   time.Time `json:"updated"`
+}
+
+// runRecord tracks the progress of a job's run.
+type runRecord struct {
+	Started     time.Time `json:"started"`
+	Finished    time.Time `json:"finished"` // zero if the run is in progress or was interrupted
+	Planned     []string  `json:"planned"`
+	Completed   []string  `json:"completed"`
+	Transmitted int       `json:"transmitted"` // bytes
+}
+
+// loadState reads the state from path. A missing file results in an empty state. No lock is needed since save
+// replaces the file atomically.
+func loadState(path string) (*state, error) {
+	s := &state{path: path}
+	buf, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		s.init()
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("loadState: %v", err)
+	}
+	if err := json.Unmarshal(buf, s); err != nil {
+		return nil, fmt.Errorf("loadState: %s: %v", path, err)
+	}
+	s.init()
+	return s, nil
+}
+
+func (s *state) init() {
+	if s.Listings == nil {
+		s.Listings = make(map[string]listing)
+	}
+	if s.Runs == nil {
+		s.Runs = make(map[string]*runRecord)
+	}
+}
+
+// State sections whose entries are merged by key when saving, see touch.
+const (
+	sectionListings      = "listings"
+	sectionRuns          = "runs"
+	sectionHolds         = "holds"
+	sectionGenerations   = "generations"
+	sectionVerified      = "verified"
+	sectionLastDaemonRun = "last_daemon_run"
+)
+
+// touch marks the entry key of section as changed by this process, so that save writes it instead of keeping the
+// entry saved by another process in the meantime. Callers running concurrently must hold s.mu.
+func (s *state) touch(section, key string) {
+	if s.changed == nil {
+		s.changed = make(map[string]bool)
+	}
+	s.changed[section+"/"+key] = true
+}
+
+// touchSnapshot marks the entry of snapshot of n in section as changed, see touch. Adding and deleting it are tracked
+// alike: save drops entries changed by this process which it no longer has. Callers must hold s.mu.
+func (s *state) touchSnapshot(section string, n *node, snapshot string) {
+	s.touch(section, n.key()+"/"+snapshot)
+}
+
+// holds returns a copy of the reasons of the held snapshots of n by snapshot. A nil state holds no snapshots.
+func (s *state) holds(n *node) map[string]string {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return copyMap(s.Holds[n.key()])
+}
+
+// generations returns a copy of the recorded generations of the snapshots of n, see setGenerations. A nil state has
+// none, otherwise the result isn't nil.
+func (s *state) generations(n *node) map[string]int {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := copyMap(s.Generations[n.key()])
+	if g == nil {
+		g = make(map[string]int)
+	}
+	return g
+}
+
+// setGenerations replaces the recorded generations of the snapshots of n. A nil state records nothing.
+func (s *state) setGenerations(n *node, g map[string]int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Generations == nil {
+		s.Generations = make(map[string]map[string]int)
+	}
+	s.Generations[n.key()] = copyMap(g)
+	s.touch(sectionGenerations, n.key())
+}
+
+// verified returns a copy of the times the snapshots of n last passed verification, see setVerified. A nil state has
+// none, otherwise the result isn't nil.
+func (s *state) verified(n *node) map[string]time.Time {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v := copyMap(s.Verified[n.key()])
+	if v == nil {
+		v = make(map[string]time.Time)
+	}
+	return v
+}
+
+// setVerified replaces the times the snapshots of n last passed verification. A nil state records nothing.
+func (s *state) setVerified(n *node, v map[string]time.Time) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.Verified == nil {
+		s.Verified = make(map[string]map[string]time.Time)
+	}
+	s.Verified[n.key()] = copyMap(v)
+	s.touch(sectionVerified, n.key())
+}
+
+// copyMap returns a copy of m, nil if m is nil.
+func copyMap[V any](m map[string]V) map[string]V {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]V, len(m))
+	for k, v := range m {
+		res[k] = v
+	}
+	return res
+}
+
+// updateListing replaces the cached listing of n.
+func (s *state) updateListing(n *node, snapshots []string) {
+	sorted := append([]string(nil), snapshots...)
+	n.sortSnapshots(sorted)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Listings[n.key()] = listing{Snapshots: sorted, Updated: time.Now()}
+	s.touch(sectionListings, n.key())
+}
+
+// listing returns the cached listing of the node identified by key.
+func (s *state) listing(key string) (listing, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.Listings[key]
+	return l, ok
+}
+
+// startRun records the start of a run of the job identified by key.
+func (s *state) startRun(key string, transfers []transfer) *runRecord {
+	r := &runRecord{Started: time.Now(), Planned: snapshotsOf(transfers)}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Runs[key] = r
+	s.touch(sectionRuns, key)
+	return r
+}
+
+// run returns the most recent run of the job identified by key or nil.
+func (s *state) run(key string) *runRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Runs[key]
+}
+
+// completed records that r sent snapshot, transmitting n bytes.
+func (s *state) completed(r *runRecord, snapshot string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.Completed = append(r.Completed, snapshot)
+	r.Transmitted += n
+	s.touchRun(r)
+}
+
+// finishRun records the end of r.
+func (s *state) finishRun(r *runRecord, finished time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r.Finished = finished
+	s.touchRun(r)
+}
+
+// touchRun marks the entry of the run r as changed. s.mu must be held.
+func (s *state) touchRun(r *runRecord) {
+	for key, run := range s.Runs {
+		if run == r {
+			s.touch(sectionRuns, key)
+		}
+	}
+}
+
+// save writes the state atomically by writing a temporary file and renaming it. Other processes may have saved the
+// state since it was loaded, so the file is read again while holding an exclusive advisory lock on path.lock and only
+// the entries changed by this process replace the ones in the file. The other entries are updated from the file, eg.
+// a running daemon sees the holds added by the hold command.
+func (s *state) save() error {
+	lock, err := lockState(s.path)
+	if err != nil {
+		return fmt.Errorf("saveState: %v", err)
+	}
+	defer lock.Close()
+	disk, err := loadState(s.path)
+	if err != nil {
+		return fmt.Errorf("saveState: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Listings = mergeEntries(s.changed, sectionListings, s.Listings, disk.Listings)
+	s.Runs = mergeEntries(s.changed, sectionRuns, s.Runs, disk.Runs)
+	s.Holds = mergeSnapshotEntries(s.changed, sectionHolds, s.Holds, disk.Holds)
+	s.Generations = mergeEntries(s.changed, sectionGenerations, s.Generations, disk.Generations)
+	s.Verified = mergeEntries(s.changed, sectionVerified, s.Verified, disk.Verified)
+	if !s.changed[sectionLastDaemonRun+"/"] {
+		s.LastDaemonRun = disk.LastDaemonRun
+	}
+	buf, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("saveState: %v", err)
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, buf, 0600); err != nil {
+		return fmt.Errorf("saveState: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("saveState: %v", err)
+	}
+	s.changed = make(map[string]bool)
+	return nil
+}
+
+// lockState creates the directory of the state file at path and takes an exclusive advisory lock on path.lock, which
+// is released by closing the returned file.
+func lockState(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// mergeEntries returns the entries of section changed by this process from ours and the other ones from disk.
+func mergeEntries[V any](changed map[string]bool, section string, ours, disk map[string]V) map[string]V {
+	res := make(map[string]V)
+	for key, v := range disk {
+		if !changed[section+"/"+key] {
+			res[key] = v
+		}
+	}
+	for key, v := range ours {
+		if changed[section+"/"+key] {
+			res[key] = v
+		}
+	}
+	return res
+}
+
+// mergeSnapshotEntries is mergeEntries for sections keyed by node key and snapshot, see touchSnapshot. Processes holding
+// different snapshots of the same node keep each other's entries. Entries changed by this process which are missing
+// from ours were deleted.
+func mergeSnapshotEntries[V any](changed map[string]bool, section string, ours, disk map[string]map[string]V) map[string]map[string]V {
+	res := make(map[string]map[string]V)
+	set := func(key, snapshot string, v V) {
+		if res[key] == nil {
+			res[key] = make(map[string]V)
+		}
+		res[key][snapshot] = v
+	}
+	for key, m := range disk {
+		for snapshot, v := range m {
+			if !changed[section+"/"+key+"/"+snapshot] {
+				set(key, snapshot, v)
+			}
+		}
+	}
+	for key, m := range ours {
+		for snapshot, v := range m {
+			if changed[section+"/"+key+"/"+snapshot] {
+				set(key, snapshot, v)
+			}
+		}
+	}
+	return res
+}
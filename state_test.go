@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mapExecutor returns the output registered for a command and an error for unknown commands. It counts invocations.
+type mapExecutor struct {
+	out   map[string]string
+	calls map[string]int
+}
+
+func (e *mapExecutor) exec(cmds [][]string) (string, int, error) {
+	var parts []string
+	for _, cmd := range cmds {
+		parts = append(parts, strings.Join(cmd, " "))
+	}
+	key := strings.Join(parts, " | ")
+	if e.calls == nil {
+		e.calls = make(map[string]int)
+	}
+	e.calls[key]++
+	out, ok := e.out[key]
+	if !ok {
+		return "", 0, fmt.Errorf("unexpected cmd: %s", key)
+	}
+	return out, 0, nil
+}
+
+func TestStateSaveLoad(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "sub", "state.json")
+	s, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &node{address: "foo", sshPort: 22, mountPoint: "/mnt", snapshotPath: "snapshot"}
+	s.updateListing(n, []string{"2", "1"})
+	if err := s.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s2.Listings[n.key()].Snapshots; !reflect.DeepEqual(got, []string{"1", "2"}) {
+		t.Errorf("unexpected listing: %#v", got)
+	}
+}
+
+func TestStateConcurrentSave(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	a := &node{address: "a", sshPort: 22, mountPoint: "/mnt", snapshotPath: "snapshot"}
+	b := &node{address: "b", sshPort: 22, mountPoint: "/mnt", snapshotPath: "snapshot"}
+
+	// a daemon and a one-shot command load the state before either saves it
+	daemon, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := daemon.startRun("job", nil)
+	cmd.Holds = map[string]map[string]string{a.key(): {"1": "audit"}}
+	cmd.touchSnapshot(sectionHolds, a, "1")
+	cmd.updateListing(b, []string{"1"})
+	if err := cmd.save(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.updateListing(a, []string{"1", "2"})
+	daemon.completed(r, "2", 10)
+	if err := daemon.save(); err != nil {
+		t.Fatal(err)
+	}
+	if daemon.holds(a)["1"] != "audit" {
+		t.Errorf("hold not seen by the daemon: %v", daemon.Holds)
+	}
+
+	res, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.holds(a)["1"] != "audit" || len(res.Listings) != 2 || res.run("job") == nil || res.run("job").Transmitted != 10 {
+		t.Errorf("lost updates: %+v", res)
+	}
+
+	// processes saving at the same time never corrupt the file
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s, err := loadState(p)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			s.startRun(strconv.Itoa(i), nil)
+			if err := s.save(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if res, err = loadState(p); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Runs) != 11 {
+		t.Errorf("unexpected runs: %v", res.Runs)
+	}
+}
+
+func TestStateGenerationsVerified(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "state.json")
+	n := &node{address: "nas", sshPort: 22, mountPoint: "/backup", snapshotPath: "laptop"}
+	a, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the maps are copies, changes only count once set
+	g := a.generations(n)
+	g["1"] = 10
+	if a.generations(n)["1"] != 0 {
+		t.Fatalf("generations not copied")
+	}
+	a.setGenerations(n, g)
+	g["1"] = 11
+	if a.generations(n)["1"] != 10 {
+		t.Fatalf("generations not copied")
+	}
+	b.setVerified(n, map[string]time.Time{"1": time.Unix(1, 0)})
+	if err := a.save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := loadState(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.generations(n)["1"] != 10 || !res.verified(n)["1"].Equal(time.Unix(1, 0)) {
+		t.Errorf("lost updates: %v, %v", res.Generations, res.Verified)
+	}
+}
+
+func TestGetSnapshotsCached(t *testing.T) {
+	list := "btrfs subvolume list /mnt"
+	probe := "ls -1 /mnt/snapshot"
+	e := &mapExecutor{out: map[string]string{
+		list:  "ID 6988 gen 23968 top level 5 path snapshot/2019-01-11_03-00\nID 6989 gen 23981 top level 5 path snapshot/2019-01-12_03-00\n",
+		probe: "2019-01-11_03-00\n2019-01-12_03-00\nfoo\n",
+	}}
+	n := &node{
+		mountPoint:    "/mnt",
+		snapshotPath:  "snapshot",
+		snapshotRegex: regexp.MustCompile(`^\d\d\d\d-\d\d-\d\d_\d\d-\d\d$`),
+		executor:      e,
+	}
+	s := &state{}
+	s.init()
+	want := []string{"2019-01-11_03-00", "2019-01-12_03-00"}
+
+	// first run performs a full listing
+	res, err := n.getSnapshotsCached(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, want) || e.calls[list] != 1 || e.calls[probe] != 0 {
+		t.Fatalf("unexpected result %#v, calls %v", res, e.calls)
+	}
+
+	// second run is served from the cache
+	res, err = n.getSnapshotsCached(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, want) || e.calls[list] != 1 || e.calls[probe] != 1 {
+		t.Fatalf("unexpected result %#v, calls %v", res, e.calls)
+	}
+
+	// a new snapshot invalidates the cache
+	e.out[probe] += "2019-01-13_03-00\n"
+	e.out[list] += "ID 6990 gen 24002 top level 5 path snapshot/2019-01-13_03-00\n"
+	res, err = n.getSnapshotsCached(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 || e.calls[list] != 2 {
+		t.Fatalf("unexpected result %#v, calls %v", res, e.calls)
+	}
+}
+
+func TestRunResume(t *testing.T) {
+	send := func(parent, snapshot string) string {
+		return fmt.Sprintf("btrfs send --quiet -p /src/snapshot/%s /src/snapshot/%s | ssh -C -p22 nas -- btrfs receive /dst", parent, snapshot)
+	}
+	e := &mapExecutor{out: map[string]string{
+		"btrfs subvolume list /src":                          "ID 1 gen 1 top level 5 path snapshot/1\nID 2 gen 2 top level 5 path snapshot/2\nID 3 gen 3 top level 5 path snapshot/3\nID 4 gen 4 top level 5 path snapshot/4\n",
+		"ssh -C -p22 nas -- btrfs subvolume list /dst":       "ID 1 gen 1 top level 5 path snapshot/1\n",
+		"ssh -C -p22 nas -- ls -1 /dst/snapshot":             "1\n2\n",
+		"btrfs subvolume list -u -R /src":                    "ID 1 gen 1 top level 5 received_uuid - uuid a1 path snapshot/1\nID 2 gen 2 top level 5 received_uuid - uuid a2 path snapshot/2\n",
+		"ssh -C -p22 nas -- btrfs subvolume list -u -R /dst": "ID 1 gen 1 top level 5 received_uuid a1 uuid b1 path snapshot/1\nID 2 gen 2 top level 5 received_uuid a2 uuid b2 path snapshot/2\n",
+		send("1", "2"): "",
+	}}
+	r := regexp.MustCompile(`^\d$`)
+	j := &job{
+		source:      node{address: "localhost", mountPoint: "/src", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+		destination: node{address: "nas", sshPort: 22, mountPoint: "/dst", snapshotPath: "snapshot", snapshotRegex: r, executor: e},
+	}
+	s, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first run is interrupted after sending 2
+	if err := j.run(s, options{}); err == nil {
+		t.Fatalf("expected error but succeeded")
+	}
+	rec := s.Runs[j.key()]
+	if !rec.Finished.IsZero() || !reflect.DeepEqual(rec.Planned, []string{"2", "3", "4"}) || !reflect.DeepEqual(rec.Completed, []string{"2"}) {
+		t.Fatalf("unexpected record: %#v", rec)
+	}
+
+	// the second run continues with 3 based on the cached listing
+	e.out[send("2", "3")] = ""
+	e.out[send("3", "4")] = ""
+	if err := j.run(s, options{}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	rec = s.Runs[j.key()]
+	if rec.Finished.IsZero() || !reflect.DeepEqual(rec.Completed, []string{"3", "4"}) {
+		t.Fatalf("unexpected record: %#v", rec)
+	}
+	if e.calls["ssh -C -p22 nas -- btrfs subvolume list /dst"] != 1 || e.calls[send("1", "2")] != 1 {
+		t.Errorf("unexpected calls: %v", e.calls)
+	}
+}
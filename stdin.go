@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// inputExecutor is implemented by executors which can write data to the stdin of the first command of a pipeline.
+type inputExecutor interface {
+	execInput(input []byte, cmds [][]string) (string, int, error)
+}
+
+// execInput runs cmds with e like exec and writes input to the stdin of the first command. Executors not implementing
+// inputExecutor get the input as the output of printf instead, which is limited by the maximum length of an argument.
+func execInput(e executor, input []byte, cmds [][]string) (string, int, error) {
+	if ie, ok := e.(inputExecutor); ok {
+		return ie.execInput(input, cmds)
+	}
+	return e.exec(append([][]string{{"printf", "%s", string(input)}}, cmds...))
+}
+
+// runInput runs cmd at n with input written to its stdin and returns its output.
+func (n *node) runInput(input []byte, cmd ...string) (string, error) {
+	out, _, err := execInput(n.executor, input, [][]string{n.stdinCommand(cmd...)})
+	return out, err
+}
+
+func (e executorImpl) execInput(input []byte, cmds [][]string) (string, int, error) {
+	e.stdin = bytes.NewReader(input)
+	return e.exec(cmds)
+}
+
+func (e allowlistExecutor) execInput(input []byte, cmds [][]string) (string, int, error) {
+	if err := e.check(cmds); err != nil {
+		return "", 0, err
+	}
+	return execInput(e.executor, input, cmds)
+}
+
+// execInput refuses commands with side effects like exec. Read-only commands are not expected to read input but may.
+func (e observerExecutor) execInput(input []byte, cmds [][]string) (string, int, error) {
+	for _, cmd := range cmds {
+		if !readOnlyCommand(cmd) {
+			return "", 0, fmt.Errorf("observer mode: refusing to run %s", strings.Join(cmd, " "))
+		}
+	}
+	return execInput(e.executor, input, cmds)
+}
+
+func (e recordExecutor) execInput(input []byte, cmds [][]string) (string, int, error) {
+	out, transmitted, err := execInput(e.executor, input, cmds)
+	entry := recordedExec{Cmds: cmds, Input: string(input), Output: out, Transmitted: transmitted}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if recErr := e.rec.add(entry); recErr != nil {
+		return out, transmitted, recErr
+	}
+	return out, transmitted, err
+}
+
+// execInput returns the recorded results of cmds regardless of the input.
+func (e *replayExecutor) execInput(input []byte, cmds [][]string) (string, int, error) {
+	return e.exec(cmds)
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExecInput(t *testing.T) {
+	out, _, err := execInput(executorImpl{}, []byte("a\nb\n"), [][]string{{"cat"}, {"wc", "-l"}})
+	if err != nil || strings.TrimSpace(out) != "2" {
+		t.Errorf("unexpected result: %q, %v", out, err)
+	}
+	n := node{address: "localhost", executor: executorImpl{}}
+	if out, err := n.runInput([]byte("data"), "cat"); err != nil || out != "data" {
+		t.Errorf("unexpected result: %q, %v", out, err)
+	}
+
+	// executors without support get the input from printf
+	e := &mapExecutor{out: map[string]string{"printf %s data | cat": "data"}}
+	if out, _, err := execInput(e, []byte("data"), [][]string{{"cat"}}); err != nil || out != "data" {
+		t.Errorf("unexpected result: %q, %v", out, err)
+	}
+
+	rec := &recording{path: filepath.Join(t.TempDir(), "recording.json")}
+	if _, _, err := execInput(recordExecutor{executorImpl{}, rec}, []byte("data"), [][]string{{"cat"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.Entries) != 1 || rec.Entries[0].Input != "data" || rec.Entries[0].Output != "data" {
+		t.Errorf("unexpected recording: %+v", rec.Entries)
+	}
+
+	// observers refuse writing commands, the allowlist refuses writes to other paths
+	out = filepath.Join(t.TempDir(), "out")
+	if _, _, err := execInput(observerExecutor{executorImpl{}}, []byte("data"), [][]string{{"tee", out}}); err == nil {
+		t.Error("expected error but succeeded")
+	}
+	if _, _, err := execInput(allowlistExecutor{executorImpl{}, []string{"/backup"}}, []byte("data"), [][]string{{"tee", out}}); err == nil {
+		t.Error("expected error but succeeded")
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// killGrace is the time commands get to exit after SIGTERM before they are killed.
+var killGrace = 10 * time.Second
+
+// watch stops the commands cs running cmds once e is cancelled, interrupt is closed, timeout expires or no data
+// passed through any of the pipes for stallTimeout, returning the reason in the latter two cases. closers connect the
+// commands. finished is closed once all commands exited.
+func (e executorImpl) watch(cmds [][]string, cs []process, closers []io.Closer, pipes []*meteredPipe, timeout, stallTimeout time.Duration, interrupt, finished <-chan struct{}) error {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	var check <-chan time.Time
+	if stallTimeout > 0 && len(pipes) > 0 {
+		t := time.NewTicker(stallTimeout / 4)
+		defer t.Stop()
+		check = t.C
+	}
+	var stopped error
+	for {
+		select {
+		case <-e.cancel:
+		case <-interrupt:
+		case <-expired:
+			log.Printf("Commands timed out after %v: %v", timeout, cmds)
+			stopped = transientError{fmt.Errorf("timed out after %v", timeout)}
+		case <-check:
+			if time.Since(lastProgress(pipes)) < stallTimeout {
+				continue
+			}
+			log.Printf("Transfer stalled, no data for %v: %v", stallTimeout, cmds)
+			stopped = transientError{fmt.Errorf("stalled, no data for %v", stallTimeout)}
+		case <-finished:
+			return nil
+		}
+		terminate(cs, closers, finished)
+		e.killRemote(cmds)
+		return stopped
+	}
+}
+
+// lastProgress returns the time data last passed through any of pipes.
+func lastProgress(pipes []*meteredPipe) time.Time {
+	var last int64
+	for _, p := range pipes {
+		if t := p.lastRead.Load(); t > last {
+			last = t
+		}
+	}
+	return time.Unix(0, last)
+}
+
+// terminate sends SIGTERM to cs and kills the ones which haven't exited after killGrace. The pipes are closed as well
+// since children of the commands may keep them open. finished is closed once all commands exited.
+func terminate(cs []process, pipes []io.Closer, finished <-chan struct{}) {
+	for _, c := range cs {
+		c.terminate()
+	}
+	select {
+	case <-finished:
+	case <-time.After(killGrace):
+		for _, c := range cs {
+			c.kill()
+		}
+		for _, p := range pipes {
+			p.Close()
+		}
+	}
+}
+
+// killRemote kills the processes of the remote commands of cmds. A remote btrfs receive stuck in the kernel doesn't
+// notice that its ssh connection was closed and would otherwise keep the destination busy.
+func (e executorImpl) killRemote(cmds [][]string) {
+	for _, cmd := range cmds {
+		kill := remoteKillCommand(cmd)
+		if kill == nil {
+			continue
+		}
+		if _, _, err := (executorImpl{timeout: killGrace, ssh: e.ssh}).exec([][]string{kill}); err != nil {
+			log.Printf("Killing remote command failed: %v", err)
+		}
+	}
+}
+
+// transferEnv is the environment variable marking the remote processes of a transfer, see tagRemote.
+const transferEnv = "BTRFS_BACKUP_TRANSFER"
+
+// newTransferTag returns a random tag identifying the remote processes of one transfer.
+func newTransferTag() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		// the tag only needs to differ from the ones of concurrent transfers
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// tagRemote returns cmds with the remote command of every ssh invocation exporting tag in transferEnv first. All
+// processes of the remote pipeline inherit it, which lets remoteKillCommand find exactly these.
+func tagRemote(cmds [][]string, tag string) [][]string {
+	tagged := make([][]string, len(cmds))
+	for i, cmd := range cmds {
+		tagged[i] = cmd
+		if len(cmd) == 0 || cmd[0] != "ssh" {
+			continue
+		}
+		remote := unwrapCommand(cmd)
+		if len(remote) == 0 {
+			continue
+		}
+		t := append([]string(nil), cmd[:len(cmd)-len(remote)]...)
+		t = append(t, "export", transferEnv+"="+tag, ";")
+		tagged[i] = append(t, remote...)
+	}
+	return tagged
+}
+
+// remoteKillCommand returns the command killing the processes of the remote pipeline of the ssh invocation cmd tagged
+// by tagRemote, or nil if cmd runs nothing remotely or isn't tagged. Processes of other transfers to the same host are
+// left alone, as are commands sent through a wrapper: the receive server only runs the commands of the client.
+func remoteKillCommand(cmd []string) []string {
+	if len(cmd) == 0 || cmd[0] != "ssh" {
+		return nil
+	}
+	remote := unwrapCommand(cmd)
+	if len(remote) < 3 || remote[0] != "export" || !strings.HasPrefix(remote[1], transferEnv+"=") {
+		return nil
+	}
+	kill := append([]string(nil), cmd[:len(cmd)-len(remote)]...)
+	// the environment of the processes isn't visible to pkill, it is read from /proc; kill fails for processes which
+	// exited in the meantime and the loop finds none if the remote commands exited by themselves
+	return append(kill, "for", "p", "in", "/proc/[0-9]*", ";", "do",
+		"grep", "-qsxzF", remote[1], "$p/environ", "&&", "kill", "-KILL", "${p#/proc/}", ";",
+		"done", ";", "true")
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExecutorTimeout(t *testing.T) {
+	defer func(d time.Duration) { killGrace = d }(killGrace)
+	killGrace = 100 * time.Millisecond
+
+	data := [][]string{
+		{"sleep", "10"},
+		// commands ignoring SIGTERM are killed after killGrace
+		{"sh", "-c", "trap '' TERM; exec sleep 10"},
+	}
+	for di, cmd := range data {
+		start := time.Now()
+		_, _, err := executorImpl{timeout: 50 * time.Millisecond}.exec([][]string{cmd, {"cat"}})
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("%d: unexpected error: %v", di, err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%d: commands not killed, took %v", di, d)
+		}
+	}
+	if out, _, err := (executorImpl{timeout: time.Second}).exec([][]string{{"echo", "ok"}}); err != nil || out != "ok\n" {
+		t.Errorf("unexpected result: %q, %v", out, err)
+	}
+}
+
+func TestExecutorListTimeout(t *testing.T) {
+	defer func(d time.Duration) { killGrace = d }(killGrace)
+	killGrace = 100 * time.Millisecond
+
+	e := executorImpl{timeout: time.Hour, listTimeout: 50 * time.Millisecond}
+	if _, _, err := e.exec([][]string{{"sleep", "10"}}); err == nil || !strings.Contains(err.Error(), "timed out after 50ms") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// transfers aren't affected
+	if out, _, err := e.exec([][]string{{"sh", "-c", "sleep 0.2; echo ok"}, {"cat"}}); err != nil || out != "ok\n" {
+		t.Errorf("unexpected result: %q, %v", out, err)
+	}
+}
+
+func TestExecutorStall(t *testing.T) {
+	defer func(d time.Duration) { killGrace = d }(killGrace)
+	killGrace = 100 * time.Millisecond
+
+	e := executorImpl{stallTimeout: 300 * time.Millisecond}
+	start := time.Now()
+	if _, _, err := e.exec([][]string{{"sh", "-c", "echo a; exec sleep 10"}, {"cat"}}); err == nil || !strings.Contains(err.Error(), "stalled") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("commands not killed, took %v", d)
+	}
+	// transfers making progress run longer than the stall timeout
+	slow := []string{"sh", "-c", "for i in 1 2 3 4 5 6 7 8; do echo $i; sleep 0.1; done"}
+	if out, _, err := e.exec([][]string{slow, {"wc", "-l"}}); err != nil || strings.TrimSpace(out) != "8" {
+		t.Errorf("unexpected result: %q, %v", out, err)
+	}
+	// single commands transfer no stream
+	if out, _, err := e.exec([][]string{{"sh", "-c", "sleep 0.5; echo ok"}}); err != nil || out != "ok\n" {
+		t.Errorf("unexpected result: %q, %v", out, err)
+	}
+}
+
+func TestTagRemote(t *testing.T) {
+	ssh := []string{"ssh", "-C", "-p22", "nas", "--"}
+	cmds := [][]string{
+		{"btrfs", "send", "/mnt/snapshot/1"},
+		append(ssh, "zstd", "-d", "|", "btrfs", "receive", "/backup/laptop"),
+	}
+	want := [][]string{
+		cmds[0],
+		append(ssh, "export", "BTRFS_BACKUP_TRANSFER=1f", ";", "zstd", "-d", "|", "btrfs", "receive", "/backup/laptop"),
+	}
+	if res := tagRemote(cmds, "1f"); !reflect.DeepEqual(res, want) {
+		t.Errorf("unexpected commands: %v", res)
+	}
+	if a, b := newTransferTag(), newTransferTag(); a == b {
+		t.Errorf("tags not unique: %v", a)
+	}
+}
+
+func TestRemoteKillCommand(t *testing.T) {
+	ssh := []string{"ssh", "-C", "-p22", "nas", "--"}
+	kill := append(ssh, "for", "p", "in", "/proc/[0-9]*", ";", "do", "grep", "-qsxzF", "BTRFS_BACKUP_TRANSFER=1f",
+		"$p/environ", "&&", "kill", "-KILL", "${p#/proc/}", ";", "done", ";", "true")
+	data := []struct {
+		cmd  []string
+		want []string
+	}{
+		{[]string{"btrfs", "send", "/mnt/snapshot/1"}, nil},
+		// untagged commands may match processes of other transfers
+		{append(ssh, "btrfs", "receive", "/backup/laptop"), nil},
+		{append(ssh, "export", "BTRFS_BACKUP_TRANSFER=1f", ";", "btrfs", "receive", "/backup/laptop"), kill},
+		{append(ssh, "export", "BTRFS_BACKUP_TRANSFER=1f", ";", "zstd", "-d", "|", "btrfs", "receive", "/backup/laptop"), kill},
+	}
+	for di, d := range data {
+		if res := remoteKillCommand(d.cmd); !reflect.DeepEqual(res, d.want) {
+			t.Errorf("%d: unexpected command: %v", di, res)
+		}
+	}
+}
+
+func TestRemoteKillCommandRun(t *testing.T) {
+	// two transfers running the same command, only the tagged one is killed
+	start := func(tag string) *exec.Cmd {
+		c := exec.Command("sh", "-c", "export "+transferEnv+"="+tag+"; sleep 10 | cat")
+		if err := c.Start(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	kill := func(tag string) {
+		remote := tagRemote([][]string{{"ssh", "nas", "--", "sleep", "10", "|", "cat"}}, tag)[0]
+		if err := exec.Command("sh", "-c", strings.Join(remoteKillCommand(remote)[3:], " ")).Run(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	killed, other := start("1f"), start("2f")
+	defer kill("2f")
+	// lets the shells start their pipelines
+	time.Sleep(100 * time.Millisecond)
+
+	kill("1f")
+	// cat exits by itself once sleep was killed
+	if err := waitTimeout(killed, time.Second); err != nil {
+		t.Errorf("tagged command not killed: %v", err)
+	}
+	if err := waitTimeout(other, 100*time.Millisecond); err == nil {
+		t.Errorf("command of other transfer killed")
+	}
+}
+
+// waitTimeout waits for c to exit, failing if it runs longer than d.
+func waitTimeout(c *exec.Cmd, d time.Duration) error {
+	exited := make(chan struct{})
+	go func() {
+		c.Wait()
+		close(exited)
+	}()
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(d):
+		return fmt.Errorf("still running after %v", d)
+	}
+}
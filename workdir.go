@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// runDirPrefix prefixes the directories containing the files a run is writing.
+const runDirPrefix = ".run-"
+
+// workDir is a local directory for scratch files, eg. staged streams. Files are written into a directory of the run
+// named after its process ID, so that leftovers of crashed runs can be told apart from the files of runs in progress.
+type workDir struct {
+	path    string
+	maxSize int // maximum number of bytes in the directory, 0 means unlimited
+}
+
+// runDir removes the leftovers of crashed runs and returns a new directory for the files written by this run.
+func (w workDir) runDir() (string, error) {
+	if err := os.MkdirAll(w.path, 0700); err != nil {
+		return "", fmt.Errorf("runDir: %v", err)
+	}
+	if err := w.cleanLeftovers(); err != nil {
+		return "", err
+	}
+	dir := filepath.Join(w.path, runDirPrefix+strconv.Itoa(os.Getpid()))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("runDir: %v", err)
+	}
+	return dir, nil
+}
+
+// cleanLeftovers removes the run directories of processes which are no longer running.
+func (w workDir) cleanLeftovers() error {
+	entries, err := os.ReadDir(w.path)
+	if err != nil {
+		return fmt.Errorf("cleanLeftovers: %v", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() || !strings.HasPrefix(e.Name(), runDirPrefix) {
+			continue
+		}
+		pid, err := strconv.Atoi(strings.TrimPrefix(e.Name(), runDirPrefix))
+		if err != nil || processAlive(pid) {
+			continue
+		}
+		p := filepath.Join(w.path, e.Name())
+		log.Printf("Removing leftovers of crashed run in %s", p)
+		if err := os.RemoveAll(p); err != nil {
+			return fmt.Errorf("cleanLeftovers: %v", err)
+		}
+	}
+	return nil
+}
+
+// processAlive reports whether a process with the given ID exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// size returns the number of bytes of all files in the directory.
+func (w workDir) size() (int, error) {
+	size := 0
+	err := filepath.WalkDir(w.path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += int(fi.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("size: %v", err)
+	}
+	return size, nil
+}
+
+// checkSpace returns an error if the directory reached its maximum size.
+func (w workDir) checkSpace() error {
+	if w.maxSize <= 0 {
+		return nil
+	}
+	size, err := w.size()
+	if err != nil {
+		return err
+	}
+	if size >= w.maxSize {
+		return fmt.Errorf("%s is full: %s of %s used", w.path, formatBytes(size), formatBytes(w.maxSize))
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWorkDir(t *testing.T) {
+	w := workDir{path: t.TempDir(), maxSize: 10}
+	// pids are limited to 2^22, so this process cannot exist
+	crashed := filepath.Join(w.path, runDirPrefix+strconv.Itoa(1<<23))
+	running := filepath.Join(w.path, runDirPrefix+"1")
+	for _, dir := range []string{crashed, running} {
+		if err := os.Mkdir(dir, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "stream.part"), []byte("01234"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.checkSpace(); err == nil {
+		t.Errorf("expected error but succeeded")
+	}
+
+	run, err := w.runDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run != filepath.Join(w.path, runDirPrefix+strconv.Itoa(os.Getpid())) {
+		t.Errorf("unexpected run directory: %s", run)
+	}
+	if _, err := os.Stat(crashed); !os.IsNotExist(err) {
+		t.Errorf("leftovers of crashed run not removed: %v", err)
+	}
+	if _, err := os.Stat(running); err != nil {
+		t.Errorf("files of running process removed: %v", err)
+	}
+	if size, err := w.size(); err != nil || size != 5 {
+		t.Errorf("unexpected size: %d, %v", size, err)
+	}
+	if err := w.checkSpace(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
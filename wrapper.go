@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Nodes whose authorized_keys force a wrapper command, eg. command="btrfs-backup receive-server", cannot run arbitrary
+// commands. Instead every remote operation invokes the wrapper and sends the requested command as the first line of
+// stdin, encoded as a JSON array of arguments. The remaining input, eg. a send stream, follows the request.
+
+// wrapperRequest returns the request line sent to a wrapper for cmd.
+func wrapperRequest(cmd []string) string {
+	buf, _ := json.Marshal(cmd) // marshalling strings cannot fail
+	return string(buf)
+}
+
+// parseWrapperRequest decodes a request line sent to a wrapper.
+func parseWrapperRequest(line string) ([]string, error) {
+	var cmd []string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &cmd); err != nil {
+		return nil, fmt.Errorf("parseWrapperRequest: %v", err)
+	}
+	if len(cmd) == 0 {
+		return nil, fmt.Errorf("parseWrapperRequest: empty request")
+	}
+	return cmd, nil
+}
+
+// wrapperCmd is an invocation of the wrapper of a node via ssh, see sshWrapperCmd.
+type wrapperCmd struct {
+	ssh     []string // invokes the wrapper, see sshArgs
+	request []string // command sent to the wrapper
+	stdin   bool     // the input of the command is forwarded to the wrapper after the request
+}
+
+// Scripts piping the request line, followed by the input if it is forwarded, into the ssh invocation passed as
+// arguments.
+const (
+	wrapperScript      = `r=$1; shift; printf '%s\n' "$r" | "$@"`
+	wrapperStdinScript = `r=$1; shift; { printf '%s\n' "$r"; exec cat; } | "$@"`
+)
+
+// sshWrapperCmd returns the invocation of the wrapper of n via ssh with remoteCmd as request. If stdin is set, the
+// input of the command is forwarded to the wrapper after the request.
+func sshWrapperCmd(n *node, remoteCmd []string, stdin bool) wrapperCmd {
+	return wrapperCmd{ssh: append(sshArgs(n), strings.Fields(n.wrapper)...), request: remoteCmd, stdin: stdin}
+}
+
+// args returns the command line running w with sh, see parseWrapperCmd for the reverse.
+func (w wrapperCmd) args() []string {
+	script := wrapperScript
+	if w.stdin {
+		script = wrapperStdinScript
+	}
+	return append([]string{"sh", "-c", script, "sh", wrapperRequest(w.request)}, w.ssh...)
+}
+
+// parseWrapperCmd returns the wrapper invocation whose command line cmd is, see wrapperCmd.args. Executors only see
+// command lines, eg. when recording or checking them against the allowlist.
+func parseWrapperCmd(cmd []string) (wrapperCmd, bool) {
+	if len(cmd) < 6 || cmd[0] != "sh" || cmd[1] != "-c" || cmd[3] != "sh" || cmd[5] != "ssh" {
+		return wrapperCmd{}, false
+	}
+	if cmd[2] != wrapperScript && cmd[2] != wrapperStdinScript {
+		return wrapperCmd{}, false
+	}
+	request, err := parseWrapperRequest(cmd[4])
+	if err != nil {
+		return wrapperCmd{}, false
+	}
+	return wrapperCmd{ssh: cmd[5:], request: request, stdin: cmd[2] == wrapperStdinScript}, true
+}
+
+// unwrapCommand returns the command run by cmd at the remote node if cmd is an ssh or wrapper invocation created by
+// sshCmd or sshWrapperCmd, otherwise cmd itself. It returns nil if the remote command cannot be determined.
+func unwrapCommand(cmd []string) []string {
+	if len(cmd) > 1 && cmd[0] == "sh" && cmd[1] == "-c" {
+		w, ok := parseWrapperCmd(cmd)
+		if !ok {
+			return nil
+		}
+		return w.request
+	}
+	if len(cmd) > 0 && cmd[0] == "ssh" {
+		for i, arg := range cmd {
+			if arg == "--" {
+				return cmd[i+1:]
+			}
+		}
+		return nil
+	}
+	return cmd
+}
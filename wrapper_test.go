@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWrapperRequest(t *testing.T) {
+	cmd := []string{"btrfs", "receive", "/backup/with space"}
+	res, err := parseWrapperRequest(wrapperRequest(cmd) + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, cmd) {
+		t.Errorf("unexpected result: %#v", res)
+	}
+
+	for _, line := range []string{"", "[]", "btrfs receive /backup", `{"cmd": "ls"}`} {
+		if _, err := parseWrapperRequest(line); err == nil {
+			t.Errorf("%q: expected error but succeeded", line)
+		}
+	}
+}
+
+func TestSendSnapshotWrapper(t *testing.T) {
+	send := "btrfs send --quiet -p /mnt/snapshot/1 /mnt/snapshot/2 | " +
+		`sh -c r=$1; shift; { printf '%s\n' "$r"; exec cat; } | "$@" sh ["btrfs","receive","/backup"] ssh -C -p22 nas -- btrfs-backup receive-server`
+	list := `sh -c r=$1; shift; printf '%s\n' "$r" | "$@" sh ["btrfs","subvolume","list","/backup"] ssh -C -p22 nas -- btrfs-backup receive-server`
+	e := &mapExecutor{out: map[string]string{send: "", list: "ID 1 gen 1 top level 5 path 1\n"}}
+	source := node{address: "localhost", mountPoint: "/mnt", snapshotPath: "snapshot", executor: e}
+	destination := node{address: "nas", sshPort: 22, mountPoint: "/backup", wrapper: "btrfs-backup receive-server", executor: e}
+
+	if _, err := sendSnapshot(&source, &destination, "2", "1", false); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := destination.run("btrfs", "subvolume", "list", "/backup"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseWrapperCmd(t *testing.T) {
+	n := &node{address: "nas", sshPort: 22, wrapper: "btrfs-backup receive-server"}
+	for _, stdin := range []bool{false, true} {
+		w := sshWrapperCmd(n, []string{"btrfs", "receive", "/backup/with space"}, stdin)
+		res, ok := parseWrapperCmd(w.args())
+		if !ok || !reflect.DeepEqual(res, w) {
+			t.Errorf("%v: unexpected result: %#v, %v", stdin, res, ok)
+		}
+	}
+
+	for _, cmd := range [][]string{
+		{"sh", "-c", "true"},
+		{"sh", "-c", "rm -rf /; ssh", "sh", `["ls"]`, "ssh", "nas"},
+		{"sh", "-c", wrapperScript, "sh", "ls", "ssh", "nas"},
+		{"ssh", "-p22", "nas", "--", "ls"},
+	} {
+		if _, ok := parseWrapperCmd(cmd); ok {
+			t.Errorf("%q: expected failure", cmd)
+		}
+	}
+}